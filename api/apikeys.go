@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+// apiKeyPrefixes are the paths the API keys can be used for; the others are
+// for the users themselves
+var apiKeyPrefixes = []string{"/users", "/groups", "/stats", "/lockouts", "/audit", "/scim"}
+
+// The functions below are for newRestServerAPI, where the datasource package
+// is shadowed
+
+func isAPIKey(token string) bool {
+	return datasource.IsAPIKey(token)
+}
+
+// apiKeyUserID is the userID of AuthBearerMiddleware for the API key
+func apiKeyUserID(id string) string {
+	return datasource.APIKeyUserPrefix + id
+}
+
+// apiKeyID returns the id of the API key if userID stands for one
+func apiKeyID(userID string) (string, bool) {
+	if !strings.HasPrefix(userID, datasource.APIKeyUserPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(userID, datasource.APIKeyUserPrefix), true
+}
+
+func apiKeyPath(path string) bool {
+	for _, prefix := range apiKeyPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type newAPIKey struct {
+	Name   string                  `json:"name"`
+	Scopes []datasource.Permission `json:"scopes"`
+	// ExpiresIn is in seconds, zero means it never expires
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type createdAPIKey struct {
+	*datasource.APIKey
+	// Key is only shown here
+	Key string `json:"key"`
+}
+
+// ListAPIKeys returns the API keys of the current user, or all of them for
+// the users who can manage them
+func (r *restServerAPI) ListAPIKeys(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	keys, err := r.ds.APIKeys()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	all := datasource.Allowed(currentUser, datasource.PermManageAPIKeys, "")
+	keyList := []*datasource.APIKey{}
+	for _, k := range keys {
+		if all || k.Owner == currentUser.Email {
+			k.Hash = ""
+			keyList = append(keyList, k)
+		}
+	}
+	w.WriteJson(keyList)
+}
+
+// CreateAPIKey creates an API key owned by the current user. The scopes must
+// be held by the user, and are checked against its roles on every use too.
+func (r *restServerAPI) CreateAPIKey(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var nk newAPIKey
+	err := req.DecodeJsonPayload(&nk)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if nk.Name == "" || len(nk.Scopes) == 0 || nk.ExpiresIn < 0 {
+		grest.Error(w, "name/scopes missing", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range nk.Scopes {
+		if !datasource.Holds(currentUser, scope) {
+			grest.Error(w, "You don't have "+string(scope), http.StatusForbidden)
+			return
+		}
+	}
+
+	k, key, err := r.ds.CreateAPIKey(currentUser, nk.Name, nk.Scopes, time.Duration(nk.ExpiresIn)*time.Second)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	k.Hash = ""
+	w.WriteJson(createdAPIKey{
+		APIKey: k,
+		Key:    key,
+	})
+}
+
+func (r *restServerAPI) DeleteAPIKey(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	k, err := r.ds.APIKey(req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if k.Owner != currentUser.Email && !allowed(w, req, datasource.PermManageAPIKeys, "") {
+		return
+	}
+
+	err = r.ds.DeleteAPIKey(k.ID)
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,37 @@
+package api
+
+import "testing"
+
+func TestAPIKeyPaths(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/users", true},
+		{"/users/a@example.com", true},
+		{"/scim/Users", true},
+		{"/audit", true},
+		{"/usersx", false},
+		{"/me", false},
+		{"/apikeys", false},
+		{"/token", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := apiKeyPath(tt.path); got != tt.want {
+			t.Errorf("apiKeyPath(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyID(t *testing.T) {
+	if id, ok := apiKeyID(apiKeyUserID("0123456789abcdef")); !ok || id != "0123456789abcdef" {
+		t.Errorf("got %q, %v; want the id", id, ok)
+	}
+	if _, ok := apiKeyID("a@example.com"); ok {
+		t.Error("a user is taken for an API key")
+	}
+	if !isAPIKey("bhk_0123456789abcdef_secret") || isAPIKey("eyJhbGciOiJSUzI1NiJ9.e30.c2ln") {
+		t.Error("the API keys and the JWTs aren't told apart")
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+type newAppPassword struct {
+	Name string `json:"name"`
+}
+
+type createdAppPassword struct {
+	*datasource.AppPassword
+	// Password is only shown here
+	Password string `json:"password"`
+}
+
+func (r *restServerAPI) ListAppPasswords(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	appPasswords := currentUser.Sanitized().AppPasswords
+	if appPasswords == nil {
+		appPasswords = []datasource.AppPassword{}
+	}
+	w.WriteJson(appPasswords)
+}
+
+func (r *restServerAPI) CreateAppPassword(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var nap newAppPassword
+	err := req.DecodeJsonPayload(&nap)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if nap.Name == "" {
+		grest.Error(w, "name is missing", http.StatusBadRequest)
+		return
+	}
+
+	ap, plain, err := currentUser.NewAppPassword(nap.Name)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !r.storeCurrentUser(w, currentUser) {
+		return
+	}
+
+	ap.Hash = ""
+	w.WriteJson(createdAppPassword{
+		AppPassword: ap,
+		Password:    plain,
+	})
+}
+
+func (r *restServerAPI) DeleteAppPassword(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	if !currentUser.RemoveAppPassword(req.PathParam("id")) {
+		grest.Error(w, datasource.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !r.storeCurrentUser(w, currentUser) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
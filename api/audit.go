@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// audit records a successful change made by the current user, and publishes
+// it to the webhooks. The actor is the target itself on the public paths,
+// e.g. the password reset.
+func (r *restServerAPI) audit(req *grest.Request, action, target string, changes map[string]datasource.AuditChange) {
+	actor := target
+	if currentUser, ok := req.Env["REMOTE_USER_OBJECT"].(*datasource.User); ok {
+		actor = currentUser.Email
+	}
+
+	err := r.ds.Audit(&datasource.AuditEvent{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		Changes:  changes,
+		SourceIP: remoteIP(req),
+		Success:  true,
+	})
+	if err != nil {
+		logging.Log(debugTag, "Error while auditing %s of %s by %s: %s", action, target, actor, err)
+	}
+
+	r.hooks.PublishAudit(action, actor, target, changes)
+}
+
+// maxAuditPage is the most audit events returned at once
+const maxAuditPage = 1000
+
+// ListAuditEvents returns a page of the audit events, the newest first. They
+// can be filtered by the actor, target, action, since and until (RFC 3339)
+// query parameters, and the page size is set by limit. If there are more,
+// the Link header has the URL of the next page, which continues from the ID
+// in the before parameter.
+func (r *restServerAPI) ListAuditEvents(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermReadAudit, "") {
+		return
+	}
+
+	query := req.URL.Query()
+	filter := datasource.AuditFilter{
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+		Action: query.Get("action"),
+		Before: query.Get("before"),
+		Limit:  100,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			grest.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			grest.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditPage {
+			grest.Error(w, fmt.Sprintf("Invalid limit, it must be between 1 and %d", maxAuditPage), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, next, err := r.ds.AuditEvents(filter)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if next != "" {
+		query.Set("before", next)
+		nextURL := *req.URL
+		nextURL.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.RequestURI()))
+	}
+	w.WriteJson(events)
+}
@@ -0,0 +1,669 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	csvContentType = "text/csv"
+	maxImportRows  = 10000
+	maxImportBytes = 32 << 20
+	// exportFlushRows is how many CSV rows are buffered before being sent
+	exportFlushRows = 100
+)
+
+// bulkRoutes maps the paths of the bulk endpoints to their routes: the router
+// takes the colon for a placeholder, so they can't be routed as they are
+var bulkRoutes = map[string]string{
+	"/users:import":  "/users/-/import",
+	"/users:export":  "/users/-/export",
+	"/groups:export": "/groups/-/export",
+}
+
+// bulkMiddleware routes the bulk endpoints, and lets the imports be sent as
+// text/csv, which the ContentTypeCheckerMiddleware would reject
+func bulkMiddleware(handler grest.HandlerFunc) grest.HandlerFunc {
+	return func(w grest.ResponseWriter, req *grest.Request) {
+		if route, found := bulkRoutes[req.URL.Path]; found {
+			req.URL.Path = route
+			req.URL.RawPath = ""
+		}
+		if req.URL.Path == bulkRoutes["/users:import"] {
+			mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if mediatype == csvContentType {
+				req.Env["IMPORT_CSV"] = true
+				req.Header.Set("Content-Type", "application/json")
+			}
+		}
+		handler(w, req)
+	}
+}
+
+// userColumn is a column of the CSV files of the users
+type userColumn struct {
+	name string
+	get  func(u *datasource.User) string
+	set  func(u *datasource.User, value string) error
+}
+
+func stringColumn(name string, field func(u *datasource.User) *string) userColumn {
+	return userColumn{
+		name: name,
+		get:  func(u *datasource.User) string { return *field(u) },
+		set: func(u *datasource.User, value string) error {
+			*field(u) = value
+			return nil
+		},
+	}
+}
+
+func boolColumn(name string, field func(u *datasource.User) *bool) userColumn {
+	return userColumn{
+		name: name,
+		get:  func(u *datasource.User) string { return strconv.FormatBool(*field(u)) },
+		set: func(u *datasource.User, value string) error {
+			if value == "" {
+				return nil
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: %s", name, value)
+			}
+			*field(u) = b
+			return nil
+		},
+	}
+}
+
+func uintColumn(name string, field func(u *datasource.User) *uint64) userColumn {
+	return userColumn{
+		name: name,
+		get:  func(u *datasource.User) string { return strconv.FormatUint(*field(u), 10) },
+		set: func(u *datasource.User, value string) error {
+			if value == "" {
+				return nil
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: %s", name, value)
+			}
+			*field(u) = n
+			return nil
+		},
+	}
+}
+
+// userColumns are the columns of the exported CSV files, named as the fields
+// of the JSON of the users. The imported files may have any of them, in any
+// order, and password too.
+var userColumns = []userColumn{
+	stringColumn("email", func(u *datasource.User) *string { return &u.Email }),
+	stringColumn("uid", func(u *datasource.User) *string { return &u.UIDStr }),
+	stringColumn("inboxAddress", func(u *datasource.User) *string { return &u.InboxAddr }),
+	boolColumn("active", func(u *datasource.User) *bool { return &u.Active }),
+	boolColumn("admin", func(u *datasource.User) *bool { return &u.Admin }),
+	{
+		name: "roles",
+		get:  func(u *datasource.User) string { return formatRoles(u.Roles) },
+		set: func(u *datasource.User, value string) (err error) {
+			u.Roles, err = parseRoles(value)
+			return err
+		},
+	},
+	stringColumn("enFirstName", func(u *datasource.User) *string { return &u.EnFirstName }),
+	stringColumn("enLastName", func(u *datasource.User) *string { return &u.EnLastName }),
+	stringColumn("faFirstName", func(u *datasource.User) *string { return &u.FaFirstName }),
+	stringColumn("faLastName", func(u *datasource.User) *string { return &u.FaLastName }),
+	stringColumn("mobileNum", func(u *datasource.User) *string { return &u.MobileNum }),
+	stringColumn("emergencyNum", func(u *datasource.User) *string { return &u.EmergencyNum }),
+	uintColumn("birthDate", func(u *datasource.User) *uint64 { return &u.BirthDate }),
+	uintColumn("enrolmentDate", func(u *datasource.User) *uint64 { return &u.EnrolmentDate }),
+	uintColumn("leavingDate", func(u *datasource.User) *uint64 { return &u.LeavingDate }),
+}
+
+var passwordColumn = stringColumn("password", func(u *datasource.User) *string { return &u.Password })
+
+// formatRoles writes the role bindings in the CSV files, separated by ";",
+// each as the role followed by its comma separated scope after a ":", e.g.
+// "helpdesk;user-admin:@example.com,boss@example.com"
+func formatRoles(bindings []datasource.RoleBinding) string {
+	var roles []string
+	for _, b := range bindings {
+		role := b.Role
+		if len(b.Scope) > 0 {
+			role += ":" + strings.Join(b.Scope, ",")
+		}
+		roles = append(roles, role)
+	}
+	return strings.Join(roles, ";")
+}
+
+func parseRoles(value string) ([]datasource.RoleBinding, error) {
+	var bindings []datasource.RoleBinding
+	for _, role := range strings.Split(value, ";") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		parts := strings.SplitN(role, ":", 2)
+		b := datasource.RoleBinding{Role: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			for _, item := range strings.Split(parts[1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					b.Scope = append(b.Scope, item)
+				}
+			}
+			if len(b.Scope) == 0 {
+				return nil, fmt.Errorf("Empty scope of role %s", b.Role)
+			}
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, datasource.ValidateRoles(bindings)
+}
+
+// importedUser is a row of an import, or why it couldn't be parsed
+type importedUser struct {
+	user *datasource.User
+	err  error
+}
+
+type importRow struct {
+	// Row is the index of the row, from one, not counting the CSV header
+	Row   int    `json:"row"`
+	Email string `json:"email"`
+	// Status is valid (in dry runs), created, failed or skipped (in the
+	// atomic imports which failed)
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	DryRun  bool         `json:"dryRun"`
+	Atomic  bool         `json:"atomic"`
+	Created int          `json:"created"`
+	Failed  int          `json:"failed"`
+	Rows    []*importRow `json:"rows"`
+}
+
+func readUsersJSON(req *grest.Request) ([]*importedUser, error) {
+	var rows []json.RawMessage
+	err := req.DecodeJsonPayload(&rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > maxImportRows {
+		return nil, fmt.Errorf("Too many rows, at most %d are allowed", maxImportRows)
+	}
+
+	users := make([]*importedUser, len(rows))
+	for i, row := range rows {
+		var u datasource.User
+		err := json.Unmarshal(row, &u)
+		users[i] = &importedUser{user: &u, err: err}
+	}
+	return users, nil
+}
+
+func readUsersCSV(req *grest.Request) ([]*importedUser, error) {
+	reader := csv.NewReader(req.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("The CSV header is missing")
+	} else if err != nil {
+		return nil, err
+	}
+	columns := make([]userColumn, len(header))
+	hasEmail := false
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, passwordColumn.name) {
+			columns[i] = passwordColumn
+			continue
+		}
+		found := false
+		for _, c := range userColumns {
+			if strings.EqualFold(name, c.name) {
+				columns[i] = c
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown column: %s", name)
+		}
+		hasEmail = hasEmail || columns[i].name == "email"
+	}
+	if !hasEmail {
+		return nil, errors.New("The email column is missing")
+	}
+
+	var users []*importedUser
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(users) == maxImportRows {
+			return nil, fmt.Errorf("Too many rows, at most %d are allowed", maxImportRows)
+		}
+
+		imported := &importedUser{user: &datasource.User{}}
+		if len(record) != len(columns) {
+			imported.err = fmt.Errorf("Expected %d fields, got %d", len(columns), len(record))
+		}
+		for i := range record {
+			if imported.err != nil {
+				break
+			}
+			imported.err = columns[i].set(imported.user, unescapeCSVCell(strings.TrimSpace(record[i])))
+		}
+		users = append(users, imported)
+	}
+	return users, nil
+}
+
+// validateImport checks a user could be created by currentUser, the same way
+// as CreateUser. seen are the emails of the rows before it.
+func (r *restServerAPI) validateImport(currentUser, u *datasource.User, seen map[string]bool) error {
+	switch {
+	case u.Email == "":
+		return errors.New("Email missing")
+	case !strings.Contains(u.Email, "@"):
+		return errors.New("Invalid email")
+	case seen[u.Email]:
+		return errors.New("Duplicate email")
+	case !datasource.Allowed(currentUser, datasource.PermCreateUsers, u.Email):
+		return errors.New("Access denied")
+	case (u.Admin || len(u.Roles) > 0) && !datasource.Allowed(currentUser, datasource.PermManageRoles, u.Email):
+		return errors.New("Access denied")
+	case !datasource.CanChangeRoles(currentUser, nil, u.Admin, u.Roles):
+		return errors.New("You can't grant roles broader than your own")
+	}
+	err := datasource.ValidateRoles(u.Roles)
+	if err != nil {
+		return err
+	}
+	if _, err := r.ds.UserByEmail(u.Email); err == nil {
+		return datasource.ErrUserExists
+	}
+	if _, err := r.ds.GroupByEmail(u.Email); err == nil {
+		return datasource.ErrGroupExists
+	}
+	return nil
+}
+
+// ImportUsers creates the users of a JSON array, or of a CSV file (see
+// userColumns) if it's sent as text/csv, and reports the result of each row.
+//
+// With dryRun=true nothing is created. With atomic=true either all the users
+// are created or none: nothing is created if any row is invalid, and the
+// users are created in one Commit. Otherwise the valid rows are created,
+// whatever happens to the others.
+func (r *restServerAPI) ImportUsers(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	// The rows are checked one by one, against the scopes of the roles
+	if !datasource.Holds(currentUser, datasource.PermCreateUsers) &&
+		!allowed(w, req, datasource.PermCreateUsers, "") {
+		return
+	}
+	req.Body = http.MaxBytesReader(w.(http.ResponseWriter), req.Body, maxImportBytes)
+
+	query := req.URL.Query()
+	report := &importReport{
+		DryRun: query.Get("dryRun") == "true",
+		Atomic: query.Get("atomic") == "true",
+		Rows:   []*importRow{},
+	}
+
+	var users []*importedUser
+	var err error
+	if csvBody, _ := req.Env["IMPORT_CSV"].(bool); csvBody {
+		users, err = readUsersCSV(req)
+	} else {
+		users, err = readUsersJSON(req)
+	}
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i, imported := range users {
+		if imported.err == nil {
+			imported.err = r.validateImport(currentUser, imported.user, seen)
+		}
+		seen[imported.user.Email] = true
+
+		row := &importRow{Row: i + 1, Email: imported.user.Email, Status: "valid"}
+		if imported.err != nil {
+			row.Status = "failed"
+			row.Error = imported.err.Error()
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	if report.Atomic && report.Failed > 0 {
+		for _, row := range report.Rows {
+			if row.Status == "valid" {
+				row.Status = "skipped"
+			}
+		}
+	}
+	if report.DryRun || (report.Atomic && report.Failed > 0) {
+		writeImportReport(w, report)
+		return
+	}
+
+	var created []*datasource.User
+	if report.Atomic {
+		created = r.importAtomically(report, users)
+	} else {
+		for i, imported := range users {
+			row := report.Rows[i]
+			if row.Status != "valid" {
+				continue
+			}
+			err := r.prepareImportedUser(imported.user)
+			if err == nil {
+				err = r.ds.CreateUser(imported.user)
+			}
+			if err != nil {
+				row.Status = "failed"
+				row.Error = err.Error()
+				report.Failed++
+				continue
+			}
+			row.Status = "created"
+			report.Created++
+			created = append(created, imported.user)
+		}
+	}
+
+	for _, u := range created {
+		r.audit(req, "user.create", u.Email, datasource.DiffUsers(nil, u))
+	}
+	writeImportReport(w, report)
+}
+
+// prepareImportedUser makes the imported user ready to be created
+func (r *restServerAPI) prepareImportedUser(u *datasource.User) error {
+	clearServerFields(u)
+	if u.Password != "" {
+		return r.ds.SetPassword(u, u.Password)
+	}
+	return nil
+}
+
+// importAtomically creates the users of the valid rows in one Commit, and
+// returns them. If it fails, none of them is created: the rows which are
+// taken in the meantime fail, and the others are skipped.
+func (r *restServerAPI) importAtomically(report *importReport, users []*importedUser) []*datasource.User {
+	var b datasource.Batch
+	var created []*datasource.User
+	var err error
+	for i, imported := range users {
+		if report.Rows[i].Status != "valid" {
+			continue
+		}
+		if err = r.prepareImportedUser(imported.user); err != nil {
+			break
+		}
+		b.CreateUser(imported.user)
+		created = append(created, imported.user)
+	}
+	if err == nil {
+		err = r.ds.Commit(&b)
+	}
+	if err == nil {
+		for _, row := range report.Rows {
+			row.Status = "created"
+		}
+		report.Created = len(created)
+		return created
+	}
+
+	logging.Log(debugTag, "Error while importing users atomically: %s", err)
+	for i, row := range report.Rows {
+		row.Status = "skipped"
+		if err == datasource.ErrUserExists || err == datasource.ErrGroupExists {
+			if _, taken := r.ds.UserByEmail(users[i].user.Email); taken == nil {
+				row.Status, row.Error = "failed", datasource.ErrUserExists.Error()
+			} else if _, taken := r.ds.GroupByEmail(users[i].user.Email); taken == nil {
+				row.Status, row.Error = "failed", datasource.ErrGroupExists.Error()
+			}
+		}
+		if row.Status == "failed" {
+			report.Failed++
+		}
+	}
+	// Failed anyway, e.g. by a conflict or an error of the store
+	if report.Failed == 0 {
+		for _, row := range report.Rows {
+			row.Status, row.Error = "failed", err.Error()
+		}
+		report.Failed = len(report.Rows)
+	}
+	return nil
+}
+
+// writeImportReport writes the report, with 400 if an atomic import failed
+func writeImportReport(w grest.ResponseWriter, report *importReport) {
+	if report.Atomic && report.Failed > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.WriteJson(report)
+}
+
+// exportCSV reports whether CSV is asked, by format=csv or the Accept header,
+// instead of JSON
+func exportCSV(req *grest.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(req.Header.Get("Accept"), csvContentType)
+}
+
+// exportWriter streams the exported records, as a JSON array or CSV rows
+type exportWriter struct {
+	w     http.ResponseWriter
+	csv   *csv.Writer
+	json  *json.Encoder
+	count int
+}
+
+func newExportWriter(w grest.ResponseWriter, name string, asCSV bool) *exportWriter {
+	hw := w.(http.ResponseWriter)
+	e := &exportWriter{w: hw}
+	if asCSV {
+		e.csv = csv.NewWriter(hw)
+		w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	} else {
+		e.json = json.NewEncoder(hw)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+	}
+	w.WriteHeader(http.StatusOK)
+	return e
+}
+
+// csvFormulaPrefixes are the first characters which make the spreadsheets
+// take a cell for a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell prefixes the values which would be taken for formulas with a
+// quote, so opening an export can't run what a user has put in their name
+func escapeCSVCell(value string) string {
+	if value != "" && strings.IndexByte(csvFormulaPrefixes, value[0]) >= 0 {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeCSVCell reverses escapeCSVCell, so the exports can be imported
+func unescapeCSVCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.IndexByte(csvFormulaPrefixes, value[1]) >= 0 {
+		return value[1:]
+	}
+	return value
+}
+
+func (e *exportWriter) writeCSV(record []string) error {
+	escaped := make([]string, len(record))
+	for i, value := range record {
+		escaped[i] = escapeCSVCell(value)
+	}
+	err := e.csv.Write(escaped)
+	if err != nil {
+		return err
+	}
+	e.count++
+	if e.count%exportFlushRows == 0 {
+		e.flush()
+	}
+	return e.csv.Error()
+}
+
+func (e *exportWriter) writeJSON(v interface{}) error {
+	separator := ","
+	if e.count == 0 {
+		separator = "["
+	}
+	_, err := io.WriteString(e.w, separator)
+	if err != nil {
+		return err
+	}
+	e.count++
+	return e.json.Encode(v)
+}
+
+func (e *exportWriter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e *exportWriter) close() error {
+	if e.json != nil {
+		end := "]\n"
+		if e.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(e.w, end)
+		return err
+	}
+	e.flush()
+	return e.csv.Error()
+}
+
+// ExportUsers streams all the users, without their passwords and second
+// factor secrets, as JSON or CSV (see exportCSV). The CSV files can be
+// imported back.
+func (r *restServerAPI) ExportUsers(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermReadUsers, "") {
+		return
+	}
+
+	users, err := r.ds.Users()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	asCSV := exportCSV(req)
+	e := newExportWriter(w, "users", asCSV)
+	if asCSV {
+		header := make([]string, len(userColumns))
+		for i, c := range userColumns {
+			header[i] = c.name
+		}
+		err = e.writeCSV(header)
+	}
+	for _, u := range users {
+		if err != nil {
+			break
+		}
+		if asCSV {
+			record := make([]string, len(userColumns))
+			for i, c := range userColumns {
+				record[i] = c.get(u)
+			}
+			err = e.writeCSV(record)
+		} else {
+			err = e.writeJSON(u.Sanitized())
+		}
+	}
+	if err == nil {
+		err = e.close()
+	}
+	if err != nil {
+		// The status is already sent
+		logging.Log(debugTag, "Error while exporting the users: %s", err)
+	}
+}
+
+var groupCSVHeader = []string{
+	"email", "name", "description", "active", "public", "joinable", "manager", "members", "ccs",
+}
+
+// ExportGroups streams the groups the current user can see, as JSON or CSV
+// (see exportCSV). In the CSV files the members and CCs are separated by ";".
+func (r *restServerAPI) ExportGroups(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	groups, err := r.ds.Groups()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	asCSV := exportCSV(req)
+	e := newExportWriter(w, "groups", asCSV)
+	if asCSV {
+		err = e.writeCSV(groupCSVHeader)
+	}
+	for _, g := range groups {
+		if err != nil {
+			break
+		}
+		if !g.Joinable && !datasource.Allowed(currentUser, datasource.PermReadGroups, g.Email) {
+			continue
+		}
+		if asCSV {
+			err = e.writeCSV([]string{
+				g.Email, g.Name, g.Description,
+				strconv.FormatBool(g.Active), strconv.FormatBool(g.Public), strconv.FormatBool(g.Joinable),
+				g.Manager, strings.Join(g.Members, ";"), strings.Join(g.CCs, ";"),
+			})
+		} else {
+			err = e.writeJSON(g)
+		}
+	}
+	if err == nil {
+		err = e.close()
+	}
+	if err != nil {
+		logging.Log(debugTag, "Error while exporting the groups: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func TestCSVCellEscaping(t *testing.T) {
+	tests := []struct {
+		value, escaped string
+	}{
+		{"Reza", "Reza"},
+		{"", ""},
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+989121234567", "'+989121234567"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tcmd", "'\tcmd"},
+		{"\rcmd", "'\rcmd"},
+		{"'quoted", "'quoted"},
+	}
+	for _, tt := range tests {
+		escaped := escapeCSVCell(tt.value)
+		if escaped != tt.escaped {
+			t.Errorf("escapeCSVCell(%q) = %q, want %q", tt.value, escaped, tt.escaped)
+		}
+		if unescaped := unescapeCSVCell(escaped); unescaped != tt.value {
+			t.Errorf("unescapeCSVCell(%q) = %q, want %q", escaped, unescaped, tt.value)
+		}
+	}
+}
+
+func TestImportAtomically(t *testing.T) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &restServerAPI{ds: ds}
+	if err := ds.CreateUser(&datasource.User{Email: "taken@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		emails  []string
+		created int
+		status  []string
+	}{
+		{[]string{"a@example.com", "taken@example.com", "b@example.com"}, 0, []string{"skipped", "failed", "skipped"}},
+		{[]string{"a@example.com", "b@example.com"}, 2, []string{"created", "created"}},
+	}
+	for _, tt := range tests {
+		report := &importReport{Atomic: true}
+		var users []*importedUser
+		for i, email := range tt.emails {
+			users = append(users, &importedUser{user: &datasource.User{Email: email, Password: "secret password"}})
+			report.Rows = append(report.Rows, &importRow{Row: i + 1, Email: email, Status: "valid"})
+		}
+
+		created := r.importAtomically(report, users)
+		if len(created) != tt.created || report.Created != tt.created {
+			t.Errorf("%v: created %d, reported %d; want %d", tt.emails, len(created), report.Created, tt.created)
+		}
+		for i, row := range report.Rows {
+			if row.Status != tt.status[i] {
+				t.Errorf("%v: row %d is %s, want %s", tt.emails, row.Row, row.Status, tt.status[i])
+			}
+		}
+		if _, err := ds.UserByEmail("a@example.com"); (err == nil) != (tt.created > 0) {
+			t.Errorf("%v: a@example.com exists: %v", tt.emails, err == nil)
+		}
+	}
+}
+
+func TestImportedUsersCantSetServerFields(t *testing.T) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &restServerAPI{ds: ds}
+	u := &datasource.User{
+		Email:        "a@example.com",
+		TOTPEnabled:  true,
+		TOTPSecret:   "JBSWY3DPEHPK3PXP",
+		AppPasswords: []datasource.AppPassword{{Name: "phone", Hash: "hash"}},
+		TokenVersion: 7,
+		OIDCSubject:  "the subject of a superadmin",
+		ExternalID:   "42",
+	}
+	if err := r.prepareImportedUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if u.TOTPEnabled || u.TOTPSecret != "" || u.AppPasswords != nil || u.TokenVersion != 0 || u.OIDCSubject != "" || u.ExternalID != "" {
+		t.Errorf("got %+v, want the fields set by bahram cleared", u)
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+)
+
+// setETag sets the ETag header of the response to the revision of the
+// returned user or group.
+func setETag(w grest.ResponseWriter, revision uint64) {
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", revision))
+}
+
+// checkIfMatch makes sure the If-Match header of the request, if present,
+// matches the revision. Otherwise it writes a 412 response and returns false.
+func checkIfMatch(w grest.ResponseWriter, req *grest.Request, revision uint64) bool {
+	if !ifMatches(req, revision, false) {
+		grest.Error(w, "It has been modified since you loaded it", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// ifMatches reports whether the If-Match header of the request is missing or
+// matches the revision. The weak tags, W/"<revision>", only match if weak is
+// set, for SCIM, whose versions are weak; otherwise the comparison is strong
+// (RFC 7232, section 3.1).
+func ifMatches(req *grest.Request, revision uint64, weak bool) bool {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		r, err := strconv.ParseUint(strings.Trim(tag, "\""), 10, 64)
+		if err == nil && r == revision {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictStatus is the status of the response to a request whose write
+// failed with datasource.ErrConflict.
+func conflictStatus(req *grest.Request) int {
+	if req.Header.Get("If-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusConflict
+}
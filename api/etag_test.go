@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+)
+
+func TestIfMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{"", false, true},
+		{`"7"`, false, true},
+		{`"8"`, false, false},
+		{`"8", "7"`, false, true},
+		{"*", false, true},
+		// Only SCIM compares weakly
+		{`W/"7"`, false, false},
+		{`W/"7"`, true, true},
+		{`W/"8"`, true, false},
+		{`"7"`, true, true},
+		{`W/"8", W/"7"`, true, true},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("PUT", "/users/a@example.com", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+		if got := ifMatches(&grest.Request{Request: r}, 7, tt.weak); got != tt.want {
+			t.Errorf("ifMatches(%q, weak %v) = %v, want %v", tt.header, tt.weak, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// jwksMaxAge is how long the clients may cache the JWKS. A new key must be
+// published at least that long before tokens are signed with it.
+const jwksMaxAge = 5 * time.Minute
+
+// tokenKeyConfig is an item of BAHRAM_TOKEN_KEYS, which is the base64 of a
+// JSON array of them. Key is the base64 of the secret for HS512, and a PEM
+// private key (PKCS#1, PKCS#8 or SEC 1) for RS256, ES256 and EdDSA.
+//
+// Tokens are signed by the first key which is active and isn't retired. To
+// rotate, add the new key to the beginning of the list with activeFrom at
+// least jwksMaxAge ahead, so it's in the cached JWKS of the clients before
+// it's used, and set retiredAt of the old one. A retired key is still
+// accepted and published for the grace period, BAHRAM_TOKEN_KEY_GRACE, which
+// defaults to accessTokenTTL.
+type tokenKeyConfig struct {
+	ID         string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	Key        string    `json:"key"`
+	ActiveFrom time.Time `json:"activeFrom"`
+	RetiredAt  time.Time `json:"retiredAt"`
+}
+
+type tokenKey struct {
+	id         string
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	activeFrom time.Time
+	retiredAt  time.Time
+}
+
+// signs reports whether new tokens may be signed by the key
+func (k *tokenKey) signs(now time.Time) bool {
+	return !now.Before(k.activeFrom) && (k.retiredAt.IsZero() || now.Before(k.retiredAt))
+}
+
+// usable reports whether tokens signed by the key are still accepted
+func (k *tokenKey) usable(now time.Time, grace time.Duration) bool {
+	return k.retiredAt.IsZero() || now.Before(k.retiredAt.Add(grace))
+}
+
+type tokenKeySet struct {
+	keys  []*tokenKey
+	grace time.Duration
+}
+
+// loadTokenKeys reads the keys from BAHRAM_TOKEN_KEYS. If it's not set, the
+// HS512 secret in BAHRAM_TOKEN_SIGN_KEY is used, without a kid.
+func loadTokenKeys(ds *datasource.DataSource) (*tokenKeySet, error) {
+	grace := accessTokenTTL
+	if value := ds.ConfigString("TOKEN_KEY_GRACE"); value != "" {
+		var err error
+		grace, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing BAHRAM_TOKEN_KEY_GRACE: %s", err)
+		}
+		// Or the tokens signed just before the retirement would be refused
+		if grace < accessTokenTTL {
+			return nil, fmt.Errorf("BAHRAM_TOKEN_KEY_GRACE must be at least %s", accessTokenTTL)
+		}
+	}
+
+	if ds.ConfigString("TOKEN_KEYS") == "" {
+		secret := ds.ConfigByteArray("TOKEN_SIGN_KEY")
+		if len(secret) == 0 {
+			return nil, errors.New("Neither BAHRAM_TOKEN_KEYS nor BAHRAM_TOKEN_SIGN_KEY is set")
+		}
+		return &tokenKeySet{grace: grace, keys: []*tokenKey{{
+			method:    jwt.SigningMethodHS512,
+			signKey:   secret,
+			verifyKey: secret,
+		}}}, nil
+	}
+
+	var configs []tokenKeyConfig
+	err := json.Unmarshal(ds.ConfigByteArray("TOKEN_KEYS"), &configs)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing BAHRAM_TOKEN_KEYS: %s", err)
+	}
+
+	set := &tokenKeySet{grace: grace}
+	ids := make(map[string]bool)
+	for _, config := range configs {
+		if config.ID == "" || ids[config.ID] {
+			return nil, fmt.Errorf("Token keys need unique kids, %q isn't", config.ID)
+		}
+		ids[config.ID] = true
+
+		key, err := parseTokenKey(config)
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing token key %s: %s", config.ID, err)
+		}
+		set.keys = append(set.keys, key)
+	}
+	if set.signingKey() == nil {
+		return nil, errors.New("None of the token keys is active and not retired")
+	}
+	return set, nil
+}
+
+func parseTokenKey(config tokenKeyConfig) (*tokenKey, error) {
+	key := &tokenKey{
+		id:         config.ID,
+		activeFrom: config.ActiveFrom,
+		retiredAt:  config.RetiredAt,
+	}
+
+	switch config.Alg {
+	case "HS512":
+		secret, err := base64.StdEncoding.DecodeString(config.Key)
+		if err != nil {
+			return nil, err
+		}
+		key.method = jwt.SigningMethodHS512
+		key.signKey = secret
+		key.verifyKey = secret
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(config.Key))
+		if err != nil {
+			return nil, err
+		}
+		key.method = jwt.SigningMethodRS256
+		key.signKey = private
+		key.verifyKey = &private.PublicKey
+	case "ES256":
+		private, err := jwt.ParseECPrivateKeyFromPEM([]byte(config.Key))
+		if err != nil {
+			return nil, err
+		}
+		if private.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+		key.method = jwt.SigningMethodES256
+		key.signKey = private
+		key.verifyKey = &private.PublicKey
+	case "EdDSA":
+		block, _ := pem.Decode([]byte(config.Key))
+		if block == nil {
+			return nil, errors.New("Key isn't in PEM format")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("EdDSA needs an Ed25519 key")
+		}
+		key.method = signingMethodEdDSA
+		key.signKey = private
+		key.verifyKey = private.Public()
+	default:
+		return nil, fmt.Errorf("Unsupported alg %q", config.Alg)
+	}
+	return key, nil
+}
+
+// signingKey returns the key new tokens are signed with
+func (s *tokenKeySet) signingKey() *tokenKey {
+	now := time.Now()
+	for _, key := range s.keys {
+		if key.signs(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// idTokenKey returns the key the ID tokens of OpenID Connect are signed
+// with: the first asymmetric one which signs, as the clients can't verify the
+// tokens signed by the secret HMAC keys
+func (s *tokenKeySet) idTokenKey() *tokenKey {
+	now := time.Now()
+	for _, key := range s.keys {
+		if _, hmac := key.method.(*jwt.SigningMethodHMAC); !hmac && key.signs(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// sign returns a token with the claims, signed by the signing key
+func (s *tokenKeySet) sign(claims map[string]interface{}) (string, error) {
+	return signWith(s.signingKey(), claims)
+}
+
+// signIDToken returns an ID token with the claims, signed by the idTokenKey
+func (s *tokenKeySet) signIDToken(claims map[string]interface{}) (string, error) {
+	return signWith(s.idTokenKey(), claims)
+}
+
+func signWith(key *tokenKey, claims map[string]interface{}) (string, error) {
+	if key == nil {
+		return "", errors.New("No token key to sign with")
+	}
+	token := jwt.New(key.method)
+	token.Claims = claims
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+	return token.SignedString(key.signKey)
+}
+
+// keyFunc is the jwt.Keyfunc for the tokens signed by the keys of the set.
+// The key is chosen by the kid, and must have the same alg as the token.
+func (s *tokenKeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	now := time.Now()
+	for _, key := range s.keys {
+		if key.id != kid {
+			continue
+		}
+		if key.method.Alg() != token.Method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		if !key.usable(now, s.grace) {
+			return nil, fmt.Errorf("Token key %s is retired", kid)
+		}
+		return key.verifyKey, nil
+	}
+	return nil, fmt.Errorf("Unknown token key: %s", kid)
+}
+
+// jwks returns the public keys of the set as a JSON Web Key Set, including the
+// ones which aren't active yet. The HMAC keys are secret, so they're left out.
+func (s *tokenKeySet) jwks() map[string]interface{} {
+	now := time.Now()
+	keys := []map[string]string{}
+	for _, key := range s.keys {
+		if !key.usable(now, s.grace) {
+			continue
+		}
+		jwk := map[string]string{
+			"kid": key.id,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk["kty"] = "EC"
+			jwk["crv"] = public.Curve.Params().Name
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(padLeft(public.X.Bytes(), size))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(padLeft(public.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// signingMethodEdDSA implements the EdDSA alg of RFC 8037 with Ed25519 keys,
+// which jwt-go doesn't support
+var signingMethodEdDSA = &SigningMethodEdDSA{}
+
+type SigningMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod("EdDSA", func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
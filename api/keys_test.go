@@ -0,0 +1,92 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTokenKeyRotation(t *testing.T) {
+	now := time.Now()
+	newKey := testTokenKey(t, "new", now.Add(jwksMaxAge), time.Time{})
+	oldKey := testTokenKey(t, "old", time.Time{}, now.Add(jwksMaxAge))
+	set := &tokenKeySet{keys: []*tokenKey{newKey, oldKey}, grace: accessTokenTTL}
+
+	tests := []struct {
+		at        time.Time
+		signingID string
+		published []string
+	}{
+		{now, "old", []string{"new", "old"}},
+		{now.Add(jwksMaxAge), "new", []string{"new", "old"}},
+		{now.Add(jwksMaxAge + accessTokenTTL), "new", []string{"new"}},
+	}
+	for _, tt := range tests {
+		var signing string
+		for _, key := range set.keys {
+			if key.signs(tt.at) {
+				signing = key.id
+				break
+			}
+		}
+		if signing != tt.signingID {
+			t.Errorf("at %s: signing with %q, want %q", tt.at.Sub(now), signing, tt.signingID)
+		}
+		var published []string
+		for _, key := range set.keys {
+			if key.usable(tt.at, set.grace) {
+				published = append(published, key.id)
+			}
+		}
+		if len(published) != len(tt.published) {
+			t.Errorf("at %s: publishing %v, want %v", tt.at.Sub(now), published, tt.published)
+		}
+	}
+
+	if key := set.signingKey(); key != oldKey {
+		t.Errorf("signing with %v before the new key is active", key)
+	}
+	if keys := set.jwks()["keys"].([]map[string]string); len(keys) != 2 {
+		t.Errorf("got %d published keys, want the new key before it's active too", len(keys))
+	}
+}
+
+func testTokenKey(t *testing.T, id string, activeFrom, retiredAt time.Time) *tokenKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tokenKey{
+		id:         id,
+		method:     jwt.SigningMethodES256,
+		signKey:    private,
+		verifyKey:  &private.PublicKey,
+		activeFrom: activeFrom,
+		retiredAt:  retiredAt,
+	}
+}
+
+func TestIDTokenKeyIsAsymmetric(t *testing.T) {
+	hmac := &tokenKey{id: "hmac", method: jwt.SigningMethodHS512, signKey: []byte("secret"), verifyKey: []byte("secret")}
+	es256 := testTokenKey(t, "es256", time.Time{}, time.Time{})
+
+	tests := []struct {
+		keys []*tokenKey
+		want *tokenKey
+	}{
+		{[]*tokenKey{hmac, es256}, es256},
+		{[]*tokenKey{es256, hmac}, es256},
+		{[]*tokenKey{hmac}, nil},
+		{[]*tokenKey{testTokenKey(t, "retired", time.Time{}, time.Now()), hmac}, nil},
+	}
+	for _, tt := range tests {
+		set := &tokenKeySet{keys: tt.keys, grace: accessTokenTTL}
+		if got := set.idTokenKey(); got != tt.want {
+			t.Errorf("got key %v, want %v", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"net/http"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const totpIssuer = "Bahram"
+
+// mfaEnrolmentPaths can be used by the admins who haven't enabled two-factor
+// authentication yet
+var mfaEnrolmentPaths = map[string]bool{
+	"/me":              true,
+	"/me/totp":         true,
+	"/me/totp/confirm": true,
+	"/logout":          true,
+}
+
+// requireAdminTOTP only lets the admins, i.e. the users with any role,
+// without two-factor authentication enable it. It's enabled unless BAHRAM_REQUIRE_ADMIN_2FA is "false".
+func requireAdminTOTP(ds *datasource.DataSource) grest.MiddlewareSimple {
+	return func(handler grest.HandlerFunc) grest.HandlerFunc {
+		return func(w grest.ResponseWriter, req *grest.Request) {
+			user, ok := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+			if ok && user.Privileged() && !user.TOTPEnabled && !mfaEnrolmentPaths[req.URL.Path] &&
+				ds.ConfigString("REQUIRE_ADMIN_2FA") != "false" {
+				grest.Error(w, "Admins must enable two-factor authentication first", http.StatusForbidden)
+				return
+			}
+			handler(w, req)
+		}
+	}
+}
+
+type mfaLogin struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+
+type mfaCode struct {
+	Code string `json:"code"`
+}
+
+// authenticateSecondFactor checks a TOTP code or a recovery code of the user
+// of the mfa challenge, which authenticate has created, and returns the user.
+func (r *restServerAPI) authenticateSecondFactor(mfaToken, code, ip string) (*datasource.User, *loginError) {
+	if mfaToken == "" || code == "" {
+		return nil, &loginError{message: "mfaToken/code missing", status: http.StatusBadRequest}
+	}
+
+	email, err := r.ds.MFAChallenge(mfaToken)
+	if err == datasource.ErrInvalidToken {
+		return nil, &loginError{message: err.Error(), status: http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, &loginError{message: err.Error(), status: http.StatusInternalServerError}
+	}
+
+	if wait := r.ds.LoginWait(email, ip); wait > 0 {
+		return nil, &loginError{
+			message:    "Too many failed attempts, try again later",
+			status:     http.StatusTooManyRequests,
+			retryAfter: wait,
+		}
+	}
+
+	user, err := r.ds.UserByEmail(email)
+	if err != nil {
+		return nil, &loginError{message: datasource.ErrInvalidToken.Error(), status: http.StatusUnauthorized}
+	}
+	if !user.Active {
+		return nil, &loginError{message: "user isn't activated", status: http.StatusForbidden}
+	}
+
+	if !user.CheckSecondFactor(code) {
+		r.ds.LoginFailed(email, ip)
+		return nil, &loginError{message: datasource.ErrInvalidCode.Error(), status: http.StatusBadRequest}
+	}
+	// Keeps the used code from being accepted again
+	err = r.ds.StoreUser(user)
+	if err == datasource.ErrConflict {
+		return nil, &loginError{message: err.Error(), status: http.StatusConflict}
+	} else if err != nil {
+		return nil, &loginError{message: err.Error(), status: http.StatusInternalServerError}
+	}
+	r.ds.LoginSucceeded(email, ip)
+
+	err = r.ds.DeleteMFAChallenge(mfaToken)
+	if err != nil {
+		logging.Log(debugTag, "Error while deleting the mfa challenge of %s: %s", email, err)
+	}
+	return user, nil
+}
+
+// LoginTOTP is the second step of Login for the users with two-factor
+// authentication. It accepts a TOTP code or a recovery code.
+func (r *restServerAPI) LoginTOTP(w grest.ResponseWriter, req *grest.Request) {
+	ml := mfaLogin{}
+	err := req.DecodeJsonPayload(&ml)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, loginErr := r.authenticateSecondFactor(ml.MFAToken, ml.Code, remoteIP(req))
+	if loginErr != nil {
+		writeLoginError(w, loginErr)
+		return
+	}
+
+	r.writeTokens(w, user)
+}
+
+// BeginTOTP creates a new TOTP secret for the current user, to be confirmed
+// by ConfirmTOTP
+func (r *restServerAPI) BeginTOTP(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if currentUser.TOTPEnabled {
+		grest.Error(w, "Two-factor authentication is already enabled", http.StatusNotAcceptable)
+		return
+	}
+
+	secret, err := r.ds.BeginTOTPEnrolment(currentUser)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(map[string]string{
+		"secret": secret,
+		"uri":    datasource.TOTPProvisioningURI(totpIssuer, currentUser.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables the secret created by BeginTOTP, given a code it has
+// generated, and returns the recovery codes
+func (r *restServerAPI) ConfirmTOTP(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var mc mfaCode
+	err := req.DecodeJsonPayload(&mc)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := r.ds.FinishTOTPEnrolment(currentUser, mc.Code)
+	if err == datasource.ErrInvalidToken || err == datasource.ErrInvalidCode {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !r.storeCurrentUser(w, currentUser) {
+		return
+	}
+	w.WriteJson(map[string][]string{
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTOTP removes the second factor of the current user, given one of
+// its codes
+func (r *restServerAPI) DisableTOTP(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var mc mfaCode
+	err := req.DecodeJsonPayload(&mc)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !currentUser.CheckSecondFactor(mc.Code) {
+		grest.Error(w, datasource.ErrInvalidCode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currentUser.DisableTOTP()
+	if !r.storeCurrentUser(w, currentUser) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user,
+// given one of its codes
+func (r *restServerAPI) RegenerateRecoveryCodes(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var mc mfaCode
+	err := req.DecodeJsonPayload(&mc)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !currentUser.CheckSecondFactor(mc.Code) {
+		grest.Error(w, datasource.ErrInvalidCode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := currentUser.NewRecoveryCodes()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !r.storeCurrentUser(w, currentUser) {
+		return
+	}
+	w.WriteJson(map[string][]string{
+		"recoveryCodes": codes,
+	})
+}
+
+// storeCurrentUser stores the user, and writes the error if it fails
+func (r *restServerAPI) storeCurrentUser(w grest.ResponseWriter, user *datasource.User) bool {
+	err := r.ds.StoreUser(user)
+	if err == datasource.ErrConflict {
+		grest.Error(w, err.Error(), http.StatusConflict)
+		return false
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,656 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// bahram is an OpenID Connect provider for the other applications, with the
+// authorization code flow. It's enabled by BAHRAM_OIDC_ISSUER, the public URL
+// bahram is served at. The ID tokens are signed by the first active
+// asymmetric token key (see keys.go), which must exist, as the clients can't
+// verify the tokens signed by the HMAC keys.
+//
+// The authorization, token and userinfo endpoints take forms and serve HTML,
+// so they're served by net/http rather than go-json-rest.
+
+// oidcScopes are the supported scopes; openid is required
+var oidcScopes = []string{"openid", "email", "profile", "groups"}
+
+// oidcAuthParams are the parameters of the authorization request, which are
+// carried by the login form
+var oidcAuthParams = []string{
+	"client_id", "redirect_uri", "response_type", "scope", "state", "nonce",
+	"code_challenge", "code_challenge_method",
+}
+
+func (r *restServerAPI) oidcIssuer() string {
+	return strings.TrimSuffix(r.ds.ConfigString("OIDC_ISSUER"), "/")
+}
+
+// OIDCDiscovery serves the OpenID Provider Metadata
+func (r *restServerAPI) OIDCDiscovery(w grest.ResponseWriter, req *grest.Request) {
+	issuer := r.oidcIssuer()
+	if issuer == "" {
+		grest.Error(w, "OpenID Connect isn't configured", http.StatusNotFound)
+		return
+	}
+
+	var algs []string
+	if key := r.keys.idTokenKey(); key != nil {
+		algs = append(algs, key.method.Alg())
+	}
+	w.WriteJson(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oidc/authorize",
+		"token_endpoint":                        issuer + "/oidc/token",
+		"userinfo_endpoint":                     issuer + "/oidc/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"scopes_supported":                      oidcScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "name", "given_name", "family_name", "groups",
+		},
+	})
+}
+
+// oidcClaims returns the claims about the user which the scopes of the
+// authorization allow
+func (r *restServerAPI) oidcClaims(a *datasource.OIDCAuthorization, u *datasource.User) (map[string]interface{}, error) {
+	subject, err := r.ds.OIDCSubject(u)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{
+		"sub": subject,
+	}
+	if a.HasScope("email") {
+		claims["email"] = u.Email
+		claims["email_verified"] = true
+	}
+	if a.HasScope("profile") {
+		claims["name"] = strings.TrimSpace(u.EnFirstName + " " + u.EnLastName)
+		claims["given_name"] = u.EnFirstName
+		claims["family_name"] = u.EnLastName
+	}
+	if a.HasScope("groups") {
+		groups, err := r.ds.Groups()
+		if err != nil {
+			return nil, err
+		}
+		memberOf := []string{}
+		for _, g := range groups {
+			if g.Active && g.IsMemeber(u.Email) {
+				memberOf = append(memberOf, g.Email)
+			}
+		}
+		claims["groups"] = memberOf
+	}
+	return claims, nil
+}
+
+var oidcLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.ClientName}}</title>
+<style>
+body { font-family: sans-serif; max-width: 22em; margin: 4em auto; padding: 0 1em; }
+input { display: block; width: 100%; margin: .4em 0 1em; padding: .4em; box-sizing: border-box; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>Sign in to {{.ClientName}}</h1>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="csrfToken" value="{{.CSRFToken}}">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}{{if .MFAToken}}<input type="hidden" name="mfaToken" value="{{.MFAToken}}">
+<label>Authentication or recovery code <input name="code" autocomplete="one-time-code" autofocus required></label>
+{{else}}<label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username" autofocus required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+{{end}}<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+type oidcLoginPage struct {
+	ClientName string
+	Params     map[string]string
+	CSRFToken  string
+	Email      string
+	MFAToken   string
+	Error      string
+}
+
+// oidcLoginCookie carries the token of the login form too, so the form can
+// only be posted by the browser it was shown to
+const oidcLoginCookie = "bahram_oidc_login"
+
+// oidcLoginRequest identifies the authorization request of a login form by
+// its parameters
+func oidcLoginRequest(params map[string]string) string {
+	values := url.Values{}
+	for name, value := range params {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// newOIDCLogin puts a new token for the authorization request in the page and
+// in the cookie
+func (r *restServerAPI) newOIDCLogin(w http.ResponseWriter, req *http.Request, page *oidcLoginPage) error {
+	token, err := r.ds.CreateOIDCLogin(oidcLoginRequest(page.Params))
+	if err != nil {
+		return err
+	}
+	page.CSRFToken = token
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    token,
+		Path:     req.URL.Path,
+		MaxAge:   int(datasource.OIDCLoginTTL.Seconds()),
+		Secure:   strings.HasPrefix(r.oidcIssuer(), "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// checkOIDCLogin reports whether the posted login form was shown to the same
+// browser for the same authorization request
+func (r *restServerAPI) checkOIDCLogin(req *http.Request, page *oidcLoginPage) bool {
+	token := req.PostForm.Get("csrfToken")
+	cookie, err := req.Cookie(oidcLoginCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		return false
+	}
+	return r.ds.CheckOIDCLogin(token, oidcLoginRequest(page.Params))
+}
+
+func writeOIDCLoginPage(w http.ResponseWriter, status int, page *oidcLoginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := oidcLoginTemplate.Execute(w, page); err != nil {
+		logging.Log(debugTag, "Error while rendering the login page: %s", err)
+	}
+}
+
+// redirectOIDC sends the user agent back to the client with the params
+func redirectOIDC(w http.ResponseWriter, req *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	for name, values := range params {
+		if values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, req, target.String(), http.StatusFound)
+}
+
+// OIDCAuthorize is the authorization endpoint. It shows a login form, checks
+// the credentials as Login and LoginTOTP do, and redirects to the client with
+// an authorization code.
+func (r *restServerAPI) OIDCAuthorize(w http.ResponseWriter, req *http.Request) {
+	if r.oidcIssuer() == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Until the redirect URI is checked, the errors can only be shown here
+	client, err := r.ds.OIDCClient(req.Form.Get("client_id"))
+	if err == datasource.ErrNotFound {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirectURI := req.Form.Get("redirect_uri")
+	if !client.AllowsRedirectURI(redirectURI) {
+		http.Error(w, "redirect_uri isn't registered for the client", http.StatusBadRequest)
+		return
+	}
+
+	state := req.Form.Get("state")
+	fail := func(code, description string) {
+		redirectOIDC(w, req, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {state},
+		})
+	}
+	scopes := strings.Fields(req.Form.Get("scope"))
+	switch {
+	case req.Form.Get("response_type") != "code":
+		fail("unsupported_response_type", "Only the code response_type is supported")
+		return
+	case !containsString(scopes, "openid"):
+		fail("invalid_scope", "The openid scope is required")
+		return
+	case req.Form.Get("code_challenge") != "" && req.Form.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "Only the S256 code_challenge_method is supported")
+		return
+	case client.Public && req.Form.Get("code_challenge") == "":
+		fail("invalid_request", "Public clients must use PKCE")
+		return
+	}
+
+	page := &oidcLoginPage{
+		ClientName: client.Name,
+		Params:     make(map[string]string),
+		Email:      req.PostForm.Get("email"),
+	}
+	for _, name := range oidcAuthParams {
+		if value := req.Form.Get(name); value != "" {
+			page.Params[name] = value
+		}
+	}
+
+	mfaToken := req.PostForm.Get("mfaToken")
+	submitted := req.Method == "POST" && (page.Email != "" || mfaToken != "")
+	status := http.StatusOK
+	if submitted && !r.checkOIDCLogin(req, page) {
+		page.Error = "The sign in form has expired, please try again"
+		status = http.StatusForbidden
+		submitted = false
+	}
+	if !submitted {
+		if err := r.newOIDCLogin(w, req, page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeOIDCLoginPage(w, status, page)
+		return
+	}
+	page.CSRFToken = req.PostForm.Get("csrfToken")
+
+	ip := remoteAddrIP(req)
+	var user *datasource.User
+	var loginErr *loginError
+	if mfaToken != "" {
+		user, loginErr = r.authenticateSecondFactor(mfaToken, req.PostForm.Get("code"), ip)
+		// Wrong codes can be retried with the same challenge
+		if loginErr != nil && loginErr.status != http.StatusUnauthorized {
+			page.MFAToken = mfaToken
+		}
+	} else {
+		user, loginErr = r.authenticate(page.Email, req.PostForm.Get("password"), ip)
+	}
+	if loginErr != nil {
+		if loginErr.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(loginErr.retryAfter.Seconds()))))
+		}
+		page.Error = loginErr.message
+		writeOIDCLoginPage(w, loginErr.status, page)
+		return
+	}
+
+	if mfaToken == "" && user.TOTPEnabled {
+		page.MFAToken, err = r.ds.CreateMFAChallenge(user.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeOIDCLoginPage(w, http.StatusOK, page)
+		return
+	}
+
+	var granted []string
+	for _, scope := range scopes {
+		if containsString(oidcScopes, scope) && !containsString(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	code, err := r.ds.CreateOIDCCode(&datasource.OIDCAuthorization{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Email:         user.Email,
+		TokenVersion:  user.TokenVersion,
+		Scopes:        granted,
+		Nonce:         req.Form.Get("nonce"),
+		CodeChallenge: req.Form.Get("code_challenge"),
+		AuthTime:      time.Now().Unix(),
+	})
+	if err != nil {
+		fail("server_error", err.Error())
+		return
+	}
+	if err := r.ds.DeleteOIDCLogin(page.CSRFToken); err != nil {
+		logging.Log(debugTag, "Error while deleting the login form token: %s", err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Path: req.URL.Path, MaxAge: -1})
+
+	err = r.ds.Audit(&datasource.AuditEvent{
+		Actor:    user.Email,
+		Action:   "oidc.authorize",
+		Target:   client.ID,
+		SourceIP: ip,
+		Success:  true,
+		Details:  client.Name,
+	})
+	if err != nil {
+		logging.Log(debugTag, "Error while auditing the authorization of %s for %s: %s", user.Email, client.ID, err)
+	}
+
+	redirectOIDC(w, req, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// writeOIDCJSON writes a response of the token or the userinfo endpoint,
+// which the browser-based clients may fetch from other origins
+func writeOIDCJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Log(debugTag, "Error while writing the response: %s", err)
+	}
+}
+
+func writeOIDCError(w http.ResponseWriter, status int, code, description string) {
+	writeOIDCJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// oidcCORS lets the public clients in the browsers call the endpoint, and
+// reports whether the request was only a preflight
+func oidcCORS(w http.ResponseWriter, req *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if req.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// OIDCToken is the token endpoint, which exchanges an authorization code for
+// an ID token and an access token for the userinfo endpoint
+func (r *restServerAPI) OIDCToken(w http.ResponseWriter, req *http.Request) {
+	issuer := r.oidcIssuer()
+	if issuer == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if oidcCORS(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		writeOIDCError(w, http.StatusMethodNotAllowed, "invalid_request", "Only POST is allowed")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.PostForm.Get("grant_type") != "authorization_code" {
+		writeOIDCError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	// client_secret_basic, whose credentials are form-encoded, or
+	// client_secret_post
+	clientID, secret, basic := req.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+	client, err := r.ds.OIDCClient(clientID)
+	if err != nil || (!client.Public && !client.CheckSecret(secret)) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"bahram\"")
+		}
+		writeOIDCError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	a, user, err := r.ds.TakeOIDCCode(req.PostForm.Get("code"))
+	if err == datasource.ErrInvalidToken {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	} else if err != nil {
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if a.ClientID != client.ID || a.RedirectURI != req.PostForm.Get("redirect_uri") {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_grant", "The code was issued for another client or redirect_uri")
+		return
+	}
+	if !a.CheckCodeVerifier(req.PostForm.Get("code_verifier")) {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		return
+	}
+
+	claims, err := r.oidcClaims(a, user)
+	if err != nil {
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	now := time.Now()
+	claims["iss"] = issuer
+	claims["aud"] = client.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(datasource.OIDCAccessTokenTTL).Unix()
+	claims["auth_time"] = a.AuthTime
+	if a.Nonce != "" {
+		claims["nonce"] = a.Nonce
+	}
+	idToken, err := r.keys.signIDToken(claims)
+	if err != nil {
+		logging.Log(debugTag, "Signing the ID token failed: %s", err)
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", "Signing failed")
+		return
+	}
+
+	accessToken, err := r.ds.CreateOIDCAccessToken(a)
+	if err != nil {
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeOIDCJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(datasource.OIDCAccessTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(a.Scopes, " "),
+	})
+}
+
+// OIDCUserInfo is the userinfo endpoint, which returns the claims about the
+// user of the access token
+func (r *restServerAPI) OIDCUserInfo(w http.ResponseWriter, req *http.Request) {
+	if r.oidcIssuer() == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if oidcCORS(w, req) {
+		return
+	}
+
+	token, err := decodeAuthHeader(req.Header.Get("Authorization"))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"bahram\"")
+		writeOIDCError(w, http.StatusUnauthorized, "invalid_request", err.Error())
+		return
+	}
+	a, user, err := r.ds.OIDCAccessToken(token)
+	if err == datasource.ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"bahram\", error=\"invalid_token\"")
+		writeOIDCError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	} else if err != nil {
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	claims, err := r.oidcClaims(a, user)
+	if err != nil {
+		writeOIDCError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeOIDCJSON(w, http.StatusOK, claims)
+}
+
+///////////////
+// Clients ////
+
+type oidcClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Public       bool     `json:"public"`
+}
+
+type createdOIDCClient struct {
+	*datasource.OIDCClient
+	// Secret is only shown here
+	Secret string `json:"secret,omitempty"`
+}
+
+func (r *restServerAPI) ListOIDCClients(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageOIDCClients, "") {
+		return
+	}
+
+	clients, err := r.ds.OIDCClients()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	clientList := []*datasource.OIDCClient{}
+	for _, c := range clients {
+		c.SecretHash = ""
+		clientList = append(clientList, c)
+	}
+	w.WriteJson(clientList)
+}
+
+func (r *restServerAPI) CreateOIDCClient(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageOIDCClients, "") {
+		return
+	}
+
+	var cr oidcClientRequest
+	err := req.DecodeJsonPayload(&cr)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cr.Name == "" || len(cr.RedirectURIs) == 0 {
+		grest.Error(w, "name/redirectUris missing", http.StatusBadRequest)
+		return
+	}
+
+	c, secret, err := r.ds.CreateOIDCClient(cr.Name, cr.RedirectURIs, cr.Public)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.SecretHash = ""
+	r.audit(req, "oidc-client.create", c.ID, datasource.Diff(nil, c))
+	w.WriteJson(createdOIDCClient{
+		OIDCClient: c,
+		Secret:     secret,
+	})
+}
+
+// UpdateOIDCClient changes the name and the redirect URIs of the client
+func (r *restServerAPI) UpdateOIDCClient(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageOIDCClients, "") {
+		return
+	}
+
+	c, err := r.ds.OIDCClient(req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var cr oidcClientRequest
+	err = req.DecodeJsonPayload(&cr)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cr.Name == "" || len(cr.RedirectURIs) == 0 {
+		grest.Error(w, "name/redirectUris missing", http.StatusBadRequest)
+		return
+	}
+
+	before := *c
+	c.Name = cr.Name
+	c.RedirectURIs = cr.RedirectURIs
+	err = r.ds.UpdateOIDCClient(c)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.SecretHash = ""
+	before.SecretHash = ""
+	r.audit(req, "oidc-client.update", c.ID, datasource.Diff(&before, c))
+	w.WriteJson(c)
+}
+
+func (r *restServerAPI) DeleteOIDCClient(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageOIDCClients, "") {
+		return
+	}
+
+	err := r.ds.DeleteOIDCClient(req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, "oidc-client.delete", req.PathParam("id"), nil)
+	w.WriteHeader(http.StatusOK)
+}
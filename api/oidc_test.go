@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func testOIDCServer(t *testing.T) (*restServerAPI, *datasource.OIDCClient, *datasource.User) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &datasource.User{Email: "a@example.com", Active: true}
+	if err := ds.SetPassword(u, "secret password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	client, _, err := ds.CreateOIDCClient("App", []string{"https://app.example.com/callback"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &tokenKeySet{keys: []*tokenKey{testTokenKey(t, "k", time.Time{}, time.Time{})}, grace: accessTokenTTL}
+	return &restServerAPI{ds: ds, keys: keys}, client, u
+}
+
+func TestOIDCLoginFormToken(t *testing.T) {
+	os.Setenv("BAHRAM_OIDC_ISSUER", "https://id.example.com")
+	defer os.Unsetenv("BAHRAM_OIDC_ISSUER")
+	r, client, _ := testOIDCServer(t)
+
+	params := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"xyz"},
+	}
+	w := httptest.NewRecorder()
+	r.OIDCAuthorize(w, httptest.NewRequest("GET", "/oidc/authorize?"+params.Encode(), nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != oidcLoginCookie {
+		t.Fatalf("got %d with cookies %v, want the login page and its cookie", w.Code, cookies)
+	}
+	token := cookies[0].Value
+	if !strings.Contains(w.Body.String(), token) {
+		t.Fatal("the form doesn't carry the token")
+	}
+
+	post := func(formToken, cookieToken, state string) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"a@example.com"}, "password": {"secret password"}, "csrfToken": {formToken}}
+		for name, values := range params {
+			form[name] = values
+		}
+		form.Set("state", state)
+		req := httptest.NewRequest("POST", "/oidc/authorize", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookieToken != "" {
+			req.AddCookie(&http.Cookie{Name: oidcLoginCookie, Value: cookieToken})
+		}
+		w := httptest.NewRecorder()
+		r.OIDCAuthorize(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name                   string
+		formToken, cookieToken string
+		state                  string
+		status                 int
+	}{
+		{"no token", "", "", "xyz", http.StatusForbidden},
+		{"no cookie", token, "", "xyz", http.StatusForbidden},
+		{"other cookie", token, "other", "xyz", http.StatusForbidden},
+		{"other request", token, token, "abc", http.StatusForbidden},
+		{"same request", token, token, "xyz", http.StatusFound},
+		{"used token", token, token, "xyz", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := post(tt.formToken, tt.cookieToken, tt.state)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusFound && !strings.Contains(w.Header().Get("Location"), "code=") {
+			t.Errorf("%s: redirected to %s, want a code", tt.name, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestOIDCSubjectIsKeptOnRename(t *testing.T) {
+	r, client, u := testOIDCServer(t)
+	a := &datasource.OIDCAuthorization{ClientID: client.ID, Email: u.Email, Scopes: []string{"openid"}}
+
+	claims, err := r.oidcClaims(a, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" || subject == u.Email {
+		t.Fatalf("got sub %q, want a generated one", subject)
+	}
+
+	renamed, err := r.ds.RenameUser(u.Email, "b@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err = r.oidcClaims(a, renamed)
+	if err != nil || claims["sub"] != subject {
+		t.Errorf("got sub %v, %v after the rename, want %q", claims["sub"], err, subject)
+	}
+}
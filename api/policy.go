@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+// allowed checks the current user may do perm on target (see
+// datasource.Allowed), and writes the error if not
+func allowed(w grest.ResponseWriter, req *grest.Request, perm datasource.Permission, target string) bool {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !datasource.Allowed(currentUser, perm, target) {
+		grest.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// allowedOnUser checks the current user may do perm on the target user (see
+// datasource.AllowedOnUser), and writes the error if not
+func allowedOnUser(w grest.ResponseWriter, req *grest.Request, perm datasource.Permission, target *datasource.User) bool {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !datasource.AllowedOnUser(currentUser, perm, target) {
+		grest.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// canChangeRoles checks the current user may set the Admin and Roles of target
+// (nil for a new user) to admin and roles, and writes the error if not
+func canChangeRoles(w grest.ResponseWriter, req *grest.Request, target *datasource.User, admin bool, roles []datasource.RoleBinding) bool {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !datasource.CanChangeRoles(currentUser, target, admin, roles) {
+		grest.Error(w, "You can't grant or revoke roles broader than your own", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -1,23 +1,57 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	grest "github.com/ant0ine/go-json-rest/rest"
 	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/bahram/smtp"
+	"github.com/cafebazaar/bahram/webhook"
 	"github.com/cafebazaar/blacksmith/logging"
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
+// publicPaths are served without authentication
+var publicPaths = map[string]bool{
+	"/login":                            true,
+	"/login/totp":                       true,
+	"/.well-known/jwks.json":            true,
+	"/.well-known/openid-configuration": true,
+	"/token/refresh":                    true,
+	"/password-reset":                   true,
+	"/password-reset/confirm":           true,
+}
+
+// accessTokenTTL is kept short, because access tokens are only revoked by
+// RevokeSessions; sessions are kept alive with refresh tokens
+const accessTokenTTL = 15 * time.Minute
+
 type restServerAPI struct {
-	rest *grest.Api
-	ds   *datasource.DataSource
+	rest  *grest.Api
+	ds    *datasource.DataSource
+	keys  *tokenKeySet
+	hooks *webhook.Dispatcher
 }
 
-func newRestServerAPI(datasource *datasource.DataSource) *restServerAPI {
+func newRestServerAPI(datasource *datasource.DataSource, hooks *webhook.Dispatcher) (*restServerAPI, error) {
+	keys, err := loadTokenKeys(datasource)
+	if err != nil {
+		return nil, err
+	}
+	if datasource.ConfigString("OIDC_ISSUER") != "" && keys.idTokenKey() == nil {
+		return nil, errors.New("OpenID Connect needs an active RS256, ES256 or EdDSA key in BAHRAM_TOKEN_KEYS")
+	}
+
 	rest := grest.NewApi()
+	rest.Use(grest.MiddlewareSimple(scimContentTypeMiddleware))
+	rest.Use(grest.MiddlewareSimple(bulkMiddleware))
 	rest.Use(grest.DefaultDevStack...)
 
 	rest.Use(&grest.CorsMiddleware{
@@ -28,7 +62,8 @@ func newRestServerAPI(datasource *datasource.DataSource) *restServerAPI {
 		},
 		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
 		AllowedHeaders: []string{
-			"Accept", "Content-Type", "X-Custom-Header", "Origin", "Authorization"},
+			"Accept", "Content-Type", "X-Custom-Header", "Origin", "Authorization", "If-Match"},
+		ExposedHeaders:                []string{"ETag"},
 		AccessControlAllowCredentials: true,
 		AccessControlMaxAge:           3600,
 	})
@@ -36,20 +71,45 @@ func newRestServerAPI(datasource *datasource.DataSource) *restServerAPI {
 	var bearerAuthMiddleware = &AuthBearerMiddleware{
 		Realm: "RestAuthentication",
 		Authenticator: func(token string) string {
-			parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			if isAPIKey(token) {
+				id, err := datasource.VerifyAPIKey(token)
+				if err != nil {
+					return ""
 				}
-				return datasource.ConfigByteArray("TOKEN_SIGN_KEY"), nil
-			})
+				return apiKeyUserID(id)
+			}
 
-			if err == nil && parsedToken.Valid {
-				return parsedToken.Claims["email"].(string)
-			} else {
+			parsedToken, err := jwt.Parse(token, keys.keyFunc)
+			if err != nil || !parsedToken.Valid {
 				return ""
 			}
+
+			email, _ := parsedToken.Claims["email"].(string)
+			version, ok := parsedToken.Claims["ver"].(float64)
+			if email == "" || !ok {
+				return ""
+			}
+			// Revoked tokens have an old version
+			user, err := datasource.UserByEmail(email)
+			if err != nil || !user.Active || uint64(version) != user.TokenVersion {
+				return ""
+			}
+			return email
 		},
 		Authorizer: func(request *grest.Request, userID string) bool {
+			if id, ok := apiKeyID(userID); ok {
+				if !apiKeyPath(request.URL.Path) {
+					return false
+				}
+				principal, err := datasource.APIKeyPrincipal(id, remoteIP(request))
+				if err != nil {
+					logging.Log(debugTag, "Couldn't fetch API key for userID=%s: %s", userID, err)
+					return false
+				}
+				request.Env["REMOTE_USER_OBJECT"] = principal
+				return true
+			}
+
 			user, err := datasource.UserByEmail(userID)
 			if err != nil {
 				logging.Log(debugTag, "Couldn't fetch user for userID=%s", userID)
@@ -62,39 +122,115 @@ func newRestServerAPI(datasource *datasource.DataSource) *restServerAPI {
 	}
 	rest.Use(&grest.IfMiddleware{
 		Condition: func(request *grest.Request) bool {
-			return request.URL.Path != "/login"
+			return !publicPaths[request.URL.Path]
 		},
 		IfTrue: bearerAuthMiddleware,
 	})
+	rest.Use(&grest.IfMiddleware{
+		Condition: func(request *grest.Request) bool {
+			return !publicPaths[request.URL.Path]
+		},
+		IfTrue: requireAdminTOTP(datasource),
+	})
 
 	return &restServerAPI{
-		rest: rest,
-		ds:   datasource,
-	}
+		rest:  rest,
+		ds:    datasource,
+		keys:  keys,
+		hooks: hooks,
+	}, nil
 }
 
 func (r *restServerAPI) MakeHandler() (http.Handler, error) {
 	router, err := grest.MakeRouter(
 		// Auth
 		grest.Post("/login", r.Login),
+		grest.Post("/login/totp", r.LoginTOTP),
+		grest.Post("/token/refresh", r.RefreshToken),
+		grest.Post("/logout", r.Logout),
+		grest.Get("/.well-known/jwks.json", r.JWKS),
+		grest.Get("/.well-known/openid-configuration", r.OIDCDiscovery),
+		grest.Post("/password-reset", r.RequestPasswordReset),
+		grest.Post("/password-reset/confirm", r.ConfirmPasswordReset),
 		// Users
 		grest.Get("/me", r.Me),
+		grest.Post("/me/totp", r.BeginTOTP),
+		grest.Post("/me/totp/confirm", r.ConfirmTOTP),
+		grest.Delete("/me/totp", r.DisableTOTP),
+		grest.Post("/me/recovery-codes", r.RegenerateRecoveryCodes),
+		grest.Get("/me/app-passwords", r.ListAppPasswords),
+		grest.Post("/me/app-passwords", r.CreateAppPassword),
+		grest.Delete("/me/app-passwords/#id", r.DeleteAppPassword),
 		grest.Get("/users", r.ListUsers),
+		// /users:import, /users:export and /groups:export, see bulkMiddleware
+		grest.Post("/users/-/import", r.ImportUsers),
+		grest.Get("/users/-/export", r.ExportUsers),
 		grest.Get("/users/#email", r.GetUser),
 		grest.Post("/users/#email", r.CreateUser),
 		grest.Put("/users/#email", r.UpdateUser),
+		grest.Delete("/users/#email", r.DeleteUser),
 		// Groups
 		grest.Get("/groups", r.ListGroups),
+		grest.Get("/groups/-/export", r.ExportGroups),
 		grest.Get("/groups/#email", r.GetGroup),
 		grest.Post("/groups/#email", r.CreateGroup),
 		grest.Put("/groups/#email", r.UpdateGroup),
+		grest.Delete("/groups/#email", r.DeleteGroup),
+		// API keys
+		grest.Get("/api-keys", r.ListAPIKeys),
+		grest.Post("/api-keys", r.CreateAPIKey),
+		grest.Delete("/api-keys/#id", r.DeleteAPIKey),
+		// Webhooks
+		grest.Get("/webhooks", r.ListWebhooks),
+		grest.Post("/webhooks", r.CreateWebhook),
+		grest.Put("/webhooks/#id", r.UpdateWebhook),
+		grest.Delete("/webhooks/#id", r.DeleteWebhook),
+		grest.Get("/webhooks/#id/deliveries", r.ListWebhookDeliveries),
+		grest.Post("/webhooks/#id/test", r.TestWebhook),
+		// OpenID Connect
+		grest.Get("/oidc/clients", r.ListOIDCClients),
+		grest.Post("/oidc/clients", r.CreateOIDCClient),
+		grest.Put("/oidc/clients/#id", r.UpdateOIDCClient),
+		grest.Delete("/oidc/clients/#id", r.DeleteOIDCClient),
+		// Audit
+		grest.Get("/audit", r.ListAuditEvents),
+		// SCIM, see scim.go
+		grest.Get(scimPrefix+"/Users", r.SCIMListUsers),
+		grest.Post(scimPrefix+"/Users", r.SCIMCreateUser),
+		grest.Get(scimPrefix+"/Users/#id", r.SCIMGetUser),
+		grest.Put(scimPrefix+"/Users/#id", r.SCIMReplaceUser),
+		grest.Patch(scimPrefix+"/Users/#id", r.SCIMPatchUser),
+		grest.Delete(scimPrefix+"/Users/#id", r.SCIMDeleteUser),
+		grest.Get(scimPrefix+"/Groups", r.SCIMListGroups),
+		grest.Post(scimPrefix+"/Groups", r.SCIMCreateGroup),
+		grest.Get(scimPrefix+"/Groups/#id", r.SCIMGetGroup),
+		grest.Put(scimPrefix+"/Groups/#id", r.SCIMReplaceGroup),
+		grest.Patch(scimPrefix+"/Groups/#id", r.SCIMPatchGroup),
+		grest.Delete(scimPrefix+"/Groups/#id", r.SCIMDeleteGroup),
+		grest.Get(scimPrefix+"/ServiceProviderConfig", r.SCIMServiceProviderConfig),
+		grest.Get(scimPrefix+"/Schemas", r.SCIMListSchemas),
+		grest.Get(scimPrefix+"/Schemas/#id", r.SCIMGetSchema),
+		grest.Get(scimPrefix+"/ResourceTypes", r.SCIMListResourceTypes),
+		grest.Get(scimPrefix+"/ResourceTypes/#id", r.SCIMGetResourceType),
+
+		// Misc
+		grest.Get("/stats", r.Stats),
+		grest.Get("/lockouts", r.ListLockouts),
+		grest.Delete("/lockouts/#kind/#key", r.ClearLockout),
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	r.rest.SetApp(router)
-	return r.rest.MakeHandler(), nil
+
+	// The OpenID Connect endpoints for the clients, see oidc.go
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/authorize", r.OIDCAuthorize)
+	mux.HandleFunc("/oidc/token", r.OIDCToken)
+	mux.HandleFunc("/oidc/userinfo", r.OIDCUserInfo)
+	mux.Handle("/", r.rest.MakeHandler())
+	return mux, nil
 }
 
 type userPass struct {
@@ -102,6 +238,73 @@ type userPass struct {
 	Password string
 }
 
+// loginError is why logging in failed, see authenticate
+type loginError struct {
+	message    string
+	status     int
+	retryAfter time.Duration
+}
+
+func writeLoginError(w grest.ResponseWriter, e *loginError) {
+	if e.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+	}
+	grest.Error(w, e.message, e.status)
+}
+
+// authenticate checks the password of the user, for Login and the OpenID
+// Connect authorization endpoint. The failures are counted by the login
+// limiter. The users with two-factor authentication must pass
+// authenticateSecondFactor too; for the others the failures are forgotten.
+func (r *restServerAPI) authenticate(email, password, ip string) (*datasource.User, *loginError) {
+	if email == "" || password == "" {
+		return nil, &loginError{message: "user/password missing", status: http.StatusBadRequest}
+	}
+
+	if wait := r.ds.LoginWait(email, ip); wait > 0 {
+		return nil, &loginError{
+			message:    "Too many failed attempts, try again later",
+			status:     http.StatusTooManyRequests,
+			retryAfter: wait,
+		}
+	}
+
+	user, err := r.ds.UserByEmail(email)
+	if err != nil || !r.ds.CheckPassword(user, password) {
+		r.ds.LoginFailed(email, ip)
+		return nil, &loginError{message: "user/password failed", status: http.StatusBadRequest}
+	}
+
+	if !user.Active {
+		return nil, &loginError{message: "user isn't activated", status: http.StatusForbidden}
+	}
+
+	// The failures are only forgotten after the second factor, so it can't
+	// be guessed by logging in again and again
+	if !user.TOTPEnabled {
+		r.ds.LoginSucceeded(email, ip)
+	}
+	return user, nil
+}
+
+// checkOldPassword checks the current password of the user before it's
+// changed. The failures are counted by the login limiter like the ones of
+// authenticate, so a stolen access token can't be used to guess it.
+func (r *restServerAPI) checkOldPassword(user *datasource.User, password, ip string) *loginError {
+	if wait := r.ds.LoginWait(user.Email, ip); wait > 0 {
+		return &loginError{
+			message:    "Too many failed attempts, try again later",
+			status:     http.StatusTooManyRequests,
+			retryAfter: wait,
+		}
+	}
+	if !user.AcceptsPassword(password, r.ds.ConfigByteArray("PASSWORD_SALT")) {
+		r.ds.LoginFailed(user.Email, ip)
+		return &loginError{message: "Old password is incorrect", status: http.StatusForbidden}
+	}
+	return nil
+}
+
 func (r *restServerAPI) Login(w grest.ResponseWriter, req *grest.Request) {
 	up := userPass{}
 	err := req.DecodeJsonPayload(&up)
@@ -110,36 +313,260 @@ func (r *restServerAPI) Login(w grest.ResponseWriter, req *grest.Request) {
 		return
 	}
 
-	if up.Email == "" || up.Password == "" {
-		grest.Error(w, "user/password missing", http.StatusBadRequest)
+	user, loginErr := r.authenticate(up.Email, up.Password, remoteIP(req))
+	if loginErr != nil {
+		writeLoginError(w, loginErr)
+		return
+	}
+
+	if user.TOTPEnabled {
+		mfaToken, err := r.ds.CreateMFAChallenge(user.Email)
+		if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Continued by LoginTOTP
+		w.WriteJson(map[string]interface{}{
+			"mfaRequired": true,
+			"mfaToken":    mfaToken,
+		})
+		return
 	}
 
-	user, err := r.ds.UserByEmail(up.Email)
+	r.writeTokens(w, user)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	// All revokes every session of the user, not only this one
+	All bool `json:"all"`
+}
+
+// writeTokens issues a new access token and refresh token for the user
+func (r *restServerAPI) writeTokens(w grest.ResponseWriter, user *datasource.User) {
+	tokenString, err := r.keys.sign(map[string]interface{}{
+		"exp":     time.Now().Add(accessTokenTTL).Unix(),
+		"email":   user.Email,
+		"isAdmin": user.Admin,
+		"ver":     user.TokenVersion,
+	})
 	if err != nil {
-		grest.Error(w, "user/password failed", http.StatusBadRequest)
+		logging.Log(debugTag, "Signing failed: %s", err)
+		grest.Error(w, "Authentication failed", http.StatusInternalServerError)
 		return
 	}
-	if !user.AcceptsPassword(up.Password, r.ds.ConfigByteArray("PASSWORD_SALT")) {
-		grest.Error(w, "user/password failed", http.StatusBadRequest)
+
+	refreshToken, err := r.ds.CreateRefreshToken(user)
+	if err != nil {
+		logging.Log(debugTag, "Creating the refresh token failed: %s", err)
+		grest.Error(w, "Authentication failed", http.StatusInternalServerError)
 		return
 	}
 
-	if !user.Active {
-		grest.Error(w, "user isn't activated", http.StatusForbidden)
+	w.WriteJson(map[string]interface{}{
+		"token":        tokenString,
+		"expiresIn":    int(accessTokenTTL.Seconds()),
+		"refreshToken": refreshToken,
+	})
+}
+
+// JWKS publishes the public keys the access tokens are signed with, so other
+// services can verify them
+func (r *restServerAPI) JWKS(w grest.ResponseWriter, req *grest.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	w.WriteJson(r.keys.jwks())
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token can only be used once.
+func (r *restServerAPI) RefreshToken(w grest.ResponseWriter, req *grest.Request) {
+	rr := refreshRequest{}
+	err := req.DecodeJsonPayload(&rr)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rr.RefreshToken == "" {
+		grest.Error(w, "refreshToken missing", http.StatusBadRequest)
 		return
 	}
 
-	token := jwt.New(jwt.GetSigningMethod("HS512"))
-	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
-	token.Claims["email"] = user.Email
-	token.Claims["isAdmin"] = user.Admin
-	tokenString, err := token.SignedString(r.ds.ConfigByteArray("TOKEN_SIGN_KEY"))
+	user, err := r.ds.TakeRefreshToken(rr.RefreshToken)
+	if err == datasource.ErrInvalidToken {
+		grest.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.writeTokens(w, user)
+}
+
+// Logout revokes the given refresh token, or every session of the user if
+// all is set. Access tokens which are already issued stay valid until they
+// expire, unless all is set.
+func (r *restServerAPI) Logout(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	lr := logoutRequest{}
+	err := req.DecodeJsonPayload(&lr)
 	if err != nil {
-		logging.Log(debugTag, "Signing failed: %s", err)
-		grest.Error(w, "Authentication failed", http.StatusInternalServerError)
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if lr.All {
+		currentUser.RevokeSessions()
+		err = r.ds.StoreUser(currentUser)
+		if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if lr.RefreshToken != "" {
+		err = r.ds.RevokeRefreshToken(lr.RefreshToken)
+		if err != nil && err != datasource.ErrInvalidToken {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type passwordResetConfirm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// RequestPasswordReset mails a password reset token to the InboxAddr of the
+// user. The response doesn't tell whether the user exists. The requests are
+// limited per email and per IP by the login limiter.
+func (r *restServerAPI) RequestPasswordReset(w grest.ResponseWriter, req *grest.Request) {
+	resetReq := passwordResetRequest{}
+	err := req.DecodeJsonPayload(&resetReq)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteJson(map[string]string{
-		"token": tokenString,
+	if resetReq.Email == "" {
+		grest.Error(w, "email missing", http.StatusBadRequest)
+		return
+	}
+
+	ip := remoteIP(req)
+	if wait := r.ds.PasswordResetWait(resetReq.Email, ip); wait > 0 {
+		writeLoginError(w, &loginError{
+			message:    "Too many password reset requests, try again later",
+			status:     http.StatusTooManyRequests,
+			retryAfter: wait,
+		})
+		return
+	}
+	r.ds.PasswordResetRequested(resetReq.Email, ip)
+
+	user, err := r.ds.UserByEmail(resetReq.Email)
+	if err == nil && user.Active && user.InboxAddr != "" {
+		err = r.sendPasswordReset(user)
+		if err != nil {
+			logging.Log(debugTag, "Error while sending the password reset of %s: %s", user.Email, err)
+		}
+	} else if err != nil && err != datasource.ErrNotFound {
+		logging.Log(debugTag, "Error while fetching user %s for password reset: %s", resetReq.Email, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *restServerAPI) sendPasswordReset(user *datasource.User) error {
+	token, err := r.ds.CreatePasswordResetToken(user.Email)
+	if err != nil {
+		return err
+	}
+
+	// e.g. https://bahram.example.com/#/reset-password?token=%s
+	link := token
+	if urlFormat := r.ds.ConfigString("PASSWORD_RESET_URL"); urlFormat != "" {
+		link = fmt.Sprintf(urlFormat, url.QueryEscape(token))
+	}
+
+	body := fmt.Sprintf("Hi,\n\n"+
+		"Someone, hopefully you, asked to reset the password of %s.\n"+
+		"Use this within an hour to choose a new password:\n\n"+
+		"%s\n\n"+
+		"If you didn't ask for it, you can ignore this mail.\n", user.Email, link)
+	return smtp.SendSystemMail(user.Email, "Reset your password", body)
+}
+
+// ConfirmPasswordReset sets the password of the user a password reset token
+// was mailed to. Each token can only be used once.
+func (r *restServerAPI) ConfirmPasswordReset(w grest.ResponseWriter, req *grest.Request) {
+	confirm := passwordResetConfirm{}
+	err := req.DecodeJsonPayload(&confirm)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if confirm.Token == "" || confirm.NewPassword == "" {
+		grest.Error(w, "token/newPassword missing", http.StatusBadRequest)
+		return
+	}
+
+	emailAddress, err := r.ds.TakePasswordResetToken(confirm.Token)
+	if err == datasource.ErrInvalidToken {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var before datasource.User
+	user, err := r.ds.UpdateUser(emailAddress, func(u *datasource.User) error {
+		before = *u
+		u.RevokeSessions()
+		return r.ds.SetPassword(u, confirm.NewPassword)
 	})
+	if err == datasource.ErrNotFound {
+		grest.Error(w, datasource.ErrInvalidToken.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, "user.resetPassword", user.Email, datasource.DiffUsers(&before, user))
+	r.deletePasswordResetTokens(user.Email)
+	// The user has proven to own the account
+	r.ds.LoginSucceeded(user.Email, remoteIP(req))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deletePasswordResetTokens invalidates the password reset tokens of a user
+// whose password has been changed
+func (r *restServerAPI) deletePasswordResetTokens(email string) {
+	if err := r.ds.DeletePasswordResetTokens(email); err != nil {
+		logging.Log(debugTag, "Error while deleting the password reset tokens of %s: %s", email, err)
+	}
+}
+
+// remoteIP returns the IP of the client, without the port
+func remoteIP(req *grest.Request) string {
+	return remoteAddrIP(req.Request)
+}
+
+func remoteAddrIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
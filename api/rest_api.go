@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"reflect"
 
 	grest "github.com/ant0ine/go-json-rest/rest"
 	"github.com/cafebazaar/bahram/datasource"
@@ -11,33 +12,35 @@ import (
 ///////////////
 // Users //////
 
-//func sendResetPassword()
-
 // Returns information about current user
 func (r *restServerAPI) Me(w grest.ResponseWriter, req *grest.Request) {
-	w.WriteJson(req.Env["REMOTE_USER_OBJECT"])
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	setETag(w, currentUser.Revision)
+	w.WriteJson(currentUser.Sanitized())
 }
 
 type UserInList struct {
-	Email       string `json:"email"`
-	UIDStr      string `json:"uid"`
-	InboxAddr   string `json:"inboxAddress"`
-	Active      bool   `json:"active"`
-	Admin       bool   `json:"admin"`
-	EnFirstName string `json:"enFirstName"`
-	EnLastName  string `json:"enLastName"`
-	FaFirstName string `json:"faFirstName"`
-	FaLastName  string `json:"faLastName"`
+	Email       string                   `json:"email"`
+	UIDStr      string                   `json:"uid"`
+	InboxAddr   string                   `json:"inboxAddress"`
+	Active      bool                     `json:"active"`
+	Admin       bool                     `json:"admin"`
+	Roles       []datasource.RoleBinding `json:"roles"`
+	EnFirstName string                   `json:"enFirstName"`
+	EnLastName  string                   `json:"enLastName"`
+	FaFirstName string                   `json:"faFirstName"`
+	FaLastName  string                   `json:"faLastName"`
 }
 type ChangePassword struct {
 	OldPassword string `json:"oldPassword"`
 	NewPassword string `json:"newPassword"`
 }
+type RenameUser struct {
+	NewEmail string `json:"newEmail"`
+}
 
 func (r *restServerAPI) ListUsers(w grest.ResponseWriter, req *grest.Request) {
-	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
-	if !currentUser.Admin {
-		grest.Error(w, "Access denied", http.StatusForbidden)
+	if !allowed(w, req, datasource.PermReadUsers, "") {
 		return
 	}
 
@@ -55,6 +58,7 @@ func (r *restServerAPI) ListUsers(w grest.ResponseWriter, req *grest.Request) {
 			InboxAddr:   u.InboxAddr,
 			Active:      u.Active,
 			Admin:       u.Admin,
+			Roles:       u.Roles,
 			EnFirstName: u.EnFirstName,
 			EnLastName:  u.EnLastName,
 			FaFirstName: u.FaFirstName,
@@ -74,8 +78,7 @@ func (r *restServerAPI) GetUser(w grest.ResponseWriter, req *grest.Request) {
 	if email == currentUser.Email {
 		user = currentUser
 	} else {
-		if !currentUser.Admin {
-			grest.Error(w, "Access denied", http.StatusForbidden)
+		if !allowed(w, req, datasource.PermReadUsers, email) {
 			return
 		}
 		user, err = r.ds.UserByEmail(email)
@@ -84,16 +87,23 @@ func (r *restServerAPI) GetUser(w grest.ResponseWriter, req *grest.Request) {
 			return
 		}
 	}
-	w.WriteJson(user)
+	setETag(w, user.Revision)
+	w.WriteJson(user.Sanitized())
 }
 
-func (r *restServerAPI) CreateUser(w grest.ResponseWriter, req *grest.Request) {
-	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
-	if !currentUser.Admin {
-		grest.Error(w, "Access denied", http.StatusForbidden)
-		return
-	}
+// clearServerFields drops the fields of a user sent by a client which aren't
+// set by the clients: two-factor authentication and app passwords are only
+// set by the user, and the token version, the OpenID Connect subject and the
+// SCIM externalId by bahram.
+func clearServerFields(u *datasource.User) {
+	u.DisableTOTP()
+	u.AppPasswords = nil
+	u.TokenVersion = 0
+	u.OIDCSubject = ""
+	u.ExternalID = ""
+}
 
+func (r *restServerAPI) CreateUser(w grest.ResponseWriter, req *grest.Request) {
 	var u datasource.User
 	err := req.DecodeJsonPayload(&u)
 	if err != nil {
@@ -101,23 +111,42 @@ func (r *restServerAPI) CreateUser(w grest.ResponseWriter, req *grest.Request) {
 		return
 	}
 
-	// TODO More Validation
-	_, err = r.ds.UserByEmail(u.Email)
-	if err == nil {
-		grest.Error(w, "A user with this email already exists", http.StatusBadRequest)
+	if !allowed(w, req, datasource.PermCreateUsers, u.Email) {
 		return
 	}
-
-	_, err = r.ds.GroupByEmail(u.Email)
-	if err == nil {
-		grest.Error(w, "A group with this email already exists", http.StatusBadRequest)
+	if (u.Admin || len(u.Roles) > 0) && !allowed(w, req, datasource.PermManageRoles, u.Email) {
+		return
+	}
+	if !canChangeRoles(w, req, nil, u.Admin, u.Roles) {
+		return
+	}
+	err = datasource.ValidateRoles(u.Roles)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	u.SetPassword(u.Password, r.ds.ConfigByteArray("PASSWORD_SALT"))
+	// TODO More Validation
+	clearServerFields(&u)
+	if u.Password != "" {
+		err = r.ds.SetPassword(&u, u.Password)
+		if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	r.ds.StoreUser(&u)
-	w.WriteJson(u)
+	err = r.ds.CreateUser(&u)
+	if err == datasource.ErrUserExists || err == datasource.ErrGroupExists {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, "user.create", u.Email, datasource.DiffUsers(nil, &u))
+	setETag(w, u.Revision)
+	w.WriteJson(u.Sanitized())
 }
 
 func (r *restServerAPI) UpdateUser(w grest.ResponseWriter, req *grest.Request) {
@@ -126,11 +155,11 @@ func (r *restServerAPI) UpdateUser(w grest.ResponseWriter, req *grest.Request) {
 	email := req.PathParam("email")
 	var user *datasource.User
 	var err error
-	if email == currentUser.Email {
+	self := email == currentUser.Email
+	if self {
 		user = currentUser
 	} else {
-		if !currentUser.Admin {
-			grest.Error(w, "Access denied", http.StatusForbidden)
+		if !allowed(w, req, datasource.PermReadUsers, email) {
 			return
 		}
 		user, err = r.ds.UserByEmail(email)
@@ -140,35 +169,73 @@ func (r *restServerAPI) UpdateUser(w grest.ResponseWriter, req *grest.Request) {
 		}
 	}
 
+	if !checkIfMatch(w, req, user.Revision) {
+		return
+	}
+	before := *user
+
 	action := req.FormValue("action")
 
 	switch action {
 	case "changePassword":
-		salt := r.ds.ConfigByteArray("PASSWORD_SALT")
+		if !self && !allowedOnUser(w, req, datasource.PermUpdateUsers, user) {
+			return
+		}
 		var cp ChangePassword
 		err = req.DecodeJsonPayload(&cp)
 		if err != nil {
 			grest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if user.HasPassword() && !user.AcceptsPassword(cp.OldPassword, salt) {
-			grest.Error(w, "Old password is incorrect", http.StatusForbidden)
+		if user.HasPassword() {
+			if loginErr := r.checkOldPassword(user, cp.OldPassword, remoteIP(req)); loginErr != nil {
+				writeLoginError(w, loginErr)
+				return
+			}
+		}
+		err = r.ds.SetPassword(user, cp.NewPassword)
+		if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		user.SetPassword(cp.NewPassword, salt)
+		user.RevokeSessions()
 		// TODO notify
 
 	case "update":
+		if !self && !allowedOnUser(w, req, datasource.PermUpdateUsers, user) {
+			return
+		}
 		var uTemp datasource.User
 		err = req.DecodeJsonPayload(&uTemp)
 		if err != nil {
 			grest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if uTemp.Active != user.Active && !allowedOnUser(w, req, datasource.PermUpdateUsers, user) {
+			return
+		}
+		rolesChanged := (len(uTemp.Roles) > 0 || len(user.Roles) > 0) && !reflect.DeepEqual(uTemp.Roles, user.Roles)
+		if uTemp.Admin != user.Admin || rolesChanged {
+			if !allowed(w, req, datasource.PermManageRoles, email) {
+				return
+			}
+			if !canChangeRoles(w, req, user, uTemp.Admin, uTemp.Roles) {
+				return
+			}
+			err = datasource.ValidateRoles(uTemp.Roles)
+			if err != nil {
+				grest.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		user.UIDStr = uTemp.UIDStr
 		user.InboxAddr = uTemp.InboxAddr // TODO notify the previous InboxAddr
+		if user.Active && !uTemp.Active {
+			user.RevokeSessions()
+		}
 		user.Active = uTemp.Active
 		user.Admin = uTemp.Admin
+		user.Roles = uTemp.Roles
 		user.EnFirstName = uTemp.EnFirstName
 		user.EnLastName = uTemp.EnLastName
 		user.FaFirstName = uTemp.FaFirstName
@@ -178,18 +245,98 @@ func (r *restServerAPI) UpdateUser(w grest.ResponseWriter, req *grest.Request) {
 		user.BirthDate = uTemp.BirthDate
 		user.EnrolmentDate = uTemp.EnrolmentDate
 		user.LeavingDate = uTemp.LeavingDate
+	case "revokeSessions":
+		if !self && !allowedOnUser(w, req, datasource.PermResetUserSecurity, user) {
+			return
+		}
+		user.RevokeSessions()
+	case "disableTOTP":
+		// For the users who have lost their authenticator and recovery codes
+		if !allowedOnUser(w, req, datasource.PermResetUserSecurity, user) {
+			return
+		}
+		user.DisableTOTP()
+	case "rename":
+		if !allowedOnUser(w, req, datasource.PermRenameUsers, user) {
+			return
+		}
+		var ru RenameUser
+		err = req.DecodeJsonPayload(&ru)
+		if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ru.NewEmail == "" {
+			grest.Error(w, "newEmail is missing", http.StatusBadRequest)
+			return
+		}
+		if !allowed(w, req, datasource.PermRenameUsers, ru.NewEmail) {
+			return
+		}
+		renamed, err := r.ds.RenameUser(user.Email, ru.NewEmail, nil)
+		if err == datasource.ErrUserExists || err == datasource.ErrGroupExists {
+			grest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			grest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.audit(req, "user.rename", user.Email, map[string]datasource.AuditChange{
+			"email": {Before: user.Email, After: renamed.Email},
+		})
+		w.WriteJson(renamed.Sanitized())
+		return
 	default:
 		grest.Error(w, fmt.Sprintf("Unknown action: %s", action), http.StatusNotAcceptable)
 		return
 	}
 
-	e := r.ds.StoreUser(user)
-	if e != nil {
+	err = r.ds.StoreUser(user)
+	if err == datasource.ErrConflict {
+		grest.Error(w, err.Error(), conflictStatus(req))
+		return
+	} else if err != nil {
 		grest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else {
-		w.WriteJson(user)
 	}
+	r.audit(req, "user."+action, user.Email, datasource.DiffUsers(&before, user))
+	if action == "changePassword" {
+		r.deletePasswordResetTokens(user.Email)
+	}
+	setETag(w, user.Revision)
+	w.WriteJson(user.Sanitized())
+}
+
+func (r *restServerAPI) DeleteUser(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	email := req.PathParam("email")
+	if !allowed(w, req, datasource.PermDeleteUsers, email) {
+		return
+	}
+	if email == currentUser.Email {
+		grest.Error(w, "You can't delete yourself", http.StatusNotAcceptable)
+		return
+	}
+	user, err := r.ds.UserByEmail(email)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !allowedOnUser(w, req, datasource.PermDeleteUsers, user) {
+		return
+	}
+
+	err = r.ds.DeleteUser(email)
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, "user.delete", email, nil)
+	w.WriteHeader(http.StatusOK)
 }
 
 ///////////////
@@ -217,7 +364,7 @@ func (r *restServerAPI) ListGroups(w grest.ResponseWriter, req *grest.Request) {
 
 	var groupList []*GroupInList
 	for _, g := range groups {
-		if !user.Admin && !g.Joinable {
+		if !g.Joinable && !g.IsMemeber(user.Email) && !datasource.Allowed(user, datasource.PermReadGroups, g.Email) {
 			continue
 		}
 		gil := &GroupInList{
@@ -240,16 +387,16 @@ func (r *restServerAPI) GetGroup(w grest.ResponseWriter, req *grest.Request) {
 		grest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	w.WriteJson(g)
-}
 
-func (r *restServerAPI) CreateGroup(w grest.ResponseWriter, req *grest.Request) {
-	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
-	if !currentUser.Admin {
-		grest.Error(w, "Access denied", http.StatusForbidden)
+	user := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !g.Joinable && !g.IsMemeber(user.Email) && !allowed(w, req, datasource.PermReadGroups, g.Email) {
 		return
 	}
+	setETag(w, g.Revision)
+	w.WriteJson(g)
+}
 
+func (r *restServerAPI) CreateGroup(w grest.ResponseWriter, req *grest.Request) {
 	// TODO check allowed domains
 
 	var g datasource.Group
@@ -259,20 +406,21 @@ func (r *restServerAPI) CreateGroup(w grest.ResponseWriter, req *grest.Request)
 		return
 	}
 
-	// TODO More Validation
-	_, err = r.ds.UserByEmail(g.Email)
-	if err == nil {
-		grest.Error(w, "A user with this email already exists", http.StatusBadRequest)
+	if !allowed(w, req, datasource.PermCreateGroups, g.Email) {
 		return
 	}
 
-	_, err = r.ds.GroupByEmail(g.Email)
-	if err == nil {
-		grest.Error(w, "A group with this email already exists", http.StatusBadRequest)
+	// TODO More Validation
+	err = r.ds.CreateGroup(&g)
+	if err == datasource.ErrUserExists || err == datasource.ErrGroupExists {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	r.ds.StoreGroup(&g)
+	r.audit(req, "group.create", g.Email, datasource.Diff(nil, &g))
+	setETag(w, g.Revision)
 	w.WriteJson(g)
 }
 
@@ -283,42 +431,38 @@ func (r *restServerAPI) UpdateGroup(w grest.ResponseWriter, req *grest.Request)
 		return
 	}
 
+	before := *g
 	user := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
 	action := req.FormValue("action")
+	if (action == "join" || action == "leave") && user.IsAPIKey() {
+		grest.Error(w, "API keys can't join groups", http.StatusNotAcceptable)
+		return
+	}
 
 	switch action {
 	case "join":
-		if g.IsMemeber(user.Email) {
-			grest.Error(w, "Already joined", http.StatusNotAcceptable)
-			return
-		}
-		g.Members = append(g.Members, user.Email)
-	case "leave":
-		if g.Manager == user.Email {
-			grest.Error(w, "You can't leave a group you which you manage", http.StatusNotAcceptable)
-			return
-		}
-		leaved := false
-		for i, m := range g.Members {
-			if m == user.Email {
-				leaved = true
-				n := len(g.Members)
-				g.Members[i] = g.Members[n-1]
-				g.Members = g.Members[:n-1]
-				break
+		// join and leave are retried on conflicts, so concurrent
+		// joins don't lose each other
+		g, err = r.ds.UpdateGroup(g.Email, func(g *datasource.Group) error {
+			if !g.Joinable && !datasource.CanManageGroup(user, g) {
+				return datasource.ErrNotJoinable
 			}
-		}
-		if !leaved {
-			grest.Error(w, "Not joined anyway", http.StatusNotAcceptable)
-			return
-		}
+			return g.Join(user.Email)
+		})
+	case "leave":
+		g, err = r.ds.UpdateGroup(g.Email, func(g *datasource.Group) error {
+			return g.Leave(user.Email)
+		})
 	case "update":
-		if !user.Admin && g.Manager != user.Email {
+		if !datasource.CanManageGroup(user, g) {
 			grest.Error(w, "You can't modify this group", http.StatusForbidden)
 			return
 		}
+		if !checkIfMatch(w, req, g.Revision) {
+			return
+		}
 		var gTemp datasource.Group
-		err := req.DecodeJsonPayload(&gTemp)
+		err = req.DecodeJsonPayload(&gTemp)
 		if err != nil {
 			grest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -331,16 +475,84 @@ func (r *restServerAPI) UpdateGroup(w grest.ResponseWriter, req *grest.Request)
 		g.Manager = gTemp.Manager
 		g.CCs = gTemp.CCs
 
+		err = r.ds.StoreGroup(g)
+
 	default:
 		grest.Error(w, fmt.Sprintf("Unknown action: %s", action), http.StatusNotAcceptable)
 		return
 	}
 
-	e := r.ds.StoreGroup(g)
-	if e != nil {
+	switch err {
+	case nil:
+		r.audit(req, "group."+action, g.Email, datasource.Diff(&before, g))
+		setETag(w, g.Revision)
+		w.WriteJson(g)
+	case datasource.ErrAlreadyMember, datasource.ErrNotMember, datasource.ErrManagerCantLeave:
+		grest.Error(w, err.Error(), http.StatusNotAcceptable)
+	case datasource.ErrNotJoinable:
+		grest.Error(w, err.Error(), http.StatusForbidden)
+	case datasource.ErrConflict:
+		grest.Error(w, err.Error(), conflictStatus(req))
+	default:
 		grest.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *restServerAPI) DeleteGroup(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermDeleteGroups, req.PathParam("email")) {
+		return
+	}
+
+	err := r.ds.DeleteGroup(req.PathParam("email"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, "group.delete", req.PathParam("email"), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+///////////////
+// Misc ///////
+
+func (r *restServerAPI) Stats(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermReadStats, "") {
+		return
+	}
+
+	w.WriteJson(map[string]interface{}{
+		"cache": r.ds.CacheStats(),
+	})
+}
+
+func (r *restServerAPI) ListLockouts(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermReadLockouts, "") {
+		return
+	}
+
+	lockouts, err := r.ds.Lockouts()
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(lockouts)
+}
+
+func (r *restServerAPI) ClearLockout(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermClearLockouts, "") {
+		return
+	}
+
+	err := r.ds.ClearLockout(req.PathParam("kind"), req.PathParam("key"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
 		return
-	} else {
-		w.WriteJson(g)
 	}
+	w.WriteHeader(http.StatusOK)
 }
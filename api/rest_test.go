@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func TestCheckOldPasswordIsLimited(t *testing.T) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &restServerAPI{ds: ds}
+	u := &datasource.User{Email: "a@example.com", Active: true}
+	if err := ds.SetPassword(u, "secret password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if loginErr := r.checkOldPassword(u, "secret password", "192.0.2.1"); loginErr != nil {
+		t.Fatalf("got %+v for the right password", loginErr)
+	}
+	var loginErr *loginError
+	for i := 0; i < 10 && (loginErr == nil || loginErr.status == http.StatusForbidden); i++ {
+		loginErr = r.checkOldPassword(u, "wrong", "192.0.2.1")
+	}
+	if loginErr == nil || loginErr.status != http.StatusTooManyRequests {
+		t.Fatalf("got %+v after the failures, want them limited", loginErr)
+	}
+	// Not even the right password is checked then
+	if loginErr := r.checkOldPassword(u, "secret password", "192.0.2.1"); loginErr == nil || loginErr.status != http.StatusTooManyRequests {
+		t.Errorf("got %+v for the right password after the failures, want it limited", loginErr)
+	}
+}
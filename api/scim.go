@@ -0,0 +1,909 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) lets the identity providers provision the
+// users and groups of bahram. The id of a resource is its email address.
+
+const (
+	scimContentType = "application/scim+json"
+	scimPrefix      = "/scim/v2"
+
+	scimUserSchema        = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema       = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimBahramUserSchema  = "urn:cafebazaar:params:scim:schemas:extension:bahram:2.0:User"
+	scimBahramGroupSchema = "urn:cafebazaar:params:scim:schemas:extension:bahram:2.0:Group"
+	scimListSchema        = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema       = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	// scimMaxResults is the most resources returned by a list request
+	scimMaxResults = 200
+)
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// scimValue is a value of a multi-valued attribute, e.g. emails or members
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimBahramUser struct {
+	FaFirstName string `json:"faFirstName,omitempty"`
+	FaLastName  string `json:"faLastName,omitempty"`
+}
+
+type scimUser struct {
+	Schemas      []string        `json:"schemas"`
+	ID           string          `json:"id,omitempty"`
+	ExternalID   string          `json:"externalId,omitempty"`
+	UserName     string          `json:"userName"`
+	Name         *scimName       `json:"name,omitempty"`
+	DisplayName  string          `json:"displayName,omitempty"`
+	Active       *bool           `json:"active,omitempty"`
+	Password     string          `json:"password,omitempty"`
+	Emails       []scimValue     `json:"emails,omitempty"`
+	PhoneNumbers []scimValue     `json:"phoneNumbers,omitempty"`
+	Groups       []scimValue     `json:"groups,omitempty"`
+	Bahram       *scimBahramUser `json:"urn:cafebazaar:params:scim:schemas:extension:bahram:2.0:User,omitempty"`
+	Meta         *scimMeta       `json:"meta,omitempty"`
+}
+
+type scimBahramGroup struct {
+	Email       string `json:"email,omitempty"`
+	Description string `json:"description,omitempty"`
+	Manager     string `json:"manager,omitempty"`
+	Active      *bool  `json:"active,omitempty"`
+	Public      bool   `json:"public"`
+	Joinable    bool   `json:"joinable"`
+}
+
+type scimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []scimValue      `json:"members,omitempty"`
+	Bahram      *scimBahramGroup `json:"urn:cafebazaar:params:scim:schemas:extension:bahram:2.0:Group,omitempty"`
+	Meta        *scimMeta        `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// scimError is both the body of the error responses and an error which the
+// SCIM handlers pass around
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func (e *scimError) Error() string {
+	return e.Detail
+}
+
+func newSCIMError(status int, scimType, detail string) *scimError {
+	return &scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+// scimContentTypeMiddleware lets the SCIM clients send application/scim+json,
+// which the ContentTypeCheckerMiddleware would reject
+func scimContentTypeMiddleware(handler grest.HandlerFunc) grest.HandlerFunc {
+	return func(w grest.ResponseWriter, req *grest.Request) {
+		if strings.HasPrefix(req.URL.Path, scimPrefix+"/") &&
+			strings.HasPrefix(req.Header.Get("Content-Type"), scimContentType) {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		handler(w, req)
+	}
+}
+
+func writeSCIM(w grest.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	w.WriteJson(v)
+}
+
+// writeSCIMError writes err, mapping the errors of datasource to their status
+func writeSCIMError(w grest.ResponseWriter, req *grest.Request, err error) {
+	var e *scimError
+	switch err {
+	case datasource.ErrNotFound:
+		e = newSCIMError(http.StatusNotFound, "", err.Error())
+	case datasource.ErrUserExists, datasource.ErrGroupExists:
+		e = newSCIMError(http.StatusConflict, "uniqueness", err.Error())
+	case datasource.ErrConflict:
+		e = newSCIMError(conflictStatus(req), "", err.Error())
+	default:
+		var ok bool
+		if e, ok = err.(*scimError); !ok {
+			e = newSCIMError(http.StatusInternalServerError, "", err.Error())
+		}
+	}
+	status, _ := strconv.Atoi(e.Status)
+	writeSCIM(w, status, e)
+}
+
+// scimAllowed is allowed, with a SCIM error
+func scimAllowed(w grest.ResponseWriter, req *grest.Request, perm datasource.Permission, target string) bool {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !datasource.Allowed(currentUser, perm, target) {
+		writeSCIMError(w, req, newSCIMError(http.StatusForbidden, "", "Access denied"))
+		return false
+	}
+	return true
+}
+
+// scimAllowedOnUser is allowedOnUser, with a SCIM error
+func scimAllowedOnUser(w grest.ResponseWriter, req *grest.Request, perm datasource.Permission, target *datasource.User) bool {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+	if !datasource.AllowedOnUser(currentUser, perm, target) {
+		writeSCIMError(w, req, newSCIMError(http.StatusForbidden, "", "Access denied"))
+		return false
+	}
+	return true
+}
+
+// scimIfMatch is checkIfMatch, with a SCIM error
+func scimIfMatch(w grest.ResponseWriter, req *grest.Request, revision uint64) bool {
+	if !ifMatches(req, revision, true) {
+		writeSCIMError(w, req, errSCIMModified)
+		return false
+	}
+	return true
+}
+
+var errSCIMModified = newSCIMError(http.StatusPreconditionFailed, "", "It has been modified since you loaded it")
+
+func scimVersion(revision uint64) string {
+	return fmt.Sprintf("W/\"%d\"", revision)
+}
+
+func scimLocation(req *grest.Request, resourceType, id string) string {
+	return req.UrlFor(fmt.Sprintf("%s/%ss/%s", scimPrefix, resourceType, id), nil).String()
+}
+
+// scimMap returns the JSON form of the resource, which the filters and the
+// PATCH operations work on
+func scimMap(resource interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(encoded, &m)
+	return m, err
+}
+
+// fromSCIMMap is the reverse of scimMap
+func fromSCIMMap(m map[string]interface{}, resource interface{}) error {
+	// Some clients send the booleans as strings, e.g. "False"
+	if key, found := scimKey(m, "active"); found {
+		if s, ok := m[key].(string); ok {
+			active, err := strconv.ParseBool(s)
+			if err != nil {
+				return newSCIMError(http.StatusBadRequest, "invalidValue", fmt.Sprintf("Invalid active: %s", s))
+			}
+			m[key] = active
+		}
+	}
+
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(encoded, resource); err != nil {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", err.Error())
+	}
+	return nil
+}
+
+// listSCIM filters and paginates the resources, as asked by the filter,
+// startIndex and count query parameters
+func listSCIM(w grest.ResponseWriter, req *grest.Request, resources []interface{}) {
+	var filter scimFilter
+	if f := req.URL.Query().Get("filter"); f != "" {
+		var err error
+		filter, err = parseSCIMFilter(f)
+		if err != nil {
+			writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidFilter", err.Error()))
+			return
+		}
+	}
+
+	startIndex, count := 1, scimMaxResults
+	if s := req.URL.Query().Get("startIndex"); s != "" {
+		startIndex, _ = strconv.Atoi(s)
+		if startIndex < 1 {
+			startIndex = 1
+		}
+	}
+	if s := req.URL.Query().Get("count"); s != "" {
+		count, _ = strconv.Atoi(s)
+		if count < 0 {
+			count = 0
+		} else if count > scimMaxResults {
+			count = scimMaxResults
+		}
+	}
+
+	var matched []interface{}
+	for _, resource := range resources {
+		if filter != nil {
+			m, err := scimMap(resource)
+			if err != nil {
+				writeSCIMError(w, req, err)
+				return
+			}
+			if !filter.match(m) {
+				continue
+			}
+		}
+		matched = append(matched, resource)
+	}
+
+	page := []interface{}{}
+	if startIndex-1 < len(matched) {
+		page = matched[startIndex-1:]
+		if len(page) > count {
+			page = page[:count]
+		}
+	}
+	writeSCIM(w, http.StatusOK, &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// decodeSCIMPatch decodes the body of a PATCH request
+func decodeSCIMPatch(req *grest.Request) ([]scimPatchOp, error) {
+	var patch scimPatchRequest
+	if err := req.DecodeJsonPayload(&patch); err != nil {
+		return nil, newSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error())
+	}
+	if len(patch.Operations) == 0 {
+		return nil, newSCIMError(http.StatusBadRequest, "invalidSyntax", "No Operations")
+	}
+	return patch.Operations, nil
+}
+
+// patchSCIM applies the operations to the JSON form of resource, and decodes
+// the result into patched
+func patchSCIM(resource interface{}, ops []scimPatchOp, patched interface{}) error {
+	m, err := scimMap(resource)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := applySCIMPatch(m, op); err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidPath", err.Error())
+		}
+	}
+	return fromSCIMMap(m, patched)
+}
+
+///////////////
+// Users //////
+
+// scimGroupsByMember maps the email of the users to the groups they're
+// members of
+func scimGroupsByMember(groups []*datasource.Group) map[string][]*datasource.Group {
+	byMember := make(map[string][]*datasource.Group)
+	for _, g := range groups {
+		for _, m := range scimMembers(g) {
+			byMember[m] = append(byMember[m], g)
+		}
+	}
+	return byMember
+}
+
+func toSCIMUser(req *grest.Request, u *datasource.User, groups []*datasource.Group) *scimUser {
+	active := u.Active
+	s := &scimUser{
+		Schemas:    []string{scimUserSchema, scimBahramUserSchema},
+		ID:         u.Email,
+		ExternalID: u.ExternalID,
+		UserName:   u.Email,
+		Active:     &active,
+		Emails:     []scimValue{{Value: u.Email, Type: "work", Primary: true}},
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Location:     scimLocation(req, "User", u.Email),
+			Version:      scimVersion(u.Revision),
+		},
+	}
+	if u.EnFirstName != "" || u.EnLastName != "" {
+		s.DisplayName = strings.TrimSpace(u.EnFirstName + " " + u.EnLastName)
+		s.Name = &scimName{
+			Formatted:  s.DisplayName,
+			GivenName:  u.EnFirstName,
+			FamilyName: u.EnLastName,
+		}
+	}
+	if u.InboxAddr != "" {
+		s.Emails = append(s.Emails, scimValue{Value: u.InboxAddr, Type: "other"})
+	}
+	if u.MobileNum != "" {
+		s.PhoneNumbers = append(s.PhoneNumbers, scimValue{Value: u.MobileNum, Type: "mobile"})
+	}
+	if u.EmergencyNum != "" {
+		s.PhoneNumbers = append(s.PhoneNumbers, scimValue{Value: u.EmergencyNum, Type: "other"})
+	}
+	for _, g := range groups {
+		s.Groups = append(s.Groups, scimValue{
+			Value:   g.Email,
+			Display: g.Name,
+			Type:    "direct",
+			Ref:     scimLocation(req, "Group", g.Email),
+		})
+	}
+	if u.FaFirstName != "" || u.FaLastName != "" {
+		s.Bahram = &scimBahramUser{FaFirstName: u.FaFirstName, FaLastName: u.FaLastName}
+	}
+	return s
+}
+
+// applySCIMUser sets the attributes of u from s, except userName, password
+// and the read-only groups. The missing attributes are cleared, except
+// active which is kept.
+func applySCIMUser(u *datasource.User, s *scimUser) {
+	u.ExternalID = s.ExternalID
+	u.EnFirstName, u.EnLastName = "", ""
+	if s.Name != nil {
+		u.EnFirstName = s.Name.GivenName
+		u.EnLastName = s.Name.FamilyName
+	}
+	if s.Active != nil {
+		if u.Active && !*s.Active {
+			u.RevokeSessions()
+		}
+		u.Active = *s.Active
+	}
+
+	// userName is the primary email, any other one is the inbox
+	u.InboxAddr = ""
+	for _, e := range s.Emails {
+		if e.Value != "" && !strings.EqualFold(e.Value, s.UserName) {
+			u.InboxAddr = e.Value
+			break
+		}
+	}
+
+	u.MobileNum, u.EmergencyNum = "", ""
+	for _, p := range s.PhoneNumbers {
+		switch {
+		case p.Type == "other" && u.EmergencyNum == "":
+			u.EmergencyNum = p.Value
+		case u.MobileNum == "":
+			u.MobileNum = p.Value
+		}
+	}
+
+	u.FaFirstName, u.FaLastName = "", ""
+	if s.Bahram != nil {
+		u.FaFirstName = s.Bahram.FaFirstName
+		u.FaLastName = s.Bahram.FaLastName
+	}
+}
+
+func (r *restServerAPI) SCIMListUsers(w grest.ResponseWriter, req *grest.Request) {
+	if !scimAllowed(w, req, datasource.PermReadUsers, "") {
+		return
+	}
+
+	users, err := r.ds.Users()
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	groups, err := r.ds.Groups()
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	byMember := scimGroupsByMember(groups)
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	var resources []interface{}
+	for _, u := range users {
+		resources = append(resources, toSCIMUser(req, u, byMember[u.Email]))
+	}
+	listSCIM(w, req, resources)
+}
+
+// scimUserGroups returns the groups the user is a member of
+func (r *restServerAPI) scimUserGroups(email string) ([]*datasource.Group, error) {
+	groups, err := r.ds.Groups()
+	if err != nil {
+		return nil, err
+	}
+	return scimGroupsByMember(groups)[email], nil
+}
+
+// writeSCIMUser writes the user with its groups
+func (r *restServerAPI) writeSCIMUser(w grest.ResponseWriter, req *grest.Request, status int, u *datasource.User) {
+	groups, err := r.scimUserGroups(u.Email)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	s := toSCIMUser(req, u, groups)
+	w.Header().Set("ETag", s.Meta.Version)
+	if status == http.StatusCreated {
+		w.Header().Set("Location", s.Meta.Location)
+	}
+	writeSCIM(w, status, s)
+}
+
+func (r *restServerAPI) SCIMGetUser(w grest.ResponseWriter, req *grest.Request) {
+	id := req.PathParam("id")
+	if !scimAllowed(w, req, datasource.PermReadUsers, id) {
+		return
+	}
+
+	u, err := r.ds.UserByEmail(id)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.writeSCIMUser(w, req, http.StatusOK, u)
+}
+
+func (r *restServerAPI) SCIMCreateUser(w grest.ResponseWriter, req *grest.Request) {
+	var s scimUser
+	if err := req.DecodeJsonPayload(&s); err != nil {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+		return
+	}
+	if s.UserName == "" {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is missing"))
+		return
+	}
+	if !scimAllowed(w, req, datasource.PermCreateUsers, s.UserName) {
+		return
+	}
+
+	u := &datasource.User{Email: s.UserName, Active: true}
+	applySCIMUser(u, &s)
+	if s.Password != "" {
+		if err := r.ds.SetPassword(u, s.Password); err != nil {
+			writeSCIMError(w, req, err)
+			return
+		}
+	}
+
+	if err := r.ds.CreateUser(u); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.audit(req, "user.create", u.Email, datasource.DiffUsers(nil, u))
+	r.writeSCIMUser(w, req, http.StatusCreated, u)
+}
+
+// saveSCIMUser makes the user what s says, renaming it if userName has
+// changed, and writes the result. A rename and the other changes are made in
+// one Commit.
+func (r *restServerAPI) saveSCIMUser(w grest.ResponseWriter, req *grest.Request, u *datasource.User, s *scimUser) {
+	if s.UserName == "" {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is missing"))
+		return
+	}
+	if !scimAllowedOnUser(w, req, datasource.PermUpdateUsers, u) {
+		return
+	}
+	renaming := s.UserName != u.Email
+	if renaming {
+		if !scimAllowedOnUser(w, req, datasource.PermRenameUsers, u) ||
+			!scimAllowed(w, req, datasource.PermRenameUsers, s.UserName) {
+			return
+		}
+	}
+
+	before := *u
+	modify := func(u *datasource.User) error {
+		applySCIMUser(u, s)
+		if s.Password != "" {
+			if err := r.ds.SetPassword(u, s.Password); err != nil {
+				return err
+			}
+			u.RevokeSessions()
+		}
+		return nil
+	}
+
+	if renaming {
+		renamed, err := r.ds.RenameUser(u.Email, s.UserName, modify)
+		if err != nil {
+			writeSCIMError(w, req, err)
+			return
+		}
+		r.audit(req, "user.rename", u.Email, map[string]datasource.AuditChange{
+			"email": {Before: u.Email, After: renamed.Email},
+		})
+		u = renamed
+		before.Email = u.Email
+	} else {
+		if err := modify(u); err != nil {
+			writeSCIMError(w, req, err)
+			return
+		}
+		if err := r.ds.StoreUser(u); err != nil {
+			writeSCIMError(w, req, err)
+			return
+		}
+	}
+	r.audit(req, "user.update", u.Email, datasource.DiffUsers(&before, u))
+	if s.Password != "" {
+		r.deletePasswordResetTokens(u.Email)
+	}
+	r.writeSCIMUser(w, req, http.StatusOK, u)
+}
+
+func (r *restServerAPI) SCIMReplaceUser(w grest.ResponseWriter, req *grest.Request) {
+	u, err := r.ds.UserByEmail(req.PathParam("id"))
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	if !scimIfMatch(w, req, u.Revision) {
+		return
+	}
+
+	var s scimUser
+	if err := req.DecodeJsonPayload(&s); err != nil {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+		return
+	}
+	r.saveSCIMUser(w, req, u, &s)
+}
+
+func (r *restServerAPI) SCIMPatchUser(w grest.ResponseWriter, req *grest.Request) {
+	u, err := r.ds.UserByEmail(req.PathParam("id"))
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	if !scimIfMatch(w, req, u.Revision) {
+		return
+	}
+
+	ops, err := decodeSCIMPatch(req)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	groups, err := r.scimUserGroups(u.Email)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	var s scimUser
+	if err := patchSCIM(toSCIMUser(req, u, groups), ops, &s); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.saveSCIMUser(w, req, u, &s)
+}
+
+func (r *restServerAPI) SCIMDeleteUser(w grest.ResponseWriter, req *grest.Request) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	id := req.PathParam("id")
+	if !scimAllowed(w, req, datasource.PermDeleteUsers, id) {
+		return
+	}
+	if id == currentUser.Email {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "mutability", "You can't delete yourself"))
+		return
+	}
+	u, err := r.ds.UserByEmail(id)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	if !scimAllowedOnUser(w, req, datasource.PermDeleteUsers, u) {
+		return
+	}
+
+	if err := r.ds.DeleteUser(id); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.audit(req, "user.delete", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+///////////////
+// Groups /////
+
+// scimMembers returns the members of the group, including its manager
+func scimMembers(g *datasource.Group) []string {
+	members := g.Members
+	if g.Manager != "" && !containsString(g.Members, g.Manager) {
+		members = append([]string{g.Manager}, members...)
+	}
+	return members
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func toSCIMGroup(req *grest.Request, g *datasource.Group) *scimGroup {
+	active := g.Active
+	s := &scimGroup{
+		Schemas:     []string{scimGroupSchema, scimBahramGroupSchema},
+		ID:          g.Email,
+		DisplayName: g.Name,
+		Bahram: &scimBahramGroup{
+			Email:       g.Email,
+			Description: g.Description,
+			Manager:     g.Manager,
+			Active:      &active,
+			Public:      g.Public,
+			Joinable:    g.Joinable,
+		},
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Location:     scimLocation(req, "Group", g.Email),
+			Version:      scimVersion(g.Revision),
+		},
+	}
+	for _, m := range scimMembers(g) {
+		s.Members = append(s.Members, scimValue{
+			Value: m,
+			Type:  "User",
+			Ref:   scimLocation(req, "User", m),
+		})
+	}
+	return s
+}
+
+// applySCIMGroup sets the name and members of g from s, and the attributes
+// of the extension if s has it. The members must be existing users. The
+// manager stays a member, whether s has it or not.
+func (r *restServerAPI) applySCIMGroup(g *datasource.Group, s *scimGroup) error {
+	if s.DisplayName == "" {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "displayName is missing")
+	}
+	g.Name = s.DisplayName
+
+	if s.Bahram != nil {
+		g.Description = s.Bahram.Description
+		g.Manager = s.Bahram.Manager
+		g.Public = s.Bahram.Public
+		g.Joinable = s.Bahram.Joinable
+		if s.Bahram.Active != nil {
+			g.Active = *s.Bahram.Active
+		}
+	}
+
+	var members []string
+	for _, m := range s.Members {
+		if m.Value == "" || m.Value == g.Manager || containsString(members, m.Value) {
+			continue
+		}
+		if _, err := r.ds.UserByEmail(m.Value); err == datasource.ErrNotFound {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", fmt.Sprintf("No such user: %s", m.Value))
+		} else if err != nil {
+			return err
+		}
+		members = append(members, m.Value)
+	}
+	g.Members = members
+	return nil
+}
+
+// scimGroupEmail returns the email of a new group: the email of the
+// extension, or displayName if it's an email address, or displayName in the
+// domain configured by BAHRAM_SCIM_GROUP_DOMAIN
+func (r *restServerAPI) scimGroupEmail(s *scimGroup) (string, error) {
+	if s.Bahram != nil && s.Bahram.Email != "" {
+		return s.Bahram.Email, nil
+	}
+	if strings.Contains(s.DisplayName, "@") {
+		return s.DisplayName, nil
+	}
+
+	domain := r.ds.ConfigString("SCIM_GROUP_DOMAIN")
+	if domain == "" {
+		return "", newSCIMError(http.StatusBadRequest, "invalidValue",
+			"The email of the group is missing, and BAHRAM_SCIM_GROUP_DOMAIN isn't set")
+	}
+	local := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			return c
+		case c == ' ':
+			return '-'
+		}
+		return -1
+	}, strings.ToLower(s.DisplayName))
+	if local == "" {
+		return "", newSCIMError(http.StatusBadRequest, "invalidValue",
+			fmt.Sprintf("Can't make an email out of %q", s.DisplayName))
+	}
+	return local + "@" + domain, nil
+}
+
+func (r *restServerAPI) writeSCIMGroup(w grest.ResponseWriter, req *grest.Request, status int, g *datasource.Group) {
+	s := toSCIMGroup(req, g)
+	w.Header().Set("ETag", s.Meta.Version)
+	if status == http.StatusCreated {
+		w.Header().Set("Location", s.Meta.Location)
+	}
+	writeSCIM(w, status, s)
+}
+
+func (r *restServerAPI) SCIMListGroups(w grest.ResponseWriter, req *grest.Request) {
+	if !scimAllowed(w, req, datasource.PermReadGroups, "") {
+		return
+	}
+
+	groups, err := r.ds.Groups()
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Email < groups[j].Email })
+	var resources []interface{}
+	for _, g := range groups {
+		resources = append(resources, toSCIMGroup(req, g))
+	}
+	listSCIM(w, req, resources)
+}
+
+func (r *restServerAPI) SCIMGetGroup(w grest.ResponseWriter, req *grest.Request) {
+	id := req.PathParam("id")
+	if !scimAllowed(w, req, datasource.PermReadGroups, id) {
+		return
+	}
+
+	g, err := r.ds.GroupByEmail(id)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.writeSCIMGroup(w, req, http.StatusOK, g)
+}
+
+func (r *restServerAPI) SCIMCreateGroup(w grest.ResponseWriter, req *grest.Request) {
+	var s scimGroup
+	if err := req.DecodeJsonPayload(&s); err != nil {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+		return
+	}
+	email, err := r.scimGroupEmail(&s)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	if !scimAllowed(w, req, datasource.PermCreateGroups, email) {
+		return
+	}
+
+	g := &datasource.Group{Email: email, Active: true}
+	if err := r.applySCIMGroup(g, &s); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	if err := r.ds.CreateGroup(g); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.audit(req, "group.create", g.Email, datasource.Diff(nil, g))
+	r.writeSCIMGroup(w, req, http.StatusCreated, g)
+}
+
+// updateSCIMGroup applies modify to the group, retrying on conflicts unless
+// the request has If-Match, and writes the result
+func (r *restServerAPI) updateSCIMGroup(w grest.ResponseWriter, req *grest.Request, modify func(g *datasource.Group) error) {
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	var before datasource.Group
+	g, err := r.ds.UpdateGroup(req.PathParam("id"), func(g *datasource.Group) error {
+		if !datasource.CanManageGroup(currentUser, g) {
+			return newSCIMError(http.StatusForbidden, "", "You can't modify this group")
+		}
+		if !ifMatches(req, g.Revision, true) {
+			return errSCIMModified
+		}
+		before = *g
+		return modify(g)
+	})
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.audit(req, "group.update", g.Email, datasource.Diff(&before, g))
+	r.writeSCIMGroup(w, req, http.StatusOK, g)
+}
+
+func (r *restServerAPI) SCIMReplaceGroup(w grest.ResponseWriter, req *grest.Request) {
+	var s scimGroup
+	if err := req.DecodeJsonPayload(&s); err != nil {
+		writeSCIMError(w, req, newSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+		return
+	}
+	r.updateSCIMGroup(w, req, func(g *datasource.Group) error {
+		return r.applySCIMGroup(g, &s)
+	})
+}
+
+func (r *restServerAPI) SCIMPatchGroup(w grest.ResponseWriter, req *grest.Request) {
+	ops, err := decodeSCIMPatch(req)
+	if err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.updateSCIMGroup(w, req, func(g *datasource.Group) error {
+		var s scimGroup
+		if err := patchSCIM(toSCIMGroup(req, g), ops, &s); err != nil {
+			return err
+		}
+		return r.applySCIMGroup(g, &s)
+	})
+}
+
+func (r *restServerAPI) SCIMDeleteGroup(w grest.ResponseWriter, req *grest.Request) {
+	id := req.PathParam("id")
+	if !scimAllowed(w, req, datasource.PermDeleteGroups, id) {
+		return
+	}
+
+	if err := r.ds.DeleteGroup(id); err != nil {
+		writeSCIMError(w, req, err)
+		return
+	}
+	r.audit(req, "group.delete", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,614 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file implements the filters (RFC 7644 section 3.4.2.2) and the PATCH
+// paths (section 3.5.2) of SCIM, on the JSON form of the resources.
+
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type scimOr struct{ left, right scimFilter }
+type scimAnd struct{ left, right scimFilter }
+type scimNot struct{ filter scimFilter }
+
+// scimCompare is "attr op value", or "attr pr"
+type scimCompare struct {
+	path  string
+	op    string
+	value interface{}
+}
+
+// scimValuePath is "attr[filter]", which matches if any value of the
+// multi-valued attr matches the filter
+type scimValuePath struct {
+	attr   string
+	filter scimFilter
+}
+
+func (f scimOr) match(r map[string]interface{}) bool  { return f.left.match(r) || f.right.match(r) }
+func (f scimAnd) match(r map[string]interface{}) bool { return f.left.match(r) && f.right.match(r) }
+func (f scimNot) match(r map[string]interface{}) bool { return !f.filter.match(r) }
+
+func (f scimValuePath) match(r map[string]interface{}) bool {
+	for _, v := range scimValues(r, f.attr) {
+		if m, ok := v.(map[string]interface{}); ok && f.filter.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f scimCompare) match(r map[string]interface{}) bool {
+	values := scimValues(r, f.path)
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	}
+	if f.op == "ne" {
+		return !(scimCompare{path: f.path, op: "eq", value: f.value}).match(r)
+	}
+	if f.op == "eq" && f.value == nil {
+		return len(values) == 0
+	}
+	for _, v := range values {
+		if compareSCIMValue(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareSCIMValue compares the strings case-insensitively, as the most of
+// the attributes of bahram aren't caseExact
+func compareSCIMValue(actual interface{}, op string, expected interface{}) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case "eq":
+			return a == e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		e, ok := expected.(bool)
+		return ok && op == "eq" && a == e
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	}
+	return false
+}
+
+// scimKey returns the key of m which is the attr, compared case-insensitively
+// as the SCIM attribute names are
+func scimKey(m map[string]interface{}, attr string) (string, bool) {
+	if _, found := m[attr]; found {
+		return attr, true
+	}
+	for k := range m {
+		if strings.EqualFold(k, attr) {
+			return k, true
+		}
+	}
+	return attr, false
+}
+
+// splitSCIMPath splits an attribute path to its parts. The attributes may be
+// prefixed by the URN of their schema, e.g. the ones of an extension:
+// urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber
+func splitSCIMPath(r map[string]interface{}, path string) []string {
+	if !strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return strings.Split(path, ".")
+	}
+
+	for _, schema := range scimValues(r, "schemas") {
+		urn, ok := schema.(string)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(path, urn) {
+			key, _ := scimKey(r, urn)
+			return []string{key}
+		}
+		if !strings.HasPrefix(strings.ToLower(path), strings.ToLower(urn)+":") {
+			continue
+		}
+		parts := strings.Split(path[len(urn)+1:], ".")
+		// The attributes of the core schema aren't nested
+		if key, found := scimKey(r, urn); found || strings.Contains(urn, ":extension:") {
+			return append([]string{key}, parts...)
+		}
+		return parts
+	}
+	return []string{path}
+}
+
+// scimValues returns the values of the attribute path in r, flattening the
+// multi-valued attributes
+func scimValues(r map[string]interface{}, path string) []interface{} {
+	current := []interface{}{r}
+	for _, part := range splitSCIMPath(r, path) {
+		var next []interface{}
+		for _, c := range current {
+			m, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, found := scimKey(m, part)
+			if !found {
+				continue
+			}
+			if list, ok := m[key].([]interface{}); ok {
+				next = append(next, list...)
+			} else if m[key] != nil {
+				next = append(next, m[key])
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+type scimToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeSCIMFilter(s string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{text: string(c)})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("Unterminated string at %d", i)
+			}
+			var text string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &text); err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, scimToken{text: text, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("()[]\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, scimToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []scimToken
+	pos    int
+}
+
+func parseSCIMFilter(s string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+func (p *scimFilterParser) peek() (scimToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return scimToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *scimFilterParser) next() (scimToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("Unexpected end of filter")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *scimFilterParser) keyword(word string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimFilterParser) expect(text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.quoted || t.text != text {
+		return fmt.Errorf("Expected %q, found %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = scimOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = scimAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseUnary() (scimFilter, error) {
+	if p.keyword("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return scimNot{f}, p.expect(")")
+	}
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "(" {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	return p.parseAttrExpr()
+}
+
+func (p *scimFilterParser) parseAttrExpr() (scimFilter, error) {
+	attr, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if attr.quoted {
+		return nil, fmt.Errorf("Expected an attribute, found %q", attr.text)
+	}
+
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "[" {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return scimValuePath{attr: attr.text, filter: f}, p.expect("]")
+	}
+
+	opToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(opToken.text)
+	switch op {
+	case "pr":
+		return scimCompare{path: attr.text, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("Unknown operator %q", opToken.text)
+	}
+
+	valueToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := scimFilterValue(valueToken)
+	if err != nil {
+		return nil, err
+	}
+	return scimCompare{path: attr.text, op: op, value: value}, nil
+}
+
+func scimFilterValue(t scimToken) (interface{}, error) {
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value %q", t.text)
+	}
+	return number, nil
+}
+
+// scimPatchPath is "attr", "attr.sub", "attr[filter]" or "attr[filter].sub"
+type scimPatchPath struct {
+	attr   string
+	sub    string
+	filter scimFilter
+}
+
+func parseSCIMPatchPath(r map[string]interface{}, path string) (*scimPatchPath, error) {
+	if i := strings.Index(path, "["); i >= 0 {
+		j := strings.LastIndex(path, "]")
+		if j < i {
+			return nil, fmt.Errorf("Invalid path %q", path)
+		}
+		f, err := parseSCIMFilter(path[i+1 : j])
+		if err != nil {
+			return nil, err
+		}
+		pp := &scimPatchPath{attr: path[:i], filter: f}
+		if rest := path[j+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ".") {
+				return nil, fmt.Errorf("Invalid path %q", path)
+			}
+			pp.sub = rest[1:]
+		}
+		return pp, nil
+	}
+
+	parts := splitSCIMPath(r, path)
+	pp := &scimPatchPath{attr: parts[0]}
+	if len(parts) == 2 {
+		pp.sub = parts[1]
+	} else if len(parts) > 2 {
+		return nil, fmt.Errorf("Invalid path %q", path)
+	}
+	return pp, nil
+}
+
+// scimPatchOp is an operation of a PATCH request
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// applySCIMPatch applies the operation to r, the JSON form of a resource
+func applySCIMPatch(r map[string]interface{}, op scimPatchOp) error {
+	operation := strings.ToLower(op.Op)
+	if op.Path == "" {
+		values, ok := op.Value.(map[string]interface{})
+		if !ok || operation == "remove" {
+			return fmt.Errorf("A path is required for %s", op.Op)
+		}
+		for attr, value := range values {
+			err := applySCIMPatch(r, scimPatchOp{Op: op.Op, Path: attr, Value: value})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pp, err := parseSCIMPatchPath(r, op.Path)
+	if err != nil {
+		return err
+	}
+	key, _ := scimKey(r, pp.attr)
+
+	if pp.filter != nil {
+		return applySCIMPatchFiltered(r, key, pp, operation, op.Value)
+	}
+
+	if pp.sub != "" {
+		parent, ok := r[key].(map[string]interface{})
+		if !ok {
+			if operation == "remove" {
+				return nil
+			}
+			parent = make(map[string]interface{})
+			r[key] = parent
+		}
+		subKey, _ := scimKey(parent, pp.sub)
+		switch operation {
+		case "add", "replace":
+			parent[subKey] = op.Value
+		case "remove":
+			delete(parent, subKey)
+		default:
+			return fmt.Errorf("Unknown op %q", op.Op)
+		}
+		return nil
+	}
+
+	switch operation {
+	case "add":
+		if list, ok := r[key].([]interface{}); ok {
+			if values, ok := op.Value.([]interface{}); ok {
+				r[key] = append(list, values...)
+			} else {
+				r[key] = append(list, op.Value)
+			}
+			return nil
+		}
+		if current, ok := r[key].(map[string]interface{}); ok {
+			if values, ok := op.Value.(map[string]interface{}); ok {
+				for k, v := range values {
+					current[k] = v
+				}
+				return nil
+			}
+		}
+		r[key] = op.Value
+	case "replace":
+		r[key] = op.Value
+	case "remove":
+		// Some clients remove values of a multi-valued attribute by giving
+		// them, instead of a filter
+		list, isList := r[key].([]interface{})
+		values, hasValues := op.Value.([]interface{})
+		if isList && hasValues {
+			r[key] = removeSCIMValues(list, values)
+			return nil
+		}
+		delete(r, key)
+	default:
+		return fmt.Errorf("Unknown op %q", op.Op)
+	}
+	return nil
+}
+
+func removeSCIMValues(list, values []interface{}) []interface{} {
+	var kept []interface{}
+	for _, item := range list {
+		removed := false
+		for _, v := range values {
+			if scimValueOf(item) == scimValueOf(v) {
+				removed = true
+			}
+		}
+		if !removed {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// scimValueOf returns the "value" of a complex value, compared
+// case-insensitively
+func scimValueOf(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		key, _ := scimKey(m, "value")
+		v = m[key]
+	}
+	s, _ := v.(string)
+	return strings.ToLower(s)
+}
+
+func applySCIMPatchFiltered(r map[string]interface{}, key string, pp *scimPatchPath, operation string, value interface{}) error {
+	list, _ := r[key].([]interface{})
+	var kept []interface{}
+	matched := false
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok || !pp.filter.match(m) {
+			kept = append(kept, item)
+			continue
+		}
+		matched = true
+		switch {
+		case operation == "remove" && pp.sub == "":
+			continue
+		case operation == "remove":
+			subKey, _ := scimKey(m, pp.sub)
+			delete(m, subKey)
+		case pp.sub != "":
+			subKey, _ := scimKey(m, pp.sub)
+			m[subKey] = value
+		default:
+			if values, ok := value.(map[string]interface{}); ok {
+				for k, v := range values {
+					m[k] = v
+				}
+			}
+		}
+		kept = append(kept, m)
+	}
+
+	// e.g. replace emails[type eq "work"].value when there's no such email
+	if !matched && operation != "remove" {
+		compare, ok := pp.filter.(scimCompare)
+		if !ok || compare.op != "eq" {
+			return fmt.Errorf("No value matches the filter of %s", pp.attr)
+		}
+		item := map[string]interface{}{compare.path: compare.value}
+		if pp.sub != "" {
+			item[pp.sub] = value
+		} else if values, ok := value.(map[string]interface{}); ok {
+			for k, v := range values {
+				item[k] = v
+			}
+		}
+		kept = append(kept, item)
+	}
+
+	r[key] = kept
+	return nil
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testSCIMUser = `{
+	"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User",
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"],
+	"userName": "A.B@example.com",
+	"name": {"givenName": "A", "familyName": "B"},
+	"active": true,
+	"emails": [
+		{"value": "a.b@example.com", "type": "work", "primary": true},
+		{"value": "a@home.example.com", "type": "home"}
+	],
+	"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"employeeNumber": "42"},
+	"meta": {"version": 3}
+}`
+
+func TestSCIMFilter(t *testing.T) {
+	var user map[string]interface{}
+	if err := json.Unmarshal([]byte(testSCIMUser), &user); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "a.b@example.com"`, true},
+		{`UserName EQ "A.B@EXAMPLE.COM"`, true},
+		{`userName ne "a.b@example.com"`, false},
+		{`userName co "@example"`, true},
+		{`userName sw "a."`, true},
+		{`userName ew ".org"`, false},
+		{`userName gt "a"`, true},
+		{`userName lt "a"`, false},
+		{`name.familyName eq "b"`, true},
+		{`title pr`, false},
+		{`name.givenName pr`, true},
+		{`title eq null`, true},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`meta.version ge 3`, true},
+		{`meta.version gt 3`, false},
+		{`emails.value eq "a@home.example.com"`, true},
+		{`emails[type eq "work" and value co "a.b"]`, true},
+		{`emails[type eq "work" and value co "home"]`, false},
+		{`emails[primary eq true]`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber eq "42"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "a.b@example.com"`, true},
+		{`userName eq "x" or active eq true`, true},
+		{`userName eq "x" or active eq true and title pr`, false},
+		{`(userName eq "x" or active eq true) and name.givenName pr`, true},
+		{`not (userName eq "x")`, true},
+		{`not(active eq true)`, false},
+		{`userName eq "with \"quotes\""`, false},
+	}
+	for _, tt := range tests {
+		f, err := parseSCIMFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %s", tt.filter, err)
+			continue
+		}
+		if got := f.match(user); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestSCIMFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName is "a"`,
+		`userName eq "a`,
+		`userName eq a`,
+		`"userName" eq "a"`,
+		`(userName eq "a"`,
+		`userName eq "a")`,
+		`emails[type eq "work"`,
+		`not userName eq "a"`,
+		`userName eq "a" and`,
+		`userName eq "a" "b"`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil {
+			t.Errorf("%s: parsed, want an error", filter)
+		}
+	}
+}
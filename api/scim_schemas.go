@@ -0,0 +1,274 @@
+package api
+
+import (
+	"net/http"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+)
+
+// The discovery endpoints of SCIM (RFC 7644 section 4), describing what
+// scim.go supports
+
+const (
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+type scimSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type scimFilterConfig struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type scimBulkConfig struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type scimAuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary,omitempty"`
+}
+
+type scimServiceProviderConfig struct {
+	Schemas               []string                   `json:"schemas"`
+	Patch                 scimSupported              `json:"patch"`
+	Bulk                  scimBulkConfig             `json:"bulk"`
+	Filter                scimFilterConfig           `json:"filter"`
+	ChangePassword        scimSupported              `json:"changePassword"`
+	Sort                  scimSupported              `json:"sort"`
+	ETag                  scimSupported              `json:"etag"`
+	AuthenticationSchemes []scimAuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *scimMeta                  `json:"meta"`
+}
+
+type scimSchemaExtension struct {
+	Schema   string `json:"schema"`
+	Required bool   `json:"required"`
+}
+
+type scimResourceType struct {
+	Schemas          []string              `json:"schemas"`
+	ID               string                `json:"id"`
+	Name             string                `json:"name"`
+	Endpoint         string                `json:"endpoint"`
+	Description      string                `json:"description"`
+	Schema           string                `json:"schema"`
+	SchemaExtensions []scimSchemaExtension `json:"schemaExtensions"`
+	Meta             *scimMeta             `json:"meta"`
+}
+
+type scimAttribute struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	MultiValued   bool            `json:"multiValued"`
+	Description   string          `json:"description,omitempty"`
+	Required      bool            `json:"required"`
+	CaseExact     bool            `json:"caseExact"`
+	Mutability    string          `json:"mutability"`
+	Returned      string          `json:"returned"`
+	Uniqueness    string          `json:"uniqueness"`
+	SubAttributes []scimAttribute `json:"subAttributes,omitempty"`
+}
+
+type scimSchema struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Attributes  []scimAttribute `json:"attributes"`
+	Meta        *scimMeta       `json:"meta"`
+}
+
+// scimAttr returns a single-valued, optional attribute
+func scimAttr(name, typ, mutability, description string) scimAttribute {
+	return scimAttribute{
+		Name:        name,
+		Type:        typ,
+		Description: description,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  "none",
+	}
+}
+
+// scimMultiValuedAttr returns a multi-valued attribute of value, type and $ref
+func scimMultiValuedAttr(name, mutability, description string) scimAttribute {
+	a := scimAttr(name, "complex", mutability, description)
+	a.MultiValued = true
+	a.SubAttributes = []scimAttribute{
+		scimAttr("value", "string", mutability, ""),
+		scimAttr("display", "string", "readOnly", ""),
+		scimAttr("type", "string", mutability, ""),
+		scimAttr("primary", "boolean", mutability, ""),
+		scimAttr("$ref", "reference", "readOnly", ""),
+	}
+	return a
+}
+
+func scimSchemas() []*scimSchema {
+	userName := scimAttr("userName", "string", "readWrite", "The email address of the user")
+	userName.Required = true
+	userName.Uniqueness = "server"
+	password := scimAttr("password", "string", "writeOnly", "")
+	password.Returned = "never"
+	name := scimAttr("name", "complex", "readWrite", "The English name of the user")
+	name.SubAttributes = []scimAttribute{
+		scimAttr("formatted", "string", "readOnly", ""),
+		scimAttr("givenName", "string", "readWrite", ""),
+		scimAttr("familyName", "string", "readWrite", ""),
+	}
+	displayName := scimAttr("displayName", "string", "readWrite", "The name of the group")
+	displayName.Required = true
+
+	return []*scimSchema{
+		{
+			ID:          scimUserSchema,
+			Name:        "User",
+			Description: "User Account",
+			Attributes: []scimAttribute{
+				userName,
+				scimAttr("externalId", "string", "readWrite", "The id of the user in the provisioning client"),
+				name,
+				scimAttr("displayName", "string", "readOnly", ""),
+				scimAttr("active", "boolean", "readWrite", ""),
+				password,
+				scimMultiValuedAttr("emails", "readWrite", "The email address of the user, and its inbox address"),
+				scimMultiValuedAttr("phoneNumbers", "readWrite", "The mobile and the other (emergency) number"),
+				scimMultiValuedAttr("groups", "readOnly", ""),
+			},
+		},
+		{
+			ID:          scimBahramUserSchema,
+			Name:        "BahramUser",
+			Description: "The attributes of the bahram users missing from the User schema",
+			Attributes: []scimAttribute{
+				scimAttr("faFirstName", "string", "readWrite", ""),
+				scimAttr("faLastName", "string", "readWrite", ""),
+			},
+		},
+		{
+			ID:          scimGroupSchema,
+			Name:        "Group",
+			Description: "Group",
+			Attributes: []scimAttribute{
+				displayName,
+				scimMultiValuedAttr("members", "readWrite", "The members of the group, including its manager"),
+			},
+		},
+		{
+			ID:          scimBahramGroupSchema,
+			Name:        "BahramGroup",
+			Description: "The attributes of the bahram groups missing from the Group schema",
+			Attributes: []scimAttribute{
+				scimAttr("email", "string", "immutable", ""),
+				scimAttr("description", "string", "readWrite", ""),
+				scimAttr("manager", "string", "readWrite", ""),
+				scimAttr("active", "boolean", "readWrite", ""),
+				scimAttr("public", "boolean", "readWrite", ""),
+				scimAttr("joinable", "boolean", "readWrite", ""),
+			},
+		},
+	}
+}
+
+func scimResourceTypes() []*scimResourceType {
+	return []*scimResourceType{
+		{
+			ID:               "User",
+			Name:             "User",
+			Endpoint:         "/Users",
+			Description:      "User Account",
+			Schema:           scimUserSchema,
+			SchemaExtensions: []scimSchemaExtension{{Schema: scimBahramUserSchema}},
+		},
+		{
+			ID:               "Group",
+			Name:             "Group",
+			Endpoint:         "/Groups",
+			Description:      "Group",
+			Schema:           scimGroupSchema,
+			SchemaExtensions: []scimSchemaExtension{{Schema: scimBahramGroupSchema}},
+		},
+	}
+}
+
+func (r *restServerAPI) SCIMServiceProviderConfig(w grest.ResponseWriter, req *grest.Request) {
+	writeSCIM(w, http.StatusOK, &scimServiceProviderConfig{
+		Schemas: []string{scimServiceProviderConfigSchema},
+		Patch:   scimSupported{true},
+		Filter:  scimFilterConfig{Supported: true, MaxResults: scimMaxResults},
+		ETag:    scimSupported{true},
+		AuthenticationSchemes: []scimAuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "API Key",
+			Description: "An API key whose scopes cover the users and groups, as a bearer token",
+			Primary:     true,
+		}},
+		Meta: &scimMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     req.UrlFor(scimPrefix+"/ServiceProviderConfig", nil).String(),
+		},
+	})
+}
+
+func (r *restServerAPI) SCIMListSchemas(w grest.ResponseWriter, req *grest.Request) {
+	var resources []interface{}
+	for _, s := range scimSchemas() {
+		resources = append(resources, withSchemaMeta(req, s))
+	}
+	listSCIM(w, req, resources)
+}
+
+func (r *restServerAPI) SCIMGetSchema(w grest.ResponseWriter, req *grest.Request) {
+	for _, s := range scimSchemas() {
+		if s.ID == req.PathParam("id") {
+			writeSCIM(w, http.StatusOK, withSchemaMeta(req, s))
+			return
+		}
+	}
+	writeSCIMError(w, req, newSCIMError(http.StatusNotFound, "", "No such schema"))
+}
+
+func withSchemaMeta(req *grest.Request, s *scimSchema) *scimSchema {
+	s.Schemas = []string{scimSchemaSchema}
+	s.Meta = &scimMeta{
+		ResourceType: "Schema",
+		Location:     req.UrlFor(scimPrefix+"/Schemas/"+s.ID, nil).String(),
+	}
+	return s
+}
+
+func (r *restServerAPI) SCIMListResourceTypes(w grest.ResponseWriter, req *grest.Request) {
+	var resources []interface{}
+	for _, t := range scimResourceTypes() {
+		resources = append(resources, withResourceTypeMeta(req, t))
+	}
+	listSCIM(w, req, resources)
+}
+
+func (r *restServerAPI) SCIMGetResourceType(w grest.ResponseWriter, req *grest.Request) {
+	for _, t := range scimResourceTypes() {
+		if t.ID == req.PathParam("id") {
+			writeSCIM(w, http.StatusOK, withResourceTypeMeta(req, t))
+			return
+		}
+	}
+	writeSCIMError(w, req, newSCIMError(http.StatusNotFound, "", "No such resource type"))
+}
+
+func withResourceTypeMeta(req *grest.Request, t *scimResourceType) *scimResourceType {
+	t.Schemas = []string{scimResourceTypeSchema}
+	t.Meta = &scimMeta{
+		ResourceType: "ResourceType",
+		Location:     req.UrlFor(scimPrefix+"/ResourceTypes/"+t.ID, nil).String(),
+	}
+	return t
+}
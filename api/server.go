@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/bahram/webhook"
 	"github.com/cafebazaar/blacksmith/logging"
 )
 
@@ -14,7 +15,13 @@ const (
 
 func Serve(listenAddr net.TCPAddr, datasource *datasource.DataSource) error {
 	logging.Log(debugTag, "Serving Rest API on %s", listenAddr)
-	restApi := newRestServerAPI(datasource)
+	hooks := webhook.NewDispatcher(datasource)
+	go hooks.Run()
+
+	restApi, err := newRestServerAPI(datasource, hooks)
+	if err != nil {
+		return err
+	}
 	handler, err := restApi.MakeHandler()
 	if err != nil {
 		return err
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"net/http"
+
+	grest "github.com/ant0ine/go-json-rest/rest"
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/bahram/webhook"
+)
+
+type webhookPayload struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+func (r *restServerAPI) ListWebhooks(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+
+	hooks, err := webhook.List(r.ds)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, h := range hooks {
+		h.Secret = ""
+	}
+	w.WriteJson(hooks)
+}
+
+// CreateWebhook creates a webhook. The secret is generated unless it's given,
+// and is only shown here.
+func (r *restServerAPI) CreateWebhook(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+
+	var payload webhookPayload
+	err := req.DecodeJsonPayload(&payload)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h := &webhook.Webhook{
+		URL:    payload.URL,
+		Secret: payload.Secret,
+		Events: payload.Events,
+		Active: payload.Active == nil || *payload.Active,
+	}
+	err = webhook.Create(r.ds, h)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteJson(h)
+}
+
+// UpdateWebhook replaces the URL, events and active state of the webhook, and
+// the secret if it's given
+func (r *restServerAPI) UpdateWebhook(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+
+	h, err := webhook.Get(r.ds, req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var payload webhookPayload
+	err = req.DecodeJsonPayload(&payload)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.URL = payload.URL
+	h.Events = payload.Events
+	if payload.Secret != "" {
+		h.Secret = payload.Secret
+	}
+	if payload.Active != nil {
+		h.Active = *payload.Active
+	}
+
+	err = webhook.Update(r.ds, h)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.Secret = ""
+	w.WriteJson(h)
+}
+
+func (r *restServerAPI) DeleteWebhook(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+
+	err := webhook.Delete(r.ds, req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ListWebhookDeliveries returns the pending deliveries of the webhook, and
+// the finished ones of the last week
+func (r *restServerAPI) ListWebhookDeliveries(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+
+	deliveries, err := webhook.Deliveries(r.ds, req.PathParam("id"))
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(deliveries)
+}
+
+// TestWebhook queues a ping event for the webhook
+func (r *restServerAPI) TestWebhook(w grest.ResponseWriter, req *grest.Request) {
+	if !allowed(w, req, datasource.PermManageWebhooks, "") {
+		return
+	}
+	currentUser := req.Env["REMOTE_USER_OBJECT"].(*datasource.User)
+
+	h, err := webhook.Get(r.ds, req.PathParam("id"))
+	if err == datasource.ErrNotFound {
+		grest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	delivery, err := r.hooks.Ping(h, currentUser.Email)
+	if err != nil {
+		grest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(delivery)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/cafebazaar/bahram/api"
 	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/bahram/ldap"
 	"github.com/cafebazaar/bahram/smtp"
 	"github.com/cafebazaar/blacksmith/logging"
 	etcd "github.com/coreos/etcd/client"
@@ -21,10 +22,18 @@ const (
 )
 
 var (
-	versionFlag = flag.Bool("version", false, "Print version info and exit")
-	debugFlag   = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
-	etcdFlag    = flag.String("etcd", "", "Etcd endpoints")
-	etcdDirFlag = flag.String("etcd-dir", "bahram", "Etcd path prefixe")
+	versionFlag  = flag.Bool("version", false, "Print version info and exit")
+	debugFlag    = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
+	storeFlag    = flag.String("store", "etcd", "Storage backend for users and groups: etcd, bolt or memory")
+	etcdFlag     = flag.String("etcd", "", "Etcd endpoints")
+	etcdDirFlag  = flag.String("etcd-dir", "bahram", "Etcd path prefixe")
+	boltPathFlag = flag.String("bolt-path", "bahram.db", "Path of the database file, when using the bolt store")
+	queueFlag    = flag.String("mail-queue", "redis", "Queue of the mails to deliver: redis, spool or memory (which loses the mails on restarts, for testing only)")
+	redisFlag    = flag.String("redis", ":6379", "Address of the Redis server, when using the redis mail queue")
+	spoolDirFlag = flag.String("spool-dir", "spool", "Path of the spool directory, when using the spool mail queue")
+	maxAgeFlag   = flag.Duration("mail-max-age", 5*24*time.Hour, "How long the deliveries are retried before the mails bounce")
+	maxTriesFlag = flag.Int("mail-max-attempts", 200, "How many times the deliveries are attempted before the mails bounce")
+	ldapFlag     = flag.String("ldap", "", "Address to serve LDAP on, e.g. :389; LDAP isn't served if it's empty")
 
 	version   string
 	commit    string
@@ -56,33 +65,48 @@ func main() {
 		os.Exit(0)
 	}
 
-	// etcd config
-	if *etcdFlag == "" || *etcdDirFlag == "" {
-		// fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints and prefix\n")
-		// os.Exit(1)
-		// TODO: remove these
-		e1 := "http://aghajoon1.cafebazaar.ir:4001"
-		e2 := "bahram"
-		etcdFlag = &e1
-		etcdDirFlag = &e2
+	var store datasource.Store
+	switch *storeFlag {
+	case "etcd":
+		store, err = newEtcdStore()
+	case "bolt":
+		store, err = datasource.NewBoltStore(*boltPathFlag)
+	case "memory":
+		store = datasource.NewMemoryStore()
+	default:
+		err = fmt.Errorf("unknown store %q", *storeFlag)
 	}
-
-	etcdClient, err := etcd.New(etcd.Config{
-		Endpoints:               strings.Split(*etcdFlag, ","),
-		HeaderTimeoutPerRequest: 5 * time.Second,
-	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		fmt.Fprintf(os.Stderr, "\nCouldn't create store: %s\n", err)
 		os.Exit(1)
 	}
-	kapi := etcd.NewKeysAPI(etcdClient)
 
-	dataSource, err := datasource.NewDataSource(kapi, *etcdDirFlag)
+	dataSource, err := datasource.NewDataSource(store)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nCouldn't create datasource: %s\n", err)
 		os.Exit(1)
 	}
 
+	var queue smtp.Queue
+	switch *queueFlag {
+	case "redis":
+		queue = smtp.NewRedisQueue(*redisFlag, "")
+	case "spool":
+		queue, err = smtp.NewSpoolQueue(*spoolDirFlag)
+	case "memory":
+		fmt.Fprintf(os.Stderr, "\nWARNING: The mail queue is in memory, and the queued mails are lost when bahram stops. Use it only for testing.\n\n")
+		queue = smtp.NewMemoryQueue()
+	default:
+		err = fmt.Errorf("unknown mail queue %q", *queueFlag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create mail queue: %s\n", err)
+		os.Exit(1)
+	}
+	smtp.SetQueue(queue)
+	smtp.SetMaxDeliveryAge(*maxAgeFlag)
+	smtp.SetMaxDeliveryAttempts(*maxTriesFlag)
+
 	var apiAddr = net.TCPAddr{IP: net.IPv4zero, Port: 80}
 	var smtpAddr = net.TCPAddr{IP: net.IPv4zero, Port: 25}
 
@@ -97,5 +121,41 @@ func main() {
 		log.Printf("Error while serving smtp: %s\n", err)
 	}()
 
+	if *ldapFlag != "" {
+		ldapAddr, err := net.ResolveTCPAddr("tcp", *ldapFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid LDAP address: %s\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			err := ldap.Serve(*ldapAddr, dataSource)
+			log.Printf("Error while serving ldap: %s\n", err)
+		}()
+	}
+
 	logging.RecordLogs(log.New(os.Stderr, "", log.LstdFlags), *debugFlag)
 }
+
+func newEtcdStore() (datasource.Store, error) {
+	// etcd config
+	if *etcdFlag == "" || *etcdDirFlag == "" {
+		// fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints and prefix\n")
+		// os.Exit(1)
+		// TODO: remove these
+		e1 := "http://aghajoon1.cafebazaar.ir:4001"
+		e2 := "bahram"
+		etcdFlag = &e1
+		etcdDirFlag = &e2
+	}
+
+	etcdClient, err := etcd.New(etcd.Config{
+		Endpoints:               strings.Split(*etcdFlag, ","),
+		HeaderTimeoutPerRequest: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create etcd connection: %s", err)
+	}
+	kapi := etcd.NewKeysAPI(etcdClient)
+
+	return datasource.NewEtcdStore(kapi, *etcdDirFlag)
+}
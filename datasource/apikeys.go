@@ -0,0 +1,266 @@
+package datasource
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	apiKeyKind = "api-keys"
+	// The uses are kept apart, so recording one can't bring back a key
+	// which is being revoked
+	apiKeyUseKind = "api-key-uses"
+	// apiKeyPrefix tells the API keys apart from the JWTs
+	apiKeyPrefix = "bhk_"
+	// APIKeyUserPrefix is the prefix of the Email of the users standing for
+	// API keys
+	APIKeyUserPrefix = "api-key:"
+
+	// apiKeyUseInterval limits how often the last use of a key is stored
+	apiKeyUseInterval = time.Minute
+)
+
+// ErrInvalidAPIKey is returned when an API key doesn't exist, has expired or
+// its owner can't log in anymore
+var ErrInvalidAPIKey = errors.New("Invalid or expired API key")
+
+// APIKey is a long-lived credential for machine clients. The key looks like
+// bhk_<ID>_<secret>; only its hash is kept.
+type APIKey struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Owner      string       `json:"owner"`
+	Scopes     []Permission `json:"scopes"`
+	Hash       string       `json:"hash,omitempty"`
+	CreatedAt  int64        `json:"createdAt"`
+	ExpiresAt  int64        `json:"expiresAt"`
+	LastUsedAt int64        `json:"lastUsedAt"`
+	LastUsedIP string       `json:"lastUsedIP"`
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != 0 && now.Unix() >= k.ExpiresAt
+}
+
+// IsAPIKey reports whether the bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+type apiKeyUse struct {
+	LastUsedAt int64  `json:"lastUsedAt"`
+	LastUsedIP string `json:"lastUsedIP"`
+}
+
+// ttl is how long the records of the key are kept
+func (k *APIKey) ttl() time.Duration {
+	if k.ExpiresAt == 0 {
+		return 0
+	}
+	return time.Unix(k.ExpiresAt, 0).Sub(time.Now())
+}
+
+func (ds *DataSource) apiKeyUse(k *APIKey) {
+	value, err := ds.Record(apiKeyUseKind, k.ID)
+	if err != nil {
+		return
+	}
+	var use apiKeyUse
+	if json.Unmarshal(value, &use) == nil {
+		k.LastUsedAt = use.LastUsedAt
+		k.LastUsedIP = use.LastUsedIP
+	}
+}
+
+// APIKey returns the API key with the id
+func (ds *DataSource) APIKey(id string) (*APIKey, error) {
+	value, err := ds.Record(apiKeyKind, id)
+	if err != nil {
+		return nil, err
+	}
+	var k APIKey
+	err = json.Unmarshal(value, &k)
+	if err != nil {
+		return nil, err
+	}
+	ds.apiKeyUse(&k)
+	return &k, nil
+}
+
+// CreateAPIKey creates an API key owned by the user, which expires after ttl
+// unless it's zero. It returns the key along with the secret, which can't be
+// read back later.
+func (ds *DataSource) CreateAPIKey(owner *User, name string, scopes []Permission, ttl time.Duration) (*APIKey, string, error) {
+	err := ValidatePermissions(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id = tokenID(id)[:16]
+	secret, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + id + "_" + secret
+
+	now := time.Now()
+	k := &APIKey{
+		ID:        id,
+		Name:      name,
+		Owner:     owner.Email,
+		Scopes:    scopes,
+		Hash:      tokenID(key),
+		CreatedAt: now.Unix(),
+	}
+	if ttl > 0 {
+		k.ExpiresAt = now.Add(ttl).Unix()
+	}
+	value, err := json.Marshal(k)
+	if err != nil {
+		return nil, "", err
+	}
+	err = ds.PutRecord(apiKeyKind, k.ID, value, ttl)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+// APIKeys returns all of the API keys
+func (ds *DataSource) APIKeys() ([]*APIKey, error) {
+	records, err := ds.Records(apiKeyKind)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*APIKey
+	now := time.Now()
+	for id, value := range records {
+		var k APIKey
+		if err := json.Unmarshal(value, &k); err != nil {
+			logging.Log(debugTag, "Error while unmarshaling API key %s: %s", id, err)
+			continue
+		}
+		if !k.expired(now) {
+			ds.apiKeyUse(&k)
+			keys = append(keys, &k)
+		}
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes the API key with the id
+func (ds *DataSource) DeleteAPIKey(id string) error {
+	err := ds.DeleteRecord(apiKeyKind, id)
+	if err != nil {
+		return err
+	}
+	if err := ds.DeleteRecord(apiKeyUseKind, id); err != nil && err != ErrNotFound {
+		logging.Log(debugTag, "Error while deleting the uses of API key %s: %s", id, err)
+	}
+	return nil
+}
+
+// moveAPIKeys gives the API keys of the user to newOwner once it's renamed,
+// or deletes them if newOwner is empty, so they aren't taken by a later user
+// with the address
+func (ds *DataSource) moveAPIKeys(owner, newOwner string) error {
+	records, err := ds.Records(apiKeyKind)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for id, value := range records {
+		var k APIKey
+		if json.Unmarshal(value, &k) != nil || k.Owner != owner {
+			continue
+		}
+		if newOwner == "" || k.expired(now) {
+			if err := ds.DeleteAPIKey(id); err != nil && err != ErrNotFound {
+				return err
+			}
+			continue
+		}
+		k.Owner = newOwner
+		value, err := json.Marshal(&k)
+		if err != nil {
+			return err
+		}
+		if err := ds.PutRecord(apiKeyKind, id, value, k.ttl()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyAPIKey returns the id of the API key, if it's valid
+func (ds *DataSource) VerifyAPIKey(key string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if !IsAPIKey(key) || len(parts) != 2 {
+		return "", ErrInvalidAPIKey
+	}
+
+	k, err := ds.APIKey(parts[0])
+	if err == ErrNotFound {
+		return "", ErrInvalidAPIKey
+	} else if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(tokenID(key))) != 1 || k.expired(time.Now()) {
+		return "", ErrInvalidAPIKey
+	}
+	return k.ID, nil
+}
+
+// IsAPIKey reports whether the user stands for an API key
+func (u *User) IsAPIKey() bool {
+	return u.apiKeyOwner != nil
+}
+
+// APIKeyPrincipal returns the user standing for a verified API key, which may
+// do what both the scopes of the key and its owner allow. The last use of the
+// key is recorded.
+func (ds *DataSource) APIKeyPrincipal(id, ip string) (*User, error) {
+	k, err := ds.APIKey(id)
+	if err == ErrNotFound {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	owner, err := ds.UserByEmail(k.Owner)
+	if err == ErrNotFound {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	if !owner.Active {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if now.Unix()-k.LastUsedAt >= int64(apiKeyUseInterval.Seconds()) || k.LastUsedIP != ip {
+		use, _ := json.Marshal(apiKeyUse{LastUsedAt: now.Unix(), LastUsedIP: ip})
+		if err := ds.PutRecord(apiKeyUseKind, k.ID, use, k.ttl()); err != nil {
+			// Not fatal, it's only the bookkeeping
+			logging.Log(debugTag, "Error while recording the use of API key %s: %s", k.ID, err)
+		}
+	}
+
+	return &User{
+		Email:        APIKeyUserPrefix + k.ID,
+		Active:       true,
+		EnFirstName:  k.Name,
+		apiKeyOwner:  owner,
+		apiKeyScopes: k.Scopes,
+	}, nil
+}
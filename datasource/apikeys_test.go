@@ -0,0 +1,140 @@
+package datasource
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	owner := &User{Email: "a@example.com", Active: true}
+	k, key, err := ds.CreateAPIKey(owner, "ci", []Permission{PermReadUsers}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAPIKey(key) || !strings.HasPrefix(key, apiKeyPrefix+k.ID+"_") {
+		t.Fatalf("got the key %s for %s", key, k.ID)
+	}
+	stored, err := ds.APIKey(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash != tokenID(key) || strings.Contains(stored.Hash, key[len(apiKeyPrefix+k.ID+"_"):]) {
+		t.Errorf("got the hash %s, want only the hash of the key", stored.Hash)
+	}
+
+	expired, expiredKey, err := ds.CreateAPIKey(owner, "old", []Permission{PermReadUsers}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	value, _ := json.Marshal(expired)
+	if err := ds.PutRecord(apiKeyKind, expired.ID, value, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		id   string
+		err  error
+	}{
+		{"valid", key, k.ID, nil},
+		{"wrong secret", key[:len(key)-1] + "x", "", ErrInvalidAPIKey},
+		{"no prefix", strings.TrimPrefix(key, apiKeyPrefix), "", ErrInvalidAPIKey},
+		{"no secret", apiKeyPrefix + k.ID, "", ErrInvalidAPIKey},
+		{"unknown id", apiKeyPrefix + "0123456789abcdef_" + key[len(apiKeyPrefix+k.ID+"_"):], "", ErrInvalidAPIKey},
+		{"expired", expiredKey, "", ErrInvalidAPIKey},
+		{"jwt", "eyJhbGciOiJSUzI1NiJ9.e30.c2ln", "", ErrInvalidAPIKey},
+	}
+	for _, tt := range tests {
+		if id, err := ds.VerifyAPIKey(tt.key); id != tt.id || err != tt.err {
+			t.Errorf("%s: got %q, %v; want %q, %v", tt.name, id, err, tt.id, tt.err)
+		}
+	}
+
+	if _, _, err := ds.CreateAPIKey(owner, "bad", []Permission{"users:everything"}, 0); err == nil {
+		t.Error("created a key with an unknown scope")
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	superadmin := &User{Email: "super@a.com", Active: true, Roles: []RoleBinding{{Role: RoleSuperadmin}}}
+	helpdesk := &User{Email: "help@a.com", Active: true, Roles: []RoleBinding{{Role: RoleHelpdesk}}}
+	inactive := &User{Email: "old@a.com", Admin: true}
+	for _, u := range []*User{superadmin, helpdesk, inactive} {
+		if err := ds.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	principal := func(owner *User, scopes ...Permission) (*User, error) {
+		k, _, err := ds.CreateAPIKey(owner, "key", scopes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds.APIKeyPrincipal(k.ID, "192.0.2.1")
+	}
+
+	readOnly, err := principal(superadmin, PermReadUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readOnly.IsAPIKey() || !Allowed(readOnly, PermReadUsers, "") || Allowed(readOnly, PermUpdateUsers, "x@a.com") {
+		t.Error("the key isn't limited to its scopes")
+	}
+	if Holds(readOnly, PermReadUsers) {
+		t.Error("the key holds roles")
+	}
+	// Its owner can't, so the key can't either
+	beyondOwner, err := principal(helpdesk, PermReadUsers, PermUpdateUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Allowed(beyondOwner, PermReadUsers, "") || Allowed(beyondOwner, PermUpdateUsers, "x@a.com") {
+		t.Error("the key isn't limited to what its owner may do")
+	}
+	if _, err := principal(inactive, PermReadUsers); err != ErrInvalidAPIKey {
+		t.Errorf("the key of an inactive owner: got %v, want %v", err, ErrInvalidAPIKey)
+	}
+}
+
+func TestAPIKeysOfRenamedAndDeletedUsers(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	owner := &User{Email: "a@example.com", Active: true}
+	if err := ds.CreateUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	k, _, err := ds.CreateAPIKey(owner, "ci", []Permission{PermReadUsers}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.RenameUser("a@example.com", "b@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	// A new user with the old address doesn't get the key
+	if err := ds.CreateUser(&User{Email: "a@example.com", Active: true, Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := ds.APIKey(k.ID)
+	if err != nil || moved.Owner != "b@example.com" || moved.ExpiresAt != k.ExpiresAt {
+		t.Fatalf("got %+v, %v after the rename; want it owned by b@example.com", moved, err)
+	}
+	if p, err := ds.APIKeyPrincipal(k.ID, "192.0.2.1"); err != nil || p.apiKeyOwner.Email != "b@example.com" {
+		t.Errorf("got %+v, %v after the rename; want it owned by b@example.com", p, err)
+	}
+
+	if err := ds.DeleteUser("b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.APIKey(k.ID); err != ErrNotFound {
+		t.Errorf("got %v after the delete, want %v", err, ErrNotFound)
+	}
+	if _, err := ds.APIKeyPrincipal(k.ID, "192.0.2.1"); err != ErrInvalidAPIKey {
+		t.Errorf("got %v after the delete, want %v", err, ErrInvalidAPIKey)
+	}
+}
@@ -0,0 +1,125 @@
+package datasource
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	// appPasswordLetters are easy to type on phones
+	appPasswordLetters = "abcdefghijklmnopqrstuvwxyz"
+
+	// appPasswordUseInterval is how often the last use of an app password is
+	// recorded, as the mail clients log in for every check
+	appPasswordUseInterval = 1 * time.Minute
+)
+
+// AppPassword is a password for a single mail or LDAP client, which is only
+// accepted by SMTP AUTH and LDAP bind. They're random, so only their SHA-256
+// hash is kept.
+type AppPassword struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Hash       string `json:"hash,omitempty"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt"`
+	LastUsedIP string `json:"lastUsedIP"`
+}
+
+func appPasswordHash(plainPassword string) string {
+	plainPassword = strings.ToLower(strings.Replace(plainPassword, " ", "", -1))
+	sum := sha256.Sum256([]byte(plainPassword))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAppPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// 26^16 is about 75 bits, and the slight bias of the modulo is harmless
+	var plain []byte
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			plain = append(plain, ' ')
+		}
+		plain = append(plain, appPasswordLetters[int(c)%len(appPasswordLetters)])
+	}
+	return string(plain), nil
+}
+
+// NewAppPassword adds an app password with the given name to the user, and
+// returns it along with the password, which can't be read back later. It
+// doesn't store the user.
+func (u *User) NewAppPassword(name string) (*AppPassword, string, error) {
+	plain, err := newAppPassword()
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	ap := AppPassword{
+		ID:        id[:12],
+		Name:      name,
+		Hash:      appPasswordHash(plain),
+		CreatedAt: time.Now().Unix(),
+	}
+	u.AppPasswords = append(u.AppPasswords, ap)
+	return &ap, plain, nil
+}
+
+// RemoveAppPassword reports whether the user had the app password. It doesn't
+// store the user.
+func (u *User) RemoveAppPassword(id string) bool {
+	for i := range u.AppPasswords {
+		if u.AppPasswords[i].ID == id {
+			u.AppPasswords = append(u.AppPasswords[:i:i], u.AppPasswords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// appPasswordIndex returns the index of the app password of the user which
+// matches plainPassword, or -1
+func (u *User) appPasswordIndex(plainPassword string) int {
+	hash := appPasswordHash(plainPassword)
+	for i := range u.AppPasswords {
+		if subtle.ConstantTimeCompare([]byte(u.AppPasswords[i].Hash), []byte(hash)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// CheckAppPassword reports whether plainPassword is one of the app passwords
+// of the user. On success, its last use is recorded and the user is stored,
+// at most once per appPasswordUseInterval unless the IP changes.
+func (ds *DataSource) CheckAppPassword(u *User, plainPassword, ip string) bool {
+	i := u.appPasswordIndex(plainPassword)
+	if i < 0 {
+		return false
+	}
+
+	now := time.Now()
+	ap := &u.AppPasswords[i]
+	if ap.LastUsedIP == ip && now.Sub(time.Unix(ap.LastUsedAt, 0)) < appPasswordUseInterval {
+		return true
+	}
+	ap.LastUsedAt = now.Unix()
+	ap.LastUsedIP = ip
+	err := ds.StoreUser(u)
+	if err != nil {
+		// Not fatal, it's only the bookkeeping
+		logging.Log(debugTag, "Error while recording the use of an app password of %s: %s", u.Email, err)
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package datasource
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAppPasswordThrottlesLastUse(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	u := &User{Email: "a@example.com", Active: true}
+	_, plain, err := u.NewAppPassword("phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		ip       string
+		ok       bool
+		stored   bool
+	}{
+		{"wrong", "192.0.2.1", false, false},
+		{plain, "192.0.2.1", true, true},
+		// Spaces and case don't matter
+		{strings.ToUpper(strings.Replace(plain, " ", "", -1)), "192.0.2.1", true, false},
+		{plain, "192.0.2.2", true, true},
+	}
+	for i, tt := range tests {
+		revision := u.Revision
+		if ok := ds.CheckAppPassword(u, tt.password, tt.ip); ok != tt.ok {
+			t.Errorf("%d: got %v, want %v", i, ok, tt.ok)
+		}
+		if stored := u.Revision != revision; stored != tt.stored {
+			t.Errorf("%d: stored %v, want %v", i, stored, tt.stored)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package datasource
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	auditKind = "audit"
+
+	// auditTrimInterval is how often the events older than the retention
+	// are removed
+	auditTrimInterval = 1 * time.Hour
+
+	// auditFailuresKind are the records of the recent unauthenticated
+	// failures, see AuditFailure
+	auditFailuresKind = "audit-failures"
+	// auditFailureWindow is how long the failures like an audited one are
+	// only counted
+	auditFailureWindow = 10 * time.Minute
+
+	// redacted stands for the secrets in the changes
+	redacted = "[redacted]"
+)
+
+// AuditEvent records a change, or an attempt to authenticate. Events are only
+// ever added.
+type AuditEvent struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Actor is the email of who did it, or the API key
+	Actor string `json:"actor"`
+	// Action is like user.create, group.join or smtp.auth
+	Action   string                 `json:"action"`
+	Target   string                 `json:"target"`
+	Changes  map[string]AuditChange `json:"changes,omitempty"`
+	SourceIP string                 `json:"sourceIP"`
+	Success  bool                   `json:"success"`
+	Details  string                 `json:"details,omitempty"`
+}
+
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditFilter selects audit events. Empty fields match everything; Action
+// also matches the actions it's a prefix of, e.g. "user" matches
+// "user.create".
+type AuditFilter struct {
+	Actor  string
+	Target string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	// Before is the cursor of the page: only the events before the one
+	// with this ID are returned
+	Before string
+	// Limit is the maximum number of returned events
+	Limit int
+}
+
+func (f *AuditFilter) matches(e *AuditEvent) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Target != "" && e.Target != f.Target {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action && !strings.HasPrefix(e.Action, f.Action+".") {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// auditRetention is how long the events are kept, configured by
+// BAHRAM_AUDIT_RETENTION (e.g. 8760h). They're kept forever by default.
+func (ds *DataSource) auditRetention() time.Duration {
+	value := ds.ConfigString("AUDIT_RETENTION")
+	if value == "" {
+		return 0
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		logging.Log(debugTag, "Invalid BAHRAM_AUDIT_RETENTION %q: %s", value, err)
+		return 0
+	}
+	return retention
+}
+
+// auditID returns the ID of an event at t, which sorts by time. The IDs of
+// the events are made unique by a random suffix.
+func auditID(t time.Time, suffix string) string {
+	return fmt.Sprintf("%020d%s", t.UnixNano(), suffix)
+}
+
+// Audit adds the event, after setting its ID and Time
+func (ds *DataSource) Audit(e *AuditEvent) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	e.Time = time.Now()
+	e.ID = auditID(e.Time, "-"+hex.EncodeToString(suffix))
+
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	err = ds.AppendLog(auditKind, e.ID, value)
+	if err != nil {
+		return err
+	}
+	ds.trimAudit(e.Time)
+	return nil
+}
+
+// trimAudit removes the events older than the retention, at most once per
+// auditTrimInterval
+func (ds *DataSource) trimAudit(now time.Time) {
+	retention := ds.auditRetention()
+	if retention <= 0 {
+		return
+	}
+	last := atomic.LoadInt64(&ds.auditTrimmed)
+	if now.UnixNano()-last < int64(auditTrimInterval) ||
+		!atomic.CompareAndSwapInt64(&ds.auditTrimmed, last, now.UnixNano()) {
+		return
+	}
+	if err := ds.TrimLog(auditKind, auditID(now.Add(-retention), "")); err != nil {
+		logging.Log(debugTag, "Error while removing the old audit events: %s", err)
+	}
+}
+
+type auditFailures struct {
+	Count int       `json:"count"`
+	Until time.Time `json:"until"`
+}
+
+// AuditFailure adds the event of an unauthenticated failure, e.g. a wrong
+// password over SMTP, unless one with the same action and source IP has
+// been added within auditFailureWindow. Those are only counted, and the
+// count is added to the details of the next event after the window, so the
+// attempts of a client can't grow the audit without limit.
+func (ds *DataSource) AuditFailure(e *AuditEvent) error {
+	id := tokenID(e.Action + "\x00" + e.SourceIP)
+	now := time.Now()
+
+	var failures auditFailures
+	if value, err := ds.Record(auditFailuresKind, id); err == nil {
+		if err := json.Unmarshal(value, &failures); err != nil {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	audit := !now.Before(failures.Until)
+	if audit {
+		if failures.Count > 0 {
+			e.Details = strings.TrimSpace(fmt.Sprintf("%s (and %d similar failures before)", e.Details, failures.Count))
+		}
+		failures = auditFailures{Until: now.Add(auditFailureWindow)}
+	} else {
+		failures.Count++
+	}
+
+	value, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+	// Kept for another window, for the count to be reported
+	err = ds.PutRecord(auditFailuresKind, id, value, failures.Until.Add(auditFailureWindow).Sub(now))
+	if err != nil {
+		return err
+	}
+	if !audit {
+		return nil
+	}
+	return ds.Audit(e)
+}
+
+// AuditEvents returns the events matching the filter, the newest first, and
+// the cursor of the next page, empty if it's the last one
+func (ds *DataSource) AuditEvents(filter AuditFilter) ([]*AuditEvent, string, error) {
+	before := filter.Before
+	if !filter.Until.IsZero() {
+		if until := auditID(filter.Until, ""); before == "" || until < before {
+			before = until
+		}
+	}
+
+	events := []*AuditEvent{}
+	next := ""
+	err := ds.ScanLog(auditKind, before, func(id string, value []byte) bool {
+		var e AuditEvent
+		if err := json.Unmarshal(value, &e); err != nil {
+			logging.Log(debugTag, "Error while unmarshaling audit event %s: %s", id, err)
+			return true
+		}
+		if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+			return false
+		}
+		if !filter.matches(&e) {
+			return true
+		}
+		if len(events) == filter.Limit {
+			next = events[len(events)-1].ID
+			return false
+		}
+		events = append(events, &e)
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return events, next, nil
+}
+
+// Diff returns the fields of the JSON forms of before and after which are
+// different. Either may be nil, for creations and deletions.
+func Diff(before, after interface{}) map[string]AuditChange {
+	beforeFields := jsonFields(before)
+	afterFields := jsonFields(after)
+
+	changes := make(map[string]AuditChange)
+	for name, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[name]) {
+			changes[name] = AuditChange{Before: value, After: afterFields[name]}
+		}
+	}
+	for name, value := range afterFields {
+		if _, found := beforeFields[name]; !found && value != nil {
+			changes[name] = AuditChange{Before: nil, After: value}
+		}
+	}
+	return changes
+}
+
+func jsonFields(v interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return fields
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logging.Log(debugTag, "Error while marshaling %T for the audit: %s", v, err)
+		return fields
+	}
+	json.Unmarshal(b, &fields)
+	return fields
+}
+
+// DiffUsers is Diff for users, which leaves the secrets out and only shows
+// whether they've changed
+func DiffUsers(before, after *User) map[string]AuditChange {
+	var sanitizedBefore, sanitizedAfter *User
+	if before != nil {
+		sanitizedBefore = before.Sanitized()
+	}
+	if after != nil {
+		sanitizedAfter = after.Sanitized()
+	}
+	changes := Diff(sanitizedBefore, sanitizedAfter)
+
+	secrets := map[string]func(u *User) string{
+		"password":      func(u *User) string { return u.Password },
+		"totpSecret":    func(u *User) string { return u.TOTPSecret },
+		"recoveryCodes": func(u *User) string { return strings.Join(u.RecoveryCodes, ",") },
+	}
+	for name, secret := range secrets {
+		var beforeSecret, afterSecret string
+		if before != nil {
+			beforeSecret = secret(before)
+		}
+		if after != nil {
+			afterSecret = secret(after)
+		}
+		if beforeSecret != afterSecret {
+			changes[name] = AuditChange{Before: redacted, After: redacted}
+		} else {
+			delete(changes, name)
+		}
+	}
+	return changes
+}
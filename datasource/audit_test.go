@@ -0,0 +1,115 @@
+package datasource
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditEventsPages(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ds := testDataSource(t, s)
+		for i := 0; i < 7; i++ {
+			err := ds.Audit(&AuditEvent{Actor: "a@example.com", Action: "user.update", Target: fmt.Sprintf("u%d@example.com", i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ds.Audit(&AuditEvent{Actor: "b@example.com", Action: "group.join"}); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			filter AuditFilter
+			pages  []int
+		}{
+			{AuditFilter{Limit: 3}, []int{3, 3, 2}},
+			{AuditFilter{Limit: 8}, []int{8}},
+			{AuditFilter{Action: "user", Limit: 4}, []int{4, 3}},
+			{AuditFilter{Actor: "b@example.com", Limit: 1}, []int{1}},
+			{AuditFilter{Until: time.Now().Add(-time.Hour), Limit: 10}, []int{0}},
+			{AuditFilter{Since: time.Now().Add(time.Hour), Limit: 10}, []int{0}},
+		}
+		for _, tt := range tests {
+			var pages []int
+			seen := make(map[string]bool)
+			filter := tt.filter
+			for {
+				events, next, err := ds.AuditEvents(filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, len(events))
+				for i, e := range events {
+					if seen[e.ID] {
+						t.Errorf("%+v: %s returned twice", tt.filter, e.ID)
+					}
+					seen[e.ID] = true
+					if i > 0 && e.ID > events[i-1].ID {
+						t.Errorf("%+v: not the newest first", tt.filter)
+					}
+				}
+				if next == "" || len(pages) > 10 {
+					break
+				}
+				filter.Before = next
+			}
+			if fmt.Sprint(pages) != fmt.Sprint(tt.pages) {
+				t.Errorf("%+v: got pages of %v, want %v", tt.filter, pages, tt.pages)
+			}
+		}
+	})
+}
+
+func TestTrimAudit(t *testing.T) {
+	os.Setenv("BAHRAM_AUDIT_RETENTION", "1h")
+	defer os.Unsetenv("BAHRAM_AUDIT_RETENTION")
+
+	ds := testDataSource(t, NewMemoryStore())
+	old := time.Now().Add(-2 * time.Hour)
+	if err := ds.AppendLog(auditKind, auditID(old, "-old"), []byte(`{"id":"old"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Audit(&AuditEvent{Action: "user.update"}); err != nil {
+		t.Fatal(err)
+	}
+	events, _, err := ds.AuditEvents(AuditFilter{Limit: 10})
+	if err != nil || len(events) != 1 || events[0].Action != "user.update" {
+		t.Errorf("got %v, %v; want only the new event", events, err)
+	}
+}
+
+func TestAuditFailureAggregates(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	for i := 0; i < 5; i++ {
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+			err := ds.AuditFailure(&AuditEvent{Actor: fmt.Sprintf("u%d@example.com", i), Action: "smtp.auth", SourceIP: ip, Details: "wrong password"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	events, _, err := ds.AuditEvents(AuditFilter{Limit: 100})
+	if err != nil || len(events) != 2 {
+		t.Fatalf("got %d events, %v; want one per IP", len(events), err)
+	}
+
+	// The next window reports the count of the previous one
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		id := tokenID("smtp.auth\x00" + ip)
+		value := []byte(fmt.Sprintf(`{"count":4,"until":%q}`, time.Now().Add(-time.Second).Format(time.RFC3339Nano)))
+		if err := ds.PutRecord(auditFailuresKind, id, value, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ds.AuditFailure(&AuditEvent{Action: "smtp.auth", SourceIP: "192.0.2.1", Details: "wrong password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, err = ds.AuditEvents(AuditFilter{Limit: 1})
+	if err != nil || len(events) != 1 || !strings.Contains(events[0].Details, "4 similar failures") {
+		t.Errorf("got %v, %v; want the count of the previous window", events, err)
+	}
+}
@@ -0,0 +1,670 @@
+package datasource
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket   = []byte("users")
+	boltGroupsBucket  = []byte("groups")
+	boltRecordsBucket = []byte("records")
+	boltMetaBucket    = []byte("meta")
+	boltLogsBucket    = []byte("logs")
+
+	boltSchemaKey = []byte("schema")
+)
+
+// boltMigrations are the steps which upgrade the database file: the i-th one
+// upgrades it from schema version i to i+1. The version of a file is kept in
+// the meta bucket; the files written before it existed are version 0.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// Version 1 prefixes the users and groups with their revision
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsersBucket, boltGroupsBucket} {
+			b := tx.Bucket(name)
+			values := make(map[string][]byte)
+			err := b.ForEach(func(k, v []byte) error {
+				values[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range values {
+				if _, err := putRecord(b, k, v, 0); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+	// Version 2 moves the audit events from the records to a log
+	func(tx *bolt.Tx) error {
+		records := tx.Bucket(boltRecordsBucket).Bucket([]byte(auditKind))
+		if records == nil {
+			return nil
+		}
+		log, err := tx.Bucket(boltLogsBucket).CreateBucketIfNotExists([]byte(auditKind))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		err = records.ForEach(func(k, v []byte) error {
+			if value := decodeBoltExpiringValue(v, now); value != nil {
+				return log.Put(append([]byte{}, k...), value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltRecordsBucket).DeleteBucket([]byte(auditKind))
+	},
+}
+
+// BoltStore keeps users and groups in a single bbolt database file. It suits
+// small, single-node deployments which don't want to run an etcd cluster.
+//
+// Each value is the JSON form of the user or group, prefixed by its revision
+// as an 8 byte big-endian number. Revisions come from the sequence of the
+// bucket, so they only grow.
+//
+// Records are kept in a bucket per kind inside the records bucket, prefixed
+// by their expiration time in Unix nanoseconds (zero if they don't expire).
+// Expired records are removed when their kind is written to, at most once
+// per sweepInterval. The logs are in a bucket per kind inside the logs
+// bucket, where the ordered keys make the scans cheap.
+//
+// The schema version of the file is kept in the meta bucket, and older files
+// are migrated when they're opened, see boltMigrations.
+type BoltStore struct {
+	db *bolt.DB
+
+	mu sync.Mutex
+	// swept is when the expired records of each kind were last removed
+	swept map[string]time.Time
+}
+
+type boltRecord struct {
+	value    string
+	revision uint64
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// A new file needs no migration
+		fresh := tx.Bucket(boltUsersBucket) == nil
+		for _, name := range [][]byte{boltUsersBucket, boltGroupsBucket, boltRecordsBucket, boltMetaBucket, boltLogsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if fresh {
+			return setBoltSchemaVersion(tx, uint64(len(boltMigrations)))
+		}
+		return migrateBolt(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db, swept: make(map[string]time.Time)}, nil
+}
+
+func setBoltSchemaVersion(tx *bolt.Tx, version uint64) error {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, version)
+	return tx.Bucket(boltMetaBucket).Put(boltSchemaKey, encoded)
+}
+
+// migrateBolt upgrades the database file to the latest schema version
+func migrateBolt(tx *bolt.Tx) error {
+	var version uint64
+	if v := tx.Bucket(boltMetaBucket).Get(boltSchemaKey); len(v) == 8 {
+		version = binary.BigEndian.Uint64(v)
+	}
+	if version > uint64(len(boltMigrations)) {
+		return fmt.Errorf("The database has schema version %d, newer than the supported %d", version, len(boltMigrations))
+	}
+
+	for ; version < uint64(len(boltMigrations)); version++ {
+		logging.Log(debugTag, "Migrating the database to schema version %d", version+1)
+		if err := boltMigrations[version](tx); err != nil {
+			return fmt.Errorf("Error while migrating the database to schema version %d: %s", version+1, err)
+		}
+		if err := setBoltSchemaVersion(tx, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func decodeBoltRecord(v []byte) (boltRecord, error) {
+	if len(v) < 8 {
+		return boltRecord{}, fmt.Errorf("Malformed record of %d bytes", len(v))
+	}
+	// v is only valid during the transaction, string() copies it
+	return boltRecord{
+		revision: binary.BigEndian.Uint64(v[:8]),
+		value:    string(v[8:]),
+	}, nil
+}
+
+// putRecord stores value under key in b, with a new revision which is
+// returned. If revision isn't zero, the current record must have it.
+func putRecord(b *bolt.Bucket, key string, value []byte, revision uint64) (uint64, error) {
+	if revision != 0 {
+		v := b.Get([]byte(key))
+		if v == nil {
+			return 0, ErrNotFound
+		}
+		current, err := decodeBoltRecord(v)
+		if err != nil {
+			return 0, err
+		}
+		if current.revision != revision {
+			return 0, ErrConflict
+		}
+	}
+
+	newRevision, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	encoded := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(encoded, newRevision)
+	copy(encoded[8:], value)
+	return newRevision, b.Put([]byte(key), encoded)
+}
+
+// createRecord puts value under key in bucket, after checking neither bucket
+// nor otherBucket already has the key.
+func createRecord(tx *bolt.Tx, bucket, otherBucket []byte, key string, value []byte, errKeyExists, errOtherExists error) (uint64, error) {
+	b := tx.Bucket(bucket)
+	if b.Get([]byte(key)) != nil {
+		return 0, errKeyExists
+	}
+	if tx.Bucket(otherBucket).Get([]byte(key)) != nil {
+		return 0, errOtherExists
+	}
+	return putRecord(b, key, value, 0)
+}
+
+// deleteRecord deletes key from b. If revision isn't zero, the current
+// record must have it.
+func deleteRecord(b *bolt.Bucket, key string, revision uint64) error {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return ErrNotFound
+	}
+	if revision != 0 {
+		current, err := decodeBoltRecord(v)
+		if err != nil {
+			return err
+		}
+		if current.revision != revision {
+			return ErrConflict
+		}
+	}
+	return b.Delete([]byte(key))
+}
+
+func (s *BoltStore) create(bucket, otherBucket []byte, key string, value []byte, errKeyExists, errOtherExists error) (uint64, error) {
+	var revision uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		revision, err = createRecord(tx, bucket, otherBucket, key, value, errKeyExists, errOtherExists)
+		return err
+	})
+	return revision, err
+}
+
+func (s *BoltStore) put(bucket []byte, key string, value []byte, revision uint64) (uint64, error) {
+	var newRevision uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		newRevision, err = putRecord(tx.Bucket(bucket), key, value, revision)
+		return err
+	})
+	return newRevision, err
+}
+
+func (s *BoltStore) delete(bucket []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteRecord(tx.Bucket(bucket), key, 0)
+	})
+}
+
+func (s *BoltStore) get(bucket []byte, key string) (boltRecord, error) {
+	var record boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		var err error
+		record, err = decodeBoltRecord(v)
+		return err
+	})
+	return record, err
+}
+
+func (s *BoltStore) list(bucket []byte) ([]boltRecord, error) {
+	var records []boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			record, err := decodeBoltRecord(v)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func userFromBoltRecord(record boltRecord) (*User, error) {
+	u, err := userFromNodeValue(record.value)
+	if err != nil {
+		return nil, err
+	}
+	u.Revision = record.revision
+	return u, nil
+}
+
+func groupFromBoltRecord(record boltRecord) (*Group, error) {
+	g, err := groupFromNodeValue(record.value)
+	if err != nil {
+		return nil, err
+	}
+	g.Revision = record.revision
+	return g, nil
+}
+
+func (s *BoltStore) CreateUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Creating %s", userJSON)
+
+	revision, err := s.create(boltUsersBucket, boltGroupsBucket, u.Email, userJSON, ErrUserExists, ErrGroupExists)
+	if err != nil {
+		return err
+	}
+	u.Revision = revision
+	return nil
+}
+
+func (s *BoltStore) StoreUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Setting %s", userJSON)
+
+	revision, err := s.put(boltUsersBucket, u.Email, userJSON, u.Revision)
+	if err != nil {
+		return err
+	}
+	u.Revision = revision
+	return nil
+}
+
+func (s *BoltStore) UserByEmail(emailAddress string) (*User, error) {
+	record, err := s.get(boltUsersBucket, emailAddress)
+	if err != nil {
+		return nil, err
+	}
+	return userFromBoltRecord(record)
+}
+
+func (s *BoltStore) Users() ([]*User, error) {
+	records, err := s.list(boltUsersBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	for _, record := range records {
+		u, err := userFromBoltRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *BoltStore) DeleteUser(emailAddress string) error {
+	logging.Debug(debugTag, "Deleting user %s", emailAddress)
+
+	return s.delete(boltUsersBucket, emailAddress)
+}
+
+func (s *BoltStore) CreateGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Creating %s", groupJSON)
+
+	revision, err := s.create(boltGroupsBucket, boltUsersBucket, g.Email, groupJSON, ErrGroupExists, ErrUserExists)
+	if err != nil {
+		return err
+	}
+	g.Revision = revision
+	return nil
+}
+
+func (s *BoltStore) StoreGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Setting %s", groupJSON)
+
+	revision, err := s.put(boltGroupsBucket, g.Email, groupJSON, g.Revision)
+	if err != nil {
+		return err
+	}
+	g.Revision = revision
+	return nil
+}
+
+func (s *BoltStore) GroupByEmail(emailAddress string) (*Group, error) {
+	record, err := s.get(boltGroupsBucket, emailAddress)
+	if err != nil {
+		return nil, err
+	}
+	return groupFromBoltRecord(record)
+}
+
+func (s *BoltStore) Groups() ([]*Group, error) {
+	records, err := s.list(boltGroupsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*Group
+	for _, record := range records {
+		g, err := groupFromBoltRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (s *BoltStore) DeleteGroup(emailAddress string) error {
+	logging.Debug(debugTag, "Deleting group %s", emailAddress)
+
+	return s.delete(boltGroupsBucket, emailAddress)
+}
+
+func (s *BoltStore) Commit(b *Batch) error {
+	values, err := b.values()
+	if err != nil {
+		return err
+	}
+
+	revisions := make([]uint64, len(b.ops))
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for i, op := range b.ops {
+			bucket, otherBucket := boltUsersBucket, boltGroupsBucket
+			errExists, errOtherExists := ErrUserExists, ErrGroupExists
+			if op.kind == groupKind {
+				bucket, otherBucket = boltGroupsBucket, boltUsersBucket
+				errExists, errOtherExists = ErrGroupExists, ErrUserExists
+			}
+
+			var err error
+			switch op.op {
+			case batchCreate:
+				revisions[i], err = createRecord(tx, bucket, otherBucket, op.email, values[i], errExists, errOtherExists)
+			case batchStore:
+				revisions[i], err = putRecord(tx.Bucket(bucket), op.email, values[i], op.revision)
+			default:
+				err = deleteRecord(tx.Bucket(bucket), op.email, op.revision)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.setRevisions(revisions)
+	return nil
+}
+
+func encodeBoltExpiringValue(value []byte, ttl time.Duration) []byte {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	encoded := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(encoded, uint64(expires))
+	copy(encoded[8:], value)
+	return encoded
+}
+
+// decodeBoltExpiringValue returns a copy of the value, or nil if it's expired
+func decodeBoltExpiringValue(v []byte, now time.Time) []byte {
+	if len(v) < 8 {
+		return nil
+	}
+	expires := int64(binary.BigEndian.Uint64(v[:8]))
+	if expires != 0 && expires <= now.UnixNano() {
+		return nil
+	}
+	return append([]byte{}, v[8:]...)
+}
+
+// sweepDue reports whether the expired records of the kind should be removed
+// now, and if so, assumes they will be
+func (s *BoltStore) sweepDue(kind string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept[kind]) < sweepInterval {
+		return false
+	}
+	s.swept[kind] = now
+	return true
+}
+
+func (s *BoltStore) PutRecord(kind, id string, value []byte, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+
+		if now := time.Now(); s.sweepDue(kind, now) {
+			var expired [][]byte
+			b.ForEach(func(k, v []byte) error {
+				if decodeBoltExpiringValue(v, now) == nil {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		return b.Put([]byte(id), encodeBoltExpiringValue(value, ttl))
+	})
+}
+
+func (s *BoltStore) CreateRecord(kind, id string, value []byte, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		if decodeBoltExpiringValue(b.Get([]byte(id)), time.Now()) != nil {
+			return ErrRecordExists
+		}
+		return b.Put([]byte(id), encodeBoltExpiringValue(value, ttl))
+	})
+}
+
+func (s *BoltStore) Record(kind, id string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return ErrNotFound
+		}
+		value = decodeBoltExpiringValue(b.Get([]byte(id)), time.Now())
+		if value == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) Records(kind string) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		now := time.Now()
+		return b.ForEach(func(k, v []byte) error {
+			if value := decodeBoltExpiringValue(v, now); value != nil {
+				records[string(k)] = value
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *BoltStore) TakeRecord(kind, id string) ([]byte, error) {
+	var value []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		value = decodeBoltExpiringValue(v, time.Now())
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if value == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) DeleteRecord(kind, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if decodeBoltExpiringValue(v, time.Now()) == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) AppendLog(kind, id string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltLogsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), value)
+	})
+}
+
+func (s *BoltStore) ScanLog(kind, before string, f func(id string, value []byte) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		var k, v []byte
+		if before == "" {
+			k, v = c.Last()
+		} else {
+			// Seek finds the first id at or after before, if any
+			k, v = c.Seek([]byte(before))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil; k, v = c.Prev() {
+			if !f(string(k), append([]byte{}, v...)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) TrimLog(kind, before string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < before; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
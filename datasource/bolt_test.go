@@ -0,0 +1,112 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltMigratesUnversionedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bahram-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bahram.db")
+
+	// The format before the schema versions: plain JSON values
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucket(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		groups, err := tx.CreateBucket(boltGroupsBucket)
+		if err != nil {
+			return err
+		}
+		if err := users.Put([]byte("a@example.com"), []byte(`{"email":"a@example.com","active":true}`)); err != nil {
+			return err
+		}
+		return groups.Put([]byte("g@example.com"), []byte(`{"email":"g@example.com","members":["a@example.com"]}`))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		s, err := NewBoltStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.UserByEmail("a@example.com")
+		if err != nil || !u.Active || u.Revision == 0 {
+			t.Errorf("open %d: got user %+v, %v", i, u, err)
+		}
+		g, err := s.GroupByEmail("g@example.com")
+		if err != nil || len(g.Members) != 1 || g.Revision == 0 {
+			t.Errorf("open %d: got group %+v, %v", i, g, err)
+		}
+		s.Close()
+	}
+}
+
+func TestBoltMovesAuditToLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bahram-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bahram.db")
+
+	// Schema version 1 kept the audit events in the records
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsersBucket, boltGroupsBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := setBoltSchemaVersion(tx, 1); err != nil {
+			return err
+		}
+		records, err := tx.CreateBucket(boltRecordsBucket)
+		if err != nil {
+			return err
+		}
+		audit, err := records.CreateBucket([]byte(auditKind))
+		if err != nil {
+			return err
+		}
+		id := auditID(time.Now(), "-0000")
+		return audit.Put([]byte(id), encodeBoltExpiringValue([]byte(`{"id":"`+id+`","action":"user.create"}`), 0))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events, _, err := testDataSource(t, s).AuditEvents(AuditFilter{Limit: 10})
+	if err != nil || len(events) != 1 || events[0].Action != "user.create" {
+		t.Errorf("got %v, %v; want the migrated event", events, err)
+	}
+	if records, _ := s.Records(auditKind); len(records) != 0 {
+		t.Errorf("%d events left in the records", len(records))
+	}
+}
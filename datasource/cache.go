@@ -0,0 +1,183 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// WatchableStore is implemented by stores which may be modified by others,
+// e.g. other bahram instances sharing the same etcd cluster. Watch blocks and
+// calls invalidate for every user or group changed in the store; an empty
+// emailAddress means any user or group of that kind may have changed.
+type WatchableStore interface {
+	Watch(invalidate func(kind, emailAddress string))
+}
+
+const (
+	userKind  = "user"
+	groupKind = "group"
+)
+
+// CacheStats counts the lookups served by the DataSource cache
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// cacheEntry keeps the JSON form of a user or group, so the objects returned
+// to the callers never alias the cached ones. notFound entries remember that
+// the address is unknown.
+type cacheEntry struct {
+	value    string
+	revision uint64
+	notFound bool
+}
+
+func cacheKey(kind, emailAddress string) string {
+	return fmt.Sprintf("%s/%s", kind, emailAddress)
+}
+
+func (ds *DataSource) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&ds.cacheHits),
+		Misses: atomic.LoadUint64(&ds.cacheMisses),
+	}
+}
+
+func (ds *DataSource) invalidate(kind, emailAddress string) {
+	atomic.AddUint64(&ds.cacheGeneration, 1)
+	if emailAddress == "" {
+		logging.Debug(debugTag, "Flushing the cache")
+		ds.cache.Flush()
+		return
+	}
+	ds.cache.Delete(cacheKey(kind, emailAddress))
+}
+
+// cached returns the cached entry for the key, if there is one
+func (ds *DataSource) cached(key string) (*cacheEntry, bool) {
+	value, found := ds.cache.Get(key)
+	if !found {
+		atomic.AddUint64(&ds.cacheMisses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&ds.cacheHits, 1)
+	return value.(*cacheEntry), true
+}
+
+// fill caches the result of a store lookup which was started at generation.
+// If anything was invalidated since then, the result may be stale and is
+// dropped.
+func (ds *DataSource) fill(key string, generation uint64, entry *cacheEntry) {
+	if atomic.LoadUint64(&ds.cacheGeneration) != generation {
+		return
+	}
+	ds.cache.Set(key, entry, 0)
+}
+
+func (ds *DataSource) UserByEmail(emailAddress string) (*User, error) {
+	key := cacheKey(userKind, emailAddress)
+	if entry, found := ds.cached(key); found {
+		if entry.notFound {
+			return nil, ErrNotFound
+		}
+		u, err := userFromNodeValue(entry.value)
+		u.Revision = entry.revision
+		return u, err
+	}
+
+	generation := atomic.LoadUint64(&ds.cacheGeneration)
+	u, err := ds.Store.UserByEmail(emailAddress)
+	if err == ErrNotFound {
+		ds.fill(key, generation, &cacheEntry{notFound: true})
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	ds.fill(key, generation, &cacheEntry{value: string(userJSON), revision: u.Revision})
+	return u, nil
+}
+
+func (ds *DataSource) GroupByEmail(emailAddress string) (*Group, error) {
+	key := cacheKey(groupKind, emailAddress)
+	if entry, found := ds.cached(key); found {
+		if entry.notFound {
+			return nil, ErrNotFound
+		}
+		g, err := groupFromNodeValue(entry.value)
+		g.Revision = entry.revision
+		return g, err
+	}
+
+	generation := atomic.LoadUint64(&ds.cacheGeneration)
+	g, err := ds.Store.GroupByEmail(emailAddress)
+	if err == ErrNotFound {
+		ds.fill(key, generation, &cacheEntry{notFound: true})
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	ds.fill(key, generation, &cacheEntry{value: string(groupJSON), revision: g.Revision})
+	return g, nil
+}
+
+// The writes are passed to the store, and invalidate the cache whether they
+// succeed or not: a conflict means the cached value is stale. The users which
+// are created get a new TokenVersion, whatever they had.
+
+func (ds *DataSource) CreateUser(u *User) error {
+	defer ds.invalidate(userKind, u.Email)
+	if err := u.newTokenVersion(); err != nil {
+		return err
+	}
+	return ds.Store.CreateUser(u)
+}
+
+func (ds *DataSource) StoreUser(u *User) error {
+	defer ds.invalidate(userKind, u.Email)
+	return ds.Store.StoreUser(u)
+}
+
+func (ds *DataSource) CreateGroup(g *Group) error {
+	defer ds.invalidate(groupKind, g.Email)
+	return ds.Store.CreateGroup(g)
+}
+
+func (ds *DataSource) StoreGroup(g *Group) error {
+	defer ds.invalidate(groupKind, g.Email)
+	return ds.Store.StoreGroup(g)
+}
+
+func (ds *DataSource) DeleteGroup(emailAddress string) error {
+	defer ds.invalidate(groupKind, emailAddress)
+	return ds.Store.DeleteGroup(emailAddress)
+}
+
+func (ds *DataSource) Commit(b *Batch) error {
+	defer func() {
+		for _, op := range b.ops {
+			ds.invalidate(op.kind, op.email)
+		}
+	}()
+	for _, op := range b.ops {
+		if op.op == batchCreate && op.user != nil {
+			if err := op.user.newTokenVersion(); err != nil {
+				return err
+			}
+		}
+	}
+	return ds.Store.Commit(b)
+}
@@ -0,0 +1,99 @@
+package datasource
+
+import "testing"
+
+// racingStore calls during in the middle of the lookups, like a change
+// reported by the watch while the store is read
+type racingStore struct {
+	Store
+	during func()
+}
+
+func (s *racingStore) UserByEmail(emailAddress string) (*User, error) {
+	u, err := s.Store.UserByEmail(emailAddress)
+	if s.during != nil {
+		s.during()
+	}
+	return u, err
+}
+
+func TestCacheIsInvalidatedByWrites(t *testing.T) {
+	store := NewMemoryStore()
+	ds := testDataSource(t, store)
+
+	if _, err := ds.UserByEmail("a@example.com"); err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+	// The unknown address is cached too
+	if _, err := ds.UserByEmail("a@example.com"); err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+	if stats := ds.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("got %+v, want a hit and a miss", stats)
+	}
+
+	u := &User{Email: "a@example.com", Active: true}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := ds.UserByEmail("a@example.com")
+	if err != nil || cached.Revision != u.Revision {
+		t.Fatalf("got %v, %v after the create; want revision %d", cached, err, u.Revision)
+	}
+
+	// The callers get copies
+	cached.Active = false
+	if again, err := ds.UserByEmail("a@example.com"); err != nil || !again.Active {
+		t.Errorf("got %v, %v; the cached user was modified through a copy", again, err)
+	}
+
+	// The writes of the other instances are seen once the watch reports them
+	stale := *u
+	stale.Active = false
+	if err := store.StoreUser(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ds.UserByEmail("a@example.com"); !again.Active || again.Revision != u.Revision {
+		t.Errorf("got %+v before the invalidation, want the cached user", again)
+	}
+	ds.invalidate(userKind, "a@example.com")
+	if again, _ := ds.UserByEmail("a@example.com"); again.Active || again.Revision != stale.Revision {
+		t.Errorf("got %+v after the invalidation, want revision %d", again, stale.Revision)
+	}
+
+	// An empty address flushes everything
+	stale.Active = true
+	if err := store.StoreUser(&stale); err != nil {
+		t.Fatal(err)
+	}
+	ds.invalidate(groupKind, "")
+	if again, _ := ds.UserByEmail("a@example.com"); !again.Active {
+		t.Errorf("got %+v after the flush, want the stored user", again)
+	}
+}
+
+func TestCacheDropsLookupsRacingInvalidations(t *testing.T) {
+	store := &racingStore{Store: NewMemoryStore()}
+	ds := testDataSource(t, store)
+	u := &User{Email: "a@example.com"}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user changes after it's read, but before it's cached
+	store.during = func() {
+		store.during = nil
+		changed := *u
+		changed.Active = true
+		if err := store.Store.StoreUser(&changed); err != nil {
+			t.Fatal(err)
+		}
+		ds.invalidate(userKind, u.Email)
+	}
+	if got, err := ds.UserByEmail(u.Email); err != nil || got.Active {
+		t.Fatalf("got %+v, %v; want the user as it was read", got, err)
+	}
+	if got, err := ds.UserByEmail(u.Email); err != nil || !got.Active {
+		t.Errorf("got %+v, %v; the stale lookup has been cached", got, err)
+	}
+}
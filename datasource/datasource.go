@@ -2,32 +2,49 @@ package datasource // import "github.com/cafebazaar/bahram/datasource"
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/cafebazaar/blacksmith/logging"
-	etcd "github.com/coreos/etcd/client"
 	"github.com/patrickmn/go-cache"
-	"golang.org/x/net/context"
 )
 
 const (
 	debugTag = "DATASOURCE"
+
+	// updateRetries is how many times UpdateGroup tries on write conflicts
+	updateRetries = 5
 )
 
+// DataSource gives the rest of bahram access to the configuration and, through
+// its Store, to the users and groups.
+//
+// Lookups of single users and groups are served from a cache, which is
+// invalidated by the writes made through the DataSource, and by the changes
+// reported by the Store if it's a WatchableStore.
 type DataSource struct {
-	keysAPI etcd.KeysAPI
-	etcdDir string
+	// accessed atomically, kept first to be 64-bit aligned
+	cacheGeneration uint64
+	cacheHits       uint64
+	cacheMisses     uint64
+	// auditTrimmed is when the old audit events were last removed
+	auditTrimmed int64
+
+	Store
 	cache   *cache.Cache
+	limiter *loginLimiter
 }
 
-func NewDataSource(kapi etcd.KeysAPI, etcdDir string) (*DataSource, error) {
+func NewDataSource(store Store) (*DataSource, error) {
 	instance := &DataSource{
-		keysAPI: kapi,
-		etcdDir: etcdDir,
-		cache:   cache.New(1*time.Minute, 30*time.Second), // protects against brute force
+		Store:   store,
+		cache:   cache.New(1*time.Minute, 30*time.Second),
+		limiter: newLoginLimiter(store),
+	}
+
+	if watchable, ok := store.(WatchableStore); ok {
+		go watchable.Watch(instance.invalidate)
 	}
 
 	return instance, nil
@@ -47,119 +64,180 @@ func (ds *DataSource) ConfigByteArray(name string) []byte {
 	return value
 }
 
-func (ds *DataSource) StoreUser(u *User) error {
-	userJSON, err := json.Marshal(u)
-	if err != nil {
-		return err
+// PasswordScheme is the scheme used to hash new passwords, configured by
+// BAHRAM_PASSWORD_SCHEME
+func (ds *DataSource) PasswordScheme() string {
+	scheme := ds.ConfigString("PASSWORD_SCHEME")
+	if scheme == "" {
+		return DefaultPasswordScheme
 	}
+	return scheme
+}
+
+// SetPassword sets the password of the user, hashed by the configured scheme.
+// It doesn't store the user.
+func (ds *DataSource) SetPassword(u *User, plainPassword string) error {
+	return u.SetPassword(plainPassword, ds.PasswordScheme())
+}
 
-	logging.Debug(debugTag, "Setting %s", userJSON)
+// CheckPassword reports whether plainPassword is the password of the user.
+// On success, if the stored hash is in the legacy format or uses outdated
+// parameters, the password is rehashed and the user is stored.
+func (ds *DataSource) CheckPassword(u *User, plainPassword string) bool {
+	if !u.AcceptsPassword(plainPassword, ds.ConfigByteArray("PASSWORD_SALT")) {
+		return false
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err = ds.keysAPI.Set(ctx, fmt.Sprintf("/%s/users/%s", ds.etcdDir, u.Email), string(userJSON[:]), nil)
-	if err != nil {
-		return err
+	if u.PasswordNeedsRehash(ds.PasswordScheme()) {
+		err := ds.SetPassword(u, plainPassword)
+		if err == nil {
+			err = ds.StoreUser(u)
+		}
+		if err != nil {
+			// Not fatal, it'll be tried again on the next login
+			logging.Log(debugTag, "Error while rehashing the password of %s: %s", u.Email, err)
+		} else {
+			logging.Debug(debugTag, "Rehashed the password of %s", u.Email)
+		}
 	}
-	return nil
+	return true
 }
 
-func (ds *DataSource) UserByEmail(emailAddress string) (*User, error) {
-	// TODO: use ds.cache
+// RenameUser moves the user with oldEmail to newEmail, and rewrites the
+// address in the Manager, Members and CCs of every group, all in one
+// Commit. The new address must not be taken by another user or group. If
+// modify isn't nil, it's applied to the renamed user in the same Commit; an
+// error returned by it aborts the rename.
+func (ds *DataSource) RenameUser(oldEmail, newEmail string, modify func(u *User) error) (*User, error) {
+	for i := 0; i < updateRetries; i++ {
+		u, err := ds.UserByEmail(oldEmail)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := ds.Groups()
+		if err != nil {
+			return nil, err
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+		var b Batch
+		b.DeleteUser(oldEmail, u.Revision)
+		u.Email = newEmail
+		if modify != nil {
+			if err := modify(u); err != nil {
+				return nil, err
+			}
+		}
+		b.CreateUser(u)
+		for _, g := range groups {
+			if g.ReplaceAddress(oldEmail, newEmail) {
+				b.StoreGroup(g)
+			}
+		}
 
-	response, err := ds.keysAPI.Get(ctx, fmt.Sprintf("/%s/users/%s", ds.etcdDir, emailAddress), nil)
-	if err != nil {
-		return nil, err
+		err = ds.Commit(&b)
+		if err == ErrConflict {
+			logging.Debug(debugTag, "Conflict while renaming user %s, retrying", oldEmail)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ds.forgetUser(oldEmail, newEmail)
+		return u, nil
 	}
-
-	return userFromNodeValue(response.Node.Value)
+	return nil, ErrConflict
 }
 
-func (ds *DataSource) Users() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	response, err := ds.keysAPI.Get(ctx, fmt.Sprintf("/%s/users", ds.etcdDir), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	var users []*User
+// DeleteUser deletes the user, and removes its address from the Manager,
+// Members and CCs of every group, all in one Commit.
+func (ds *DataSource) DeleteUser(emailAddress string) error {
+	for i := 0; i < updateRetries; i++ {
+		groups, err := ds.Groups()
+		if err != nil {
+			return err
+		}
 
-	errCount := 0
-	for i := range response.Node.Nodes {
-		u, e := userFromNodeValue(response.Node.Nodes[i].Value)
-		if e != nil {
-			errCount += 1
-			logging.Debug(debugTag, "Error while userFromNodeValue: %s", e)
-		} else {
-			users = append(users, u)
+		var b Batch
+		b.DeleteUser(emailAddress, 0)
+		for _, g := range groups {
+			if g.RemoveAddress(emailAddress) {
+				b.StoreGroup(g)
+			}
 		}
-	}
 
-	if errCount > 0 {
-		return nil, fmt.Errorf("Errors happened while trying to unmarshal %d user(s)", errCount)
+		err = ds.Commit(&b)
+		if err == ErrConflict {
+			logging.Debug(debugTag, "Conflict while deleting user %s, retrying", emailAddress)
+			continue
+		} else if err != nil {
+			return err
+		}
+		ds.forgetUser(emailAddress, "")
+		return nil
 	}
-
-	return users, nil
+	return ErrConflict
 }
 
-func (ds *DataSource) StoreGroup(g *Group) error {
-	groupJSON, err := json.Marshal(g)
-	if err != nil {
-		return err
+// forgetUser invalidates the tokens of a user which has been deleted or
+// renamed to newEmail, and deletes or moves its API keys. The user has been
+// committed by then, so the errors are only logged.
+func (ds *DataSource) forgetUser(emailAddress, newEmail string) {
+	if err := ds.deleteUserTokens(emailAddress); err != nil {
+		logging.Log(debugTag, "Error while deleting the tokens of %s: %s", emailAddress, err)
 	}
-
-	logging.Debug(debugTag, "Setting %s", groupJSON)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err = ds.keysAPI.Set(ctx, fmt.Sprintf("/%s/groups/%s", ds.etcdDir, g.Email), string(groupJSON[:]), nil)
-	if err != nil {
-		return err
+	if err := ds.moveAPIKeys(emailAddress, newEmail); err != nil {
+		logging.Log(debugTag, "Error while moving the API keys of %s: %s", emailAddress, err)
 	}
-	return nil
 }
 
-func (ds *DataSource) GroupByEmail(emailAddress string) (*Group, error) {
-	// TODO: use ds.cache
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	response, err := ds.keysAPI.Get(ctx, fmt.Sprintf("/%s/groups/%s", ds.etcdDir, emailAddress), nil)
-	if err != nil {
-		return nil, err
-	}
+// UpdateUser loads the user, applies modify to it and stores the result,
+// retrying on conflicts like UpdateGroup.
+func (ds *DataSource) UpdateUser(emailAddress string, modify func(u *User) error) (*User, error) {
+	for i := 0; i < updateRetries; i++ {
+		u, err := ds.UserByEmail(emailAddress)
+		if err != nil {
+			return nil, err
+		}
 
-	return groupFromNodeValue(response.Node.Value)
-}
+		err = modify(u)
+		if err != nil {
+			return nil, err
+		}
 
-func (ds *DataSource) Groups() ([]*Group, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	response, err := ds.keysAPI.Get(ctx, fmt.Sprintf("/%s/groups", ds.etcdDir), nil)
-	if err != nil {
-		return nil, err
+		err = ds.StoreUser(u)
+		if err == ErrConflict {
+			logging.Debug(debugTag, "Conflict while updating user %s, retrying", emailAddress)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return u, nil
 	}
+	return nil, ErrConflict
+}
 
-	var groups []*Group
+// UpdateGroup loads the group, applies modify to it and stores the result. If
+// the group is modified by someone else in the meantime, it's reloaded and
+// modify is applied again. An error returned by modify aborts the update.
+func (ds *DataSource) UpdateGroup(emailAddress string, modify func(g *Group) error) (*Group, error) {
+	for i := 0; i < updateRetries; i++ {
+		g, err := ds.GroupByEmail(emailAddress)
+		if err != nil {
+			return nil, err
+		}
 
-	errCount := 0
-	for i := range response.Node.Nodes {
-		g, e := groupFromNodeValue(response.Node.Nodes[i].Value)
-		if e != nil {
-			errCount += 1
-			logging.Debug(debugTag, "Error while groupFromNodeValue: %s", e)
-		} else {
-			groups = append(groups, g)
+		err = modify(g)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	if errCount > 0 {
-		return nil, fmt.Errorf("Errors happened while trying to unmarshal %d group(s)", errCount)
+		err = ds.StoreGroup(g)
+		if err == ErrConflict {
+			logging.Debug(debugTag, "Conflict while updating group %s, retrying", emailAddress)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return g, nil
 	}
-
-	return groups, nil
+	return nil, ErrConflict
 }
@@ -0,0 +1,527 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// EtcdStore keeps users and groups as JSON values under /<etcdDir>/users and
+// /<etcdDir>/groups. The etcd ModifiedIndex of a node is used as the revision
+// of the user or group it holds.
+type EtcdStore struct {
+	keysAPI etcd.KeysAPI
+	etcdDir string
+}
+
+func NewEtcdStore(kapi etcd.KeysAPI, etcdDir string) (*EtcdStore, error) {
+	instance := &EtcdStore{
+		keysAPI: kapi,
+		etcdDir: etcdDir,
+	}
+
+	return instance, nil
+}
+
+// translateError maps etcd errors to the errors defined by Store
+func (s *EtcdStore) translateError(err error) error {
+	if etcd.IsKeyNotFound(err) {
+		return ErrNotFound
+	}
+	if isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Watch implements WatchableStore
+func (s *EtcdStore) Watch(invalidate func(kind, emailAddress string)) {
+	go s.watchDir("users", userKind, invalidate)
+	s.watchDir("groups", groupKind, invalidate)
+}
+
+func (s *EtcdStore) watchDir(dir, kind string, invalidate func(kind, emailAddress string)) {
+	prefix := fmt.Sprintf("/%s/%s/", s.etcdDir, dir)
+	for {
+		watcher := s.keysAPI.Watcher(strings.TrimSuffix(prefix, "/"), &etcd.WatcherOptions{Recursive: true})
+		// Changes made while there was no watcher are lost
+		invalidate(kind, "")
+
+		for {
+			response, err := watcher.Next(context.Background())
+			if err != nil {
+				logging.Log(debugTag, "Error while watching %s, rewatching: %s", prefix, err)
+				time.Sleep(3 * time.Second)
+				break
+			}
+			if strings.HasPrefix(response.Node.Key, prefix) {
+				invalidate(kind, strings.TrimPrefix(response.Node.Key, prefix))
+			}
+		}
+	}
+}
+
+func isEtcdErrorCode(err error, code int) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == code
+}
+
+// create stores value at key only if the key doesn't exist yet, after making
+// sure otherKey (the same email in the other namespace) doesn't exist either.
+// etcd v2 can't make the two checks atomic, but the create itself is, so two
+// concurrent creates of the same user or group can't both succeed.
+func (s *EtcdStore) create(key, otherKey, value string, errKeyExists, errOtherExists error) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := s.keysAPI.Get(ctx, otherKey, nil)
+	if err == nil {
+		return 0, errOtherExists
+	}
+	if !etcd.IsKeyNotFound(err) {
+		return 0, err
+	}
+
+	response, err := s.keysAPI.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+		return 0, errKeyExists
+	} else if err != nil {
+		return 0, err
+	}
+	return response.Node.ModifiedIndex, nil
+}
+
+// set stores value at key. If revision isn't zero, the write only succeeds if
+// the node hasn't been modified since that revision.
+func (s *EtcdStore) set(key, value string, revision uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := s.keysAPI.Set(ctx, key, value, &etcd.SetOptions{PrevIndex: revision})
+	if err != nil {
+		return 0, s.translateError(err)
+	}
+	return response.Node.ModifiedIndex, nil
+}
+
+func userFromNode(node *etcd.Node) (*User, error) {
+	u, err := userFromNodeValue(node.Value)
+	if err != nil {
+		return nil, err
+	}
+	u.Revision = node.ModifiedIndex
+	return u, nil
+}
+
+func groupFromNode(node *etcd.Node) (*Group, error) {
+	g, err := groupFromNodeValue(node.Value)
+	if err != nil {
+		return nil, err
+	}
+	g.Revision = node.ModifiedIndex
+	return g, nil
+}
+
+func (s *EtcdStore) CreateUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Creating %s", userJSON)
+
+	revision, err := s.create(
+		fmt.Sprintf("/%s/users/%s", s.etcdDir, u.Email),
+		fmt.Sprintf("/%s/groups/%s", s.etcdDir, u.Email),
+		string(userJSON[:]), ErrUserExists, ErrGroupExists)
+	if err != nil {
+		return err
+	}
+	u.Revision = revision
+	return nil
+}
+
+func (s *EtcdStore) StoreUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Setting %s", userJSON)
+
+	revision, err := s.set(fmt.Sprintf("/%s/users/%s", s.etcdDir, u.Email), string(userJSON[:]), u.Revision)
+	if err != nil {
+		return err
+	}
+	u.Revision = revision
+	return nil
+}
+
+func (s *EtcdStore) UserByEmail(emailAddress string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/users/%s", s.etcdDir, emailAddress), nil)
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	return userFromNode(response.Node)
+}
+
+func (s *EtcdStore) Users() ([]*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/users", s.etcdDir), nil)
+	if etcd.IsKeyNotFound(err) {
+		// None has been created yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+
+	errCount := 0
+	for i := range response.Node.Nodes {
+		u, e := userFromNode(response.Node.Nodes[i])
+		if e != nil {
+			errCount += 1
+			logging.Debug(debugTag, "Error while userFromNode: %s", e)
+		} else {
+			users = append(users, u)
+		}
+	}
+
+	if errCount > 0 {
+		return nil, fmt.Errorf("Errors happened while trying to unmarshal %d user(s)", errCount)
+	}
+
+	return users, nil
+}
+
+func (s *EtcdStore) DeleteUser(emailAddress string) error {
+	logging.Debug(debugTag, "Deleting user %s", emailAddress)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Delete(ctx, fmt.Sprintf("/%s/users/%s", s.etcdDir, emailAddress), nil)
+	return s.translateError(err)
+}
+
+func (s *EtcdStore) CreateGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Creating %s", groupJSON)
+
+	revision, err := s.create(
+		fmt.Sprintf("/%s/groups/%s", s.etcdDir, g.Email),
+		fmt.Sprintf("/%s/users/%s", s.etcdDir, g.Email),
+		string(groupJSON[:]), ErrGroupExists, ErrUserExists)
+	if err != nil {
+		return err
+	}
+	g.Revision = revision
+	return nil
+}
+
+func (s *EtcdStore) StoreGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(debugTag, "Setting %s", groupJSON)
+
+	revision, err := s.set(fmt.Sprintf("/%s/groups/%s", s.etcdDir, g.Email), string(groupJSON[:]), g.Revision)
+	if err != nil {
+		return err
+	}
+	g.Revision = revision
+	return nil
+}
+
+func (s *EtcdStore) GroupByEmail(emailAddress string) (*Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/groups/%s", s.etcdDir, emailAddress), nil)
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	return groupFromNode(response.Node)
+}
+
+func (s *EtcdStore) Groups() ([]*Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/groups", s.etcdDir), nil)
+	if etcd.IsKeyNotFound(err) {
+		// None has been created yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var groups []*Group
+
+	errCount := 0
+	for i := range response.Node.Nodes {
+		g, e := groupFromNode(response.Node.Nodes[i])
+		if e != nil {
+			errCount += 1
+			logging.Debug(debugTag, "Error while groupFromNode: %s", e)
+		} else {
+			groups = append(groups, g)
+		}
+	}
+
+	if errCount > 0 {
+		return nil, fmt.Errorf("Errors happened while trying to unmarshal %d group(s)", errCount)
+	}
+
+	return groups, nil
+}
+
+func (s *EtcdStore) DeleteGroup(emailAddress string) error {
+	logging.Debug(debugTag, "Deleting group %s", emailAddress)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Delete(ctx, fmt.Sprintf("/%s/groups/%s", s.etcdDir, emailAddress), nil)
+	return s.translateError(err)
+}
+
+func (s *EtcdStore) recordKey(kind, id string) string {
+	return fmt.Sprintf("/%s/records/%s/%s", s.etcdDir, kind, id)
+}
+
+func (s *EtcdStore) PutRecord(kind, id string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Set(ctx, s.recordKey(kind, id), string(value), &etcd.SetOptions{TTL: ttl})
+	return err
+}
+
+func (s *EtcdStore) CreateRecord(kind, id string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Set(ctx, s.recordKey(kind, id), string(value), &etcd.SetOptions{TTL: ttl, PrevExist: etcd.PrevNoExist})
+	if isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+		return ErrRecordExists
+	}
+	return err
+}
+
+func (s *EtcdStore) Record(kind, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, s.recordKey(kind, id), nil)
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+	return []byte(response.Node.Value), nil
+}
+
+func (s *EtcdStore) Records(kind string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/records/%s", s.etcdDir, kind), nil)
+	if etcd.IsKeyNotFound(err) {
+		return map[string][]byte{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string][]byte)
+	prefix := s.recordKey(kind, "")
+	for _, node := range response.Node.Nodes {
+		records[strings.TrimPrefix(node.Key, prefix)] = []byte(node.Value)
+	}
+	return records, nil
+}
+
+func (s *EtcdStore) TakeRecord(kind, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, s.recordKey(kind, id), nil)
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	// Only one of the concurrent takers can delete this very revision
+	_, err = s.keysAPI.Delete(ctx, s.recordKey(kind, id), &etcd.DeleteOptions{PrevIndex: response.Node.ModifiedIndex})
+	if etcd.IsKeyNotFound(err) || isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(response.Node.Value), nil
+}
+
+func (s *EtcdStore) DeleteRecord(kind, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Delete(ctx, s.recordKey(kind, id), nil)
+	return s.translateError(err)
+}
+
+// nodeKey returns the key of the user or group
+func (s *EtcdStore) nodeKey(kind, emailAddress string) string {
+	return fmt.Sprintf("/%s/%ss/%s", s.etcdDir, kind, emailAddress)
+}
+
+// Commit makes the writes one by one, as etcd v2 has no transactions over
+// several keys. If one of them fails, the ones already made are undone in
+// reverse order; only a crash in between can leave the batch half made.
+func (s *EtcdStore) Commit(b *Batch) error {
+	values, err := b.values()
+	if err != nil {
+		return err
+	}
+
+	revisions := make([]uint64, len(b.ops))
+	var undos []func(ctx context.Context) error
+	for i, op := range b.ops {
+		var undo func(ctx context.Context) error
+		revisions[i], undo, err = s.apply(op, values[i])
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			for j := len(undos) - 1; j >= 0; j-- {
+				if undoErr := undos[j](ctx); undoErr != nil {
+					logging.Log(debugTag, "Error while undoing a partly committed batch: %s", undoErr)
+				}
+			}
+			return err
+		}
+		undos = append(undos, undo)
+	}
+	b.setRevisions(revisions)
+	return nil
+}
+
+// apply makes the write of op, and returns the new revision and how to undo
+// the write
+func (s *EtcdStore) apply(op batchOp, value []byte) (uint64, func(ctx context.Context) error, error) {
+	key := s.nodeKey(op.kind, op.email)
+	if op.op == batchCreate {
+		errExists, errOtherExists, otherKind := ErrUserExists, ErrGroupExists, groupKind
+		if op.kind == groupKind {
+			errExists, errOtherExists, otherKind = ErrGroupExists, ErrUserExists, userKind
+		}
+		revision, err := s.create(key, s.nodeKey(otherKind, op.email), string(value), errExists, errOtherExists)
+		if err != nil {
+			return 0, nil, err
+		}
+		return revision, func(ctx context.Context) error {
+			_, err := s.keysAPI.Delete(ctx, key, &etcd.DeleteOptions{PrevIndex: revision})
+			return err
+		}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := s.keysAPI.Get(ctx, key, nil)
+	if err != nil {
+		return 0, nil, s.translateError(err)
+	}
+	previous := response.Node
+	if op.revision != 0 && previous.ModifiedIndex != op.revision {
+		return 0, nil, ErrConflict
+	}
+
+	if op.op == batchStore {
+		response, err = s.keysAPI.Set(ctx, key, string(value), &etcd.SetOptions{PrevIndex: previous.ModifiedIndex})
+		if err != nil {
+			return 0, nil, s.translateError(err)
+		}
+		revision := response.Node.ModifiedIndex
+		return revision, func(ctx context.Context) error {
+			_, err := s.keysAPI.Set(ctx, key, previous.Value, &etcd.SetOptions{PrevIndex: revision})
+			return err
+		}, nil
+	}
+
+	_, err = s.keysAPI.Delete(ctx, key, &etcd.DeleteOptions{PrevIndex: previous.ModifiedIndex})
+	if err != nil {
+		return 0, nil, s.translateError(err)
+	}
+	return 0, func(ctx context.Context) error {
+		_, err := s.keysAPI.Set(ctx, key, previous.Value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+		return err
+	}, nil
+}
+
+func (s *EtcdStore) logKey(kind, id string) string {
+	return fmt.Sprintf("/%s/logs/%s/%s", s.etcdDir, kind, id)
+}
+
+func (s *EtcdStore) AppendLog(kind, id string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.keysAPI.Set(ctx, s.logKey(kind, id), string(value), nil)
+	return err
+}
+
+// logNodes returns the entries of the log, sorted by id. etcd v2 can't read a
+// range of keys, so it's the whole log.
+func (s *EtcdStore) logNodes(ctx context.Context, kind string) (etcd.Nodes, error) {
+	response, err := s.keysAPI.Get(ctx, fmt.Sprintf("/%s/logs/%s", s.etcdDir, kind), &etcd.GetOptions{Sort: true})
+	if etcd.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return response.Node.Nodes, nil
+}
+
+func (s *EtcdStore) ScanLog(kind, before string, f func(id string, value []byte) bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes, err := s.logNodes(ctx, kind)
+	if err != nil {
+		return err
+	}
+
+	prefix := s.logKey(kind, "")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		id := strings.TrimPrefix(nodes[i].Key, prefix)
+		if before != "" && id >= before {
+			continue
+		}
+		if !f(id, []byte(nodes[i].Value)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *EtcdStore) TrimLog(kind, before string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes, err := s.logNodes(ctx, kind)
+	if err != nil {
+		return err
+	}
+
+	prefix := s.logKey(kind, "")
+	for _, node := range nodes {
+		if strings.TrimPrefix(node.Key, prefix) >= before {
+			break
+		}
+		_, err := s.keysAPI.Delete(ctx, node.Key, nil)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
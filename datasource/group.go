@@ -2,6 +2,14 @@ package datasource
 
 import (
 	"encoding/json"
+	"errors"
+)
+
+var (
+	ErrAlreadyMember    = errors.New("Already joined")
+	ErrNotMember        = errors.New("Not joined anyway")
+	ErrManagerCantLeave = errors.New("You can't leave a group you which you manage")
+	ErrNotJoinable      = errors.New("This group isn't joinable")
 )
 
 type Group struct {
@@ -14,6 +22,9 @@ type Group struct {
 	Manager     string   `json:"manager"`
 	Members     []string `json:"members"`
 	CCs         []string `json:"ccs"`
+
+	// Revision is set by the Store, see Store
+	Revision uint64 `json:"-"`
 }
 
 func groupFromNodeValue(value string) (*Group, error) {
@@ -33,3 +44,67 @@ func (g *Group) IsMemeber(email string) bool {
 	}
 	return false
 }
+
+func (g *Group) Join(email string) error {
+	if g.IsMemeber(email) {
+		return ErrAlreadyMember
+	}
+	g.Members = append(g.Members, email)
+	return nil
+}
+
+func (g *Group) Leave(email string) error {
+	if g.Manager == email {
+		return ErrManagerCantLeave
+	}
+	for i, m := range g.Members {
+		if m == email {
+			n := len(g.Members)
+			g.Members[i] = g.Members[n-1]
+			g.Members = g.Members[:n-1]
+			return nil
+		}
+	}
+	return ErrNotMember
+}
+
+// ReplaceAddress replaces oldEmail with newEmail wherever the group refers to
+// it, and reports whether anything changed.
+func (g *Group) ReplaceAddress(oldEmail, newEmail string) bool {
+	changed := false
+	if g.Manager == oldEmail {
+		g.Manager = newEmail
+		changed = true
+	}
+	for _, list := range [][]string{g.Members, g.CCs} {
+		for i := range list {
+			if list[i] == oldEmail {
+				list[i] = newEmail
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// RemoveAddress removes emailAddress wherever the group refers to it, and
+// reports whether anything changed. A removed manager leaves the group
+// without one.
+func (g *Group) RemoveAddress(emailAddress string) bool {
+	changed := false
+	if g.Manager == emailAddress {
+		g.Manager = ""
+		changed = true
+	}
+	for _, list := range []*[]string{&g.Members, &g.CCs} {
+		kept := (*list)[:0]
+		for _, a := range *list {
+			if a != emailAddress {
+				kept = append(kept, a)
+			}
+		}
+		changed = changed || len(kept) != len(*list)
+		*list = kept
+	}
+	return changed
+}
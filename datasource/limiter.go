@@ -0,0 +1,254 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// Failed logins are counted per account and per source IP. After a few free
+// attempts, every failure blocks further attempts for an exponentially
+// growing delay, and too many failures lock the account or IP out for a
+// while. Failures are forgotten after failuresTTL without a new one.
+//
+// The state is kept in the records of the Store, so the bahram instances
+// sharing it limit together. The updates of an instance are serialized, but
+// concurrent failures on different instances may be counted as one.
+
+// The password reset requests are limited the same way, as their own kinds,
+// so they can't be used to flood the inbox of a user.
+
+const (
+	LockoutKindAccount = "account"
+	LockoutKindIP      = "ip"
+
+	LockoutKindResetAccount = "reset-account"
+	LockoutKindResetIP      = "reset-ip"
+
+	failuresTTL     = 1 * time.Hour
+	baseDelay       = 1 * time.Second
+	maxDelay        = 5 * time.Minute
+	lockoutDuration = 30 * time.Minute
+)
+
+type limiterPolicy struct {
+	freeAttempts int
+	lockoutAfter int
+}
+
+var limiterPolicies = map[string]limiterPolicy{
+	LockoutKindAccount: {freeAttempts: 3, lockoutAfter: 10},
+	// Many users may share an IP behind a NAT
+	LockoutKindIP: {freeAttempts: 20, lockoutAfter: 100},
+
+	LockoutKindResetAccount: {freeAttempts: 2, lockoutAfter: 5},
+	LockoutKindResetIP:      {freeAttempts: 5, lockoutAfter: 30},
+}
+
+var lockoutKinds = []string{LockoutKindAccount, LockoutKindIP, LockoutKindResetAccount, LockoutKindResetIP}
+
+// Lockout describes the failed logins of an account or an IP
+type Lockout struct {
+	Kind         string    `json:"kind"`
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"lastFailure"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+	Locked       bool      `json:"locked"`
+}
+
+type loginLimiter struct {
+	mu    sync.Mutex
+	store Store
+}
+
+func newLoginLimiter(store Store) *loginLimiter {
+	return &loginLimiter{store: store}
+}
+
+// limiterRecordKind is the kind of the records of the lockouts of the kind
+func limiterRecordKind(kind string) string {
+	return "lockouts-" + kind
+}
+
+func (l *loginLimiter) get(kind, key string) (*Lockout, error) {
+	value, err := l.store.Record(limiterRecordKind(kind), key)
+	if err != nil {
+		return nil, err
+	}
+	var lockout Lockout
+	if err := json.Unmarshal(value, &lockout); err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// wait returns how long the caller must wait before the next attempt
+func (l *loginLimiter) wait(kind, key string, now time.Time) time.Duration {
+	lockout, err := l.get(kind, key)
+	if err != nil {
+		if err != ErrNotFound {
+			logging.Log(debugTag, "Error while loading the failed logins of %s %s: %s", kind, key, err)
+		}
+		return 0
+	}
+	if !now.Before(lockout.BlockedUntil) {
+		return 0
+	}
+	return lockout.BlockedUntil.Sub(now)
+}
+
+// failed adds a failure to the lockout, and returns how long it must be kept
+func (lockout *Lockout) failed(now time.Time) time.Duration {
+	lockout.Failures++
+	lockout.LastFailure = now
+
+	policy := limiterPolicies[lockout.Kind]
+	switch {
+	case lockout.Failures >= policy.lockoutAfter:
+		if !lockout.Locked {
+			logging.Log(debugTag, "Locking out %s %s after %d failures", lockout.Kind, lockout.Key, lockout.Failures)
+		}
+		lockout.Locked = true
+		lockout.BlockedUntil = now.Add(lockoutDuration)
+	case lockout.Failures > policy.freeAttempts:
+		delay := baseDelay << uint(lockout.Failures-policy.freeAttempts-1)
+		if delay > maxDelay || delay <= 0 {
+			delay = maxDelay
+		}
+		lockout.BlockedUntil = now.Add(delay)
+	}
+
+	// Forget it failuresTTL after the last failure, or after the block ends
+	forgetAt := now
+	if lockout.BlockedUntil.After(forgetAt) {
+		forgetAt = lockout.BlockedUntil
+	}
+	return forgetAt.Add(failuresTTL).Sub(now)
+}
+
+func (l *loginLimiter) fail(kind, key string, now time.Time) {
+	lockout, err := l.get(kind, key)
+	if err == ErrNotFound {
+		lockout = &Lockout{Kind: kind, Key: key}
+	} else if err != nil {
+		logging.Log(debugTag, "Error while loading the failed logins of %s %s: %s", kind, key, err)
+		return
+	}
+	ttl := lockout.failed(now)
+
+	value, err := json.Marshal(lockout)
+	if err == nil {
+		err = l.store.PutRecord(limiterRecordKind(kind), key, value, ttl)
+	}
+	if err != nil {
+		logging.Log(debugTag, "Error while storing the failed logins of %s %s: %s", kind, key, err)
+	}
+}
+
+// waitBoth returns the longer wait of the account and the ip
+func (l *loginLimiter) waitBoth(accountKind, ipKind, account, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	wait := l.wait(accountKind, account, now)
+	if ipWait := l.wait(ipKind, ip, now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+func (l *loginLimiter) failBoth(accountKind, ipKind, account, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.fail(accountKind, account, now)
+	l.fail(ipKind, ip, now)
+}
+
+// LoginWait returns how long a login attempt to the account from ip has to
+// wait because of the previous failures, zero if it's allowed now.
+func (ds *DataSource) LoginWait(account, ip string) time.Duration {
+	return ds.limiter.waitBoth(LockoutKindAccount, LockoutKindIP, account, ip)
+}
+
+// LoginFailed records a failed login to the account from ip
+func (ds *DataSource) LoginFailed(account, ip string) {
+	ds.limiter.failBoth(LockoutKindAccount, LockoutKindIP, account, ip)
+}
+
+// PasswordResetWait returns how long a password reset request for the account
+// from ip has to wait because of the previous ones, zero if it's allowed now.
+func (ds *DataSource) PasswordResetWait(account, ip string) time.Duration {
+	return ds.limiter.waitBoth(LockoutKindResetAccount, LockoutKindResetIP, account, ip)
+}
+
+// PasswordResetRequested records a password reset request for the account
+// from ip. They're counted whether the account exists or not.
+func (ds *DataSource) PasswordResetRequested(account, ip string) {
+	ds.limiter.failBoth(LockoutKindResetAccount, LockoutKindResetIP, account, ip)
+}
+
+// LoginSucceeded forgets the failed logins to the account. Those of the IP
+// are kept, they may be attempts to other accounts.
+func (ds *DataSource) LoginSucceeded(account, ip string) {
+	ds.limiter.mu.Lock()
+	defer ds.limiter.mu.Unlock()
+
+	err := ds.Store.DeleteRecord(limiterRecordKind(LockoutKindAccount), account)
+	if err != nil && err != ErrNotFound {
+		logging.Log(debugTag, "Error while clearing the failed logins of %s: %s", account, err)
+	}
+}
+
+// Lockouts lists the accounts and IPs with recent failed logins or password
+// reset requests
+func (ds *DataSource) Lockouts() ([]*Lockout, error) {
+	ds.limiter.mu.Lock()
+	defer ds.limiter.mu.Unlock()
+
+	var lockouts []*Lockout
+	for _, kind := range lockoutKinds {
+		records, err := ds.Store.Records(limiterRecordKind(kind))
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range records {
+			var lockout Lockout
+			if err := json.Unmarshal(value, &lockout); err != nil {
+				return nil, err
+			}
+			lockouts = append(lockouts, &lockout)
+		}
+	}
+	sort.Sort(lockoutsByLastFailure(lockouts))
+	return lockouts, nil
+}
+
+// ClearLockout forgets the failed logins of an account or IP
+func (ds *DataSource) ClearLockout(kind, key string) error {
+	if _, found := limiterPolicies[kind]; !found {
+		return fmt.Errorf("Unknown lockout kind %q", kind)
+	}
+
+	ds.limiter.mu.Lock()
+	defer ds.limiter.mu.Unlock()
+
+	if err := ds.Store.DeleteRecord(limiterRecordKind(kind), key); err != nil {
+		return err
+	}
+	logging.Log(debugTag, "Cleared the failed logins of %s %s", kind, key)
+	return nil
+}
+
+type lockoutsByLastFailure []*Lockout
+
+func (l lockoutsByLastFailure) Len() int           { return len(l) }
+func (l lockoutsByLastFailure) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l lockoutsByLastFailure) Less(i, j int) bool { return l[i].LastFailure.After(l[j].LastFailure) }
@@ -0,0 +1,81 @@
+package datasource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutBackOff(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		kind     string
+		failures int
+		blocked  time.Duration
+		locked   bool
+	}{
+		{LockoutKindAccount, 1, 0, false},
+		{LockoutKindAccount, 3, 0, false},
+		{LockoutKindAccount, 4, 1 * time.Second, false},
+		{LockoutKindAccount, 5, 2 * time.Second, false},
+		{LockoutKindAccount, 9, 32 * time.Second, false},
+		{LockoutKindAccount, 10, lockoutDuration, true},
+		{LockoutKindAccount, 12, lockoutDuration, true},
+		{LockoutKindIP, 20, 0, false},
+		{LockoutKindIP, 21, 1 * time.Second, false},
+		{LockoutKindIP, 40, maxDelay, false},
+		{LockoutKindIP, 99, maxDelay, false},
+		{LockoutKindIP, 100, lockoutDuration, true},
+	}
+	for _, tt := range tests {
+		lockout := &Lockout{Kind: tt.kind, Key: "key"}
+		var ttl time.Duration
+		for i := 0; i < tt.failures; i++ {
+			ttl = lockout.failed(now)
+		}
+
+		var blocked time.Duration
+		if !lockout.BlockedUntil.IsZero() {
+			blocked = lockout.BlockedUntil.Sub(now)
+		}
+		if blocked != tt.blocked || lockout.Locked != tt.locked {
+			t.Errorf("%s after %d failures: blocked for %s, locked %v; want %s, %v",
+				tt.kind, tt.failures, blocked, lockout.Locked, tt.blocked, tt.locked)
+		}
+		if ttl != blocked+failuresTTL {
+			t.Errorf("%s after %d failures: kept for %s, want %s", tt.kind, tt.failures, ttl, blocked+failuresTTL)
+		}
+	}
+}
+
+func TestLimiterIsSharedThroughTheStore(t *testing.T) {
+	store := NewMemoryStore()
+	ds1 := testDataSource(t, store)
+	ds2 := testDataSource(t, store)
+
+	for i := 0; i < limiterPolicies[LockoutKindAccount].freeAttempts; i++ {
+		ds1.LoginFailed("a@example.com", "192.0.2.1")
+	}
+	if wait := ds2.LoginWait("a@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("blocked for %s after the free attempts", wait)
+	}
+	ds1.LoginFailed("a@example.com", "192.0.2.1")
+	if wait := ds2.LoginWait("a@example.com", "192.0.2.2"); wait <= 0 {
+		t.Error("not blocked by the failures on the other instance")
+	}
+
+	lockouts, err := ds2.Lockouts()
+	if err != nil || len(lockouts) != 2 {
+		t.Fatalf("got lockouts %v, %v; want the account and the ip", lockouts, err)
+	}
+
+	ds2.LoginSucceeded("a@example.com", "192.0.2.2")
+	if wait := ds1.LoginWait("a@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("blocked for %s after a successful login", wait)
+	}
+	if err := ds1.ClearLockout(LockoutKindIP, "192.0.2.1"); err != nil {
+		t.Error(err)
+	}
+	if err := ds1.ClearLockout(LockoutKindIP, "192.0.2.1"); err != ErrNotFound {
+		t.Errorf("clearing twice: got %v, want %v", err, ErrNotFound)
+	}
+}
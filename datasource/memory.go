@@ -0,0 +1,443 @@
+package datasource
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps users and groups in process memory. It's meant for unit
+// tests and local development; everything is lost when the process exits.
+//
+// Values are kept in their JSON form, the same way EtcdStore keeps them, so
+// the objects returned to callers never alias the stored ones.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	revision uint64
+	users    map[string]memoryRecord
+	groups   map[string]memoryRecord
+	records  map[string]map[string]memoryRecord
+	logs     map[string][]memoryLogEntry
+	// swept is when the expired records of each kind were last removed
+	swept map[string]time.Time
+}
+
+type memoryLogEntry struct {
+	id    string
+	value []byte
+}
+
+type memoryRecord struct {
+	value    string
+	revision uint64
+	expires  time.Time
+}
+
+func (r memoryRecord) expired(now time.Time) bool {
+	return !r.expires.IsZero() && !now.Before(r.expires)
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:   make(map[string]memoryRecord),
+		groups:  make(map[string]memoryRecord),
+		records: make(map[string]map[string]memoryRecord),
+		logs:    make(map[string][]memoryLogEntry),
+		swept:   make(map[string]time.Time),
+	}
+}
+
+// put stores value under key in records, and returns the new revision. The
+// caller must hold s.mu for writing.
+func (s *MemoryStore) put(records map[string]memoryRecord, key, value string, revision uint64) (uint64, error) {
+	if revision != 0 {
+		current, found := records[key]
+		if !found {
+			return 0, ErrNotFound
+		}
+		if current.revision != revision {
+			return 0, ErrConflict
+		}
+	}
+	s.revision++
+	records[key] = memoryRecord{value: value, revision: s.revision}
+	return s.revision, nil
+}
+
+func (s *MemoryStore) CreateUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[u.Email]; found {
+		return ErrUserExists
+	}
+	if _, found := s.groups[u.Email]; found {
+		return ErrGroupExists
+	}
+	u.Revision, err = s.put(s.users, u.Email, string(userJSON), 0)
+	return err
+}
+
+func (s *MemoryStore) StoreUser(u *User) error {
+	userJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revision, err := s.put(s.users, u.Email, string(userJSON), u.Revision)
+	if err != nil {
+		return err
+	}
+	u.Revision = revision
+	return nil
+}
+
+func userFromMemoryRecord(record memoryRecord) (*User, error) {
+	u, err := userFromNodeValue(record.value)
+	if err != nil {
+		return nil, err
+	}
+	u.Revision = record.revision
+	return u, nil
+}
+
+func (s *MemoryStore) UserByEmail(emailAddress string) (*User, error) {
+	s.mu.RLock()
+	record, found := s.users[emailAddress]
+	s.mu.RUnlock()
+
+	if !found {
+		return nil, ErrNotFound
+	}
+	return userFromMemoryRecord(record)
+}
+
+func (s *MemoryStore) Users() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []*User
+	for _, email := range sortedKeys(s.users) {
+		u, err := userFromMemoryRecord(s.users[email])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) DeleteUser(emailAddress string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[emailAddress]; !found {
+		return ErrNotFound
+	}
+	delete(s.users, emailAddress)
+	return nil
+}
+
+func (s *MemoryStore) CreateGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.groups[g.Email]; found {
+		return ErrGroupExists
+	}
+	if _, found := s.users[g.Email]; found {
+		return ErrUserExists
+	}
+	g.Revision, err = s.put(s.groups, g.Email, string(groupJSON), 0)
+	return err
+}
+
+func (s *MemoryStore) StoreGroup(g *Group) error {
+	groupJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revision, err := s.put(s.groups, g.Email, string(groupJSON), g.Revision)
+	if err != nil {
+		return err
+	}
+	g.Revision = revision
+	return nil
+}
+
+func groupFromMemoryRecord(record memoryRecord) (*Group, error) {
+	g, err := groupFromNodeValue(record.value)
+	if err != nil {
+		return nil, err
+	}
+	g.Revision = record.revision
+	return g, nil
+}
+
+func (s *MemoryStore) GroupByEmail(emailAddress string) (*Group, error) {
+	s.mu.RLock()
+	record, found := s.groups[emailAddress]
+	s.mu.RUnlock()
+
+	if !found {
+		return nil, ErrNotFound
+	}
+	return groupFromMemoryRecord(record)
+}
+
+func (s *MemoryStore) Groups() ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []*Group
+	for _, email := range sortedKeys(s.groups) {
+		g, err := groupFromMemoryRecord(s.groups[email])
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (s *MemoryStore) DeleteGroup(emailAddress string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.groups[emailAddress]; !found {
+		return ErrNotFound
+	}
+	delete(s.groups, emailAddress)
+	return nil
+}
+
+// apply makes the write of op, and returns the new revision. The caller must
+// hold s.mu for writing.
+func (s *MemoryStore) apply(op batchOp, value []byte) (uint64, error) {
+	records, others := s.users, s.groups
+	errExists, errOtherExists := ErrUserExists, ErrGroupExists
+	if op.kind == groupKind {
+		records, others = s.groups, s.users
+		errExists, errOtherExists = ErrGroupExists, ErrUserExists
+	}
+
+	switch op.op {
+	case batchCreate:
+		if _, found := records[op.email]; found {
+			return 0, errExists
+		}
+		if _, found := others[op.email]; found {
+			return 0, errOtherExists
+		}
+		return s.put(records, op.email, string(value), 0)
+	case batchStore:
+		return s.put(records, op.email, string(value), op.revision)
+	default:
+		current, found := records[op.email]
+		if !found {
+			return 0, ErrNotFound
+		}
+		if op.revision != 0 && current.revision != op.revision {
+			return 0, ErrConflict
+		}
+		delete(records, op.email)
+		return 0, nil
+	}
+}
+
+func copyMemoryRecords(m map[string]memoryRecord) map[string]memoryRecord {
+	c := make(map[string]memoryRecord, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *MemoryStore) Commit(b *Batch) error {
+	values, err := b.values()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The writes are made to copies, which replace the maps only if they
+	// all succeed
+	users, groups, revision := s.users, s.groups, s.revision
+	s.users, s.groups = copyMemoryRecords(users), copyMemoryRecords(groups)
+	revisions := make([]uint64, len(b.ops))
+	for i, op := range b.ops {
+		revisions[i], err = s.apply(op, values[i])
+		if err != nil {
+			s.users, s.groups, s.revision = users, groups, revision
+			return err
+		}
+	}
+	b.setRevisions(revisions)
+	return nil
+}
+
+func (s *MemoryStore) PutRecord(kind, id string, value []byte, ttl time.Duration) error {
+	record := memoryRecord{value: string(value)}
+	if ttl > 0 {
+		record.expires = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string]memoryRecord)
+	}
+	// Nobody else removes the expired records
+	now := time.Now()
+	if now.Sub(s.swept[kind]) >= sweepInterval {
+		for otherID, other := range s.records[kind] {
+			if other.expired(now) {
+				delete(s.records[kind], otherID)
+			}
+		}
+		s.swept[kind] = now
+	}
+	s.records[kind][id] = record
+	return nil
+}
+
+func (s *MemoryStore) CreateRecord(kind, id string, value []byte, ttl time.Duration) error {
+	record := memoryRecord{value: string(value)}
+	if ttl > 0 {
+		record.expires = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string]memoryRecord)
+	}
+	if current, found := s.records[kind][id]; found && !current.expired(time.Now()) {
+		return ErrRecordExists
+	}
+	s.records[kind][id] = record
+	return nil
+}
+
+func (s *MemoryStore) Record(kind, id string) ([]byte, error) {
+	s.mu.RLock()
+	record, found := s.records[kind][id]
+	s.mu.RUnlock()
+
+	if !found || record.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return []byte(record.value), nil
+}
+
+func (s *MemoryStore) Records(kind string) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make(map[string][]byte)
+	now := time.Now()
+	for id, record := range s.records[kind] {
+		if !record.expired(now) {
+			records[id] = []byte(record.value)
+		}
+	}
+	return records, nil
+}
+
+func (s *MemoryStore) TakeRecord(kind, id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, found := s.records[kind][id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	delete(s.records[kind], id)
+	if record.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return []byte(record.value), nil
+}
+
+func (s *MemoryStore) DeleteRecord(kind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, found := s.records[kind][id]
+	if !found {
+		return ErrNotFound
+	}
+	delete(s.records[kind], id)
+	if record.expired(time.Now()) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendLog(kind, id string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log := s.logs[kind]
+	entry := memoryLogEntry{id: id, value: append([]byte{}, value...)}
+	i := sort.Search(len(log), func(i int) bool { return log[i].id > id })
+	if i == len(log) {
+		s.logs[kind] = append(log, entry)
+		return nil
+	}
+	// A copy, as the scans may be reading log
+	inserted := make([]memoryLogEntry, 0, len(log)+1)
+	inserted = append(append(append(inserted, log[:i]...), entry), log[i:]...)
+	s.logs[kind] = inserted
+	return nil
+}
+
+func (s *MemoryStore) ScanLog(kind, before string, f func(id string, value []byte) bool) error {
+	s.mu.RLock()
+	log := s.logs[kind]
+	s.mu.RUnlock()
+
+	// The entries are never modified, so log can be read unlocked
+	end := len(log)
+	if before != "" {
+		end = sort.Search(len(log), func(i int) bool { return log[i].id >= before })
+	}
+	for i := end - 1; i >= 0; i-- {
+		if !f(log[i].id, append([]byte{}, log[i].value...)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) TrimLog(kind, before string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log := s.logs[kind]
+	n := sort.Search(len(log), func(i int) bool { return log[i].id >= before })
+	s.logs[kind] = append([]memoryLogEntry{}, log[n:]...)
+	return nil
+}
+
+func sortedKeys(m map[string]memoryRecord) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,356 @@
+package datasource
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	oidcClientKind = "oidc-clients"
+
+	oidcCodeKind = "oidc-codes"
+	oidcCodeTTL  = 1 * time.Minute
+
+	oidcAccessTokenKind = "oidc-access-tokens"
+	// OIDCAccessTokenTTL is how long the access tokens given to the OpenID
+	// Connect clients, only good for the userinfo endpoint, are valid
+	OIDCAccessTokenTTL = 15 * time.Minute
+
+	oidcLoginKind = "oidc-logins"
+	// OIDCLoginTTL is how long the login form of the authorization endpoint
+	// can be posted
+	OIDCLoginTTL = 30 * time.Minute
+)
+
+// ErrInvalidRedirectURI is returned for the redirect URIs which aren't
+// absolute, or have a fragment
+var ErrInvalidRedirectURI = errors.New("Invalid redirect URI")
+
+// OIDCClient is an application which logs the users in by bahram, as an
+// OpenID Connect provider. Public clients, e.g. single-page and mobile apps,
+// have no secret and must use PKCE.
+type OIDCClient struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Public       bool     `json:"public"`
+	SecretHash   string   `json:"secretHash,omitempty"`
+	CreatedAt    int64    `json:"createdAt"`
+}
+
+// AllowsRedirectURI reports whether uri is one of the registered redirect
+// URIs. They're compared exactly, as OpenID Connect requires.
+func (c *OIDCClient) AllowsRedirectURI(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecret reports whether secret is the secret of the client
+func (c *OIDCClient) CheckSecret(secret string) bool {
+	if c.Public || c.SecretHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.SecretHash), []byte(tokenID(secret))) == 1
+}
+
+// ValidateRedirectURIs makes sure each uri can be redirected to
+func ValidateRedirectURIs(uris []string) error {
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return fmt.Errorf("%s: %s", ErrInvalidRedirectURI, uri)
+		}
+	}
+	return nil
+}
+
+func (ds *DataSource) putOIDCClient(c *OIDCClient) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ds.PutRecord(oidcClientKind, c.ID, value, 0)
+}
+
+// CreateOIDCClient registers a client. It returns the client along with its
+// secret, which can't be read back later, unless the client is public.
+func (ds *DataSource) CreateOIDCClient(name string, redirectURIs []string, public bool) (*OIDCClient, string, error) {
+	err := ValidateRedirectURIs(redirectURIs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	c := &OIDCClient{
+		ID:           tokenID(id)[:16],
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Public:       public,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	var secret string
+	if !public {
+		secret, err = newToken()
+		if err != nil {
+			return nil, "", err
+		}
+		c.SecretHash = tokenID(secret)
+	}
+
+	err = ds.putOIDCClient(c)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, secret, nil
+}
+
+// UpdateOIDCClient stores the name and the redirect URIs of the client
+func (ds *DataSource) UpdateOIDCClient(c *OIDCClient) error {
+	err := ValidateRedirectURIs(c.RedirectURIs)
+	if err != nil {
+		return err
+	}
+	return ds.putOIDCClient(c)
+}
+
+// OIDCClient returns the client with the id
+func (ds *DataSource) OIDCClient(id string) (*OIDCClient, error) {
+	value, err := ds.Record(oidcClientKind, id)
+	if err != nil {
+		return nil, err
+	}
+	var c OIDCClient
+	err = json.Unmarshal(value, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// OIDCClients returns all of the registered clients
+func (ds *DataSource) OIDCClients() ([]*OIDCClient, error) {
+	records, err := ds.Records(oidcClientKind)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*OIDCClient
+	for id, value := range records {
+		var c OIDCClient
+		if err := json.Unmarshal(value, &c); err != nil {
+			logging.Log(debugTag, "Error while unmarshaling OIDC client %s: %s", id, err)
+			continue
+		}
+		clients = append(clients, &c)
+	}
+	return clients, nil
+}
+
+// DeleteOIDCClient removes the client. The tokens already given to it stay
+// valid until they expire.
+func (ds *DataSource) DeleteOIDCClient(id string) error {
+	return ds.DeleteRecord(oidcClientKind, id)
+}
+
+// OIDCAuthorization is what the user has allowed a client, on the way from
+// the authorization endpoint to the token endpoint and the userinfo endpoint
+type OIDCAuthorization struct {
+	ClientID      string   `json:"clientId"`
+	RedirectURI   string   `json:"redirectUri"`
+	Email         string   `json:"email"`
+	TokenVersion  uint64   `json:"tokenVersion"`
+	Scopes        []string `json:"scopes"`
+	Nonce         string   `json:"nonce,omitempty"`
+	CodeChallenge string   `json:"codeChallenge,omitempty"`
+	AuthTime      int64    `json:"authTime"`
+}
+
+// HasScope reports whether the client was given the scope
+func (a *OIDCAuthorization) HasScope(scope string) bool {
+	for _, s := range a.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCodeVerifier makes sure the PKCE verifier matches the challenge of
+// the authorization, if it has one. Only the S256 method is supported.
+func (a *OIDCAuthorization) CheckCodeVerifier(verifier string) bool {
+	if a.CodeChallenge == "" {
+		return verifier == ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(a.CodeChallenge)) == 1
+}
+
+// oidcUser returns the user of the authorization, if it's still active and its
+// sessions haven't been revoked since
+func (ds *DataSource) oidcUser(a *OIDCAuthorization) (*User, error) {
+	u, err := ds.UserByEmail(a.Email)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if !u.Active || u.TokenVersion != a.TokenVersion {
+		return nil, ErrInvalidToken
+	}
+	return u, nil
+}
+
+func (ds *DataSource) putOIDCAuthorization(kind string, a *OIDCAuthorization, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(kind, tokenID(token), value, ttl)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func decodeOIDCAuthorization(value []byte, err error) (*OIDCAuthorization, error) {
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	var a OIDCAuthorization
+	err = json.Unmarshal(value, &a)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CreateOIDCCode returns an authorization code, which the client can exchange
+// for the tokens once, within a minute
+func (ds *DataSource) CreateOIDCCode(a *OIDCAuthorization) (string, error) {
+	return ds.putOIDCAuthorization(oidcCodeKind, a, oidcCodeTTL)
+}
+
+// TakeOIDCCode invalidates the authorization code, and returns the
+// authorization along with its user
+func (ds *DataSource) TakeOIDCCode(code string) (*OIDCAuthorization, *User, error) {
+	a, err := decodeOIDCAuthorization(ds.TakeRecord(oidcCodeKind, tokenID(code)))
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := ds.oidcUser(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, u, nil
+}
+
+// CreateOIDCAccessToken returns an access token for the userinfo endpoint,
+// valid for OIDCAccessTokenTTL
+func (ds *DataSource) CreateOIDCAccessToken(a *OIDCAuthorization) (string, error) {
+	return ds.putOIDCAuthorization(oidcAccessTokenKind, a, OIDCAccessTokenTTL)
+}
+
+// OIDCAccessToken returns the authorization of the access token along with
+// its user
+func (ds *DataSource) OIDCAccessToken(token string) (*OIDCAuthorization, *User, error) {
+	a, err := decodeOIDCAuthorization(ds.Record(oidcAccessTokenKind, tokenID(token)))
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := ds.oidcUser(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, u, nil
+}
+
+// OIDCSubject returns the sub of the user in the ID tokens. Unlike the email,
+// it's kept when the user is renamed, so the clients don't take the renamed
+// user for a new one, nor a new user with an old address for the old one. It's
+// generated the first time it's needed.
+func (ds *DataSource) OIDCSubject(u *User) (string, error) {
+	for i := 0; i < updateRetries; i++ {
+		if u.OIDCSubject != "" {
+			return u.OIDCSubject, nil
+		}
+		subject, err := newToken()
+		if err != nil {
+			return "", err
+		}
+		stored := *u
+		stored.OIDCSubject = subject
+		err = ds.StoreUser(&stored)
+		if err == nil {
+			*u = stored
+			return subject, nil
+		} else if err != ErrConflict {
+			return "", err
+		}
+		// It may have got one in the meantime
+		u, err = ds.UserByEmail(u.Email)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", ErrConflict
+}
+
+// CreateOIDCLogin returns a token for the login form of an authorization
+// request, which is given by its parameters. The form is only accepted with
+// the token, for the same request and within OIDCLoginTTL.
+func (ds *DataSource) CreateOIDCLogin(request string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(oidcLoginKind, tokenID(token), []byte(tokenID(request)), OIDCLoginTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CheckOIDCLogin reports whether the token was created for the request, and
+// hasn't expired or been deleted
+func (ds *DataSource) CheckOIDCLogin(token, request string) bool {
+	if token == "" {
+		return false
+	}
+	value, err := ds.Record(oidcLoginKind, tokenID(token))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(value, []byte(tokenID(request))) == 1
+}
+
+// DeleteOIDCLogin invalidates the token of a login form
+func (ds *DataSource) DeleteOIDCLogin(token string) error {
+	err := ds.DeleteRecord(oidcLoginKind, tokenID(token))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package datasource
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passwords are stored in the PHC string format
+// (https://github.com/P-H-C/phc-string-format), e.g.
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// with a random salt per password. Passwords set by older versions of bahram
+// are a bare base64 scrypt hash, salted with the global PASSWORD_SALT; they
+// are still accepted, and are rehashed on the next successful login.
+
+const (
+	PasswordSchemeArgon2id = "argon2id"
+	PasswordSchemeScrypt   = "scrypt"
+
+	DefaultPasswordScheme = PasswordSchemeArgon2id
+
+	passwordSaltLen = 16
+	passwordHashLen = 32
+)
+
+// The parameters used for new hashes. Hashes with other parameters are
+// verified with their own, and rehashed.
+var passwordParams = map[string][]passwordParam{
+	PasswordSchemeArgon2id: {{"m", 19456}, {"t", 2}, {"p", 1}},
+	PasswordSchemeScrypt:   {{"ln", 15}, {"r", 8}, {"p", 1}},
+}
+
+type passwordParam struct {
+	name  string
+	value int
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+type passwordHash struct {
+	scheme  string
+	version int
+	params  map[string]int
+	salt    []byte
+	hash    []byte
+}
+
+func computePasswordHash(scheme string, version int, params map[string]int, plainPassword string, salt []byte) ([]byte, error) {
+	switch scheme {
+	case PasswordSchemeArgon2id:
+		if version != argon2.Version {
+			return nil, fmt.Errorf("Unsupported argon2id version %d", version)
+		}
+		if params["m"] < 1 || params["t"] < 1 || params["p"] < 1 || params["p"] > 255 {
+			return nil, fmt.Errorf("Invalid argon2id parameters %v", params)
+		}
+		return argon2.IDKey([]byte(plainPassword), salt,
+			uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), passwordHashLen), nil
+	case PasswordSchemeScrypt:
+		if params["ln"] < 1 || params["ln"] > 30 {
+			return nil, fmt.Errorf("Invalid scrypt parameters %v", params)
+		}
+		return scrypt.Key([]byte(plainPassword), salt,
+			1<<uint(params["ln"]), params["r"], params["p"], passwordHashLen)
+	default:
+		return nil, fmt.Errorf("Unknown password scheme %q", scheme)
+	}
+}
+
+// hashPassword returns the PHC string of plainPassword, hashed with scheme
+// and a new random salt
+func hashPassword(plainPassword string, scheme string) (string, error) {
+	defaults, found := passwordParams[scheme]
+	if !found {
+		return "", fmt.Errorf("Unknown password scheme %q", scheme)
+	}
+
+	h := passwordHash{
+		scheme: scheme,
+		params: make(map[string]int),
+		salt:   make([]byte, passwordSaltLen),
+	}
+	if scheme == PasswordSchemeArgon2id {
+		h.version = argon2.Version
+	}
+	for _, p := range defaults {
+		h.params[p.name] = p.value
+	}
+	if _, err := rand.Read(h.salt); err != nil {
+		return "", err
+	}
+
+	var err error
+	h.hash, err = computePasswordHash(h.scheme, h.version, h.params, plainPassword, h.salt)
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+func (h *passwordHash) String() string {
+	var params []string
+	for _, p := range passwordParams[h.scheme] {
+		params = append(params, fmt.Sprintf("%s=%d", p.name, h.params[p.name]))
+	}
+
+	parts := []string{"", h.scheme}
+	if h.version != 0 {
+		parts = append(parts, fmt.Sprintf("v=%d", h.version))
+	}
+	parts = append(parts,
+		strings.Join(params, ","),
+		phcEncoding.EncodeToString(h.salt),
+		phcEncoding.EncodeToString(h.hash))
+	return strings.Join(parts, "$")
+}
+
+func parsePasswordHash(encoded string) (*passwordHash, error) {
+	// "", scheme, [version,] params, salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil, fmt.Errorf("Malformed password hash")
+	}
+
+	h := &passwordHash{
+		scheme: parts[1],
+		params: make(map[string]int),
+	}
+	if _, found := passwordParams[h.scheme]; !found {
+		return nil, fmt.Errorf("Unknown password scheme %q", h.scheme)
+	}
+
+	rest := parts[2:]
+	if len(parts) == 6 {
+		if !strings.HasPrefix(rest[0], "v=") {
+			return nil, fmt.Errorf("Malformed password hash version")
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(rest[0], "v="))
+		if err != nil {
+			return nil, fmt.Errorf("Malformed password hash version: %s", err)
+		}
+		h.version = v
+		rest = rest[1:]
+	}
+
+	for _, param := range strings.Split(rest[0], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Malformed password hash parameter %q", param)
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed password hash parameter %q", param)
+		}
+		h.params[kv[0]] = value
+	}
+
+	var err error
+	if h.salt, err = phcEncoding.DecodeString(rest[1]); err != nil {
+		return nil, fmt.Errorf("Malformed password hash salt: %s", err)
+	}
+	if h.hash, err = phcEncoding.DecodeString(rest[2]); err != nil {
+		return nil, fmt.Errorf("Malformed password hash: %s", err)
+	}
+	return h, nil
+}
+
+// verify reports whether plainPassword matches the hash
+func (h *passwordHash) verify(plainPassword string) (bool, error) {
+	computed, err := computePasswordHash(h.scheme, h.version, h.params, plainPassword, h.salt)
+	if err != nil {
+		return false, err
+	}
+	return equalHashes(h.hash, computed), nil
+}
+
+// outdated reports whether the hash should be recomputed to use scheme with
+// its current parameters
+func (h *passwordHash) outdated(scheme string) bool {
+	if h.scheme != scheme || len(h.salt) < passwordSaltLen {
+		return true
+	}
+	for _, p := range passwordParams[scheme] {
+		if h.params[p.name] != p.value {
+			return true
+		}
+	}
+	return false
+}
+
+func isLegacyPasswordHash(encoded string) bool {
+	return !strings.HasPrefix(encoded, "$")
+}
+
+// legacyPasswordHash is the hash used by older versions of bahram: scrypt
+// with a global salt, encoded in base64
+func legacyPasswordHash(plainPassword string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(plainPassword), salt, 16384, 8, 1, 32)
+}
+
+// equalHashes compares the hashes in constant time, so the time it takes
+// doesn't tell how much of a guess was right
+func equalHashes(a, b []byte) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,160 @@
+package datasource
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePasswordHash(t *testing.T) {
+	valid := []string{
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g",
+		"$scrypt$ln=15,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g",
+	}
+	for _, encoded := range valid {
+		h, err := parsePasswordHash(encoded)
+		if err != nil {
+			t.Errorf("%s: %s", encoded, err)
+			continue
+		}
+		if got := h.String(); got != encoded {
+			t.Errorf("%s: encoded again as %s", encoded, got)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"c2FsdA",
+		"$md5$x=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdA",
+		"$argon2id$x=19$m=19456,t=2,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=a$m=19456,t=2,p=1$c2FsdA$aGFzaA",
+		"$scrypt$ln=15,r$c2FsdA$aGFzaA",
+		"$scrypt$ln=a,r=8,p=1$c2FsdA$aGFzaA",
+		"$scrypt$ln=15,r=8,p=1$c2F*dA$aGFzaA",
+		"$scrypt$ln=15,r=8,p=1$c2FsdA$aGFz*A",
+	}
+	for _, encoded := range invalid {
+		if _, err := parsePasswordHash(encoded); err == nil {
+			t.Errorf("%q: parsed, want an error", encoded)
+		}
+	}
+}
+
+func TestPasswordSchemes(t *testing.T) {
+	for _, scheme := range []string{PasswordSchemeArgon2id, PasswordSchemeScrypt} {
+		u := &User{Email: "a@example.com"}
+		if err := u.SetPassword("secret password", scheme); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(u.Password, "$"+scheme+"$") {
+			t.Errorf("%s: got hash %s", scheme, u.Password)
+		}
+		if !u.AcceptsPassword("secret password", nil) {
+			t.Errorf("%s: the password isn't accepted", scheme)
+		}
+		if u.AcceptsPassword("secret passwore", nil) {
+			t.Errorf("%s: a wrong password is accepted", scheme)
+		}
+		if u.PasswordNeedsRehash(scheme) {
+			t.Errorf("%s: a new hash needs a rehash", scheme)
+		}
+
+		// Salted per password
+		other := &User{Email: "b@example.com"}
+		if err := other.SetPassword("secret password", scheme); err != nil {
+			t.Fatal(err)
+		}
+		if other.Password == u.Password {
+			t.Errorf("%s: the same password got the same hash", scheme)
+		}
+	}
+	if err := (&User{}).SetPassword("secret password", "md5"); err == nil {
+		t.Error("hashed with an unknown scheme")
+	}
+}
+
+func TestPasswordsWithOtherParameters(t *testing.T) {
+	h := &passwordHash{
+		scheme:  PasswordSchemeArgon2id,
+		version: 19,
+		params:  map[string]int{"m": 64, "t": 1, "p": 1},
+		salt:    []byte("saltsaltsaltsalt"),
+	}
+	var err error
+	h.hash, err = computePasswordHash(h.scheme, h.version, h.params, "secret password", h.salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Email: "a@example.com", Password: h.String()}
+	if !u.AcceptsPassword("secret password", nil) {
+		t.Error("the password isn't accepted with its own parameters")
+	}
+	if !u.PasswordNeedsRehash(PasswordSchemeArgon2id) {
+		t.Error("the outdated parameters don't need a rehash")
+	}
+
+	tests := []struct {
+		name   string
+		encode func(h passwordHash) string
+	}{
+		{"unknown version", func(h passwordHash) string { h.version = 16; return h.String() }},
+		{"invalid parameters", func(h passwordHash) string { h.params = map[string]int{"m": 64}; return h.String() }},
+		{"short salt", func(h passwordHash) string { h.salt = h.salt[:8]; return h.String() }},
+	}
+	for _, tt := range tests {
+		u := &User{Email: "a@example.com", Password: tt.encode(*h)}
+		if u.AcceptsPassword("secret password", nil) {
+			t.Errorf("%s: the password is accepted", tt.name)
+		}
+	}
+}
+
+func TestCheckPasswordRehashes(t *testing.T) {
+	salt := []byte("the global salt")
+	os.Setenv("BAHRAM_PASSWORD_SALT", base64.StdEncoding.EncodeToString(salt))
+	defer os.Unsetenv("BAHRAM_PASSWORD_SALT")
+	legacy, err := legacyPasswordHash("secret password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &User{}
+	if err := other.SetPassword("secret password", PasswordSchemeScrypt); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+	}{
+		{"legacy", base64.StdEncoding.EncodeToString(legacy)},
+		{"other scheme", other.Password},
+	}
+	for _, tt := range tests {
+		ds := testDataSource(t, NewMemoryStore())
+		u := &User{Email: "a@example.com", Active: true, Password: tt.password}
+		if err := ds.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+
+		if ds.CheckPassword(u, "wrong") || u.Password != tt.password {
+			t.Errorf("%s: a wrong password is accepted, or has rehashed", tt.name)
+		}
+		if !ds.CheckPassword(u, "secret password") {
+			t.Errorf("%s: the password isn't accepted", tt.name)
+			continue
+		}
+		stored, err := ds.UserByEmail(u.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(stored.Password, "$"+DefaultPasswordScheme+"$") {
+			t.Errorf("%s: got %s after the login, want it rehashed", tt.name, stored.Password)
+		}
+		// Without the global salt
+		if !stored.AcceptsPassword("secret password", nil) {
+			t.Errorf("%s: the rehashed password isn't accepted", tt.name)
+		}
+	}
+}
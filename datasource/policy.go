@@ -0,0 +1,262 @@
+package datasource
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Permission is something a user needs a role for. Users don't need any
+// role to read and update their own profile, or to join and leave groups.
+type Permission string
+
+const (
+	PermReadUsers   Permission = "users:read"
+	PermCreateUsers Permission = "users:create"
+	PermUpdateUsers Permission = "users:update"
+	PermDeleteUsers Permission = "users:delete"
+	PermRenameUsers Permission = "users:rename"
+	// PermResetUserSecurity is revoking the sessions and removing the second
+	// factor of other users
+	PermResetUserSecurity Permission = "users:reset-security"
+	// PermManageRoles is setting Admin and Roles of users
+	PermManageRoles Permission = "users:manage-roles"
+
+	// PermReadGroups is seeing the groups which aren't joinable
+	PermReadGroups   Permission = "groups:read"
+	PermCreateGroups Permission = "groups:create"
+	PermUpdateGroups Permission = "groups:update"
+	PermDeleteGroups Permission = "groups:delete"
+
+	PermReadStats     Permission = "stats:read"
+	PermReadLockouts  Permission = "lockouts:read"
+	PermClearLockouts Permission = "lockouts:clear"
+
+	// PermManageAPIKeys is seeing and revoking the API keys of others
+	PermManageAPIKeys Permission = "api-keys:manage"
+
+	PermReadAudit Permission = "audit:read"
+
+	PermManageWebhooks Permission = "webhooks:manage"
+
+	// PermManageOIDCClients is registering the OpenID Connect clients
+	PermManageOIDCClients Permission = "oidc-clients:manage"
+)
+
+var allPermissions = []Permission{
+	PermReadUsers, PermCreateUsers, PermUpdateUsers, PermDeleteUsers, PermRenameUsers,
+	PermResetUserSecurity, PermManageRoles,
+	PermReadGroups, PermCreateGroups, PermUpdateGroups, PermDeleteGroups,
+	PermReadStats, PermReadLockouts, PermClearLockouts,
+	PermManageAPIKeys, PermReadAudit, PermManageWebhooks, PermManageOIDCClients,
+}
+
+const (
+	RoleSuperadmin = "superadmin"
+	RoleUserAdmin  = "user-admin"
+	RoleGroupAdmin = "group-admin"
+	RoleHelpdesk   = "helpdesk"
+	RoleAuditor    = "auditor"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleSuperadmin: nil, // everything, see Allowed
+	RoleUserAdmin: {
+		PermReadUsers, PermCreateUsers, PermUpdateUsers, PermDeleteUsers, PermRenameUsers,
+		PermResetUserSecurity, PermReadGroups, PermReadLockouts, PermClearLockouts,
+	},
+	RoleGroupAdmin: {
+		PermReadUsers, PermReadGroups, PermCreateGroups, PermUpdateGroups, PermDeleteGroups,
+	},
+	RoleHelpdesk: {
+		PermReadUsers, PermResetUserSecurity, PermReadGroups, PermReadLockouts, PermClearLockouts,
+	},
+	RoleAuditor: {
+		PermReadUsers, PermReadGroups, PermReadStats, PermReadLockouts, PermReadAudit,
+	},
+}
+
+// RoleBinding gives a role to a user. If Scope isn't empty, the role only
+// applies to the users and groups it matches: each item is either an email,
+// or a domain prefixed by "@".
+type RoleBinding struct {
+	Role  string   `json:"role"`
+	Scope []string `json:"scope,omitempty"`
+}
+
+func (b RoleBinding) covers(target string) bool {
+	if len(b.Scope) == 0 {
+		return true
+	}
+	// Unscoped actions, e.g. listing, need an unscoped role
+	if target == "" {
+		return false
+	}
+	target = strings.ToLower(target)
+	for _, item := range b.Scope {
+		item = strings.ToLower(item)
+		if strings.HasPrefix(item, "@") {
+			if strings.HasSuffix(target, item) {
+				return true
+			}
+		} else if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoles checks the roles exist
+func ValidateRoles(bindings []RoleBinding) error {
+	for _, b := range bindings {
+		if _, found := rolePermissions[b.Role]; !found {
+			return fmt.Errorf("Unknown role: %s", b.Role)
+		}
+	}
+	return nil
+}
+
+// ValidatePermissions checks the permissions exist
+func ValidatePermissions(perms []Permission) error {
+	for _, perm := range perms {
+		if !hasPermission(allPermissions, perm) {
+			return fmt.Errorf("Unknown permission: %s", perm)
+		}
+	}
+	return nil
+}
+
+func hasPermission(perms []Permission, perm Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Privileged reports whether the user has any role. Admin is the legacy form
+// of the superadmin role.
+func (u *User) Privileged() bool {
+	return u.Admin || len(u.Roles) > 0
+}
+
+// Allowed reports whether the user may do perm on target, the email of the
+// user or group it's done on. Target is empty for the actions which aren't
+// on a single user or group, like listing them.
+//
+// An API key may do what both its scopes and its owner allow.
+func Allowed(u *User, perm Permission, target string) bool {
+	if u == nil || !u.Active {
+		return false
+	}
+	if u.apiKeyOwner != nil {
+		return hasPermission(u.apiKeyScopes, perm) && Allowed(u.apiKeyOwner, perm, target)
+	}
+	return holds(u, perm, func(b RoleBinding) bool {
+		return b.covers(target)
+	})
+}
+
+// AllowedOnUser is Allowed for the actions on the target user. Privileged
+// targets also need PermManageRoles on them, so the scoped roles can't take
+// over the accounts of those above them. Users may always act on themselves
+// as far as Allowed goes.
+func AllowedOnUser(u *User, perm Permission, target *User) bool {
+	if !Allowed(u, perm, target.Email) {
+		return false
+	}
+	if !target.Privileged() || (u.apiKeyOwner == nil && u.Email == target.Email) {
+		return true
+	}
+	return Allowed(u, PermManageRoles, target.Email)
+}
+
+// canGrant reports whether the user may give the roles, and Admin if admin is
+// set: it must be allowed every permission of each role on all of its scope,
+// so no one can grant more than they have.
+func canGrant(u *User, admin bool, bindings []RoleBinding) bool {
+	if admin {
+		bindings = append([]RoleBinding{{Role: RoleSuperadmin}}, bindings...)
+	}
+	for _, b := range bindings {
+		perms := rolePermissions[b.Role]
+		if b.Role == RoleSuperadmin {
+			perms = allPermissions
+		}
+		targets := b.Scope
+		if len(targets) == 0 {
+			targets = []string{""}
+		}
+		for _, perm := range perms {
+			for _, target := range targets {
+				if !Allowed(u, perm, target) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// CanChangeRoles reports whether the user may change the Admin and Roles of
+// target (nil for a new user) to admin and roles. Every role which is added
+// or removed must be one it could grant.
+func CanChangeRoles(u *User, target *User, admin bool, roles []RoleBinding) bool {
+	var oldAdmin bool
+	var oldRoles []RoleBinding
+	if target != nil {
+		oldAdmin, oldRoles = target.Admin, target.Roles
+	}
+	changed := append(missingBindings(oldRoles, roles), missingBindings(roles, oldRoles)...)
+	return canGrant(u, admin != oldAdmin, changed)
+}
+
+// missingBindings returns the bindings of a which aren't in b
+func missingBindings(a, b []RoleBinding) []RoleBinding {
+	var missing []RoleBinding
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if reflect.DeepEqual(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, x)
+		}
+	}
+	return missing
+}
+
+// Holds reports whether any role of the user grants perm, on any target
+func Holds(u *User, perm Permission) bool {
+	if u == nil || !u.Active || u.apiKeyOwner != nil {
+		return false
+	}
+	return holds(u, perm, func(b RoleBinding) bool {
+		return true
+	})
+}
+
+func holds(u *User, perm Permission, applies func(b RoleBinding) bool) bool {
+	if u.Admin {
+		return true
+	}
+	for _, b := range u.Roles {
+		if !applies(b) {
+			continue
+		}
+		if b.Role == RoleSuperadmin || hasPermission(rolePermissions[b.Role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanManageGroup reports whether the user may modify the group, either by a
+// role or by being its manager
+func CanManageGroup(u *User, g *Group) bool {
+	return g.Manager == u.Email || Allowed(u, PermUpdateGroups, g.Email)
+}
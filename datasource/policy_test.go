@@ -0,0 +1,116 @@
+package datasource
+
+import "testing"
+
+var (
+	testAdmin      = &User{Email: "root@a.com", Active: true, Admin: true}
+	testSuperadmin = &User{Email: "super@a.com", Active: true, Roles: []RoleBinding{{Role: RoleSuperadmin}}}
+	testUserAdmin  = &User{Email: "ua@a.com", Active: true, Roles: []RoleBinding{{Role: RoleUserAdmin, Scope: []string{"@a.com"}}}}
+	testHelpdesk   = &User{Email: "help@a.com", Active: true, Roles: []RoleBinding{{Role: RoleHelpdesk}}}
+	testGroupAdmin = &User{Email: "ga@a.com", Active: true, Roles: []RoleBinding{{Role: RoleGroupAdmin}}}
+	testPlain      = &User{Email: "x@a.com", Active: true}
+	testOutsider   = &User{Email: "y@b.com", Active: true}
+	testInactive   = &User{Email: "old@a.com", Admin: true}
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		user   *User
+		perm   Permission
+		target string
+		want   bool
+	}{
+		{testAdmin, PermManageRoles, "", true},
+		{testSuperadmin, PermManageWebhooks, "", true},
+		{testInactive, PermReadUsers, "", false},
+		{nil, PermReadUsers, "", false},
+
+		{testUserAdmin, PermUpdateUsers, "x@a.com", true},
+		{testUserAdmin, PermUpdateUsers, "X@A.COM", true},
+		{testUserAdmin, PermUpdateUsers, "y@b.com", false},
+		{testUserAdmin, PermUpdateUsers, "x@sub.a.com", false},
+		// Scoped roles can't list
+		{testUserAdmin, PermReadUsers, "", false},
+		{testUserAdmin, PermManageRoles, "x@a.com", false},
+		{testUserAdmin, PermCreateGroups, "g@a.com", false},
+
+		{testHelpdesk, PermResetUserSecurity, "y@b.com", true},
+		{testHelpdesk, PermUpdateUsers, "y@b.com", false},
+		{testHelpdesk, PermReadUsers, "", true},
+
+		{testGroupAdmin, PermUpdateGroups, "g@a.com", true},
+		{testGroupAdmin, PermUpdateUsers, "x@a.com", false},
+
+		{testPlain, PermReadUsers, "", false},
+		{testPlain, PermReadGroups, "g@a.com", false},
+	}
+	for _, tt := range tests {
+		if got := Allowed(tt.user, tt.perm, tt.target); got != tt.want {
+			t.Errorf("Allowed(%v, %s, %q) = %v, want %v", tt.user, tt.perm, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedOnPrivilegedUsers(t *testing.T) {
+	tests := []struct {
+		user   *User
+		perm   Permission
+		target *User
+		want   bool
+	}{
+		{testUserAdmin, PermUpdateUsers, testPlain, true},
+		{testUserAdmin, PermUpdateUsers, testOutsider, false},
+		// The superadmins are in the scope, but above the user admin
+		{testUserAdmin, PermUpdateUsers, testSuperadmin, false},
+		{testUserAdmin, PermRenameUsers, testSuperadmin, false},
+		{testUserAdmin, PermDeleteUsers, testAdmin, false},
+		{testUserAdmin, PermResetUserSecurity, testHelpdesk, false},
+		{testHelpdesk, PermResetUserSecurity, testPlain, true},
+		{testHelpdesk, PermResetUserSecurity, testSuperadmin, false},
+		{testHelpdesk, PermResetUserSecurity, testUserAdmin, false},
+		// Themselves
+		{testUserAdmin, PermUpdateUsers, testUserAdmin, true},
+		{testHelpdesk, PermResetUserSecurity, testHelpdesk, true},
+
+		{testSuperadmin, PermUpdateUsers, testAdmin, true},
+		{testAdmin, PermDeleteUsers, testSuperadmin, true},
+	}
+	for _, tt := range tests {
+		if got := AllowedOnUser(tt.user, tt.perm, tt.target); got != tt.want {
+			t.Errorf("AllowedOnUser(%s, %s, %s) = %v, want %v", tt.user.Email, tt.perm, tt.target.Email, got, tt.want)
+		}
+	}
+}
+
+func TestCanChangeRoles(t *testing.T) {
+	scopedSuperadmin := &User{Email: "ds@a.com", Active: true, Roles: []RoleBinding{{Role: RoleSuperadmin, Scope: []string{"@a.com"}}}}
+	helpdeskA := RoleBinding{Role: RoleHelpdesk, Scope: []string{"@a.com"}}
+	helpdeskB := RoleBinding{Role: RoleHelpdesk, Scope: []string{"@b.com"}}
+
+	tests := []struct {
+		name   string
+		user   *User
+		target *User
+		admin  bool
+		roles  []RoleBinding
+		want   bool
+	}{
+		{"superadmin grants anything", testSuperadmin, nil, true, []RoleBinding{{Role: RoleSuperadmin}}, true},
+		{"admin grants admin", testAdmin, testPlain, true, nil, true},
+		{"scoped grants in its scope", scopedSuperadmin, testPlain, false, []RoleBinding{helpdeskA}, true},
+		{"scoped grants outside its scope", scopedSuperadmin, testPlain, false, []RoleBinding{helpdeskB}, false},
+		{"scoped grants unscoped", scopedSuperadmin, testPlain, false, []RoleBinding{{Role: RoleHelpdesk}}, false},
+		{"scoped grants admin", scopedSuperadmin, testPlain, true, nil, false},
+		{"scoped revokes unscoped", scopedSuperadmin, testHelpdesk, false, nil, false},
+		{"scoped keeps unscoped", scopedSuperadmin,
+			&User{Email: "h@a.com", Roles: []RoleBinding{{Role: RoleHelpdesk}}},
+			false, []RoleBinding{{Role: RoleHelpdesk}, helpdeskA}, true},
+		{"user admin grants group admin", testUserAdmin, testPlain, false, []RoleBinding{{Role: RoleGroupAdmin, Scope: []string{"@a.com"}}}, false},
+		{"nothing changes", testPlain, testPlain, false, nil, true},
+	}
+	for _, tt := range tests {
+		if got := CanChangeRoles(tt.user, tt.target, tt.admin, tt.roles); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package datasource
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the requested, or the to be
+	// deleted, user, group or record doesn't exist.
+	ErrNotFound = errors.New("Not found")
+	// ErrUserExists is returned by CreateUser and CreateGroup when a user
+	// with the same email already exists.
+	ErrUserExists = errors.New("A user with this email already exists")
+	// ErrGroupExists is returned by CreateUser and CreateGroup when a group
+	// with the same email already exists.
+	ErrGroupExists = errors.New("A group with this email already exists")
+	// ErrConflict is returned by StoreUser and StoreGroup when the stored
+	// user or group has been modified since it was loaded.
+	ErrConflict = errors.New("It has been modified by someone else, please reload and try again")
+	// ErrRecordExists is returned by CreateRecord when the record already
+	// exists and hasn't expired.
+	ErrRecordExists = errors.New("The record already exists")
+)
+
+// sweepInterval is how often the stores which remove the expired records
+// themselves do it, per kind of record
+const sweepInterval = 1 * time.Minute
+
+// Store is the storage backend behind a DataSource. Implementations must be
+// safe for concurrent use.
+//
+// Users and groups share one address space: CreateUser and CreateGroup fail
+// if the email is already taken by either a user or a group.
+//
+// Every loaded or stored user and group carries the Revision it has in the
+// store. StoreUser and StoreGroup only overwrite the stored value if it still
+// has the same revision (or if the given Revision is zero), and set the new
+// revision on success.
+type Store interface {
+	CreateUser(u *User) error
+	StoreUser(u *User) error
+	UserByEmail(emailAddress string) (*User, error)
+	Users() ([]*User, error)
+	DeleteUser(emailAddress string) error
+
+	CreateGroup(g *Group) error
+	StoreGroup(g *Group) error
+	GroupByEmail(emailAddress string) (*Group, error)
+	Groups() ([]*Group, error)
+	DeleteGroup(emailAddress string) error
+
+	// Records are opaque values grouped by kind, for the data which isn't a
+	// user or a group, e.g. tokens. A zero ttl means the record never
+	// expires; expired records are never returned.
+	PutRecord(kind, id string, value []byte, ttl time.Duration) error
+	// CreateRecord is PutRecord, unless the record exists, in which case it
+	// returns ErrRecordExists. Only one of the concurrent creators succeeds,
+	// so it can be used as a lock which expires.
+	CreateRecord(kind, id string, value []byte, ttl time.Duration) error
+	Record(kind, id string) ([]byte, error)
+	// Records returns the records of the kind, by their id
+	Records(kind string) (map[string][]byte, error)
+	// TakeRecord returns and deletes the record atomically, so a record can
+	// only be taken once.
+	TakeRecord(kind, id string) ([]byte, error)
+	DeleteRecord(kind, id string) error
+
+	// Commit makes all the writes of the batch, or none of them if one of
+	// them fails, in which case its error is returned.
+	Commit(b *Batch) error
+
+	// Logs are append-only lists of entries by kind, e.g. the audit
+	// events, kept in the order of their ids. The ids should start with the
+	// time, so the new entries go at the end.
+	AppendLog(kind, id string, value []byte) error
+	// ScanLog calls f with the entries of the log whose ids are before
+	// before (all of them if it's empty), the last first, until f returns
+	// false.
+	ScanLog(kind, before string, f func(id string, value []byte) bool) error
+	// TrimLog deletes the entries of the log whose ids are before before
+	TrimLog(kind, before string) error
+}
+
+type batchOpType int
+
+const (
+	batchCreate batchOpType = iota
+	batchStore
+	batchDelete
+)
+
+type batchOp struct {
+	op    batchOpType
+	kind  string
+	email string
+	// revision is the one the stored user or group must have, for
+	// batchStore and batchDelete; zero means any
+	revision uint64
+	user     *User
+	group    *Group
+}
+
+// Batch is a set of writes to users and groups which Store.Commit makes
+// atomically. The writes have the same checks as the Store methods of the
+// same name, and the users and groups given to the batch get their new
+// revisions once it's committed.
+type Batch struct {
+	ops []batchOp
+}
+
+func (b *Batch) CreateUser(u *User) {
+	b.ops = append(b.ops, batchOp{op: batchCreate, kind: userKind, email: u.Email, user: u})
+}
+
+func (b *Batch) StoreUser(u *User) {
+	b.ops = append(b.ops, batchOp{op: batchStore, kind: userKind, email: u.Email, revision: u.Revision, user: u})
+}
+
+// DeleteUser deletes the user, only if it still has the revision (unless it's
+// zero)
+func (b *Batch) DeleteUser(emailAddress string, revision uint64) {
+	b.ops = append(b.ops, batchOp{op: batchDelete, kind: userKind, email: emailAddress, revision: revision})
+}
+
+func (b *Batch) CreateGroup(g *Group) {
+	b.ops = append(b.ops, batchOp{op: batchCreate, kind: groupKind, email: g.Email, group: g})
+}
+
+func (b *Batch) StoreGroup(g *Group) {
+	b.ops = append(b.ops, batchOp{op: batchStore, kind: groupKind, email: g.Email, revision: g.Revision, group: g})
+}
+
+// DeleteGroup deletes the group, only if it still has the revision (unless
+// it's zero)
+func (b *Batch) DeleteGroup(emailAddress string, revision uint64) {
+	b.ops = append(b.ops, batchOp{op: batchDelete, kind: groupKind, email: emailAddress, revision: revision})
+}
+
+// values returns the JSON form of the user or group written by each op, nil
+// for the deletes
+func (b *Batch) values() ([][]byte, error) {
+	values := make([][]byte, len(b.ops))
+	for i, op := range b.ops {
+		var err error
+		switch {
+		case op.user != nil:
+			values[i], err = json.Marshal(op.user)
+		case op.group != nil:
+			values[i], err = json.Marshal(op.group)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// setRevisions is called once the batch is committed, with the new revision
+// of each op
+func (b *Batch) setRevisions(revisions []uint64) {
+	for i, op := range b.ops {
+		switch {
+		case op.user != nil:
+			op.user.Revision = revisions[i]
+		case op.group != nil:
+			op.group.Revision = revisions[i]
+		}
+	}
+}
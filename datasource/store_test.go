@@ -0,0 +1,192 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testStores calls f with each of the Store implementations which don't need
+// a server
+func testStores(t *testing.T, f func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bahram-bolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewBoltStore(filepath.Join(dir, "bahram.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		f(t, s)
+	})
+}
+
+func testDataSource(t *testing.T, s Store) *DataSource {
+	ds, err := NewDataSource(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestCommitIsAtomic(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		a := &User{Email: "a@example.com"}
+		if err := s.CreateUser(a); err != nil {
+			t.Fatal(err)
+		}
+		stale := *a
+		a.Active = true
+		if err := s.StoreUser(a); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name  string
+			batch func(b *Batch)
+			err   error
+		}{
+			{"existing user", func(b *Batch) {
+				b.CreateUser(&User{Email: "b@example.com"})
+				b.CreateUser(&User{Email: "a@example.com"})
+			}, ErrUserExists},
+			{"existing group", func(b *Batch) {
+				b.CreateUser(&User{Email: "b@example.com"})
+				b.CreateGroup(&Group{Email: "a@example.com"})
+			}, ErrUserExists},
+			{"stale store", func(b *Batch) {
+				b.CreateUser(&User{Email: "b@example.com"})
+				b.StoreUser(&stale)
+			}, ErrConflict},
+			{"stale delete", func(b *Batch) {
+				b.CreateUser(&User{Email: "b@example.com"})
+				b.DeleteUser(stale.Email, stale.Revision)
+			}, ErrConflict},
+			{"missing delete", func(b *Batch) {
+				b.CreateUser(&User{Email: "b@example.com"})
+				b.DeleteGroup("c@example.com", 0)
+			}, ErrNotFound},
+		}
+		for _, tt := range tests {
+			var b Batch
+			tt.batch(&b)
+			if err := s.Commit(&b); err != tt.err {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			}
+			if _, err := s.UserByEmail("b@example.com"); err != ErrNotFound {
+				t.Errorf("%s: the failed batch has created b@example.com", tt.name)
+			}
+			if u, err := s.UserByEmail(a.Email); err != nil || u.Revision != a.Revision {
+				t.Errorf("%s: the failed batch has modified a@example.com", tt.name)
+			}
+		}
+
+		var b Batch
+		c := &User{Email: "c@example.com"}
+		b.CreateUser(c)
+		b.DeleteUser(a.Email, a.Revision)
+		if err := s.Commit(&b); err != nil {
+			t.Fatal(err)
+		}
+		if c.Revision == 0 {
+			t.Error("the committed user has no revision")
+		}
+		if _, err := s.UserByEmail(a.Email); err != ErrNotFound {
+			t.Errorf("a@example.com hasn't been deleted: %v", err)
+		}
+	})
+}
+
+func TestRenameAndDeleteUserUpdateGroups(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ds := testDataSource(t, s)
+		for _, email := range []string{"a@example.com", "b@example.com"} {
+			if err := ds.CreateUser(&User{Email: email}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groups := []*Group{
+			{Email: "g1@example.com", Manager: "a@example.com", Members: []string{"b@example.com", "a@example.com"}},
+			{Email: "g2@example.com", Manager: "b@example.com", Members: []string{"b@example.com"}, CCs: []string{"a@example.com"}},
+		}
+		for _, g := range groups {
+			if err := ds.CreateGroup(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := ds.RenameUser("a@example.com", "b@example.com", nil); err != ErrUserExists {
+			t.Errorf("renaming to a taken address: got %v, want %v", err, ErrUserExists)
+		}
+		if _, err := ds.RenameUser("a@example.com", "c@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.DeleteUser("b@example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]*Group{
+			"g1@example.com": {Manager: "c@example.com", Members: []string{"c@example.com"}},
+			"g2@example.com": {Manager: "", Members: []string{}, CCs: []string{"c@example.com"}},
+		}
+		for email, w := range want {
+			g, err := ds.GroupByEmail(email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.Manager != w.Manager || len(g.Members) != len(w.Members) ||
+				(len(w.Members) > 0 && !reflect.DeepEqual(g.Members, w.Members)) ||
+				(len(w.CCs) > 0 && !reflect.DeepEqual(g.CCs, w.CCs)) {
+				t.Errorf("%s: got manager %q, members %v and ccs %v; want %q, %v and %v",
+					email, g.Manager, g.Members, g.CCs, w.Manager, w.Members, w.CCs)
+			}
+		}
+		if _, err := ds.UserByEmail("a@example.com"); err != ErrNotFound {
+			t.Errorf("the old address still exists: %v", err)
+		}
+	})
+}
+
+func TestUpdateUserRetriesOnConflicts(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ds := testDataSource(t, s)
+		if err := ds.CreateUser(&User{Email: "a@example.com", Active: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		calls := 0
+		u, err := ds.UpdateUser("a@example.com", func(u *User) error {
+			calls++
+			if calls == 1 {
+				// Deactivated meanwhile
+				other, err := ds.UserByEmail(u.Email)
+				if err != nil {
+					return err
+				}
+				other.Active = false
+				if err := ds.StoreUser(other); err != nil {
+					return err
+				}
+			}
+			u.EnFirstName = "A"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 || u.Active || u.EnFirstName != "A" {
+			t.Errorf("got %+v after %d calls, want the deactivation kept", u, calls)
+		}
+		if stored, err := ds.UserByEmail(u.Email); err != nil || stored.Active || stored.EnFirstName != "A" {
+			t.Errorf("stored %+v, %v; want both changes", stored, err)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package datasource
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	passwordResetKind = "password-resets"
+	passwordResetTTL  = 1 * time.Hour
+
+	mfaChallengeKind = "mfa-challenges"
+	mfaChallengeTTL  = 5 * time.Minute
+
+	refreshTokenKind = "refresh-tokens"
+	// RefreshTokenTTL is how long a session lasts without being refreshed
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// ErrInvalidToken is returned when a token doesn't exist, has expired or has
+// already been used.
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// ErrInvalidCode is returned when a second factor code isn't accepted
+var ErrInvalidCode = errors.New("Invalid code")
+
+// newToken returns a random token, safe to be put in URLs
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenID is the id under which a token is kept in the Store. Only the hash
+// is stored, so the tokens can't be read back from the Store.
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePasswordResetToken returns a new token which can be used once, within
+// an hour, to set the password of the user.
+func (ds *DataSource) CreatePasswordResetToken(emailAddress string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(passwordResetKind, tokenID(token), []byte(emailAddress), passwordResetTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// TakePasswordResetToken returns the email of the user the token was created
+// for, and invalidates the token.
+func (ds *DataSource) TakePasswordResetToken(token string) (string, error) {
+	emailAddress, err := ds.TakeRecord(passwordResetKind, tokenID(token))
+	if err == ErrNotFound {
+		return "", ErrInvalidToken
+	} else if err != nil {
+		return "", err
+	}
+	return string(emailAddress), nil
+}
+
+// DeletePasswordResetTokens invalidates all the password reset tokens of the
+// user, once it has a new password
+func (ds *DataSource) DeletePasswordResetTokens(emailAddress string) error {
+	records, err := ds.Records(passwordResetKind)
+	if err != nil {
+		return err
+	}
+	for id, value := range records {
+		if string(value) != emailAddress {
+			continue
+		}
+		if err := ds.DeleteRecord(passwordResetKind, id); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+type refreshToken struct {
+	Email        string `json:"email"`
+	TokenVersion uint64 `json:"tokenVersion"`
+}
+
+// CreateRefreshToken returns a new refresh token for the user. It's valid for
+// RefreshTokenTTL, until it's used, or until the sessions of the user are
+// revoked.
+func (ds *DataSource) CreateRefreshToken(u *User) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(refreshToken{Email: u.Email, TokenVersion: u.TokenVersion})
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(refreshTokenKind, tokenID(token), value, RefreshTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// TakeRefreshToken invalidates the refresh token, and returns the user it was
+// created for if the user is still active and its sessions haven't been
+// revoked since.
+func (ds *DataSource) TakeRefreshToken(token string) (*User, error) {
+	value, err := ds.TakeRecord(refreshTokenKind, tokenID(token))
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rt refreshToken
+	err = json.Unmarshal(value, &rt)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := ds.UserByEmail(rt.Email)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if !u.Active || u.TokenVersion != rt.TokenVersion {
+		return nil, ErrInvalidToken
+	}
+	return u, nil
+}
+
+// RevokeRefreshToken invalidates the refresh token
+func (ds *DataSource) RevokeRefreshToken(token string) error {
+	err := ds.DeleteRecord(refreshTokenKind, tokenID(token))
+	if err == ErrNotFound {
+		return ErrInvalidToken
+	}
+	return err
+}
+
+// deleteUserTokens invalidates the refresh tokens, the password reset tokens
+// and the OpenID Connect codes and access tokens of the user, once it's
+// deleted or renamed, so they aren't taken for a later user with the address
+func (ds *DataSource) deleteUserTokens(emailAddress string) error {
+	for _, kind := range []string{refreshTokenKind, oidcCodeKind, oidcAccessTokenKind} {
+		records, err := ds.Records(kind)
+		if err != nil {
+			return err
+		}
+		for id, value := range records {
+			var owner struct {
+				Email string `json:"email"`
+			}
+			if json.Unmarshal(value, &owner) != nil || owner.Email != emailAddress {
+				continue
+			}
+			if err := ds.DeleteRecord(kind, id); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+	}
+	return ds.DeletePasswordResetTokens(emailAddress)
+}
+
+// CreateMFAChallenge returns a token which proves the password of the user has
+// been checked, to be exchanged with the second factor
+func (ds *DataSource) CreateMFAChallenge(emailAddress string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(mfaChallengeKind, tokenID(token), []byte(emailAddress), mfaChallengeTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// MFAChallenge returns the email of the user the challenge was created for.
+// The challenge stays valid until it's deleted or expires, so wrong codes
+// can be retried.
+func (ds *DataSource) MFAChallenge(token string) (string, error) {
+	emailAddress, err := ds.Record(mfaChallengeKind, tokenID(token))
+	if err == ErrNotFound {
+		return "", ErrInvalidToken
+	} else if err != nil {
+		return "", err
+	}
+	return string(emailAddress), nil
+}
+
+// DeleteMFAChallenge invalidates the challenge
+func (ds *DataSource) DeleteMFAChallenge(token string) error {
+	err := ds.DeleteRecord(mfaChallengeKind, tokenID(token))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package datasource
+
+import "testing"
+
+func TestDeletePasswordResetTokens(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+
+	var tokens []string
+	for _, email := range []string{"a@example.com", "a@example.com", "b@example.com"} {
+		token, err := ds.CreatePasswordResetToken(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := ds.DeletePasswordResetTokens("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []error{ErrInvalidToken, ErrInvalidToken, nil} {
+		if _, err := ds.TakePasswordResetToken(tokens[i]); err != want {
+			t.Errorf("token %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestTokensOfDeletedUsers(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	u := &User{Email: "a@example.com", Active: true}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := ds.CreateRefreshToken(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := ds.CreateOIDCAccessToken(&OIDCAuthorization{Email: u.Email, TokenVersion: u.TokenVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A copy, to put them back after the delete
+	stale := map[string][]byte{}
+	records, err := ds.Records(refreshTokenKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, value := range records {
+		stale[id] = value
+	}
+
+	if err := ds.DeleteUser(u.Email); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := ds.Records(refreshTokenKind); err != nil || len(records) != 0 {
+		t.Errorf("got refresh tokens %v, %v after the delete; want none", records, err)
+	}
+	if records, err := ds.Records(oidcAccessTokenKind); err != nil || len(records) != 0 {
+		t.Errorf("got access tokens %v, %v after the delete; want none", records, err)
+	}
+
+	// The new user with the address doesn't accept the tokens of the old one,
+	// even if they're left behind
+	for id, value := range stale {
+		if err := ds.PutRecord(refreshTokenKind, id, value, RefreshTokenTTL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again := &User{Email: u.Email, Active: true, TokenVersion: u.TokenVersion}
+	if err := ds.CreateUser(again); err != nil {
+		t.Fatal(err)
+	}
+	if again.TokenVersion == u.TokenVersion {
+		t.Fatal("the new user has the TokenVersion of the old one")
+	}
+	if _, err := ds.TakeRefreshToken(refresh); err != ErrInvalidToken {
+		t.Errorf("taking a refresh token of the old user: got %v, want %v", err, ErrInvalidToken)
+	}
+	if _, _, err := ds.OIDCAccessToken(access); err != ErrInvalidToken {
+		t.Errorf("an access token of the old user: got %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestRenameDeletesTokens(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	u := &User{Email: "a@example.com", Active: true}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := ds.CreateRefreshToken(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset, err := ds.CreatePasswordResetToken(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.RenameUser(u.Email, "b@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(&User{Email: "a@example.com", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.TakeRefreshToken(refresh); err != ErrInvalidToken {
+		t.Errorf("taking a refresh token of the old address: got %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := ds.TakePasswordResetToken(reset); err != ErrInvalidToken {
+		t.Errorf("taking a password reset token of the old address: got %v, want %v", err, ErrInvalidToken)
+	}
+}
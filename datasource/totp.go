@@ -0,0 +1,196 @@
+package datasource
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) with the parameters every authenticator app supports:
+// HMAC-SHA1, 6 digits and 30 second steps
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSecretSize = 20
+	// totpSkew is how many steps before and after the current one are
+	// accepted, for the clocks which aren't in sync
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	totpEnrolmentKind = "totp-enrolments"
+	totpEnrolmentTTL  = 10 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp is the HOTP value (RFC 4226) of the secret for the counter
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// validateTOTP returns the counter of the step the code belongs to, if it's
+// valid for the secret at now
+func validateTOTP(encodedSecret, code string, now time.Time) (uint64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPProvisioningURI is the otpauth URI of the secret, which is shown to the
+// user as a QR code to be scanned by the authenticator app
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// CheckTOTP reports whether code is the current TOTP code of the user. Each
+// code is only accepted once; the step of the accepted code is kept in the
+// user, which must be stored afterwards.
+func (u *User) CheckTOTP(code string) bool {
+	if !u.TOTPEnabled {
+		return false
+	}
+	counter, ok := validateTOTP(u.TOTPSecret, code, time.Now())
+	if !ok || counter <= u.TOTPLastCounter {
+		return false
+	}
+	u.TOTPLastCounter = counter
+	return true
+}
+
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user, and returns the
+// new ones. Only their hashes are kept in the user.
+func (u *User) NewRecoveryCodes() ([]string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	u.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// UseRecoveryCode reports whether code is one of the recovery codes of the
+// user, and removes it if so. The user must be stored afterwards.
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := recoveryCodeHash(code)
+	for i, h := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecondFactor accepts either a TOTP code or a recovery code. The user
+// must be stored afterwards.
+func (u *User) CheckSecondFactor(code string) bool {
+	return u.CheckTOTP(code) || u.UseRecoveryCode(code)
+}
+
+// DisableTOTP removes the second factor of the user. It doesn't store the
+// user.
+func (u *User) DisableTOTP() {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastCounter = 0
+	u.RecoveryCodes = nil
+}
+
+// BeginTOTPEnrolment returns a new secret for the user, which is enabled by
+// FinishTOTPEnrolment once the user proves to have it in an authenticator.
+func (ds *DataSource) BeginTOTPEnrolment(u *User) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	err = ds.PutRecord(totpEnrolmentKind, u.Email, []byte(secret), totpEnrolmentTTL)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// FinishTOTPEnrolment enables the secret given by BeginTOTPEnrolment if code
+// is valid for it, and returns the new recovery codes of the user. It doesn't
+// store the user.
+func (ds *DataSource) FinishTOTPEnrolment(u *User, code string) ([]string, error) {
+	secret, err := ds.Record(totpEnrolmentKind, u.Email)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	counter, ok := validateTOTP(string(secret), code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, err := u.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.TOTPEnabled = true
+	u.TOTPSecret = string(secret)
+	u.TOTPLastCounter = counter
+
+	if err := ds.DeleteRecord(totpEnrolmentKind, u.Email); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return codes, nil
+}
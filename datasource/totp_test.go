@@ -0,0 +1,169 @@
+package datasource
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	secret := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp(secret, uint64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1500000000, 0)
+	current := uint64(now.Unix()) / totpPeriod
+
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"current", hotp(raw, current), true},
+		{"previous", hotp(raw, current-1), true},
+		{"next", hotp(raw, current+1), true},
+		{"too old", hotp(raw, current-2), false},
+		{"too new", hotp(raw, current+2), false},
+		{"short", hotp(raw, current)[1:], false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		counter, valid := validateTOTP(secret, tt.code, now)
+		if valid != tt.valid {
+			t.Errorf("%s: got %v, want %v", tt.name, valid, tt.valid)
+		}
+		if valid && hotp(raw, counter) != tt.code {
+			t.Errorf("%s: got the counter %d of another code", tt.name, counter)
+		}
+	}
+	if _, valid := validateTOTP("not base32!", hotp(raw, current), now); valid {
+		t.Error("accepted a code of an invalid secret")
+	}
+}
+
+func TestCheckTOTPRejectsReplays(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := totpEncoding.DecodeString(secret)
+	current := uint64(time.Now().Unix()) / totpPeriod
+	u := &User{Email: "a@example.com", TOTPSecret: secret}
+
+	if u.CheckTOTP(hotp(raw, current)) {
+		t.Error("accepted a code before TOTP is enabled")
+	}
+	u.TOTPEnabled = true
+	if !u.CheckTOTP(hotp(raw, current)) {
+		t.Fatal("the current code isn't accepted")
+	}
+	if u.CheckTOTP(hotp(raw, current)) {
+		t.Error("the current code is accepted twice")
+	}
+	if u.CheckTOTP(hotp(raw, current-1)) {
+		t.Error("the code of an earlier step is accepted after the current one")
+	}
+	if !u.CheckTOTP(hotp(raw, current+1)) {
+		t.Error("the code of the next step isn't accepted")
+	}
+	if u.TOTPLastCounter != current+1 {
+		t.Errorf("got the last counter %d, want %d", u.TOTPLastCounter, current+1)
+	}
+}
+
+func TestRecoveryCodesAreUsedOnce(t *testing.T) {
+	u := &User{Email: "a@example.com", TOTPEnabled: true}
+	codes, err := u.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(u.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(u.RecoveryCodes), recoveryCodeCount)
+	}
+	for _, code := range u.RecoveryCodes {
+		for _, plain := range codes {
+			if strings.Contains(code, plain) {
+				t.Fatal("a recovery code is kept in plain")
+			}
+		}
+	}
+
+	if !u.CheckSecondFactor(codes[0]) {
+		t.Error("a recovery code isn't accepted")
+	}
+	if u.CheckSecondFactor(codes[0]) {
+		t.Error("a recovery code is accepted twice")
+	}
+	// Case, dashes and spaces don't matter
+	if !u.UseRecoveryCode(" " + strings.ToUpper(strings.Replace(codes[1], "-", "", -1)) + " ") {
+		t.Error("a recovery code as typed differently isn't accepted")
+	}
+	if u.UseRecoveryCode("wrong-codes") {
+		t.Error("a wrong recovery code is accepted")
+	}
+	if len(u.RecoveryCodes) != recoveryCodeCount-2 {
+		t.Errorf("got %d codes left, want %d", len(u.RecoveryCodes), recoveryCodeCount-2)
+	}
+
+	// New codes replace the old ones
+	if _, err := u.NewRecoveryCodes(); err != nil {
+		t.Fatal(err)
+	}
+	if u.UseRecoveryCode(codes[2]) {
+		t.Error("an old recovery code is accepted")
+	}
+}
+
+func TestTOTPEnrolment(t *testing.T) {
+	ds := testDataSource(t, NewMemoryStore())
+	u := &User{Email: "a@example.com", Active: true}
+
+	if _, err := ds.FinishTOTPEnrolment(u, "123456"); err != ErrInvalidToken {
+		t.Errorf("finishing without beginning: got %v, want %v", err, ErrInvalidToken)
+	}
+	secret, err := ds.BeginTOTPEnrolment(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := totpEncoding.DecodeString(secret)
+	code := hotp(raw, uint64(time.Now().Unix())/totpPeriod)
+	wrong := hotp(raw, uint64(time.Now().Unix())/totpPeriod+5)
+
+	if _, err := ds.FinishTOTPEnrolment(u, wrong); err != ErrInvalidCode {
+		t.Errorf("finishing with a wrong code: got %v, want %v", err, ErrInvalidCode)
+	}
+	if u.TOTPEnabled {
+		t.Fatal("enabled by a wrong code")
+	}
+	codes, err := ds.FinishTOTPEnrolment(u, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.TOTPEnabled || u.TOTPSecret != secret || len(codes) != recoveryCodeCount {
+		t.Errorf("got enabled %v with %d recovery codes, want the secret enabled", u.TOTPEnabled, len(codes))
+	}
+	// The code which enrolled can't log in
+	if u.CheckTOTP(code) {
+		t.Error("the enrolment code is accepted again")
+	}
+	if _, err := ds.FinishTOTPEnrolment(u, code); err != ErrInvalidToken {
+		t.Errorf("finishing twice: got %v, want %v", err, ErrInvalidToken)
+	}
+
+	u.DisableTOTP()
+	if u.TOTPEnabled || u.TOTPSecret != "" || u.CheckSecondFactor(codes[0]) {
+		t.Error("the second factor is still accepted after it's disabled")
+	}
+}
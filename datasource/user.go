@@ -1,11 +1,12 @@
 package datasource
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 
 	"github.com/cafebazaar/blacksmith/logging"
-	"golang.org/x/crypto/scrypt"
 )
 
 type User struct {
@@ -24,7 +25,33 @@ type User struct {
 	BirthDate     uint64 `json:"birthDate"`
 	EnrolmentDate uint64 `json:"enrolmentDate"`
 	LeavingDate   uint64 `json:"leavingDate"`
+	// TokenVersion is put in the issued tokens; increasing it revokes them
+	TokenVersion uint64 `json:"tokenVersion"`
+
+	// Two-factor authentication, see totp.go
+	TOTPEnabled     bool     `json:"totpEnabled"`
+	TOTPSecret      string   `json:"totpSecret"`
+	TOTPLastCounter uint64   `json:"totpLastCounter"`
+	RecoveryCodes   []string `json:"recoveryCodes"`
+
+	// Roles are checked by Allowed, in addition to Admin
+	Roles []RoleBinding `json:"roles"`
+
+	// AppPasswords are only accepted by SMTP AUTH and LDAP bind
+	AppPasswords []AppPassword `json:"appPasswords"`
+
+	// ExternalID is the id of the user in the SCIM client which provisions it
+	ExternalID string `json:"externalId,omitempty"`
+	// OIDCSubject is the sub of the user in the ID tokens, see OIDCSubject
+	OIDCSubject string `json:"oidcSubject,omitempty"`
 	// Links         []string `json:"birthDate"`
+
+	// Revision is set by the Store, see Store
+	Revision uint64 `json:"-"`
+
+	// Set on the users standing for API keys, see APIKeyPrincipal
+	apiKeyOwner  *User
+	apiKeyScopes []Permission
 }
 
 func userFromNodeValue(value string) (*User, error) {
@@ -33,49 +60,99 @@ func userFromNodeValue(value string) (*User, error) {
 	return &u, err
 }
 
-func (u *User) HasPassword() bool {
-	return u.Password != ""
+// Sanitized returns a copy of the user without the password hash and the
+// second factor secrets, to be shown to the clients
+func (u *User) Sanitized() *User {
+	sanitized := *u
+	sanitized.Password = ""
+	sanitized.TOTPSecret = ""
+	sanitized.TOTPLastCounter = 0
+	sanitized.RecoveryCodes = nil
+	sanitized.AppPasswords = nil
+	for _, ap := range u.AppPasswords {
+		ap.Hash = ""
+		sanitized.AppPasswords = append(sanitized.AppPasswords, ap)
+	}
+	return &sanitized
 }
 
-func (u *User) encodePassword(plainPassword string, salt []byte) ([]byte, error) {
-	// TODO can we encode random salt into encoded password
-	password, err := scrypt.Key([]byte(plainPassword), salt, 16384, 8, 1, 32)
-	if err != nil {
-		return nil, err
+// RevokeSessions makes the access and refresh tokens issued for the user so
+// far invalid. It doesn't store the user.
+func (u *User) RevokeSessions() {
+	u.TokenVersion++
+}
+
+// newTokenVersion gives the user a random TokenVersion, so the tokens of an
+// earlier user with the same address aren't valid for it. It's below 2^52,
+// as the version is a number in the JWTs.
+func (u *User) newTokenVersion() error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
 	}
-	return password, nil
+	u.TokenVersion = binary.BigEndian.Uint64(b[:]) >> 12
+	return nil
 }
 
-func (u *User) AcceptsPassword(plainPassword string, salt []byte) bool {
-	encodedInputPassword, err := u.encodePassword(plainPassword, salt)
-	if err != nil {
-		logging.Debug(debugTag, "Error while encodePassword: %s", err)
+func (u *User) HasPassword() bool {
+	return u.Password != ""
+}
+
+// AcceptsPassword reports whether plainPassword is the password of the user.
+// legacySalt is the global salt of the passwords set by older versions.
+func (u *User) AcceptsPassword(plainPassword string, legacySalt []byte) bool {
+	if !u.HasPassword() {
 		return false
 	}
 
-	userPassword, err := base64.StdEncoding.DecodeString(u.Password)
-	if err != nil {
-		return false
+	if isLegacyPasswordHash(u.Password) {
+		encodedInputPassword, err := legacyPasswordHash(plainPassword, legacySalt)
+		if err != nil {
+			logging.Debug(debugTag, "Error while legacyPasswordHash: %s", err)
+			return false
+		}
+		userPassword, err := base64.StdEncoding.DecodeString(u.Password)
+		if err != nil {
+			return false
+		}
+		return equalHashes(userPassword, encodedInputPassword)
 	}
-	if userPassword == nil || encodedInputPassword == nil {
+
+	h, err := parsePasswordHash(u.Password)
+	if err != nil {
+		logging.Log(debugTag, "Error while parsing the password hash of %s: %s", u.Email, err)
 		return false
 	}
-	if len(userPassword) != len(encodedInputPassword) {
+	accepted, err := h.verify(plainPassword)
+	if err != nil {
+		logging.Log(debugTag, "Error while verifying the password of %s: %s", u.Email, err)
 		return false
 	}
-	for i := range userPassword {
-		if userPassword[i] != encodedInputPassword[i] {
-			return false
-		}
-	}
-	return true
+	return accepted
 }
 
-func (u *User) SetPassword(plainPassword string, salt []byte) error {
-	encodedPassword, err := u.encodePassword(plainPassword, salt)
+// SetPassword hashes plainPassword using scheme and a new random salt
+func (u *User) SetPassword(plainPassword string, scheme string) error {
+	encodedPassword, err := hashPassword(plainPassword, scheme)
 	if err != nil {
 		return err
 	}
-	u.Password = base64.StdEncoding.EncodeToString(encodedPassword)
+	u.Password = encodedPassword
 	return nil
 }
+
+// PasswordNeedsRehash reports whether the password isn't hashed using scheme
+// with its current parameters
+func (u *User) PasswordNeedsRehash(scheme string) bool {
+	if !u.HasPassword() {
+		return false
+	}
+	if isLegacyPasswordHash(u.Password) {
+		return true
+	}
+	h, err := parsePasswordHash(u.Password)
+	if err != nil {
+		return false
+	}
+	return h.outdated(scheme)
+}
@@ -0,0 +1,220 @@
+package ldap
+
+import (
+	"strings"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+// The directory is built from the users and groups on every search:
+//
+//	<base DN>
+//	  ou=users,<base DN>    uid=<email> for each active user
+//	  ou=groups,<base DN>   cn=<email> for each active group
+//
+// Groups list their members (and manager) in member, and users list their
+// groups in memberOf.
+
+type attribute struct {
+	name   string
+	values []string
+}
+
+type entry struct {
+	dn         string
+	attributes []attribute
+}
+
+func (e *entry) add(name string, values ...string) {
+	var nonEmpty []string
+	for _, v := range values {
+		if v != "" {
+			nonEmpty = append(nonEmpty, v)
+		}
+	}
+	if len(nonEmpty) > 0 {
+		e.attributes = append(e.attributes, attribute{name: name, values: nonEmpty})
+	}
+}
+
+// get returns the values of the attribute, whose name is case-insensitive
+func (e *entry) get(name string) []string {
+	for _, a := range e.attributes {
+		if strings.EqualFold(a.name, name) {
+			return a.values
+		}
+	}
+	return nil
+}
+
+// normalizeDN lowercases the DN and removes the spaces around its separators,
+// so the DNs can be compared as strings. Escaped commas aren't supported,
+// none of the generated DNs has one.
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		pair := strings.SplitN(part, "=", 2)
+		for j := range pair {
+			pair[j] = strings.TrimSpace(pair[j])
+		}
+		parts[i] = strings.ToLower(strings.Join(pair, "="))
+	}
+	return strings.Join(parts, ",")
+}
+
+type directory struct {
+	baseDN string
+}
+
+func (d *directory) usersDN() string {
+	return "ou=users," + d.baseDN
+}
+
+func (d *directory) groupsDN() string {
+	return "ou=groups," + d.baseDN
+}
+
+func (d *directory) userDN(email string) string {
+	return "uid=" + email + "," + d.usersDN()
+}
+
+func (d *directory) groupDN(email string) string {
+	return "cn=" + email + "," + d.groupsDN()
+}
+
+// bindEmail returns the email of the user the bind name stands for. Either the
+// DN of the user or its bare email is accepted.
+func (d *directory) bindEmail(name string) (string, bool) {
+	if !strings.Contains(name, "=") {
+		return name, name != ""
+	}
+	normalized := normalizeDN(name)
+	suffix := "," + normalizeDN(d.usersDN())
+	if !strings.HasPrefix(normalized, "uid=") || !strings.HasSuffix(normalized, suffix) {
+		return "", false
+	}
+	email := strings.TrimSuffix(strings.TrimPrefix(normalized, "uid="), suffix)
+	return email, email != "" && !strings.Contains(email, ",")
+}
+
+// entries returns the entries which the bound user can see: its own, the
+// users it may read, and the groups it's a member of, can join, or may read.
+func (d *directory) entries(ds *datasource.DataSource, bound *datasource.User) ([]*entry, error) {
+	users, err := ds.Users()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := ds.Groups()
+	if err != nil {
+		return nil, err
+	}
+
+	base := &entry{dn: d.baseDN}
+	base.add("objectClass", "top", "domain")
+	if first := strings.SplitN(normalizeDN(d.baseDN), ",", 2)[0]; strings.HasPrefix(first, "dc=") {
+		base.add("dc", strings.TrimPrefix(first, "dc="))
+	}
+	usersOU := &entry{dn: d.usersDN()}
+	usersOU.add("objectClass", "top", "organizationalUnit")
+	usersOU.add("ou", "users")
+	groupsOU := &entry{dn: d.groupsDN()}
+	groupsOU.add("objectClass", "top", "organizationalUnit")
+	groupsOU.add("ou", "groups")
+	entries := []*entry{base, usersOU, groupsOU}
+
+	active := make(map[string]bool)
+	for _, u := range users {
+		if u.Active {
+			active[u.Email] = true
+		}
+	}
+
+	memberOf := make(map[string][]string)
+	for _, g := range groups {
+		if !g.Active {
+			continue
+		}
+		var members []string
+		for _, m := range append([]string{g.Manager}, g.Members...) {
+			if active[m] && !containsString(members, d.userDN(m)) {
+				members = append(members, d.userDN(m))
+				memberOf[m] = append(memberOf[m], d.groupDN(g.Email))
+			}
+		}
+
+		if !g.IsMemeber(bound.Email) && !g.Joinable && !datasource.Allowed(bound, datasource.PermReadGroups, g.Email) {
+			continue
+		}
+		e := &entry{dn: d.groupDN(g.Email)}
+		e.add("objectClass", "top", "groupOfNames")
+		e.add("cn", g.Email)
+		e.add("mail", g.Email)
+		e.add("displayName", g.Name)
+		e.add("description", g.Description)
+		if active[g.Manager] {
+			e.add("owner", d.userDN(g.Manager))
+		}
+		e.add("member", members...)
+		entries = append(entries, e)
+	}
+
+	for _, u := range users {
+		if !u.Active {
+			continue
+		}
+		if u.Email != bound.Email && !datasource.Allowed(bound, datasource.PermReadUsers, u.Email) {
+			continue
+		}
+		name := strings.TrimSpace(u.EnFirstName + " " + u.EnLastName)
+		if name == "" {
+			name = u.Email
+		}
+		surname := u.EnLastName
+		if surname == "" {
+			surname = name
+		}
+		e := &entry{dn: d.userDN(u.Email)}
+		e.add("objectClass", "top", "person", "organizationalPerson", "inetOrgPerson")
+		e.add("uid", u.Email)
+		e.add("mail", u.Email)
+		e.add("cn", name)
+		e.add("sn", surname)
+		e.add("givenName", u.EnFirstName)
+		e.add("displayName", name)
+		e.add("employeeNumber", u.UIDStr)
+		e.add("mobile", u.MobileNum)
+		e.add("memberOf", memberOf[u.Email]...)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	scopeBaseObject   = 0
+	scopeSingleLevel  = 1
+	scopeWholeSubtree = 2
+)
+
+// inScope reports whether the entry is in the scope of the search from base.
+// Both DNs must be normalized.
+func inScope(dn, base string, scope int64) bool {
+	switch scope {
+	case scopeBaseObject:
+		return dn == base
+	case scopeSingleLevel:
+		parts := strings.SplitN(dn, ",", 2)
+		return len(parts) == 2 && parts[1] == base
+	case scopeWholeSubtree:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package ldap
+
+import (
+	"errors"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// The choices of Filter, RFC 4511 section 4.5.1
+const (
+	filterAnd             = 0
+	filterOr              = 1
+	filterNot             = 2
+	filterEqualityMatch   = 3
+	filterSubstrings      = 4
+	filterGreaterOrEqual  = 5
+	filterLessOrEqual     = 6
+	filterPresent         = 7
+	filterApproxMatch     = 8
+	filterExtensibleMatch = 9
+)
+
+// The choices of the substrings of a SubstringFilter
+const (
+	substringInitial = 0
+	substringAny     = 1
+	substringFinal   = 2
+)
+
+var (
+	errBadFilter         = errors.New("Malformed filter")
+	errUnsupportedFilter = errors.New("Extensible match filters aren't supported")
+)
+
+// stringValue returns the value of an OCTET STRING, whether it's universal or
+// context-specific (whose value isn't decoded by ber)
+func stringValue(p *ber.Packet) string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	if p.Data != nil {
+		return p.Data.String()
+	}
+	return ""
+}
+
+// matchFilter evaluates the filter on the entry. All the comparisons are
+// case-insensitive, and the approximate match is the equality match.
+func matchFilter(f *ber.Packet, e *entry) (bool, error) {
+	if f.ClassType != ber.ClassContext {
+		return false, errBadFilter
+	}
+
+	switch f.Tag {
+	case filterAnd:
+		for _, child := range f.Children {
+			ok, err := matchFilter(child, e)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case filterOr:
+		for _, child := range f.Children {
+			ok, err := matchFilter(child, e)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case filterNot:
+		if len(f.Children) != 1 {
+			return false, errBadFilter
+		}
+		ok, err := matchFilter(f.Children[0], e)
+		return !ok, err
+
+	case filterPresent:
+		return len(e.get(stringValue(f))) > 0, nil
+
+	case filterEqualityMatch, filterApproxMatch, filterGreaterOrEqual, filterLessOrEqual:
+		if len(f.Children) != 2 {
+			return false, errBadFilter
+		}
+		attr := stringValue(f.Children[0])
+		want := strings.ToLower(stringValue(f.Children[1]))
+		values := e.get(attr)
+		if strings.EqualFold(attr, "objectClass") || strings.EqualFold(attr, "objectCategory") {
+			values = e.get("objectClass")
+		}
+		for _, v := range values {
+			v = strings.ToLower(v)
+			switch {
+			case f.Tag == filterGreaterOrEqual && v >= want,
+				f.Tag == filterLessOrEqual && v <= want,
+				(f.Tag == filterEqualityMatch || f.Tag == filterApproxMatch) && v == want:
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case filterSubstrings:
+		if len(f.Children) != 2 {
+			return false, errBadFilter
+		}
+		values := e.get(stringValue(f.Children[0]))
+		for _, v := range values {
+			if matchSubstrings(strings.ToLower(v), f.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case filterExtensibleMatch:
+		return false, errUnsupportedFilter
+	}
+	return false, errBadFilter
+}
+
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for i, part := range parts {
+		s := strings.ToLower(stringValue(part))
+		switch part.Tag {
+		case substringInitial:
+			if i != 0 || !strings.HasPrefix(value, s) {
+				return false
+			}
+			value = value[len(s):]
+		case substringAny:
+			j := strings.Index(value, s)
+			if j < 0 {
+				return false
+			}
+			value = value[j+len(s):]
+		case substringFinal:
+			if i != len(parts)-1 || !strings.HasSuffix(value, s) {
+				return false
+			}
+			value = value[:len(value)-len(s)]
+		}
+	}
+	return true
+}
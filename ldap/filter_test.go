@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func filterOf(tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, "Filter")
+	for _, child := range children {
+		p.AppendChild(child)
+	}
+	return p
+}
+
+func octetString(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func compareFilter(tag ber.Tag, attr, value string) *ber.Packet {
+	return filterOf(tag, octetString(attr), octetString(value))
+}
+
+func presentFilter(attr string) *ber.Packet {
+	return ber.NewString(ber.ClassContext, ber.TypePrimitive, filterPresent, attr, "Present")
+}
+
+// substring is a part of a SubstringFilter, whose tag is substringInitial,
+// substringAny or substringFinal
+type substring struct {
+	tag   ber.Tag
+	value string
+}
+
+func substringParts(parts []substring) []*ber.Packet {
+	var packets []*ber.Packet
+	for _, part := range parts {
+		packets = append(packets, ber.NewString(ber.ClassContext, ber.TypePrimitive, part.tag, part.value, ""))
+	}
+	return packets
+}
+
+func substringsFilter(attr string, parts ...substring) *ber.Packet {
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Substrings")
+	for _, p := range substringParts(parts) {
+		seq.AppendChild(p)
+	}
+	return filterOf(filterSubstrings, octetString(attr), seq)
+}
+
+func TestMatchFilter(t *testing.T) {
+	e := &entry{dn: "uid=a.b@example.com,ou=users,dc=example,dc=com"}
+	e.add("mail", "A.B@example.com")
+	e.add("cn", "A B")
+	e.add("objectClass", "top", "person")
+
+	tests := []struct {
+		name   string
+		filter *ber.Packet
+		want   bool
+		err    error
+	}{
+		{"(mail=a.b@EXAMPLE.com)", compareFilter(filterEqualityMatch, "mail", "a.b@EXAMPLE.com"), true, nil},
+		{"(MAIL=x@example.com)", compareFilter(filterEqualityMatch, "MAIL", "x@example.com"), false, nil},
+		{"(mail~=a.b@example.com)", compareFilter(filterApproxMatch, "mail", "a.b@example.com"), true, nil},
+		{"(objectCategory=person)", compareFilter(filterEqualityMatch, "objectCategory", "Person"), true, nil},
+		{"(mail>=a)", compareFilter(filterGreaterOrEqual, "mail", "a"), true, nil},
+		{"(mail<=a)", compareFilter(filterLessOrEqual, "mail", "a"), false, nil},
+		{"(cn=*)", presentFilter("cn"), true, nil},
+		{"(uid=*)", presentFilter("uid"), false, nil},
+		{"(&(objectClass=person)(mail=x@example.com))", filterOf(filterAnd,
+			compareFilter(filterEqualityMatch, "objectClass", "person"),
+			compareFilter(filterEqualityMatch, "mail", "x@example.com")), false, nil},
+		{"(|(mail=x@example.com)(cn=a b))", filterOf(filterOr,
+			compareFilter(filterEqualityMatch, "mail", "x@example.com"),
+			compareFilter(filterEqualityMatch, "cn", "a b")), true, nil},
+		{"(&)", filterOf(filterAnd), true, nil},
+		{"(|)", filterOf(filterOr), false, nil},
+		{"(!(mail=x@example.com))", filterOf(filterNot,
+			compareFilter(filterEqualityMatch, "mail", "x@example.com")), true, nil},
+		{"(mail=a.b*)", substringsFilter("mail", substring{substringInitial, "A.B"}), true, nil},
+		{"(mail=*@example.com)", substringsFilter("mail", substring{substringFinal, "@example.com"}), true, nil},
+		{"(mail=a*example*com)", substringsFilter("mail",
+			substring{substringInitial, "a"}, substring{substringAny, "example"}, substring{substringFinal, "com"}), true, nil},
+		{"(cn=*b*)", substringsFilter("cn", substring{substringAny, "b"}), true, nil},
+		{"(uid=*b*)", substringsFilter("uid", substring{substringAny, "b"}), false, nil},
+
+		{"not of two filters", filterOf(filterNot, presentFilter("cn"), presentFilter("mail")), false, errBadFilter},
+		{"equality without a value", filterOf(filterEqualityMatch, octetString("mail")), false, errBadFilter},
+		{"universal filter", octetString("mail"), false, errBadFilter},
+		{"unknown choice", filterOf(12), false, errBadFilter},
+		{"extensible match", filterOf(filterExtensibleMatch), false, errUnsupportedFilter},
+		{"error in an and", filterOf(filterAnd, presentFilter("cn"), filterOf(filterExtensibleMatch)), false, errUnsupportedFilter},
+	}
+	for _, tt := range tests {
+		// As the filters are received
+		f, err := ber.DecodePacketErr(tt.filter.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got, err := matchFilter(f, e)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: got %v, %v; want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestMatchSubstrings(t *testing.T) {
+	tests := []struct {
+		value string
+		parts []substring
+		want  bool
+	}{
+		{"abc", nil, true},
+		{"abc", []substring{{substringInitial, "ab"}}, true},
+		{"abc", []substring{{substringInitial, "bc"}}, false},
+		{"abc", []substring{{substringFinal, "bc"}}, true},
+		{"abc", []substring{{substringFinal, "ab"}}, false},
+		{"abc", []substring{{substringAny, "b"}}, true},
+		{"abc", []substring{{substringAny, "d"}}, false},
+		{"abcabc", []substring{{substringAny, "c"}, {substringAny, "a"}, {substringFinal, "c"}}, true},
+		{"abc", []substring{{substringAny, "c"}, {substringAny, "a"}}, false},
+		// The parts don't overlap
+		{"ab", []substring{{substringInitial, "ab"}, {substringFinal, "b"}}, false},
+		{"aba", []substring{{substringInitial, "a"}, {substringFinal, "a"}}, true},
+		{"a", []substring{{substringInitial, "a"}, {substringFinal, "a"}}, false},
+		// The initial part is first, and the final one is last
+		{"abc", []substring{{substringAny, "b"}, {substringInitial, "a"}}, false},
+		{"abc", []substring{{substringFinal, "c"}, {substringAny, "b"}}, false},
+		// The value is lowercased by matchFilter, the parts here
+		{"abc", []substring{{substringInitial, "AB"}}, true},
+	}
+	for _, tt := range tests {
+		if got := matchSubstrings(tt.value, substringParts(tt.parts)); got != tt.want {
+			t.Errorf("matchSubstrings(%q, %v) = %v, want %v", tt.value, tt.parts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Package ldap serves the users and groups as a read-only LDAP directory, for
+// the services which only speak LDAP. The users bind with their bahram
+// passwords, or their app passwords if they have enabled two-factor
+// authentication.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+const (
+	debugTag = "LDAP"
+
+	maxConnections = 100
+	idleTimeout    = 5 * time.Minute
+	// maxMessageLength is far more than any request needs
+	maxMessageLength = 1 << 20
+)
+
+// The application tags of the protocol operations, RFC 4511 section 4.2
+const (
+	appBindRequest      = 0
+	appBindResponse     = 1
+	appUnbindRequest    = 2
+	appSearchRequest    = 3
+	appSearchEntry      = 4
+	appSearchDone       = 5
+	appModifyRequest    = 6
+	appModifyResponse   = 7
+	appAddRequest       = 8
+	appAddResponse      = 9
+	appDelRequest       = 10
+	appDelResponse      = 11
+	appModDNRequest     = 12
+	appModDNResponse    = 13
+	appCompareRequest   = 14
+	appCompareResponse  = 15
+	appAbandonRequest   = 16
+	appExtendedRequest  = 23
+	appExtendedResponse = 24
+)
+
+// The result codes which are used, RFC 4511 appendix A
+const (
+	resultSuccess                  = 0
+	resultOperationsError          = 1
+	resultProtocolError            = 2
+	resultSizeLimitExceeded        = 4
+	resultAuthMethodNotSupported   = 7
+	resultConfidentialityRequired  = 13
+	resultNoSuchObject             = 32
+	resultInvalidCredentials       = 49
+	resultInsufficientAccessRights = 50
+	resultUnavailable              = 52
+	resultUnwillingToPerform       = 53
+	resultOther                    = 80
+)
+
+const (
+	oidStartTLS = "1.3.6.1.4.1.1466.20037"
+	oidWhoAmI   = "1.3.6.1.4.1.4203.1.11.3"
+)
+
+type server struct {
+	ds        *datasource.DataSource
+	dir       *directory
+	tlsConfig *tls.Config
+	// plaintextBind allows the passwords to be sent without TLS
+	plaintextBind bool
+	sem           chan struct{}
+}
+
+// session is the state of a connection
+type session struct {
+	conn net.Conn
+	ip   string
+	tls  bool
+	// bound is the email of the bound user, empty for anonymous sessions
+	bound string
+}
+
+// Serve listens for LDAP clients. The directory is under BAHRAM_LDAP_BASE_DN,
+// e.g. "dc=cafebazaar,dc=ir". StartTLS is offered if BAHRAM_LDAP_TLS_CERT and
+// BAHRAM_LDAP_TLS_KEY are set to the paths of the certificate and its key.
+// The binds with a password are refused before StartTLS, unless
+// BAHRAM_LDAP_PLAINTEXT_BIND is true.
+func Serve(listenAddr net.TCPAddr, ds *datasource.DataSource) error {
+	baseDN := normalizeDN(ds.ConfigString("LDAP_BASE_DN"))
+	if baseDN == "" {
+		return errors.New("BAHRAM_LDAP_BASE_DN isn't set")
+	}
+	s := &server{
+		ds:            ds,
+		dir:           &directory{baseDN: baseDN},
+		plaintextBind: ds.ConfigString("LDAP_PLAINTEXT_BIND") == "true",
+		sem:           make(chan struct{}, maxConnections),
+	}
+
+	certFile, keyFile := ds.ConfigString("LDAP_TLS_CERT"), ds.ConfigString("LDAP_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else if !s.plaintextBind {
+		logging.Log(debugTag, "StartTLS isn't configured, so only anonymous binds are possible")
+	}
+
+	ber.MaxPacketLengthBytes = maxMessageLength
+	listener, err := net.Listen("tcp", listenAddr.String())
+	if err != nil {
+		return err
+	}
+	logging.Log(debugTag, "Serving LDAP on %s for %s", listenAddr.String(), baseDN)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				logging.Log(debugTag, "Accept error: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.sem <- struct{}{}
+		go s.handle(conn)
+	}
+}
+
+func (s *server) handle(conn net.Conn) {
+	c := &session{conn: conn, ip: conn.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(c.ip); err == nil {
+		c.ip = host
+	}
+	defer func() {
+		c.conn.Close()
+		<-s.sem
+	}()
+
+	for {
+		c.conn.SetDeadline(time.Now().Add(idleTimeout))
+		packet, err := ber.ReadPacket(c.conn)
+		if err != nil {
+			if err != io.EOF {
+				logging.Debug(debugTag, "Read error from %s: %s", c.ip, err)
+			}
+			return
+		}
+		if len(packet.Children) < 2 {
+			logging.Debug(debugTag, "Malformed message from %s", c.ip)
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		if !ok || op.ClassType != ber.ClassApplication {
+			logging.Debug(debugTag, "Malformed message from %s", c.ip)
+			return
+		}
+
+		switch op.Tag {
+		case appBindRequest:
+			err = s.bind(c, messageID, op)
+		case appUnbindRequest:
+			return
+		case appSearchRequest:
+			err = s.search(c, messageID, op)
+		case appExtendedRequest:
+			err = s.extended(c, messageID, op)
+		case appAbandonRequest:
+			// The operations are done before reading the next message
+		case appModifyRequest:
+			err = c.result(messageID, appModifyResponse, resultUnwillingToPerform, "The directory is read-only")
+		case appAddRequest:
+			err = c.result(messageID, appAddResponse, resultUnwillingToPerform, "The directory is read-only")
+		case appDelRequest:
+			err = c.result(messageID, appDelResponse, resultUnwillingToPerform, "The directory is read-only")
+		case appModDNRequest:
+			err = c.result(messageID, appModDNResponse, resultUnwillingToPerform, "The directory is read-only")
+		case appCompareRequest:
+			err = c.result(messageID, appCompareResponse, resultUnwillingToPerform, "Compare isn't supported, use search")
+		default:
+			logging.Debug(debugTag, "Unknown operation %d from %s", op.Tag, c.ip)
+			return
+		}
+		if err != nil {
+			logging.Debug(debugTag, "Write error to %s: %s", c.ip, err)
+			return
+		}
+	}
+}
+
+func (c *session) send(messageID int64, op *ber.Packet) error {
+	message := ber.NewSequence("LDAPMessage")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+	message.AppendChild(op)
+	_, err := c.conn.Write(message.Bytes())
+	return err
+}
+
+func newResult(tag ber.Tag, code int64, message string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "LDAPResult")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "diagnosticMessage"))
+	return p
+}
+
+func (c *session) result(messageID int64, tag ber.Tag, code int64, message string) error {
+	return c.send(messageID, newResult(tag, code, message))
+}
+
+// bind only supports the simple authentication. The name is either the DN of
+// the user or its email. As with SMTP AUTH, the main password isn't accepted
+// when two-factor authentication is enabled.
+func (s *server) bind(c *session, messageID int64, op *ber.Packet) error {
+	// A failed bind leaves the session anonymous
+	c.bound = ""
+
+	if len(op.Children) != 3 {
+		return c.result(messageID, appBindResponse, resultProtocolError, "Malformed bind request")
+	}
+	if version, _ := op.Children[0].Value.(int64); version != 3 {
+		return c.result(messageID, appBindResponse, resultProtocolError, "Only LDAPv3 is supported")
+	}
+	name := stringValue(op.Children[1])
+	auth := op.Children[2]
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		return c.result(messageID, appBindResponse, resultAuthMethodNotSupported, "Only simple bind is supported")
+	}
+	password := stringValue(auth)
+
+	if name == "" && password == "" {
+		return c.result(messageID, appBindResponse, resultSuccess, "")
+	}
+	if !c.tls && !s.plaintextBind {
+		return c.result(messageID, appBindResponse, resultConfidentialityRequired, "StartTLS is required before binding")
+	}
+	if password == "" {
+		return c.result(messageID, appBindResponse, resultUnwillingToPerform, "Unauthenticated bind isn't allowed")
+	}
+	email, ok := s.dir.bindEmail(name)
+	if !ok {
+		return c.result(messageID, appBindResponse, resultInvalidCredentials, "")
+	}
+
+	if s.ds.LoginWait(email, c.ip) > 0 {
+		s.auditBind(email, c.ip, false, "blocked")
+		return c.result(messageID, appBindResponse, resultUnwillingToPerform, "Too many failed attempts, try again later")
+	}
+
+	user, err := s.ds.UserByEmail(email)
+	if err != nil || !user.Active {
+		s.ds.LoginFailed(email, c.ip)
+		s.auditBind(email, c.ip, false, "unknown user")
+		return c.result(messageID, appBindResponse, resultInvalidCredentials, "")
+	}
+
+	details := ""
+	if s.ds.CheckAppPassword(user, password, c.ip) {
+		details = "app password"
+	} else if !user.TOTPEnabled && s.ds.CheckPassword(user, password) {
+		details = "password"
+	} else {
+		s.ds.LoginFailed(email, c.ip)
+		s.auditBind(email, c.ip, false, "wrong password")
+		return c.result(messageID, appBindResponse, resultInvalidCredentials, "")
+	}
+	s.ds.LoginSucceeded(email, c.ip)
+	s.auditBind(email, c.ip, true, details)
+	c.bound = user.Email
+	return c.result(messageID, appBindResponse, resultSuccess, "")
+}
+
+func (s *server) auditBind(email, ip string, success bool, details string) {
+	audit := s.ds.Audit
+	if !success {
+		// Anyone can fail, so those are aggregated
+		audit = s.ds.AuditFailure
+	}
+	err := audit(&datasource.AuditEvent{
+		Actor:    email,
+		Action:   "ldap.bind",
+		Target:   email,
+		SourceIP: ip,
+		Success:  success,
+		Details:  details,
+	})
+	if err != nil {
+		logging.Log(debugTag, "Error while auditing the bind of %s: %s", email, err)
+	}
+}
+
+// boundUser returns the bound user, as it's now. The session loses its bind
+// if the user is deactivated or removed since.
+func (s *server) boundUser(c *session) *datasource.User {
+	if c.bound == "" {
+		return nil
+	}
+	user, err := s.ds.UserByEmail(c.bound)
+	if err != nil || !user.Active {
+		c.bound = ""
+		return nil
+	}
+	return user
+}
+
+func (s *server) rootDSE() *entry {
+	e := &entry{}
+	e.add("objectClass", "top")
+	e.add("namingContexts", s.dir.baseDN)
+	e.add("supportedLDAPVersion", "3")
+	e.add("supportedExtension", oidWhoAmI)
+	if s.tlsConfig != nil {
+		e.add("supportedExtension", oidStartTLS)
+	}
+	e.add("vendorName", "Bahram")
+	return e
+}
+
+// search returns the matching entries the bound user can see. Only the root
+// DSE can be read anonymously.
+func (s *server) search(c *session, messageID int64, op *ber.Packet) error {
+	if len(op.Children) != 8 {
+		return c.result(messageID, appSearchDone, resultProtocolError, "Malformed search request")
+	}
+	base := normalizeDN(stringValue(op.Children[0]))
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	typesOnly, _ := op.Children[5].Value.(bool)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, stringValue(a))
+	}
+
+	var candidates []*entry
+	if base == "" && scope == scopeBaseObject {
+		candidates = []*entry{s.rootDSE()}
+	} else {
+		user := s.boundUser(c)
+		if user == nil {
+			return c.result(messageID, appSearchDone, resultInsufficientAccessRights, "Bind first")
+		}
+		entries, err := s.dir.entries(s.ds, user)
+		if err != nil {
+			logging.Log(debugTag, "Error while listing the entries: %s", err)
+			return c.result(messageID, appSearchDone, resultOther, "")
+		}
+		found := false
+		for _, e := range entries {
+			dn := normalizeDN(e.dn)
+			if dn == base {
+				found = true
+			}
+			if inScope(dn, base, scope) {
+				candidates = append(candidates, e)
+			}
+		}
+		if !found {
+			return c.result(messageID, appSearchDone, resultNoSuchObject, "")
+		}
+	}
+
+	var sent int64
+	for _, e := range candidates {
+		ok, err := matchFilter(filter, e)
+		if err == errUnsupportedFilter {
+			return c.result(messageID, appSearchDone, resultUnwillingToPerform, err.Error())
+		} else if err != nil {
+			return c.result(messageID, appSearchDone, resultProtocolError, err.Error())
+		}
+		if !ok {
+			continue
+		}
+		if sizeLimit > 0 && sent == sizeLimit {
+			return c.result(messageID, appSearchDone, resultSizeLimitExceeded, "")
+		}
+		if err := c.send(messageID, searchEntry(e, attrs, typesOnly)); err != nil {
+			return err
+		}
+		sent++
+	}
+	return c.result(messageID, appSearchDone, resultSuccess, "")
+}
+
+// searchEntry encodes the requested attributes of the entry. No attributes,
+// or "*", stand for all of them, and "1.1" for none.
+func searchEntry(e *entry, attrs []string, typesOnly bool) *ber.Packet {
+	all := len(attrs) == 0
+	for _, a := range attrs {
+		if a == "*" {
+			all = true
+		}
+	}
+
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, appSearchEntry, nil, "SearchResultEntry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	list := ber.NewSequence("attributes")
+	for _, a := range e.attributes {
+		if !all && !requested(attrs, a.name) {
+			continue
+		}
+		attr := ber.NewSequence("PartialAttribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		if !typesOnly {
+			for _, v := range a.values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+			}
+		}
+		attr.AppendChild(values)
+		list.AppendChild(attr)
+	}
+	p.AppendChild(list)
+	return p
+}
+
+func requested(attrs []string, name string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// extended supports StartTLS and "Who am I?"
+func (s *server) extended(c *session, messageID int64, op *ber.Packet) error {
+	if len(op.Children) < 1 {
+		return c.result(messageID, appExtendedResponse, resultProtocolError, "Malformed extended request")
+	}
+
+	switch stringValue(op.Children[0]) {
+	case oidWhoAmI:
+		p := newResult(appExtendedResponse, resultSuccess, "")
+		authzID := ""
+		if c.bound != "" {
+			authzID = "dn:" + s.dir.userDN(c.bound)
+		}
+		p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, authzID, "responseValue"))
+		return c.send(messageID, p)
+
+	case oidStartTLS:
+		if s.tlsConfig == nil {
+			return c.result(messageID, appExtendedResponse, resultUnavailable, "StartTLS isn't configured")
+		}
+		if c.tls {
+			return c.result(messageID, appExtendedResponse, resultOperationsError, "TLS is already started")
+		}
+		p := newResult(appExtendedResponse, resultSuccess, "")
+		p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, oidStartTLS, "responseName"))
+		if err := c.send(messageID, p); err != nil {
+			return err
+		}
+		tlsConn := tls.Server(c.conn, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.tls = true
+		return nil
+	}
+	return c.result(messageID, appExtendedResponse, resultProtocolError, "Unknown extended operation")
+}
@@ -0,0 +1,70 @@
+package ldap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cafebazaar/bahram/datasource"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// testBind sends a bind request to the server, and returns the result code
+func testBind(t *testing.T, s *server, tls bool, name, password string) int64 {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, appBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Name"))
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Password"))
+	op, err := ber.DecodePacketErr(request.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	c := &session{conn: serverConn, ip: "192.0.2.1", tls: tls}
+	go func() {
+		defer serverConn.Close()
+		s.bind(c, 1, op)
+	}()
+
+	response, err := ber.ReadPacket(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := response.Children[1].Children[0].Value.(int64)
+	return code
+}
+
+func TestBindNeedsTLS(t *testing.T) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &datasource.User{Email: "a@example.com", Active: true}
+	if err := ds.SetPassword(u, "secret password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tls, plaintextBind bool
+		name, password     string
+		want               int64
+	}{
+		{false, false, "", "", resultSuccess},
+		{false, false, "a@example.com", "secret password", resultConfidentialityRequired},
+		{false, false, "a@example.com", "wrong", resultConfidentialityRequired},
+		{true, false, "a@example.com", "secret password", resultSuccess},
+		{true, false, "a@example.com", "wrong", resultInvalidCredentials},
+		{false, true, "a@example.com", "secret password", resultSuccess},
+	}
+	for _, tt := range tests {
+		s := &server{ds: ds, dir: &directory{baseDN: "dc=example,dc=com"}, plaintextBind: tt.plaintextBind}
+		if got := testBind(t, s, tt.tls, tt.name, tt.password); got != tt.want {
+			t.Errorf("bind as %q with TLS %v, plaintext binds %v: got %d, want %d",
+				tt.name, tt.tls, tt.plaintextBind, got, tt.want)
+		}
+	}
+}
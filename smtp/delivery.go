@@ -0,0 +1,522 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+// Recipient is the delivery state of one of the final recipients of a
+// message, which are looked up on its first delivery attempt
+type Recipient struct {
+	// Email is the address the sender knows, which is reported in the bounces
+	Email string
+	// Address is where the message is delivered, the InboxAddr of the local
+	// users
+	Address string
+	// Status is recipientPending, recipientDelivered or recipientFailed
+	Status   string
+	Attempts int
+	// LastError is the error of the last attempt, and Code is its enhanced
+	// status code (RFC 3463)
+	LastError string
+	Code      string
+	// Notified is whether the failure is reported
+	Notified bool
+	// Group is set for the members of the group the message is sent to, whose
+	// failures are reported to the Manager of the group rather than the
+	// sender
+	Group   string
+	Manager string
+}
+
+const (
+	recipientPending   = "pending"
+	recipientDelivered = "delivered"
+	recipientFailed    = "failed"
+)
+
+const (
+	// queuePollInterval is how long the delivery workers wait when the queue
+	// is empty
+	queuePollInterval = time.Second
+	// deliveryWorkers is the number of the messages delivered at once
+	deliveryWorkers = 3
+	// deliveryTimeout limits each delivery to a mail exchanger
+	deliveryTimeout = 5 * time.Minute
+	// The retries are after retryDelay, then twice that and so on, up to
+	// maxRetryDelay
+	retryDelay    = time.Minute
+	maxRetryDelay = time.Hour
+	// delayWarningAge is when the sender is warned that the message isn't
+	// delivered yet
+	delayWarningAge = 4 * time.Hour
+)
+
+// maxDeliveryAge is how long the deliveries are retried before the message
+// bounces
+var maxDeliveryAge = 5 * 24 * time.Hour
+
+// SetMaxDeliveryAge sets how long the temporary failures are retried before
+// the message bounces. It must be called before Serve.
+func SetMaxDeliveryAge(d time.Duration) {
+	maxDeliveryAge = d
+}
+
+// maxDeliveryAttempts is how many times a message is leased before it
+// bounces. The messages leased more than that, because their leases expire
+// and not because they're retried, are moved to the dead letters.
+var maxDeliveryAttempts = 200
+
+// SetMaxDeliveryAttempts sets how many times the deliveries are attempted
+// before the message bounces. It must be called before Serve.
+func SetMaxDeliveryAttempts(n int) {
+	maxDeliveryAttempts = n
+}
+
+// deliveryError is a failed delivery attempt
+type deliveryError struct {
+	// code is the enhanced status code (RFC 3463), which starts with 4 if
+	// the failure is temporary and 5 if it's permanent
+	code    string
+	message string
+}
+
+func (e *deliveryError) Error() string {
+	return e.message
+}
+
+func (e *deliveryError) permanent() bool {
+	return strings.HasPrefix(e.code, "5")
+}
+
+var enhancedCodeRegex = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+
+// classifyError returns the deliveryError of an error of sendMsg. The 5xx
+// replies are permanent failures, and the other replies and the connection
+// errors are temporary.
+func classifyError(host string, err error) *deliveryError {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		msg := strings.Replace(tpErr.Msg, "\n", " ", -1)
+		class := fmt.Sprint(tpErr.Code / 100)
+		code := enhancedCodeRegex.FindString(msg)
+		if !strings.HasPrefix(code, class) {
+			code = class + ".0.0"
+		}
+		return &deliveryError{
+			code:    code,
+			message: fmt.Sprintf("%d %s (from %s)", tpErr.Code, msg, host),
+		}
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return &deliveryError{code: "4.4.1", message: fmt.Sprintf("Can't connect to %s: %s", host, err)}
+	}
+	return &deliveryError{code: "4.4.2", message: fmt.Sprintf("Error while delivering to %s: %s", host, err)}
+}
+
+// lookupMX returns the mail exchangers of the domain, by preference, or the
+// domain itself if it has no MX records
+func lookupMX(domain string) ([]string, *deliveryError) {
+	nss, err := net.LookupMX(domain)
+	if err == nil && len(nss) == 1 && strings.TrimSuffix(nss[0].Host, ".") == "" {
+		// A null MX (RFC 7505)
+		return nil, &deliveryError{code: "5.1.10", message: fmt.Sprintf("The domain %s doesn't accept mail", domain)}
+	}
+	if err == nil && len(nss) > 0 {
+		var hosts []string
+		for _, ns := range nss {
+			logln(1, fmt.Sprintf("%s %d", ns.Host, ns.Pref))
+			hosts = append(hosts, strings.TrimSuffix(ns.Host, "."))
+		}
+		return hosts, nil
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Temporary() {
+		return nil, &deliveryError{code: "4.4.3", message: fmt.Sprintf("Can't look up the MX of %s: %s", domain, err)}
+	}
+
+	_, err = net.LookupHost(domain)
+	if err == nil {
+		return []string{domain}, nil
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+		return nil, &deliveryError{code: "5.1.2", message: fmt.Sprintf("Can't find the domain %s", domain)}
+	}
+	return nil, &deliveryError{code: "4.4.3", message: fmt.Sprintf("Can't look up %s: %s", domain, err)}
+}
+
+// sendMsg delivers the message to msg.To through the mail exchanger host
+func sendMsg(host string, msg ClientMessage) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "25"), deliveryTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(deliveryTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Hello(gConfig["GSMTP_HOST_NAME"]); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(msg.From); err != nil {
+		return err
+	}
+	if err = c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(msg.Data)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	// The message is accepted even if QUIT fails
+	c.Quit()
+	return nil
+}
+
+// deliverTo attempts to deliver the message to the recipient, through its
+// mail exchangers in order
+func deliverTo(r *Recipient, msg ClientMessage) {
+	logln(1, r.Address)
+	r.Attempts++
+	msg.To = r.Address
+
+	hosts, dErr := lookupMX(addressHost(r.Address))
+	for _, host := range hosts {
+		err := sendMsg(host, msg)
+		if err == nil {
+			logln(1, "successfully send message")
+			r.Status = recipientDelivered
+			return
+		}
+		logln(1, fmt.Sprintf("error in send message: %s", err))
+		dErr = classifyError(host, err)
+		if dErr.permanent() {
+			break
+		}
+	}
+
+	r.LastError = dErr.message
+	r.Code = dErr.code
+	if dErr.permanent() {
+		r.Status = recipientFailed
+	}
+}
+
+// resolveRecipients looks up the final recipients of the message. The
+// messages which shouldn't be delivered at all have none, and the errors are
+// the ones which are worth retrying.
+func resolveRecipients(msg *ClientMessage, ds *datasource.DataSource) ([]*Recipient, error) {
+	logln(1, fmt.Sprintf("%s", msg.From))
+	fromHost := strings.ToLower(addressHost(msg.From))
+	if isAllowedHost(fromHost) {
+		if msg.Auth == false || msg.Username != msg.From {
+			logln(1, fmt.Sprintf("%s %s", msg.Username, msg.From))
+			logln(1, "Not authenticated")
+			return nil, nil
+		}
+	}
+
+	toHost := strings.ToLower(addressHost(msg.To))
+	if !isAllowedHost(toHost) {
+		if msg.Auth {
+			// Relayed for an authenticated client, see addRecipient
+			return []*Recipient{{Email: msg.To, Address: msg.To, Status: recipientPending}}, nil
+		}
+		return nil, nil
+	}
+
+	user, err := lookupUser(ds, msg.To)
+	if err == nil {
+		if !user.Active || user.InboxAddr == "" {
+			return []*Recipient{{
+				Email:     msg.To,
+				Status:    recipientFailed,
+				LastError: "550 5.2.1 Mailbox unavailable",
+				Code:      "5.2.1",
+			}}, nil
+		}
+		return []*Recipient{{Email: msg.To, Address: user.InboxAddr, Status: recipientPending}}, nil
+	} else if err != datasource.ErrNotFound {
+		return nil, err
+	}
+
+	group, err := lookupGroup(ds, msg.To)
+	if err == datasource.ErrNotFound {
+		logln(1, "Can't find such user or group")
+		return []*Recipient{{
+			Email:     msg.To,
+			Status:    recipientFailed,
+			LastError: "550 5.1.1 User unknown",
+			Code:      "5.1.1",
+		}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The manager receives the mail of the group too, and is told of the
+	// members which can't receive it, see notifyManager
+	rcpts := []*Recipient{}
+	seen := map[string]bool{}
+	for _, member := range append([]string{group.Manager}, group.Members...) {
+		if member == "" || seen[strings.ToLower(member)] {
+			continue
+		}
+		seen[strings.ToLower(member)] = true
+		user, err = lookupUser(ds, member)
+		if err == datasource.ErrNotFound {
+			rcpts = append(rcpts, &Recipient{
+				Email:     member,
+				Status:    recipientFailed,
+				LastError: "550 5.1.1 User unknown",
+				Code:      "5.1.1",
+				Group:     group.Email,
+				Manager:   group.Manager,
+			})
+		} else if err != nil {
+			return nil, err
+		} else if !user.Active || user.InboxAddr == "" {
+			rcpts = append(rcpts, &Recipient{
+				Email:     member,
+				Status:    recipientFailed,
+				LastError: "550 5.2.1 Mailbox unavailable",
+				Code:      "5.2.1",
+				Group:     group.Email,
+				Manager:   group.Manager,
+			})
+		} else {
+			rcpts = append(rcpts, &Recipient{
+				Email:   member,
+				Address: user.InboxAddr,
+				Status:  recipientPending,
+				Group:   group.Email,
+				Manager: group.Manager,
+			})
+		}
+	}
+	return rcpts, nil
+}
+
+// deliver attempts the pending recipients of the leased message, and notifies
+// the sender of the failures, and of the delay once the message is
+// delayWarningAge old. The failures of the group members are reported to the
+// manager of the group instead. The state of the recipients is kept in the message, so
+// the next attempts only retry the pending ones. It returns whether any are
+// still pending.
+func deliver(lease *Lease, ds *datasource.DataSource) (bool, error) {
+	msg := lease.Message
+	now := time.Now()
+	if msg.Received.IsZero() {
+		// Queued by an older version
+		msg.Received = now
+	}
+
+	if msg.Recipients == nil {
+		rcpts, err := resolveRecipients(msg, ds)
+		if err != nil {
+			return false, err
+		}
+		msg.Recipients = rcpts
+	}
+
+	expired := now.Sub(msg.Received) >= maxDeliveryAge || lease.Attempts >= maxDeliveryAttempts
+	var pending []*Recipient
+	for _, r := range msg.Recipients {
+		if r.Status != recipientPending {
+			continue
+		}
+		deliverTo(r, *msg)
+		if r.Status != recipientPending {
+			continue
+		}
+		if expired {
+			r.Status = recipientFailed
+			r.Code = "4.4.7"
+			r.LastError = "Delivery time expired, the last error was: " + r.LastError
+		} else {
+			pending = append(pending, r)
+		}
+	}
+
+	var failed, failedMembers, delayed []*Recipient
+	for _, r := range msg.Recipients {
+		if r.Status == recipientFailed && !r.Notified {
+			if r.Group != "" {
+				failedMembers = append(failedMembers, r)
+			} else {
+				failed = append(failed, r)
+			}
+		}
+	}
+	for _, r := range pending {
+		if r.Group == "" {
+			delayed = append(delayed, r)
+		}
+	}
+	if len(failed) > 0 {
+		if err := notifySender(msg, failed, dsnFailed); err != nil {
+			return len(pending) > 0, err
+		}
+		for _, r := range failed {
+			r.Notified = true
+		}
+	}
+	if len(failedMembers) > 0 {
+		if err := notifyManager(msg, failedMembers); err != nil {
+			return len(pending) > 0, err
+		}
+		for _, r := range failedMembers {
+			r.Notified = true
+		}
+	}
+
+	if len(delayed) > 0 && !msg.DelayNotified && now.Sub(msg.Received) >= delayWarningAge {
+		if err := notifySender(msg, delayed, dsnDelayed); err != nil {
+			return true, err
+		}
+		msg.DelayNotified = true
+	}
+	return len(pending) > 0, nil
+}
+
+// notifySender queues the delivery status notification of the recipients to
+// the sender of the message, unless it's a bounce itself
+func notifySender(msg *ClientMessage, rcpts []*Recipient, action string) error {
+	if msg.From == "" {
+		logln(1, fmt.Sprintf("Not notifying the null sender of %d %s recipients", len(rcpts), action))
+		return nil
+	}
+	return mailQueue.Enqueue(newDSN(msg, rcpts, action))
+}
+
+// notifyManager reports the failed members of a group to its manager, as the
+// sender shouldn't learn the members. They're only logged if the group has no
+// manager, or the manager is one of them.
+func notifyManager(msg *ClientMessage, rcpts []*Recipient) error {
+	group, manager := rcpts[0].Group, rcpts[0].Manager
+	lines := []string{fmt.Sprintf("The mail of %s from <%s>, %q, couldn't be delivered to these members:", group, msg.From, msg.Subject), ""}
+	for _, r := range rcpts {
+		logln(1, fmt.Sprintf("Can't deliver the mail of %s from %s to %s: %s", group, msg.From, r.Email, r.LastError))
+		if strings.EqualFold(r.Email, manager) {
+			manager = ""
+		}
+		lines = append(lines, "<"+r.Email+">: "+r.LastError)
+	}
+	if manager == "" {
+		return nil
+	}
+	return SendSystemMail(manager, "Undelivered mail of "+group, strings.Join(lines, "\n"))
+}
+
+// nextRetry returns the delay before the next attempt, after the attempts
+func nextRetry(attempts int) time.Duration {
+	delay := retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// readFromQueue delivers the messages of the queue. A message is acked only
+// after it's processed, and its lease is renewed meanwhile, so it's delivered
+// again if the process stops before that, and isn't leased by another worker
+// while it's being delivered.
+func readFromQueue(queue Queue, ds *datasource.DataSource) {
+	for {
+		lease, err := queue.Lease()
+		if err != nil {
+			logln(1, fmt.Sprintf("Error while leasing from the mail queue: %s", err))
+		}
+		if lease == nil {
+			time.Sleep(queuePollInterval)
+			continue
+		}
+		processLease(queue, lease, ds)
+	}
+}
+
+func processLease(queue Queue, lease *Lease, ds *datasource.DataSource) {
+	if lease.Attempts > maxDeliveryAttempts {
+		// The last attempts haven't finished, as the message bounces on its
+		// last attempt
+		logln(1, fmt.Sprintf("Giving up on %s after %d attempts", lease.ID, lease.Attempts))
+		if err := queue.DeadLetter(lease, "Too many attempts, the last error was: "+lease.LastError); err != nil {
+			logln(1, fmt.Sprintf("Error while releasing %s: %s", lease.ID, err))
+		}
+		return
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := queue.Renew(lease); err != nil {
+					logln(1, fmt.Sprintf("Error while renewing the lease of %s: %s", lease.ID, err))
+				}
+			}
+		}
+	}()
+
+	retry, err := deliver(lease, ds)
+	close(stop)
+	<-stopped
+
+	if err != nil && (time.Since(lease.Message.Received) >= maxDeliveryAge || lease.Attempts >= maxDeliveryAttempts) {
+		logln(1, fmt.Sprintf("Giving up on %s after %d attempts: %s", lease.ID, lease.Attempts, err))
+		err = queue.DeadLetter(lease, err.Error())
+	} else if err != nil || retry {
+		reason := pendingErrors(lease.Message)
+		if err != nil {
+			reason = err.Error()
+		}
+		delay := nextRetry(lease.Attempts)
+		logln(1, fmt.Sprintf("Retrying %s in %s: %s", lease.ID, delay, reason))
+		err = queue.Nack(lease, delay, reason)
+	} else {
+		err = queue.Ack(lease)
+	}
+	if err != nil {
+		logln(1, fmt.Sprintf("Error while releasing %s: %s", lease.ID, err))
+	}
+}
+
+// pendingErrors returns the last errors of the pending recipients
+func pendingErrors(msg *ClientMessage) string {
+	var errs []string
+	for _, r := range msg.Recipients {
+		if r.Status == recipientPending {
+			errs = append(errs, r.Email+": "+r.LastError)
+		}
+	}
+	return strings.Join(errs, "; ")
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func TestResolveGroupRecipients(t *testing.T) {
+	initTestVars(t)
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []*datasource.User{
+		{Email: "manager@cafebazaar.ir", Active: true, InboxAddr: "manager@inbox.example.com"},
+		{Email: "a@cafebazaar.ir", Active: true, InboxAddr: "a@inbox.example.com"},
+		{Email: "noinbox@cafebazaar.ir", Active: true},
+		{Email: "old@cafebazaar.ir", InboxAddr: "old@inbox.example.com"},
+		{Email: "Mixed.Case@cafebazaar.ir", Active: true, InboxAddr: "mixed@inbox.example.com"},
+	}
+	for _, u := range users {
+		if err := ds.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group := &datasource.Group{
+		Email:   "team@cafebazaar.ir",
+		Active:  true,
+		Manager: "manager@cafebazaar.ir",
+		Members: []string{"a@cafebazaar.ir", "manager@cafebazaar.ir", "noinbox@cafebazaar.ir", "old@cafebazaar.ir", "Mixed.Case@cafebazaar.ir", "A@cafebazaar.ir"},
+	}
+	if err := ds.CreateGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &ClientMessage{From: "sender@example.com", To: "Team@cafebazaar.ir"}
+	rcpts, err := resolveRecipients(msg, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := func(r Recipient) *Recipient {
+		r.Group, r.Manager = "team@cafebazaar.ir", "manager@cafebazaar.ir"
+		return &r
+	}
+	want := []*Recipient{
+		member(Recipient{Email: "manager@cafebazaar.ir", Address: "manager@inbox.example.com", Status: recipientPending}),
+		member(Recipient{Email: "a@cafebazaar.ir", Address: "a@inbox.example.com", Status: recipientPending}),
+		member(Recipient{Email: "noinbox@cafebazaar.ir", Status: recipientFailed, LastError: "550 5.2.1 Mailbox unavailable", Code: "5.2.1"}),
+		member(Recipient{Email: "old@cafebazaar.ir", Status: recipientFailed, LastError: "550 5.2.1 Mailbox unavailable", Code: "5.2.1"}),
+		member(Recipient{Email: "Mixed.Case@cafebazaar.ir", Address: "mixed@inbox.example.com", Status: recipientPending}),
+	}
+	if len(rcpts) != len(want) {
+		t.Fatalf("got %d recipients, want %d", len(rcpts), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(rcpts[i], want[i]) {
+			t.Errorf("recipient %d: got %+v, want %+v", i, *rcpts[i], *want[i])
+		}
+	}
+
+	direct := []struct {
+		to   string
+		want Recipient
+	}{
+		{"Mixed.Case@cafebazaar.ir", Recipient{Email: "Mixed.Case@cafebazaar.ir", Address: "mixed@inbox.example.com", Status: recipientPending}},
+		{"noinbox@cafebazaar.ir", Recipient{Email: "noinbox@cafebazaar.ir", Status: recipientFailed, LastError: "550 5.2.1 Mailbox unavailable", Code: "5.2.1"}},
+		{"old@cafebazaar.ir", Recipient{Email: "old@cafebazaar.ir", Status: recipientFailed, LastError: "550 5.2.1 Mailbox unavailable", Code: "5.2.1"}},
+		{"nobody@cafebazaar.ir", Recipient{Email: "nobody@cafebazaar.ir", Status: recipientFailed, LastError: "550 5.1.1 User unknown", Code: "5.1.1"}},
+	}
+	for _, tt := range direct {
+		msg = &ClientMessage{From: "sender@example.com", To: tt.to}
+		rcpts, err = resolveRecipients(msg, ds)
+		if err != nil || len(rcpts) != 1 || !reflect.DeepEqual(*rcpts[0], tt.want) {
+			t.Errorf("%s: got %v, %v; want %+v", tt.to, rcpts, err, tt.want)
+		}
+	}
+}
+
+func TestDeliverReportsMembersToManager(t *testing.T) {
+	initTestVars(t)
+	defer SetQueue(mailQueue)
+	q := NewMemoryQueue()
+	SetQueue(q)
+
+	failed := func(email, group, manager string) *Recipient {
+		return &Recipient{Email: email, Status: recipientFailed, LastError: "550 5.1.1 User unknown", Code: "5.1.1", Group: group, Manager: manager}
+	}
+	tests := []struct {
+		name  string
+		rcpts []*Recipient
+		to    string
+	}{
+		{"direct", []*Recipient{failed("b@cafebazaar.ir", "", "")}, "sender@example.com"},
+		{"member", []*Recipient{failed("b@cafebazaar.ir", "team@cafebazaar.ir", "manager@cafebazaar.ir")}, "manager@cafebazaar.ir"},
+		{"no manager", []*Recipient{failed("b@cafebazaar.ir", "team@cafebazaar.ir", "")}, ""},
+		{"failed manager", []*Recipient{
+			failed("b@cafebazaar.ir", "team@cafebazaar.ir", "manager@cafebazaar.ir"),
+			failed("Manager@cafebazaar.ir", "team@cafebazaar.ir", "manager@cafebazaar.ir"),
+		}, ""},
+	}
+	for _, tt := range tests {
+		msg := &ClientMessage{From: "sender@example.com", To: "team@cafebazaar.ir", Received: time.Now(), Recipients: tt.rcpts}
+		if _, err := deliver(&Lease{Message: msg}, nil); err != nil {
+			t.Fatal(err)
+		}
+		lease, err := q.Lease()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var to string
+		if lease != nil {
+			to = lease.Message.To
+			q.Ack(lease)
+		}
+		if to != tt.to {
+			t.Errorf("%s: the failures are reported to %q, want %q", tt.name, to, tt.to)
+		}
+		for _, r := range tt.rcpts {
+			if !r.Notified {
+				t.Errorf("%s: %s isn't marked as reported", tt.name, r.Email)
+			}
+		}
+	}
+}
+
+func TestProcessLeaseDeadLettersAfterMaxAttempts(t *testing.T) {
+	defer SetMaxDeliveryAttempts(maxDeliveryAttempts)
+	SetMaxDeliveryAttempts(1)
+
+	q := NewMemoryQueue()
+	if err := q.Enqueue(&ClientMessage{From: "a@example.com", To: "b@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Lease(); err != nil {
+		t.Fatal(err)
+	}
+	// The worker has stopped
+	expireLeases(t, q, time.Second)
+	lease, err := q.Lease()
+	if err != nil || lease == nil || lease.Attempts != 2 {
+		t.Fatalf("got lease %+v, %v; want the second attempt", lease, err)
+	}
+
+	processLease(q, lease, nil)
+	if len(q.dead) != 1 || q.dead[0].ID != lease.ID {
+		t.Errorf("got dead letters %v, want %s", q.dead, lease.ID)
+	}
+	if l, err := q.Lease(); l != nil || err != nil {
+		t.Errorf("got lease %v, %v after dead lettering; want none", l, err)
+	}
+}
@@ -0,0 +1,110 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The actions of the delivery status notifications
+const (
+	dsnFailed  = "failed"
+	dsnDelayed = "delayed"
+)
+
+// mailerDaemon is the sender of the delivery status notifications
+func mailerDaemon() string {
+	return "MAILER-DAEMON@" + gConfig["GM_PRIMARY_MAIL_HOST"]
+}
+
+// newDSN returns the delivery status notification (RFC 3464) of the
+// recipients of msg to its sender. action is dsnFailed for the bounces, and
+// dsnDelayed for the warnings of the recipients which are still retried.
+func newDSN(msg *ClientMessage, rcpts []*Recipient, action string) *ClientMessage {
+	now := time.Now()
+	boundary := md5hex(msg.From + msg.To + fmt.Sprint(now.UnixNano()))
+
+	subject := "Undelivered Mail Returned to Sender"
+	explanation := "Your message couldn't be delivered to the following recipients:"
+	if action == dsnDelayed {
+		subject = "Delayed Mail (still being retried)"
+		explanation = fmt.Sprintf("Your message couldn't be delivered yet to the following recipients. "+
+			"It will be retried until %s.", msg.Received.Add(maxDeliveryAge).Format(time.RFC1123Z))
+	}
+
+	headers := []string{
+		"From: Mail Delivery System <" + mailerDaemon() + ">",
+		"To: <" + msg.From + ">",
+		"Subject: " + subject,
+		"Date: " + now.Format(time.RFC1123Z),
+		"Message-ID: <" + boundary + "@" + gConfig["GM_PRIMARY_MAIL_HOST"] + ">",
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + boundary + "\"",
+	}
+
+	human := []string{explanation, ""}
+	status := []string{
+		"Reporting-MTA: dns; " + gConfig["GSMTP_HOST_NAME"],
+		"Arrival-Date: " + msg.Received.Format(time.RFC1123Z),
+	}
+	for _, r := range rcpts {
+		human = append(human, "<"+r.Email+">: "+r.LastError)
+		status = append(status,
+			"",
+			"Final-Recipient: rfc822; "+r.Email,
+			"Action: "+action,
+			"Status: "+r.Code,
+		)
+		if len(r.LastError) > 3 && strings.Trim(r.LastError[:3], "0123456789") == "" {
+			status = append(status, "Diagnostic-Code: smtp; "+r.LastError)
+		}
+		if r.Attempts > 0 {
+			status = append(status, "Last-Attempt-Date: "+now.Format(time.RFC1123Z))
+		}
+		if action == dsnDelayed {
+			status = append(status, "Will-Retry-Until: "+msg.Received.Add(maxDeliveryAge).Format(time.RFC1123Z))
+		}
+	}
+
+	parts := []string{
+		"This is a MIME-encapsulated message.",
+		"",
+		"--" + boundary,
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		strings.Join(human, "\r\n"),
+		"",
+		"--" + boundary,
+		"Content-Type: message/delivery-status",
+		"",
+		strings.Join(status, "\r\n"),
+		"",
+		"--" + boundary,
+		"Content-Type: text/rfc822-headers",
+		"",
+		messageHeaders(msg.Data),
+		"",
+		"--" + boundary + "--",
+	}
+
+	return &ClientMessage{
+		// The null reverse path, so the notifications never bounce
+		From:     "",
+		To:       msg.From,
+		Auth:     true,
+		Data:     strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Join(parts, "\r\n") + "\r\n",
+		Subject:  subject,
+		Received: now,
+	}
+}
+
+// messageHeaders returns the header of the message, in CRLF lines
+func messageHeaders(data string) string {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	if i := strings.Index(data, "\n\n"); i >= 0 {
+		data = data[:i]
+	}
+	data = strings.TrimRight(data, "\n")
+	return strings.Replace(data, "\n", "\r\n", -1)
+}
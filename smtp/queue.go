@@ -0,0 +1,140 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Queue keeps the accepted mails until they're delivered. The workers lease
+// the messages one at a time, and either ack them when they're done, nack
+// them to be leased again later, or move them to the dead letters.
+//
+// A lease expires after leaseTimeout unless it's renewed, and the message is
+// then leased again, so the messages of the workers which crash aren't lost.
+// The expired leases can't be acked, nacked or renewed anymore: they fail
+// with errNotLeased.
+//
+// mailQueue is set by SetQueue, and is a RedisQueue, a SpoolQueue or a
+// MemoryQueue.
+type Queue interface {
+	// Enqueue adds the messages, either all of them or none
+	Enqueue(msgs ...*ClientMessage) error
+	// Lease takes the next message which is due, or returns nil if there's
+	// none. The message isn't leased again until it's nacked, or the lease
+	// expires.
+	Lease() (*Lease, error)
+	// Renew extends the lease to leaseTimeout from now
+	Renew(l *Lease) error
+	// Ack removes the leased message from the queue
+	Ack(l *Lease) error
+	// Nack returns the leased message to the queue, to be leased again after
+	// delay. reason is kept with it.
+	Nack(l *Lease, delay time.Duration, reason string) error
+	// DeadLetter moves the leased message to the dead letters, which are
+	// only kept to be looked into
+	DeadLetter(l *Lease, reason string) error
+}
+
+// Lease is a message taken from the Queue
+type Lease struct {
+	ID string
+	// Attempts counts the leases of the message, including this one
+	Attempts int
+	// LastError is the reason of the last nack
+	LastError string
+	Message   *ClientMessage
+
+	// token identifies the lease, for the Queue
+	token string
+}
+
+// leaseTimeout is how long a lease lasts if it isn't renewed
+const leaseTimeout = 5 * time.Minute
+
+var (
+	errNoQueue   = errors.New("The mail queue isn't set")
+	errNotLeased = errors.New("The message isn't leased, or the lease has expired")
+)
+
+var mailQueue Queue
+
+// SetQueue sets the queue of the mails, both of the ones which are received
+// and of SendSystemMail. It must be called before Serve.
+func SetQueue(q Queue) {
+	mailQueue = q
+}
+
+// queuedMessage is how the messages are kept in the queues
+type queuedMessage struct {
+	ID        string         `json:"id"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"lastError,omitempty"`
+	Message   *ClientMessage `json:"message"`
+}
+
+// newToken returns a random hex token of n bytes
+func newToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newQueuedMessage gives the message a new id, which sorts by the time it's
+// queued
+func newQueuedMessage(msg *ClientMessage) (*queuedMessage, error) {
+	token, err := newToken(8)
+	if err != nil {
+		return nil, err
+	}
+	return &queuedMessage{
+		ID:      fmt.Sprintf("%020d-%s", time.Now().UnixNano(), token),
+		Message: msg,
+	}, nil
+}
+
+// decodeQueuedMessage decodes a queued message. The ones queued by the older
+// versions are plain ClientMessages, without an id.
+func decodeQueuedMessage(data []byte) (*queuedMessage, error) {
+	var qm queuedMessage
+	err := json.Unmarshal(data, &qm)
+	if err != nil {
+		return nil, err
+	}
+	if qm.Message == nil {
+		var msg ClientMessage
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			return nil, err
+		}
+		qm.ID = "legacy-" + md5hex(string(data))
+		qm.Message = &msg
+	}
+	return &qm, nil
+}
+
+// lease returns the lease of the message, which is leased as token
+func (qm *queuedMessage) lease(token string) *Lease {
+	return &Lease{
+		ID:        qm.ID,
+		Attempts:  qm.Attempts + 1,
+		LastError: qm.LastError,
+		Message:   qm.Message,
+		token:     token,
+	}
+}
+
+// leased returns the message as it's queued again after the lease
+func leased(l *Lease, reason string) *queuedMessage {
+	return &queuedMessage{
+		ID:        l.ID,
+		Attempts:  l.Attempts,
+		LastError: reason,
+		Message:   l.Message,
+	}
+}
@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is a Queue which is lost on restarts, for tests and
+// development
+type MemoryQueue struct {
+	mu sync.Mutex
+	// ready is sorted by due
+	ready []*memoryItem
+	// leased is by the tokens of the leases
+	leased map[string]*memoryItem
+	dead   []*queuedMessage
+}
+
+// memoryItem is a queued message, and when it's due or its lease expires
+type memoryItem struct {
+	due time.Time
+	qm  *queuedMessage
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{leased: make(map[string]*memoryItem)}
+}
+
+func (q *MemoryQueue) Enqueue(msgs ...*ClientMessage) error {
+	var items []*memoryItem
+	now := time.Now()
+	for _, msg := range msgs {
+		qm, err := newQueuedMessage(msg)
+		if err != nil {
+			return err
+		}
+		items = append(items, &memoryItem{due: now, qm: qm})
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range items {
+		q.insert(item)
+	}
+	return nil
+}
+
+func (q *MemoryQueue) insert(item *memoryItem) {
+	i := sort.Search(len(q.ready), func(i int) bool {
+		return q.ready[i].due.After(item.due)
+	})
+	q.ready = append(q.ready, nil)
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = item
+}
+
+func (q *MemoryQueue) Lease() (*Lease, error) {
+	token, err := newToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for t, item := range q.leased {
+		if item.due.Before(now) {
+			// The expired lease counts as an attempt
+			delete(q.leased, t)
+			qm := *item.qm
+			qm.Attempts++
+			q.insert(&memoryItem{due: now, qm: &qm})
+		}
+	}
+
+	if len(q.ready) == 0 || q.ready[0].due.After(now) {
+		return nil, nil
+	}
+	qm := q.ready[0].qm
+	q.ready = q.ready[1:]
+	q.leased[token] = &memoryItem{due: now.Add(leaseTimeout), qm: qm}
+	return qm.lease(token), nil
+}
+
+// take ends the lease, if it hasn't expired
+func (q *MemoryQueue) take(l *Lease) error {
+	item, found := q.leased[l.token]
+	if !found || item.due.Before(time.Now()) {
+		return errNotLeased
+	}
+	delete(q.leased, l.token)
+	return nil
+}
+
+func (q *MemoryQueue) Renew(l *Lease) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, found := q.leased[l.token]
+	if !found || item.due.Before(time.Now()) {
+		return errNotLeased
+	}
+	item.due = time.Now().Add(leaseTimeout)
+	return nil
+}
+
+func (q *MemoryQueue) Ack(l *Lease) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.take(l)
+}
+
+func (q *MemoryQueue) Nack(l *Lease, delay time.Duration, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.take(l); err != nil {
+		return err
+	}
+	q.insert(&memoryItem{due: time.Now().Add(delay), qm: leased(l, reason)})
+	return nil
+}
+
+func (q *MemoryQueue) DeadLetter(l *Lease, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.take(l); err != nil {
+		return err
+	}
+	q.dead = append(q.dead, leased(l, reason))
+	return nil
+}
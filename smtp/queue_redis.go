@@ -0,0 +1,232 @@
+package smtp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisQueue is a Queue in Redis, which can be shared by the bahram
+// instances. Under its key are:
+//
+//	<key>            the list of the ready messages, oldest on the right
+//	<key>:delayed    the sorted set of the nacked messages, by when they're due
+//	<key>:leases     the hash of the leased messages, by the lease tokens
+//	<key>:deadlines  the sorted set of the lease tokens, by when they expire
+//	<key>:dead       the list of the dead letters
+//	<key>:expired    the hash of how many leases of the messages have expired,
+//	                 by their ids, which are counted as attempts
+//
+// The times are in Unix milliseconds. The moves between them are made by Lua
+// scripts, so they're atomic.
+type RedisQueue struct {
+	pool *redis.Pool
+	key  string
+}
+
+// messageIDScript is the Lua function which returns the id of a queued
+// message, or false for the ones queued by the older versions
+const messageIDScript = `
+local function messageID(raw)
+	local ok, msg = pcall(cjson.decode, raw)
+	if ok and type(msg) == 'table' and type(msg.id) == 'string' then
+		return msg.id
+	end
+	return false
+end
+`
+
+// leaseScript returns the expired leases and the due messages to the ready
+// list, ahead of the others, and leases the oldest ready message. It returns
+// the message and how many of its leases have expired.
+var leaseScript = redis.NewScript(5, messageIDScript+`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[4], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, token in ipairs(expired) do
+	local raw = redis.call('HGET', KEYS[3], token)
+	redis.call('HDEL', KEYS[3], token)
+	redis.call('ZREM', KEYS[4], token)
+	if raw then
+		local id = messageID(raw)
+		if id then
+			redis.call('HINCRBY', KEYS[5], id, 1)
+		end
+		redis.call('RPUSH', KEYS[1], raw)
+	end
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, raw in ipairs(due) do
+	redis.call('ZREM', KEYS[2], raw)
+	redis.call('RPUSH', KEYS[1], raw)
+end
+local raw = redis.call('RPOP', KEYS[1])
+if not raw then
+	return false
+end
+redis.call('HSET', KEYS[3], ARGV[3], raw)
+redis.call('ZADD', KEYS[4], ARGV[2], ARGV[3])
+local id = messageID(raw)
+local n = 0
+if id then
+	n = tonumber(redis.call('HGET', KEYS[5], id)) or 0
+end
+return {raw, n}
+`)
+
+// renewScript extends a lease which hasn't expired
+var renewScript = redis.NewScript(1, `
+local deadline = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) < tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// releaseScript ends a lease which hasn't expired, and then either drops the
+// message (ARGV[3] is "ack"), adds it to the delayed ones ("nack", with the
+// due time and the message as ARGV[4] and ARGV[5]) or to the dead letters
+// ("dead", with the message as ARGV[5]). The expired leases of the message,
+// whose id is ARGV[6], are counted in its attempts then, so they're dropped.
+var releaseScript = redis.NewScript(5, `
+local deadline = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if not deadline or tonumber(deadline) < tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+if ARGV[6] ~= '' then
+	redis.call('HDEL', KEYS[5], ARGV[6])
+end
+if ARGV[3] == 'nack' then
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[5])
+elseif ARGV[3] == 'dead' then
+	redis.call('LPUSH', KEYS[4], ARGV[5])
+end
+return 1
+`)
+
+// NewRedisQueue returns the queue under key, email_queue if it's empty, in
+// the Redis server at address
+func NewRedisQueue(address, key string) *RedisQueue {
+	if key == "" {
+		key = "email_queue"
+	}
+	return &RedisQueue{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address)
+			},
+		},
+		key: key,
+	}
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (q *RedisQueue) Enqueue(msgs ...*ClientMessage) error {
+	args := []interface{}{q.key}
+	for _, msg := range msgs {
+		qm, err := newQueuedMessage(msg)
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(qm)
+		if err != nil {
+			return err
+		}
+		args = append(args, raw)
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("LPUSH", args...)
+	return err
+}
+
+func (q *RedisQueue) Lease() (*Lease, error) {
+	token, err := newToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	reply, err := redis.Values(leaseScript.Do(conn,
+		q.key, q.key+":delayed", q.key+":leases", q.key+":deadlines", q.key+":expired",
+		unixMillis(now), unixMillis(now.Add(leaseTimeout)), token))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var raw string
+	var expired int
+	if _, err := redis.Scan(reply, &raw, &expired); err != nil {
+		return nil, err
+	}
+
+	qm, err := decodeQueuedMessage([]byte(raw))
+	if err != nil {
+		// It can't ever be delivered
+		q.release(token, "", "dead", 0, raw)
+		return nil, err
+	}
+	qm.Attempts += expired
+	return qm.lease(token), nil
+}
+
+func (q *RedisQueue) Renew(l *Lease) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	n, err := redis.Int(renewScript.Do(conn, q.key+":deadlines",
+		l.token, unixMillis(now), unixMillis(now.Add(leaseTimeout))))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotLeased
+	}
+	return nil
+}
+
+func (q *RedisQueue) release(token, id, mode string, due int64, raw interface{}) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(releaseScript.Do(conn,
+		q.key+":leases", q.key+":deadlines", q.key+":delayed", q.key+":dead", q.key+":expired",
+		token, unixMillis(time.Now()), mode, due, raw, id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotLeased
+	}
+	return nil
+}
+
+func (q *RedisQueue) Ack(l *Lease) error {
+	return q.release(l.token, l.ID, "ack", 0, "")
+}
+
+func (q *RedisQueue) Nack(l *Lease, delay time.Duration, reason string) error {
+	raw, err := json.Marshal(leased(l, reason))
+	if err != nil {
+		return err
+	}
+	return q.release(l.token, l.ID, "nack", unixMillis(time.Now().Add(delay)), raw)
+}
+
+func (q *RedisQueue) DeadLetter(l *Lease, reason string) error {
+	raw, err := json.Marshal(leased(l, reason))
+	if err != nil {
+		return err
+	}
+	return q.release(l.token, l.ID, "dead", 0, raw)
+}
@@ -0,0 +1,402 @@
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpoolQueue is a Queue in a local directory, for the deployments without
+// Redis. Each message is a file:
+//
+//	new/<due>-<id>                the ready and the nacked messages
+//	cur/<deadline>-<token>-<id>   the leased messages
+//	dead/<id>                     the dead letters
+//	tmp/                          the files being written
+//
+// The times are in Unix nanoseconds. The files are written in tmp and
+// renamed, so they're never seen half written, and leased by renaming them
+// to cur, so a message is leased once even if the directory is shared by
+// several processes. The directories are synced after each rename, so the
+// renames aren't lost if the machine crashes. The leases which expire are
+// renamed back to new by the next Lease.
+type SpoolQueue struct {
+	dir string
+}
+
+const (
+	// dueLength is the length of the times in the names
+	dueLength = 20
+	// tokenLength is the length of the lease tokens in the names in cur
+	tokenLength = 32
+	// doneSuffix marks the leases being nacked or dead lettered
+	doneSuffix = ".done"
+)
+
+func NewSpoolQueue(dir string) (*SpoolQueue, error) {
+	for _, sub := range []string{"new", "cur", "dead", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SpoolQueue{dir: dir}, nil
+}
+
+func (q *SpoolQueue) path(sub, name string) string {
+	return filepath.Join(q.dir, sub, name)
+}
+
+// syncDir flushes the entries of the directory to the disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rename renames fromSub/from to toSub/to, and syncs both directories
+func (q *SpoolQueue) rename(fromSub, from, toSub, to string) error {
+	err := os.Rename(q.path(fromSub, from), q.path(toSub, to))
+	if err != nil {
+		return err
+	}
+	if fromSub != toSub {
+		if err := syncDir(filepath.Join(q.dir, fromSub)); err != nil {
+			return err
+		}
+	}
+	return syncDir(filepath.Join(q.dir, toSub))
+}
+
+// write writes the message to sub/name, through tmp
+func (q *SpoolQueue) write(sub, name string, qm *queuedMessage) error {
+	data, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Join(q.dir, "tmp"), name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = q.rename("tmp", filepath.Base(f.Name()), sub, name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func newSpoolName(due time.Time, id string) string {
+	return fmt.Sprintf("%0*d-%s", dueLength, due.UnixNano(), id)
+}
+
+func curSpoolName(deadline time.Time, token, id string) string {
+	return fmt.Sprintf("%0*d-%s-%s", dueLength, deadline.UnixNano(), token, id)
+}
+
+// parseSpoolName returns the time and the rest of a name in new or cur
+func parseSpoolName(name string) (int64, string, bool) {
+	if len(name) <= dueLength+1 || name[dueLength] != '-' {
+		return 0, "", false
+	}
+	t, err := strconv.ParseInt(name[:dueLength], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return t, name[dueLength+1:], true
+}
+
+// curID returns the id of the message of a name in cur
+func curID(name string) (string, bool) {
+	_, rest, ok := parseSpoolName(strings.TrimSuffix(name, doneSuffix))
+	if !ok || len(rest) <= tokenLength+1 {
+		return "", false
+	}
+	return rest[tokenLength+1:], true
+}
+
+func (q *SpoolQueue) readNames(sub string) ([]string, error) {
+	dir, err := os.Open(filepath.Join(q.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// reclaim moves the expired leases back to new, counting them as attempts.
+// The leases being released are only reclaimed once they're leaseTimeout
+// late, as the process releasing them has stopped then, and are dropped if
+// the message has been written already.
+func (q *SpoolQueue) reclaim(now time.Time) error {
+	names, err := q.readNames("cur")
+	if err != nil {
+		return err
+	}
+	var written map[string]bool
+	for _, name := range names {
+		deadline, _, ok := parseSpoolName(name)
+		if !ok {
+			continue
+		}
+		if deadline >= now.UnixNano() {
+			// The rest haven't expired either
+			break
+		}
+		id, ok := curID(name)
+		if !ok {
+			continue
+		}
+		done := strings.HasSuffix(name, doneSuffix)
+		if done {
+			if deadline >= now.Add(-leaseTimeout).UnixNano() {
+				continue
+			}
+			if written == nil {
+				written, err = q.writtenIDs()
+				if err != nil {
+					return err
+				}
+			}
+			if written[id] {
+				err = os.Remove(q.path("cur", name))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				continue
+			}
+		}
+		err = q.reclaimLease(now, name, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writtenIDs returns the ids of the messages in new and dead
+func (q *SpoolQueue) writtenIDs() (map[string]bool, error) {
+	ids := make(map[string]bool)
+	for _, sub := range []string{"new", "dead"} {
+		names, err := q.readNames(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if sub == "new" {
+				_, name, _ = parseSpoolName(name)
+			}
+			ids[name] = true
+		}
+	}
+	return ids, nil
+}
+
+// reclaimLease moves the expired lease cur/name to new. It's taken first by
+// renaming it to a done lease which expires now, so it's reclaimed by a
+// single process, and again if the process stops meanwhile.
+func (q *SpoolQueue) reclaimLease(now time.Time, name, id string) error {
+	token, err := newToken(tokenLength / 2)
+	if err != nil {
+		return err
+	}
+	taken := curSpoolName(now, token, id) + doneSuffix
+	err = q.rename("cur", name, "cur", taken)
+	if os.IsNotExist(err) {
+		// Reclaimed by another process
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(q.path("cur", taken))
+	if err != nil {
+		return err
+	}
+	qm, err := decodeQueuedMessage(data)
+	if err != nil {
+		// It can't ever be delivered
+		return q.rename("cur", taken, "dead", id)
+	}
+	qm.Attempts++
+	err = q.write("new", newSpoolName(now, id), qm)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(q.path("cur", taken))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(q.dir, "cur"))
+}
+
+func (q *SpoolQueue) Enqueue(msgs ...*ClientMessage) error {
+	var written []string
+	now := time.Now()
+	for _, msg := range msgs {
+		qm, err := newQueuedMessage(msg)
+		if err != nil {
+			return err
+		}
+		name := newSpoolName(now, qm.ID)
+		err = q.write("new", name, qm)
+		if err != nil {
+			for _, w := range written {
+				os.Remove(q.path("new", w))
+			}
+			return err
+		}
+		written = append(written, name)
+	}
+	return nil
+}
+
+func (q *SpoolQueue) Lease() (*Lease, error) {
+	now := time.Now()
+	if err := q.reclaim(now); err != nil {
+		return nil, err
+	}
+	names, err := q.readNames("new")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		due, id, ok := parseSpoolName(name)
+		if !ok {
+			continue
+		}
+		if due > now.UnixNano() {
+			// The rest aren't due either
+			return nil, nil
+		}
+
+		token, err := newToken(tokenLength / 2)
+		if err != nil {
+			return nil, err
+		}
+		cur := curSpoolName(now.Add(leaseTimeout), token, id)
+		err = q.rename("new", name, "cur", cur)
+		if os.IsNotExist(err) {
+			// Leased by another process
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(q.path("cur", cur))
+		if err != nil {
+			return nil, err
+		}
+		qm, err := decodeQueuedMessage(data)
+		if err != nil {
+			// It can't ever be delivered
+			q.rename("cur", cur, "dead", id)
+			return nil, err
+		}
+		return qm.lease(cur), nil
+	}
+	return nil, nil
+}
+
+// checkLeased returns errNotLeased if the lease has expired, even if it
+// hasn't been reclaimed yet
+func (q *SpoolQueue) checkLeased(l *Lease) error {
+	deadline, _, ok := parseSpoolName(l.token)
+	if !ok || deadline < time.Now().UnixNano() {
+		return errNotLeased
+	}
+	return nil
+}
+
+func (q *SpoolQueue) Renew(l *Lease) error {
+	if err := q.checkLeased(l); err != nil {
+		return err
+	}
+	id, _ := curID(l.token)
+	token, err := newToken(tokenLength / 2)
+	if err != nil {
+		return err
+	}
+	cur := curSpoolName(time.Now().Add(leaseTimeout), token, id)
+	err = q.rename("cur", l.token, "cur", cur)
+	if os.IsNotExist(err) {
+		return errNotLeased
+	} else if err != nil {
+		return err
+	}
+	l.token = cur
+	return nil
+}
+
+func (q *SpoolQueue) Ack(l *Lease) error {
+	if err := q.checkLeased(l); err != nil {
+		return err
+	}
+	err := os.Remove(q.path("cur", l.token))
+	if os.IsNotExist(err) {
+		return errNotLeased
+	} else if err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(q.dir, "cur"))
+}
+
+// release ends the lease and writes the message to sub/name. The lease is
+// marked done first, so it can't be reclaimed meanwhile, but is still
+// reclaimed if the process stops before the message is written.
+func (q *SpoolQueue) release(l *Lease, sub, name, reason string) error {
+	if err := q.checkLeased(l); err != nil {
+		return err
+	}
+	done := l.token + doneSuffix
+	err := q.rename("cur", l.token, "cur", done)
+	if os.IsNotExist(err) {
+		return errNotLeased
+	} else if err != nil {
+		return err
+	}
+	err = q.write(sub, name, leased(l, reason))
+	if err != nil {
+		q.rename("cur", done, "cur", l.token)
+		return err
+	}
+	err = os.Remove(q.path("cur", done))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(q.dir, "cur"))
+}
+
+func (q *SpoolQueue) Nack(l *Lease, delay time.Duration, reason string) error {
+	return q.release(l, "new", newSpoolName(time.Now().Add(delay), l.ID), reason)
+}
+
+func (q *SpoolQueue) DeadLetter(l *Lease, reason string) error {
+	return q.release(l, "dead", l.ID, reason)
+}
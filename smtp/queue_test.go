@@ -0,0 +1,309 @@
+package smtp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// testQueues calls f with each of the Queue implementations. The RedisQueue
+// is skipped unless there's a Redis server at BAHRAM_TEST_REDIS.
+func testQueues(t *testing.T, f func(t *testing.T, q Queue)) {
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryQueue())
+	})
+	t.Run("spool", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bahram-spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		q, err := NewSpoolQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(t, q)
+	})
+	t.Run("redis", func(t *testing.T) {
+		address := os.Getenv("BAHRAM_TEST_REDIS")
+		if address == "" {
+			t.Skip("BAHRAM_TEST_REDIS isn't set")
+		}
+		token, err := newToken(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := NewRedisQueue(address, "bahram-test-"+token)
+		defer func() {
+			conn := q.pool.Get()
+			defer conn.Close()
+			for _, suffix := range []string{"", ":delayed", ":leases", ":deadlines", ":dead", ":expired"} {
+				conn.Do("DEL", q.key+suffix)
+			}
+		}()
+		f(t, q)
+	})
+}
+
+func testMessage(to string) *ClientMessage {
+	return &ClientMessage{From: "a@example.com", To: to}
+}
+
+// mustLease leases the next message, which must be to
+func mustLease(t *testing.T, q Queue, to string) *Lease {
+	l, err := q.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l == nil || l.Message.To != to {
+		t.Fatalf("got lease %+v, want the message to %s", l, to)
+	}
+	return l
+}
+
+func mustBeEmpty(t *testing.T, q Queue) {
+	if l, err := q.Lease(); l != nil || err != nil {
+		t.Fatalf("got lease %+v, %v; want none", l, err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	testQueues(t, func(t *testing.T, q Queue) {
+		mustBeEmpty(t, q)
+		if err := q.Enqueue(testMessage("1@example.com"), testMessage("2@example.com")); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Enqueue(testMessage("3@example.com")); err != nil {
+			t.Fatal(err)
+		}
+
+		// In the order they're queued
+		first := mustLease(t, q, "1@example.com")
+		if first.Attempts != 1 || first.LastError != "" {
+			t.Errorf("got attempts %d and error %q, want the first attempt", first.Attempts, first.LastError)
+		}
+		second := mustLease(t, q, "2@example.com")
+		third := mustLease(t, q, "3@example.com")
+		mustBeEmpty(t, q)
+
+		if err := q.Renew(first); err != nil {
+			t.Error(err)
+		}
+		if err := q.Nack(first, time.Hour, "421 Try again later"); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Nack(second, 0, "421 Try again"); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.DeadLetter(third, "550 No such user"); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range []*Lease{first, second, third} {
+			if err := q.Ack(l); err != errNotLeased {
+				t.Errorf("acking %s after its release: got %v, want %v", l.Message.To, err, errNotLeased)
+			}
+			if err := q.Renew(l); err != errNotLeased {
+				t.Errorf("renewing %s after its release: got %v, want %v", l.Message.To, err, errNotLeased)
+			}
+		}
+
+		// Only the one nacked without a delay is due
+		again := mustLease(t, q, "2@example.com")
+		if again.ID != second.ID || again.Attempts != 2 || again.LastError != "421 Try again" {
+			t.Errorf("got %+v after the nack, want %s attempted once", again, second.ID)
+		}
+		mustBeEmpty(t, q)
+		if err := q.Ack(again); err != nil {
+			t.Fatal(err)
+		}
+		mustBeEmpty(t, q)
+
+		if err := q.Enqueue(testMessage("4@example.com")); err != nil {
+			t.Fatal(err)
+		}
+		expired := mustLease(t, q, "4@example.com")
+		expireLeases(t, q, time.Second)
+		for name, release := range map[string]func() error{
+			"acking":         func() error { return q.Ack(expired) },
+			"renewing":       func() error { return q.Renew(expired) },
+			"nacking":        func() error { return q.Nack(expired, 0, "") },
+			"dead lettering": func() error { return q.DeadLetter(expired, "") },
+		} {
+			if err := release(); err != errNotLeased {
+				t.Errorf("%s the expired lease: got %v, want %v", name, err, errNotLeased)
+			}
+		}
+		// The expired lease counts as an attempt
+		reclaimed := mustLease(t, q, "4@example.com")
+		if reclaimed.ID != expired.ID || reclaimed.Attempts != 2 {
+			t.Errorf("got %+v after the lease expired, want %s attempted once", reclaimed, expired.ID)
+		}
+		if err := q.Nack(reclaimed, 0, "421 Try again"); err != nil {
+			t.Fatal(err)
+		}
+		if l := mustLease(t, q, "4@example.com"); l.Attempts != 3 {
+			t.Errorf("got %d attempts after the nack, want 3", l.Attempts)
+		}
+	})
+}
+
+func TestSpoolQueueSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bahram-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewSpoolQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&ClientMessage{From: "a@example.com", To: "b@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := q.Lease()
+	if err != nil || lease == nil {
+		t.Fatalf("got lease %v, %v; want the message", lease, err)
+	}
+	if err := q.Nack(lease, 0, "421 Try again"); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"tmp", "cur"} {
+		names, err := q.readNames(sub)
+		if err != nil || len(names) != 0 {
+			t.Errorf("%s: got %v, %v; want it empty", sub, names, err)
+		}
+	}
+
+	// Another process, after a restart
+	q, err = NewSpoolQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := q.Lease()
+	if err != nil || again == nil {
+		t.Fatalf("got lease %v, %v; want the nacked message", again, err)
+	}
+	if again.ID != lease.ID || again.Attempts != 2 || again.LastError != "421 Try again" || again.Message.To != "b@example.com" {
+		t.Errorf("got %+v after the restart, want %s attempted once", again, lease.ID)
+	}
+	if err := q.Renew(again); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(again); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := q.Lease(); l != nil || err != nil {
+		t.Errorf("got lease %v, %v after the ack; want none", l, err)
+	}
+	if err := q.Ack(again); err != errNotLeased {
+		t.Errorf("acking twice: got %v, want %v", err, errNotLeased)
+	}
+}
+
+// expireLeases moves the deadlines of the leases of the queue back to ago
+func expireLeases(t *testing.T, q Queue, ago time.Duration) {
+	deadline := time.Now().Add(-ago)
+	switch q := q.(type) {
+	case *MemoryQueue:
+		for _, item := range q.leased {
+			item.due = deadline
+		}
+	case *SpoolQueue:
+		names, err := q.readNames("cur")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			_, rest, _ := parseSpoolName(name)
+			expired := fmt.Sprintf("%0*d-%s", dueLength, deadline.UnixNano(), rest)
+			if err := os.Rename(q.path("cur", name), q.path("cur", expired)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	case *RedisQueue:
+		conn := q.pool.Get()
+		defer conn.Close()
+		tokens, err := redis.Strings(conn.Do("ZRANGE", q.key+":deadlines", 0, -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range tokens {
+			if _, err := conn.Do("ZADD", q.key+":deadlines", unixMillis(deadline), token); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSpoolQueueWaitsForReleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bahram-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewSpoolQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&ClientMessage{From: "a@example.com", To: "b@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := q.Lease()
+	if err != nil || lease == nil {
+		t.Fatalf("got lease %v, %v; want the message", lease, err)
+	}
+	// Being nacked by a process
+	if err := os.Rename(q.path("cur", lease.token), q.path("cur", lease.token+doneSuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	expireLeases(t, q, time.Second)
+	if l, err := q.Lease(); l != nil || err != nil {
+		t.Errorf("got lease %v, %v while the message is released; want none", l, err)
+	}
+	expireLeases(t, q, leaseTimeout+time.Second)
+	l, err := q.Lease()
+	if err != nil || l == nil || l.ID != lease.ID || l.Attempts != 2 {
+		t.Errorf("got lease %+v, %v after the release stopped; want the second attempt", l, err)
+	}
+}
+
+func TestSpoolQueueDropsWrittenReleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bahram-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewSpoolQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&ClientMessage{From: "a@example.com", To: "b@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := q.Lease()
+	if err != nil || lease == nil {
+		t.Fatalf("got lease %v, %v; want the message", lease, err)
+	}
+	// Dead lettered by a process which stopped before removing the lease
+	done := lease.token + doneSuffix
+	if err := os.Rename(q.path("cur", lease.token), q.path("cur", done)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.write("dead", lease.ID, leased(lease, "550 No such user")); err != nil {
+		t.Fatal(err)
+	}
+
+	expireLeases(t, q, leaseTimeout+time.Second)
+	if l, err := q.Lease(); l != nil || err != nil {
+		t.Errorf("got lease %v, %v of the dead letter; want none", l, err)
+	}
+	if names, err := q.readNames("cur"); err != nil || len(names) != 0 {
+		t.Errorf("got leases %v, %v; want them dropped", names, err)
+	}
+}
@@ -8,14 +8,11 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/smtp"
 	"regexp"
 	"strconv"
 	"strings"
@@ -23,7 +20,6 @@ import (
 
 	"github.com/cafebazaar/bahram/datasource"
 	"github.com/cafebazaar/blacksmith/logging"
-	"github.com/garyburd/redigo/redis"
 	"github.com/sloonz/go-iconv"
 	"github.com/sloonz/go-qprintable"
 )
@@ -32,17 +28,11 @@ const (
 	debugTag = "SMTP"
 )
 
-type redisClient struct {
-	count int
-	conn  redis.Conn
-	time  int
-}
-
 type Client struct {
 	state       int
 	helo        string
 	mail_from   string
-	rcpt_to     string
+	rcpt_to     []string
 	read_buffer string
 	response    string
 	address     string
@@ -54,6 +44,9 @@ type Client struct {
 	time        int64
 	tls_on      bool
 	auth        bool
+	// xclient is whether the client is a trusted proxy, which may pass on
+	// the address of its client with XCLIENT
+	xclient     bool
 	conn        net.Conn
 	bufin       *bufio.Reader
 	bufout      *bufio.Writer
@@ -70,6 +63,13 @@ type ClientMessage struct {
 	Subject  string
 	Username string
 	Auth     bool
+
+	// Received is when the message is queued
+	Received time.Time
+	// Recipients is the delivery state of the final recipients, see deliver
+	Recipients []*Recipient
+	// DelayNotified is whether the sender is warned of the delay
+	DelayNotified bool
 }
 
 var gConfig = map[string]string{
@@ -98,6 +98,50 @@ var max_size int // max email DATA size
 var timeout time.Duration
 var allowedHosts = make(map[string]bool, 15)
 
+// trustedProxies are the networks of the proxies which may send XCLIENT, from
+// BAHRAM_SMTP_TRUSTED_PROXIES
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the comma separated CIDRs or IPs
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy: %s", item)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %s", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether the connection comes from a trusted proxy
+func isTrustedProxy(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func initVar() {
 	sem = make(chan int, 50)
 	SaveMailChan = make(chan *Client, 5)
@@ -119,8 +163,19 @@ func initVar() {
 	}
 }
 
+// Serve listens for the SMTP clients, and delivers the mails of the queue set
+// by SetQueue. Only the proxies in BAHRAM_SMTP_TRUSTED_PROXIES, e.g.
+// "10.0.0.0/8,192.0.2.1", may send XCLIENT.
 func Serve(listenAddr net.TCPAddr, datasource *datasource.DataSource) error {
+	if mailQueue == nil {
+		return errNoQueue
+	}
 	initVar()
+	var err error
+	trustedProxies, err = parseTrustedProxies(datasource.ConfigString("SMTP_TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
 
 	addr := listenAddr.String()
 
@@ -134,7 +189,9 @@ func Serve(listenAddr net.TCPAddr, datasource *datasource.DataSource) error {
 	for i := 0; i < 3; i++ {
 		go procMail()
 	}
-	go readFromQueue(datasource)
+	for i := 0; i < deliveryWorkers; i++ {
+		go readFromQueue(mailQueue, datasource)
+	}
 
 	var clientId int64
 	clientId = 1
@@ -157,27 +214,13 @@ func Serve(listenAddr net.TCPAddr, datasource *datasource.DataSource) error {
 			clientId:    clientId,
 			savedNotify: make(chan int),
 			auth:        false,
+			xclient:     isTrustedProxy(conn.RemoteAddr()),
 		}
 		go handleClient(client, datasource)
 		clientId++
 	}
 }
 
-func (c *redisClient) redisConnection() (err error) {
-	if c.count > 100 {
-		c.conn.Close()
-		c.count = 0
-	}
-	if c.count == 0 {
-		c.conn, err = redis.Dial("tcp", ":6379")
-		if err != nil {
-			// handle error
-			return err
-		}
-	}
-	return nil
-}
-
 func isAllowedHost(host string) bool {
 	if allowed := allowedHosts[host]; !allowed {
 		return false
@@ -185,105 +228,21 @@ func isAllowedHost(host string) bool {
 	return true
 }
 
-func sendMsg(ns *net.MX, msg ClientMessage) {
-	err := smtp.SendMail(ns.Host+":25", nil, msg.From, []string{msg.To}, []byte(msg.Data))
-	if err == nil {
-		logln(1, "successfully send message")
-	} else {
-		logln(1, fmt.Sprintf("error in send message: %s", err))
-	}
-}
-
-func procMsg(msg ClientMessage, datasource *datasource.DataSource) {
-	rcpt := make([]string, 0, 100)
-
-	toHost := strings.Split(msg.To, "@")[1]
-	if isAllowedHost(toHost) {
-		user, err := datasource.UserByEmail(msg.To)
-		if err == nil {
-			rcpt = append(rcpt, user.InboxAddr)
-		} else {
-			group, err := datasource.GroupByEmail(msg.To)
-			if err == nil {
-				for _, member := range group.Members {
-					user, err = datasource.UserByEmail(member)
-					if err == nil {
-						rcpt = append(rcpt, user.InboxAddr)
-					}
-				}
-			} else {
-				logln(1, "Can't find such user or group")
-				return
-			}
-		}
-	}
-
-	logln(1, fmt.Sprintf("%s", msg.From))
-	fromHost := strings.Split(msg.From, "@")[1]
-	if isAllowedHost(fromHost) {
-		if msg.Auth == false || msg.Username != msg.From {
-			logln(1, fmt.Sprintf("%s %s", msg.Username, msg.From))
-			logln(1, "Not authenticated")
-			return
-		}
-	}
-
-	for _, email := range rcpt {
-		logln(1, email)
-		host := strings.Split(email, "@")[1]
-
-		nss, err := net.LookupMX(host)
-		if err == nil {
-			for _, ns := range nss {
-				logln(1, fmt.Sprintf("%s %d", ns.Host, ns.Pref))
-			}
-			curMsg := msg
-			curMsg.To = email
-			sendMsg(nss[0], curMsg)
-		} else {
-			logln(1, "Error in lookup MX")
-		}
-	}
-}
-
-func readFromQueue(datasource *datasource.DataSource) {
-	for {
-		r := &redisClient{}
-		redis_err := r.redisConnection()
-		if redis_err == nil {
-			values, do_err := redis.Strings(r.conn.Do("LRANGE", "email_queue", 0, 1))
-			if do_err == nil {
-				if len(values) > 0 {
-					var msg ClientMessage
-					json.Unmarshal([]byte(values[0]), &msg)
-					procMsg(msg, datasource)
-				}
-				_, do_err = redis.Strings(r.conn.Do("LPOP", "email_queue"))
-			} else {
-				logln(1, fmt.Sprintf("Redis do error %s", do_err))
-			}
-		} else {
-			logln(1, "redis connection error")
-		}
-		time.Sleep(3000 * time.Millisecond)
+// addressHost returns the domain of the address, which is empty for the null
+// reverse path of the bounces
+func addressHost(address string) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return ""
 	}
+	return address[i+1:]
 }
 
 func procMail() {
-	var to string
-
 	for {
 		client := <-SaveMailChan
 
-		if user, _, addr_err := validateEmailData(client); addr_err != nil { // user, host, addr_err
-			logln(1, fmt.Sprintln("mail_from didnt validate: %v", addr_err)+" client.mail_from: "+client.mail_from)
-			// notify client that a save completed, -1 = error
-			client.savedNotify <- -1
-			continue
-		} else {
-			to = user + "@" + gConfig["GM_PRIMARY_MAIL_HOST"]
-		}
-
+		to := strings.Join(client.rcpt_to, ", ")
 		logln(1, to)
 		logln(1, client.data)
 
@@ -291,87 +250,312 @@ func procMail() {
 		client.subject = mimeHeaderDecode(client.subject)
 		client.hash = md5hex(to + client.mail_from + client.subject + strconv.FormatInt(time.Now().UnixNano(), 10))
 
-		redis := &redisClient{}
-		redis_err := redis.redisConnection()
-		if redis_err == nil {
-			msg := &ClientMessage{
+		// Each recipient is queued as a message of its own
+		var msgs []*ClientMessage
+		received := time.Now()
+		for _, rcpt := range client.rcpt_to {
+			msgs = append(msgs, &ClientMessage{
 				From:     client.mail_from,
-				To:       client.rcpt_to,
+				To:       rcpt,
 				Auth:     client.auth,
 				Data:     client.data,
 				Subject:  client.subject,
 				Username: client.username,
-			}
-			tmp, _ := json.Marshal(msg)
-			_, do_err := redis.conn.Do("RPUSH", "email_queue", tmp)
+				Received: received,
+			})
+		}
 
-			if do_err == nil {
-				logln(1, "Email saved "+client.hash+" len: "+strconv.Itoa(length))
-				client.savedNotify <- 1
-			} else {
-				logln(1, "Redis do error")
-				client.savedNotify <- -1
-			}
+		err := mailQueue.Enqueue(msgs...)
+		if err == nil {
+			logln(1, "Email saved "+client.hash+" len: "+strconv.Itoa(length))
+			client.savedNotify <- 1
 		} else {
-			logln(1, "redis connection error")
+			logln(1, fmt.Sprintf("Error while queueing %s: %s", client.hash, err))
 			client.savedNotify <- -1
 		}
 	}
 }
 
 func clientAuth(client *Client, datasource *datasource.DataSource) string {
-	succ := "235 Authentication succeeded"
-	fail := "535 Authentication failed"
+	succ := "235 2.7.0 Authentication succeeded"
+	fail := "535 5.7.8 Authentication failed"
+	blocked := "454 4.7.0 Too many failed attempts, try again later"
+
+	ip := clientIP(client)
+	if datasource.LoginWait(client.username, ip) > 0 {
+		auditAuth(datasource, client.username, ip, false, "blocked")
+		return blocked
+	}
 
 	user, err := datasource.UserByEmail(client.username)
-	if err != nil {
+	if err != nil || !user.Active {
+		datasource.LoginFailed(client.username, ip)
+		auditAuth(datasource, client.username, ip, false, "unknown user")
 		return fail
 	}
 
 	logln(1, user.Email)
-	if user.AcceptsPassword(client.password, datasource.ConfigByteArray("PASSWORD_SALT")) {
+	// With two-factor authentication, the main password is only for the
+	// REST login
+	if datasource.CheckAppPassword(user, client.password, ip) {
+		datasource.LoginSucceeded(client.username, ip)
+		auditAuth(datasource, client.username, ip, true, "app password")
+		client.auth = true
+		return succ
+	}
+	if !user.TOTPEnabled && datasource.CheckPassword(user, client.password) {
+		datasource.LoginSucceeded(client.username, ip)
+		auditAuth(datasource, client.username, ip, true, "password")
 		client.auth = true
 		return succ
 	}
+	datasource.LoginFailed(client.username, ip)
+	auditAuth(datasource, client.username, ip, false, "wrong password")
 	return fail
 }
 
+func auditAuth(ds *datasource.DataSource, username, ip string, success bool, details string) {
+	audit := ds.Audit
+	if !success {
+		// Anyone can fail, so those are aggregated
+		audit = ds.AuditFailure
+	}
+	err := audit(&datasource.AuditEvent{
+		Actor:    username,
+		Action:   "smtp.auth",
+		Target:   username,
+		SourceIP: ip,
+		Success:  success,
+		Details:  details,
+	})
+	if err != nil {
+		logln(1, fmt.Sprintf("Error while auditing the auth of %s: %s", username, err))
+	}
+}
+
+// clientIP returns the IP of the client, without the port. The address may
+// have been set by XCLIENT, without a port.
+func clientIP(client *Client) string {
+	host, _, err := net.SplitHostPort(client.address)
+	if err != nil {
+		return client.address
+	}
+	return host
+}
+
+// The states of a session, RFC 5321 section 4.1.4. A mail transaction is MAIL,
+// one or more RCPT, and DATA; it's reset by RSET, HELO and EHLO, and at the
+// end of DATA.
+const (
+	stateGreeting = iota // the greeting isn't sent yet
+	stateHelo            // waiting for HELO or EHLO
+	stateReady           // waiting for MAIL
+	stateMail            // waiting for RCPT
+	stateRcpt            // waiting for more RCPT, or DATA
+	stateData            // reading the message
+	stateStartTLS        // upgrading the connection to TLS
+)
+
+// maxRecipients is the least RFC 5321 lets a server accept
+const maxRecipients = 100
+
+// resetTransaction forgets the sender, the recipients and the message
+func resetTransaction(client *Client) {
+	client.mail_from = ""
+	client.rcpt_to = nil
+	client.data = ""
+	client.subject = ""
+	client.hash = ""
+	if client.state > stateReady {
+		client.state = stateReady
+	}
+}
+
+// reversePath returns the address of MAIL FROM, which is empty for the null
+// reverse path of the bounces
+func reversePath(arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "<>") {
+		return "", nil
+	}
+	user, host, err := extractEmail(arg)
+	if err != nil {
+		return "", err
+	}
+	return user + "@" + host, nil
+}
+
+// addRecipient decides on a recipient of RCPT TO, and returns the reply. The
+// recipients in the allowed hosts must be active users or groups; the others
+// are relayed, for the authenticated clients only.
+func addRecipient(client *Client, datasource *datasource.DataSource, arg string) string {
+	user, host, err := extractEmail(arg)
+	if err != nil {
+		return "501 5.1.3 Bad recipient address syntax"
+	}
+	rcpt := user + "@" + host
+	for _, r := range client.rcpt_to {
+		if strings.EqualFold(r, rcpt) {
+			return "250 2.1.5 Accepted"
+		}
+	}
+	if len(client.rcpt_to) >= maxRecipients {
+		return "452 4.5.3 Too many recipients"
+	}
+	if isAllowedHost(strings.ToLower(host)) {
+		if resp := checkLocalRecipient(datasource, rcpt); resp != "" {
+			return resp
+		}
+	} else if !client.auth {
+		return "550 5.7.1 <" + rcpt + ">: Relay access denied"
+	}
+	client.rcpt_to = append(client.rcpt_to, rcpt)
+	return "250 2.1.5 Accepted"
+}
+
+// checkLocalRecipient returns the rejection of a recipient in the allowed
+// hosts, or "" if it's an active user with an inbox, or an active group with
+// a manager or members
+func checkLocalRecipient(ds *datasource.DataSource, rcpt string) string {
+	unknown := "550 5.1.1 <" + rcpt + ">: Recipient address rejected: User unknown"
+	noMailbox := "550 5.2.1 <" + rcpt + ">: Recipient address rejected: Mailbox unavailable"
+	lookupFailed := "451 4.3.0 <" + rcpt + ">: Temporary lookup failure"
+
+	user, err := lookupUser(ds, rcpt)
+	if err == nil {
+		if !user.Active {
+			return unknown
+		}
+		if user.InboxAddr == "" {
+			return noMailbox
+		}
+		return ""
+	} else if err != datasource.ErrNotFound {
+		logln(1, fmt.Sprintf("Error while looking up %s: %s", rcpt, err))
+		return lookupFailed
+	}
+
+	group, err := lookupGroup(ds, rcpt)
+	if err == nil {
+		if !group.Active {
+			return unknown
+		}
+		if group.Manager == "" && len(group.Members) == 0 {
+			return noMailbox
+		}
+		return ""
+	} else if err != datasource.ErrNotFound {
+		logln(1, fmt.Sprintf("Error while looking up %s: %s", rcpt, err))
+		return lookupFailed
+	}
+	return unknown
+}
+
+// lookupUser returns the user with the address. The users are stored as they
+// were created, so the address is looked up as it is first, then in lower
+// case.
+func lookupUser(ds *datasource.DataSource, address string) (*datasource.User, error) {
+	user, err := ds.UserByEmail(address)
+	if err == datasource.ErrNotFound && strings.ToLower(address) != address {
+		user, err = ds.UserByEmail(strings.ToLower(address))
+	}
+	return user, err
+}
+
+// lookupGroup is lookupUser for the groups
+func lookupGroup(ds *datasource.DataSource, address string) (*datasource.Group, error) {
+	group, err := ds.GroupByEmail(address)
+	if err == datasource.ErrNotFound && strings.ToLower(address) != address {
+		group, err = ds.GroupByEmail(strings.ToLower(address))
+	}
+	return group, err
+}
+
 func handleClient(client *Client, datasource *datasource.DataSource) {
 	defer closeClient(client)
-	//	defer closeClient(client)
 	greeting := "220 " + gConfig["GSMTP_HOST_NAME"] +
 		" SMTP Bahram-SMTPd #" + strconv.FormatInt(client.clientId, 10) + " (" + strconv.Itoa(len(sem)) + ") " + time.Now().Format(time.RFC1123Z)
-	advertiseTls := "250-STARTTLS\r\n"
-	passInput := false
-	for i := 0; i < 100; i++ {
+	// The AUTH LOGIN exchange: the username, then the password
+	userInput, passInput := false, false
+	for client.kill_time == 0 {
 		switch client.state {
-		case 0:
+		case stateGreeting:
 			responseAdd(client, greeting)
-			client.state = 1
-		case 1:
+			client.state = stateHelo
+		case stateData:
+			var err error
+			client.data, err = readSmtp(client)
+			if err != nil {
+				logln(1, fmt.Sprintf("DATA read error: %v", err))
+				// The rest of the message would be taken for commands
+				responseAdd(client, "552 5.3.4 Message not accepted")
+				killClient(client)
+				break
+			}
+			// to do: timeout when adding to SaveMailChan
+			// place on the channel so that one of the save mail workers can pick it up
+			SaveMailChan <- client
+			// wait for the save to complete
+			status := <-client.savedNotify
+
+			if status == 1 {
+				responseAdd(client, "250 2.0.0 OK : queued as "+client.hash)
+			} else {
+				responseAdd(client, "554 5.3.0 Error: transaction failed, blame it on the weather")
+			}
+			resetTransaction(client)
+		case stateStartTLS:
+			// upgrade to TLS
+			var tlsConn *tls.Conn
+			tlsConn = tls.Server(client.conn, TLSconfig)
+			err := tlsConn.Handshake() // not necessary to call here, but might as well
+			if err != nil {
+				logln(1, fmt.Sprintf("Could not TLS handshake:%v", err))
+				return
+			}
+			client.conn = net.Conn(tlsConn)
+			client.bufin = bufio.NewReader(client.conn)
+			client.bufout = bufio.NewWriter(client.conn)
+			client.tls_on = true
+			// The client starts over with EHLO and forgets whatever it
+			// learned before, RFC 3207 section 4.2
+			client.helo = ""
+			client.auth = false
+			client.username, client.password = "", ""
+			userInput, passInput = false, false
+			resetTransaction(client)
+			client.state = stateHelo
+			continue
+		default:
 			input, err := readSmtp(client)
 			if err != nil {
 				logln(1, fmt.Sprintf("Read error: %v", err))
-				if err == io.EOF {
-					// client closed the connection already
-					return
-				}
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					// too slow, timeout
-					return
-				}
-				break
+				return
 			}
 			input = strings.Trim(input, " \n\r")
 			cmd := strings.ToUpper(input)
 			switch {
+			case (userInput || passInput) && input == "*":
+				userInput, passInput = false, false
+				responseAdd(client, "501 5.0.0 Authentication cancelled")
+			case userInput:
+				dec, err := base64.StdEncoding.DecodeString(input)
+				userInput = false
+				if err != nil {
+					responseAdd(client, "501 5.5.2 Cannot decode the username")
+					break
+				}
+				client.username = string(dec)
+				passInput = true
+				responseAdd(client, "334 UGFzc3dvcmQ6")
 			case passInput:
 				dec, err := base64.StdEncoding.DecodeString(input)
+				passInput = false
 				if err != nil {
-					return
+					responseAdd(client, "501 5.5.2 Cannot decode the password")
+					break
 				}
 				client.password = string(dec)
-				passInput = false
 				resp := clientAuth(client, datasource)
 				responseAdd(client, resp)
 
@@ -379,115 +563,132 @@ func handleClient(client *Client, datasource *datasource.DataSource) {
 				if len(input) > 5 {
 					client.helo = input[5:]
 				}
+				client.state = stateReady
+				resetTransaction(client)
 				responseAdd(client, "250 "+gConfig["GSMTP_HOST_NAME"]+" Hello ")
 			case strings.Index(cmd, "EHLO") == 0:
 				if len(input) > 5 {
 					client.helo = input[5:]
 				}
-				responseAdd(client, "250-"+gConfig["GSMTP_HOST_NAME"]+" Hello "+client.helo+"["+client.address+"]"+"\r\n"+"250-SIZE "+gConfig["GSMTP_MAX_SIZE"]+"\r\n"+advertiseTls+"250-AUTH LOGIN\r\n"+"250 HELP")
+				client.state = stateReady
+				resetTransaction(client)
+				advertiseTls := "250-STARTTLS\r\n"
+				if client.tls_on {
+					advertiseTls = ""
+				}
+				advertiseXclient := ""
+				if client.xclient {
+					advertiseXclient = "250-XCLIENT ADDR NAME\r\n"
+				}
+				responseAdd(client, "250-"+gConfig["GSMTP_HOST_NAME"]+" Hello "+client.helo+"["+client.address+"]"+"\r\n"+"250-SIZE "+gConfig["GSMTP_MAX_SIZE"]+"\r\n"+advertiseTls+advertiseXclient+"250-AUTH LOGIN\r\n"+"250-ENHANCEDSTATUSCODES\r\n"+"250 HELP")
 
 			case strings.Index(cmd, "MAIL FROM:") == 0:
-				if len(input) > 10 {
-					client.mail_from = input[10:]
+				switch client.state {
+				case stateHelo:
+					responseAdd(client, "503 5.5.1 Send HELO or EHLO first")
+				case stateMail, stateRcpt:
+					responseAdd(client, "503 5.5.1 Sender already specified")
+				default:
+					from, err := reversePath(input[10:])
+					if err != nil {
+						responseAdd(client, "501 5.1.7 Bad sender address syntax")
+						break
+					}
+					client.mail_from = from
+					client.state = stateMail
+					responseAdd(client, "250 2.1.0 Ok")
 				}
-				responseAdd(client, "250 Ok")
 			case strings.Index(cmd, "XCLIENT") == 0:
 				// Nginx sends this
 				// XCLIENT ADDR=212.96.64.216 NAME=[UNAVAILABLE]
-				client.address = input[13:]
-				client.address = client.address[0:strings.Index(client.address, " ")]
-				fmt.Println("client address:[" + client.address + "]")
-				responseAdd(client, "250 OK")
+				if !client.xclient {
+					responseAdd(client, "550 5.7.0 Insufficient authorization")
+					break
+				}
+				for _, attr := range strings.Fields(input)[1:] {
+					if strings.HasPrefix(strings.ToUpper(attr), "ADDR=") {
+						client.address = attr[5:]
+					}
+				}
+				logln(1, "client address:["+client.address+"]")
+				responseAdd(client, "250 2.0.0 OK")
 			case strings.Index(cmd, "RCPT TO:") == 0:
-				if len(input) > 8 {
-					client.rcpt_to = input[8:]
+				switch client.state {
+				case stateMail, stateRcpt:
+					resp := addRecipient(client, datasource, input[8:])
+					if len(client.rcpt_to) > 0 {
+						client.state = stateRcpt
+					}
+					responseAdd(client, resp)
+				default:
+					responseAdd(client, "503 5.5.1 Need MAIL command")
 				}
-				responseAdd(client, "250 Accepted")
 			case strings.Index(cmd, "NOOP") == 0:
-				responseAdd(client, "250 OK")
+				responseAdd(client, "250 2.0.0 OK")
 			case strings.Index(cmd, "RSET") == 0:
-				client.mail_from = ""
-				client.rcpt_to = ""
-				responseAdd(client, "250 OK")
+				resetTransaction(client)
+				responseAdd(client, "250 2.0.0 OK")
 			case strings.Index(cmd, "DATA") == 0:
-				responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
-				client.state = 2
-			case (strings.Index(cmd, "STARTTLS") == 0) && !client.tls_on:
-				responseAdd(client, "220 Ready to start TLS")
-				// go to start TLS state
-				client.state = 3
+				switch client.state {
+				case stateRcpt:
+					responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
+					client.state = stateData
+				case stateMail:
+					responseAdd(client, "554 5.5.1 No valid recipients")
+				default:
+					responseAdd(client, "503 5.5.1 Need MAIL command")
+				}
+			case strings.Index(cmd, "STARTTLS") == 0:
+				switch {
+				case client.tls_on:
+					responseAdd(client, "503 5.5.1 TLS already active")
+				case client.state != stateReady:
+					responseAdd(client, "503 5.5.1 Send EHLO first, and not in a mail transaction")
+				default:
+					responseAdd(client, "220 2.0.0 Ready to start TLS")
+					// go to start TLS state
+					client.state = stateStartTLS
+				}
 			case strings.Index(cmd, "AUTH LOGIN") == 0:
-				tmp := input[11:]
-				dec, err := base64.StdEncoding.DecodeString(tmp)
-				if err != nil {
-					return
+				switch {
+				case client.state != stateReady:
+					responseAdd(client, "503 5.5.1 Send EHLO first, and not in a mail transaction")
+				case client.auth:
+					responseAdd(client, "503 5.5.1 Already authenticated")
+				case strings.TrimSpace(input[10:]) == "":
+					// Without the initial response, the username is asked
+					userInput = true
+					responseAdd(client, "334 VXNlcm5hbWU6")
+				default:
+					dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(input[10:]))
+					if err != nil {
+						responseAdd(client, "501 5.5.2 Cannot decode the username")
+						break
+					}
+					passInput = true
+					client.username = string(dec)
+					responseAdd(client, "334 UGFzc3dvcmQ6")
 				}
-				passInput = true
-				client.username = string(dec)
-				responseAdd(client, "334 UGFzc3dvcmQ6")
+			case strings.Index(cmd, "HELP") == 0:
+				responseAdd(client, "214 2.0.0 See RFC 5321")
 			case strings.Index(cmd, "QUIT") == 0:
-				responseAdd(client, "221 Bye")
+				responseAdd(client, "221 2.0.0 Bye")
 				killClient(client)
 			default:
-				responseAdd(client, fmt.Sprintf("500 unrecognized command"))
+				responseAdd(client, fmt.Sprintf("500 5.5.2 unrecognized command"))
 				client.errors++
 				if client.errors > 3 {
-					responseAdd(client, fmt.Sprintf("500 Too many unrecognized commands"))
+					responseAdd(client, fmt.Sprintf("500 5.5.2 Too many unrecognized commands"))
 					killClient(client)
 				}
 			}
-		case 2:
-			var err error
-			client.data, err = readSmtp(client)
-			if err == nil {
-				// to do: timeout when adding to SaveMailChan
-				// place on the channel so that one of the save mail workers can pick it up
-				SaveMailChan <- client
-				// wait for the save to complete
-				status := <-client.savedNotify
-
-				if status == 1 {
-					responseAdd(client, "250 OK : queued as "+client.hash)
-				} else {
-					responseAdd(client, "554 Error: transaction failed, blame it on the weather")
-				}
-			} else {
-				logln(1, fmt.Sprintf("DATA read error: %v", err))
-			}
-			client.state = 1
-		case 3:
-			// upgrade to TLS
-			var tlsConn *tls.Conn
-			tlsConn = tls.Server(client.conn, TLSconfig)
-			err := tlsConn.Handshake() // not necessary to call here, but might as well
-			if err == nil {
-				client.conn = net.Conn(tlsConn)
-				client.bufin = bufio.NewReader(client.conn)
-				client.bufout = bufio.NewWriter(client.conn)
-				client.tls_on = true
-			} else {
-				logln(1, fmt.Sprintf("Could not TLS handshake:%v", err))
-			}
-			advertiseTls = ""
-			client.state = 1
 		}
 		// Send a response back to the client
 		err := responseWrite(client)
 		if err != nil {
-			if err == io.EOF {
-				// client closed the connection already
-				return
-			}
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				// too slow, timeout
-				return
-			}
-		}
-		if client.kill_time > 1 {
 			return
 		}
 	}
-
 }
 
 func responseAdd(client *Client, line string) {
@@ -505,7 +706,7 @@ func readSmtp(client *Client) (input string, err error) {
 	var reply string
 	// Command state terminator by default
 	suffix := "\r\n"
-	if client.state == 2 {
+	if client.state == stateData {
 		// DATA state
 		suffix = "\r\n.\r\n"
 	}
@@ -518,7 +719,7 @@ func readSmtp(client *Client) (input string, err error) {
 				err = errors.New("Maximum DATA size exceeded (" + strconv.Itoa(max_size) + ")")
 				return input, err
 			}
-			if client.state == 2 {
+			if client.state == stateData {
 				// Extract the subject while we are at it.
 				scanSubject(client, reply)
 			}
@@ -591,22 +792,6 @@ func mimeHeaderDecode(str string) string {
 	return str
 }
 
-func validateEmailData(client *Client) (user string, host string, addr_err error) {
-	if user, host, addr_err = extractEmail(client.mail_from); addr_err != nil {
-		return user, host, addr_err
-	}
-	client.mail_from = user + "@" + host
-	if user, host, addr_err = extractEmail(client.rcpt_to); addr_err != nil {
-		return user, host, addr_err
-	}
-	client.rcpt_to = user + "@" + host
-	// check if on allowed hosts
-	/*if allowed := allowedHosts[host]; !allowed {
-		return user, host, errors.New("invalid host:" + host)
-	}*/
-	return user, host, addr_err
-}
-
 func extractEmail(str string) (name string, host string, err error) {
 	re, _ := regexp.Compile(`<(.+?)@(.+?)>`) // go home regex, you're drunk!
 	if matched := re.FindStringSubmatch(str); len(matched) > 2 {
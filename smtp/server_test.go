@@ -0,0 +1,253 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+var testVars sync.Once
+
+// initTestVars sets the globals of the server once, as the sessions of the
+// earlier tests may still be reading them
+func initTestVars(t *testing.T) {
+	testVars.Do(func() {
+		initVar()
+		TLSconfig = testTLSConfig(t)
+	})
+}
+
+// testSession starts a session with a client of the address, and returns the
+// connection of the client
+func testSession(t *testing.T, address string) (net.Conn, *textproto.Conn) {
+	initTestVars(t)
+
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &datasource.User{Email: "a@cafebazaar.ir", Active: true}
+	if err := ds.SetPassword(u, "secret password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	client := &Client{
+		conn:        serverConn,
+		address:     address,
+		bufin:       bufio.NewReader(serverConn),
+		bufout:      bufio.NewWriter(serverConn),
+		savedNotify: make(chan int),
+		xclient:     isTrustedProxy(&net.TCPAddr{IP: net.ParseIP(strings.Split(address, ":")[0])}),
+	}
+	sem <- 1
+	go handleClient(client, ds)
+
+	conn := textproto.NewConn(clientConn)
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return clientConn, conn
+}
+
+// expect sends the command, and checks the code of the reply
+func expect(t *testing.T, conn *textproto.Conn, command string, code int) string {
+	if err := conn.PrintfLine("%s", command); err != nil {
+		t.Fatal(err)
+	}
+	_, message, err := conn.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %s", command, err)
+	}
+	return message
+}
+
+func encoded(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestAuthLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		codes    []int
+	}{
+		{"initial response",
+			[]string{"AUTH LOGIN " + encoded("a@cafebazaar.ir"), encoded("secret password")},
+			[]int{334, 235}},
+		{"no initial response",
+			[]string{"AUTH LOGIN", encoded("a@cafebazaar.ir"), encoded("secret password")},
+			[]int{334, 334, 235}},
+		{"wrong password",
+			[]string{"AUTH LOGIN", encoded("a@cafebazaar.ir"), encoded("wrong")},
+			[]int{334, 334, 535}},
+		{"cancelled",
+			[]string{"AUTH LOGIN", "*", "NOOP"},
+			[]int{334, 501, 250}},
+		{"bad base64",
+			[]string{"AUTH LOGIN", "%%%", "NOOP"},
+			[]int{334, 501, 250}},
+	}
+	for _, tt := range tests {
+		clientConn, conn := testSession(t, "192.0.2.1:1234")
+		expect(t, conn, "EHLO client.example.com", 250)
+		for i, command := range tt.commands {
+			if err := conn.PrintfLine("%s", command); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := conn.ReadResponse(tt.codes[i]); err != nil {
+				t.Errorf("%s: %s: %s", tt.name, command, err)
+				break
+			}
+		}
+		clientConn.Close()
+	}
+
+	_, conn := testSession(t, "192.0.2.1:1234")
+	expect(t, conn, "EHLO client.example.com", 250)
+	if message := expect(t, conn, "AUTH LOGIN", 334); message != "VXNlcm5hbWU6" {
+		t.Errorf("got %q, want the username prompt", message)
+	}
+}
+
+func TestXClientNeedsTrustedProxy(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		address string
+		trusted bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"192.0.2.7:1234", true},
+		{"192.0.2.8:1234", false},
+	}
+	for _, tt := range tests {
+		clientConn, conn := testSession(t, tt.address)
+		ehlo := expect(t, conn, "EHLO proxy.example.com", 250)
+		if strings.Contains(ehlo, "XCLIENT") != tt.trusted {
+			t.Errorf("%s: XCLIENT advertised %v, want %v", tt.address, !tt.trusted, tt.trusted)
+		}
+		code := 550
+		if tt.trusted {
+			code = 250
+		}
+		expect(t, conn, "XCLIENT ADDR=198.51.100.1 NAME=[UNAVAILABLE]", code)
+		clientConn.Close()
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("an invalid CIDR is accepted")
+	}
+}
+
+func TestStartTLSResetsSession(t *testing.T) {
+	clientConn, conn := testSession(t, "192.0.2.1:1234")
+	expect(t, conn, "EHLO client.example.com", 250)
+	expect(t, conn, "AUTH LOGIN "+encoded("a@cafebazaar.ir"), 334)
+	expect(t, conn, encoded("secret password"), 235)
+	expect(t, conn, "STARTTLS", 220)
+
+	tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn = textproto.NewConn(tlsConn)
+	expect(t, conn, "MAIL FROM:<a@cafebazaar.ir>", 503)
+	expect(t, conn, "EHLO client.example.com", 250)
+	expect(t, conn, "MAIL FROM:<a@cafebazaar.ir>", 250)
+	// The authentication before STARTTLS is forgotten
+	expect(t, conn, "RCPT TO:<b@example.com>", 550)
+}
+
+func TestCheckLocalRecipient(t *testing.T) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []*datasource.User{
+		{Email: "a@cafebazaar.ir", Active: true, InboxAddr: "a@inbox.example.com"},
+		{Email: "noinbox@cafebazaar.ir", Active: true},
+		{Email: "old@cafebazaar.ir", InboxAddr: "old@inbox.example.com"},
+		{Email: "Mixed.Case@cafebazaar.ir", Active: true, InboxAddr: "mixed@inbox.example.com"},
+	}
+	for _, u := range users {
+		if err := ds.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := []*datasource.Group{
+		{Email: "team@cafebazaar.ir", Active: true, Members: []string{"a@cafebazaar.ir"}},
+		{Email: "managed@cafebazaar.ir", Active: true, Manager: "a@cafebazaar.ir"},
+		{Email: "empty@cafebazaar.ir", Active: true},
+		{Email: "gone@cafebazaar.ir", Members: []string{"a@cafebazaar.ir"}},
+		{Email: "Big.Team@cafebazaar.ir", Active: true, Members: []string{"a@cafebazaar.ir"}},
+	}
+	for _, g := range groups {
+		if err := ds.CreateGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rcpt string
+		code string
+	}{
+		{"a@cafebazaar.ir", ""},
+		{"A@CafeBazaar.IR", ""},
+		{"noinbox@cafebazaar.ir", "550 5.2.1"},
+		{"old@cafebazaar.ir", "550 5.1.1"},
+		{"team@cafebazaar.ir", ""},
+		{"Team@cafebazaar.ir", ""},
+		{"managed@cafebazaar.ir", ""},
+		{"empty@cafebazaar.ir", "550 5.2.1"},
+		{"gone@cafebazaar.ir", "550 5.1.1"},
+		{"nobody@cafebazaar.ir", "550 5.1.1"},
+		{"Mixed.Case@cafebazaar.ir", ""},
+		{"Big.Team@cafebazaar.ir", ""},
+	}
+	for _, tt := range tests {
+		if got := checkLocalRecipient(ds, tt.rcpt); !strings.HasPrefix(got, tt.code) || (tt.code == "") != (got == "") {
+			t.Errorf("checkLocalRecipient(%s) = %q, want %q", tt.rcpt, got, tt.code)
+		}
+	}
+}
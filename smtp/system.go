@@ -0,0 +1,44 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SystemMailFrom is the sender of the mails bahram sends on its own
+func SystemMailFrom() string {
+	return "no-reply@" + gConfig["GM_PRIMARY_MAIL_HOST"]
+}
+
+// SendSystemMail queues a plain text mail from bahram itself to a bahram user
+// or group. It's delivered the same way as the mails of the authenticated
+// users, to the InboxAddr of the recipients.
+func SendSystemMail(to, subject, body string) error {
+	from := SystemMailFrom()
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + md5hex(to+subject+fmt.Sprint(time.Now().UnixNano())) + "@" + gConfig["GM_PRIMARY_MAIL_HOST"] + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\n", "\r\n", -1)
+
+	msg := &ClientMessage{
+		From:     from,
+		To:       to,
+		Auth:     true,
+		Data:     strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n",
+		Subject:  subject,
+		Username: from,
+		Received: time.Now(),
+	}
+	if mailQueue == nil {
+		return errNoQueue
+	}
+	return mailQueue.Enqueue(msg)
+}
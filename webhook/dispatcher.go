@@ -0,0 +1,446 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	maxAttempts = 8
+	// The n-th retry is after firstRetry * 2^(n-1), at most maxRetryDelay
+	firstRetry    = 30 * time.Second
+	maxRetryDelay = 6 * time.Hour
+
+	pollInterval    = 10 * time.Second
+	deliveryTimeout = 10 * time.Second
+	// leaseTimeout is how long a delivery is kept from the other workers
+	// once one of them has started it. If the worker dies, it's attempted
+	// again after it.
+	leaseTimeout = 6 * deliveryTimeout
+
+	// maxConcurrentDeliveries limits the deliveries in flight, and
+	// maxConcurrentPerWebhook the ones to a single webhook, so a slow
+	// receiver doesn't hold back the others
+	maxConcurrentDeliveries = 16
+	maxConcurrentPerWebhook = 2
+)
+
+var ErrPrivateAddress = errors.New("The webhook URL resolves to a private address")
+
+// privateNetworks are the addresses the webhooks aren't delivered to: this
+// host, the private and shared networks, the link-local ones (where the
+// metadata services of the clouds are), and multicast
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardedDialer only connects to the public addresses. The name is
+// resolved here and the checked address is dialed, so a name can't resolve
+// to a public address for the check and to a private one for the
+// connection, and the redirects are checked too.
+type guardedDialer struct {
+	dialer       net.Dialer
+	allowPrivate bool
+}
+
+func (g *guardedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrPrivateAddress
+	for _, addr := range addrs {
+		if !g.allowPrivate && isPrivateIP(addr.IP) {
+			continue
+		}
+		var conn net.Conn
+		conn, err = g.dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the X-Bahram-Signature header of a delivery. The receivers
+// compute the HMAC-SHA256 of "<t>.<body>" with the secret of the webhook and
+// compare it with v1, and should reject old timestamps.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Dispatcher queues the events for the subscribed webhooks, and delivers
+// them. The queue is kept in the datasource, so the pending deliveries
+// survive restarts and are shared by the bahram instances.
+//
+// The webhooks are only delivered to public addresses, unless
+// BAHRAM_WEBHOOK_ALLOW_PRIVATE is true.
+type Dispatcher struct {
+	ds     *datasource.DataSource
+	client *http.Client
+	wake   chan struct{}
+	// slots holds a value for each delivery in flight
+	slots chan struct{}
+
+	mu sync.Mutex
+	// inFlight counts the deliveries in flight by webhook
+	inFlight map[string]int
+}
+
+func NewDispatcher(ds *datasource.DataSource) *Dispatcher {
+	dialer := &guardedDialer{
+		dialer:       net.Dialer{Timeout: deliveryTimeout},
+		allowPrivate: ds.ConfigString("WEBHOOK_ALLOW_PRIVATE") == "true",
+	}
+	return &Dispatcher{
+		ds: ds,
+		client: &http.Client{
+			Timeout: deliveryTimeout,
+			// No proxy, as it would be the one checked by the dialer
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: deliveryTimeout,
+				MaxIdleConnsPerHost: maxConcurrentPerWebhook,
+			},
+		},
+		wake:     make(chan struct{}, 1),
+		slots:    make(chan struct{}, maxConcurrentDeliveries),
+		inFlight: make(map[string]int),
+	}
+}
+
+// auditEvents maps the actions of the audit log to the event types
+var auditEvents = map[string]string{
+	"user.create":  EventUserCreated,
+	"user.update":  EventUserUpdated,
+	"user.rename":  EventUserRenamed,
+	"user.delete":  EventUserDeleted,
+	"group.create": EventGroupCreated,
+	"group.update": EventGroupUpdated,
+	"group.delete": EventGroupDeleted,
+	"group.join":   EventMemberAdded,
+	"group.leave":  EventMemberRemoved,
+}
+
+// PublishAudit publishes the events for an audited change, if there are any
+func (d *Dispatcher) PublishAudit(action, actor, target string, changes map[string]datasource.AuditChange) {
+	eventType, found := auditEvents[action]
+	if !found {
+		return
+	}
+	d.Publish(Event{Type: eventType, Actor: actor, Target: target, Changes: changes})
+
+	if active, found := changes["active"]; found && eventType == EventUserUpdated && active.After == false {
+		d.Publish(Event{Type: EventUserDisabled, Actor: actor, Target: target, Changes: changes})
+	}
+}
+
+// Publish queues the event for the active webhooks which are subscribed to
+// it. Errors are only logged, so the changes which are already made don't
+// fail.
+func (d *Dispatcher) Publish(e Event) {
+	hooks, err := List(d.ds)
+	if err != nil {
+		logging.Log(debugTag, "Error while listing webhooks for %s: %s", e.Type, err)
+		return
+	}
+
+	for _, h := range hooks {
+		if !h.Active || !h.subscribed(e.Type) {
+			continue
+		}
+		if _, err := d.enqueue(h, e); err != nil {
+			logging.Log(debugTag, "Error while queueing %s for webhook %s: %s", e.Type, h.ID, err)
+		}
+	}
+	d.kick()
+}
+
+// Ping queues a ping event for the webhook, whether it's active or not
+func (d *Dispatcher) Ping(h *Webhook, actor string) (*Delivery, error) {
+	delivery, err := d.enqueue(h, Event{Type: EventPing, Actor: actor})
+	if err != nil {
+		return nil, err
+	}
+	d.kick()
+	return delivery, nil
+}
+
+func (d *Dispatcher) enqueue(h *Webhook, e Event) (*Delivery, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	e.ID = id
+	e.Time = now
+	delivery := &Delivery{
+		// Sorted by the creation time
+		ID:          fmt.Sprintf("%020d-%s", now.UnixNano(), id[:8]),
+		WebhookID:   h.ID,
+		Event:       e,
+		Status:      StatusPending,
+		NextAttempt: now.Unix(),
+		CreatedAt:   now.Unix(),
+	}
+	return delivery, putDelivery(d.ds, delivery)
+}
+
+func (d *Dispatcher) kick() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the due deliveries, forever
+func (d *Dispatcher) Run() {
+	d.movePending()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue()
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// movePending moves the pending deliveries queued before they were kept
+// apart from the finished ones
+func (d *Dispatcher) movePending() {
+	all, err := deliveries(d.ds, deliveryKind)
+	if err != nil {
+		logging.Log(debugTag, "Error while listing deliveries: %s", err)
+		return
+	}
+	for id, delivery := range all {
+		if delivery.Status != StatusPending {
+			continue
+		}
+		if err := putDelivery(d.ds, delivery); err != nil {
+			logging.Log(debugTag, "Error while moving delivery %s: %s", id, err)
+			continue
+		}
+		d.ds.DeleteRecord(deliveryKind, id)
+	}
+}
+
+// deliverDue starts the due deliveries, the oldest first, as far as the
+// limits on the deliveries in flight allow
+func (d *Dispatcher) deliverDue() {
+	pending, err := deliveries(d.ds, pendingKind)
+	if err != nil {
+		logging.Log(debugTag, "Error while listing deliveries: %s", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	var due []*Delivery
+	for _, delivery := range pending {
+		if delivery.NextAttempt <= now {
+			due = append(due, delivery)
+		}
+	}
+	sort.Sort(byDeliveryID(due))
+
+	for _, delivery := range due {
+		if !d.reserve(delivery.WebhookID) {
+			continue
+		}
+		// The lease keeps the other workers from delivering it too, and
+		// expires if this one dies before storing the outcome
+		err := d.ds.CreateRecord(leaseKind, delivery.ID, nil, leaseTimeout)
+		if err != nil {
+			if err != datasource.ErrRecordExists {
+				logging.Log(debugTag, "Error while leasing delivery %s: %s", delivery.ID, err)
+			}
+			d.unreserve(delivery.WebhookID)
+			continue
+		}
+		go d.deliver(delivery.ID, delivery.WebhookID)
+	}
+}
+
+// reserve takes a slot for a delivery to the webhook, if there's one
+func (d *Dispatcher) reserve(webhookID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inFlight[webhookID] >= maxConcurrentPerWebhook {
+		return false
+	}
+	select {
+	case d.slots <- struct{}{}:
+	default:
+		return false
+	}
+	d.inFlight[webhookID]++
+	return true
+}
+
+func (d *Dispatcher) unreserve(webhookID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	<-d.slots
+	if d.inFlight[webhookID]--; d.inFlight[webhookID] <= 0 {
+		delete(d.inFlight, webhookID)
+	}
+}
+
+// deliver attempts the leased delivery, and stores the outcome before
+// releasing the lease
+func (d *Dispatcher) deliver(id, webhookID string) {
+	defer func() {
+		d.unreserve(webhookID)
+		// The skipped deliveries may go now
+		d.kick()
+	}()
+
+	// Reloaded, as it may have been attempted since it was listed
+	value, err := d.ds.Record(pendingKind, id)
+	if err != nil {
+		d.ds.DeleteRecord(leaseKind, id)
+		return
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(value, &delivery); err != nil || delivery.NextAttempt > time.Now().Unix() {
+		d.ds.DeleteRecord(leaseKind, id)
+		return
+	}
+
+	d.attempt(&delivery)
+	if err := putDelivery(d.ds, &delivery); err != nil {
+		// Kept leased, so it's attempted again once the lease expires
+		logging.Log(debugTag, "Error while storing delivery %s: %s", id, err)
+		return
+	}
+	d.ds.DeleteRecord(leaseKind, id)
+}
+
+// attempt tries to deliver once, and updates the state of the delivery
+func (d *Dispatcher) attempt(delivery *Delivery) {
+	delivery.Attempts++
+	now := time.Now()
+
+	h, err := Get(d.ds, delivery.WebhookID)
+	if err == datasource.ErrNotFound {
+		delivery.Status = StatusFailed
+		delivery.LastError = "The webhook is deleted"
+		delivery.FinishedAt = now.Unix()
+		return
+	} else if err != nil {
+		d.retry(delivery, err.Error())
+		return
+	}
+
+	code, err := d.send(h, delivery)
+	delivery.ResponseCode = code
+	if err != nil {
+		logging.Debug(debugTag, "Delivery %s to %s failed: %s", delivery.ID, h.URL, err)
+		d.retry(delivery, err.Error())
+		return
+	}
+	delivery.Status = StatusDelivered
+	delivery.LastError = ""
+	delivery.FinishedAt = now.Unix()
+}
+
+func (d *Dispatcher) retry(delivery *Delivery, reason string) {
+	delivery.LastError = reason
+	if delivery.Attempts >= maxAttempts {
+		delivery.Status = StatusFailed
+		delivery.FinishedAt = time.Now().Unix()
+		return
+	}
+	delay := firstRetry << uint(delivery.Attempts-1)
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	delivery.NextAttempt = time.Now().Add(delay).Unix()
+}
+
+func (d *Dispatcher) send(h *Webhook, delivery *Delivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bahram-Webhook")
+	req.Header.Set("X-Bahram-Event", delivery.Event.Type)
+	req.Header.Set("X-Bahram-Delivery", delivery.ID)
+	req.Header.Set("X-Bahram-Signature", Sign(h.Secret, time.Now().Unix(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Unexpected response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,138 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.100.100.200", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"fd00:ec2::254", true},
+		{"fe80::1", true},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func testDispatcher(t *testing.T, handler http.HandlerFunc) (*Dispatcher, *Webhook, *httptest.Server) {
+	ds, err := datasource.NewDataSource(datasource.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+
+	h := &Webhook{URL: server.URL, Events: []string{AllEvents}, Active: true}
+	if err := Create(ds, h); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return NewDispatcher(ds), h, server
+}
+
+// waitFinished delivers the due deliveries until the delivery is finished
+func waitFinished(t *testing.T, d *Dispatcher, id string) *Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d.deliverDue()
+		if all, _ := deliveries(d.ds, deliveryKind); all[id] != nil {
+			return all[id]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("delivery %s isn't finished", id)
+	return nil
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	var received int32
+	d, h, server := testDispatcher(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	})
+	defer server.Close()
+	delivery, err := d.Ping(h, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.deliverDue()
+	time.Sleep(100 * time.Millisecond)
+
+	if atomic.LoadInt32(&received) != 0 {
+		t.Fatal("delivered to a loopback address")
+	}
+	pending, err := deliveries(d.ds, pendingKind)
+	if err != nil || pending[delivery.ID] == nil || !strings.Contains(pending[delivery.ID].LastError, ErrPrivateAddress.Error()) {
+		t.Errorf("got %v, %v; want a retry for %q", pending[delivery.ID], err, ErrPrivateAddress)
+	}
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	os.Setenv("BAHRAM_WEBHOOK_ALLOW_PRIVATE", "true")
+	defer os.Unsetenv("BAHRAM_WEBHOOK_ALLOW_PRIVATE")
+
+	var received int32
+	d, h, server := testDispatcher(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	})
+	defer server.Close()
+
+	// Leased by a worker which died
+	leased, err := d.Ping(h, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ds.CreateRecord(leaseKind, leased.ID, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := d.Ping(h, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := waitFinished(t, d, delivery.ID)
+	if finished.Status != StatusDelivered || finished.Attempts != 1 || atomic.LoadInt32(&received) != 1 {
+		t.Errorf("got %s after %d attempts and %d requests, want delivered once", finished.Status, finished.Attempts, received)
+	}
+	if _, err := d.ds.Record(leaseKind, delivery.ID); err != datasource.ErrNotFound {
+		t.Errorf("the lease is kept after the delivery: %v", err)
+	}
+	if _, err := d.ds.Record(pendingKind, delivery.ID); err != datasource.ErrNotFound {
+		t.Errorf("the delivery is still pending: %v", err)
+	}
+
+	// Attempted again once the lease is gone
+	if _, err := d.ds.Record(pendingKind, leased.ID); err != nil {
+		t.Errorf("the leased delivery isn't pending: %v", err)
+	}
+	d.ds.DeleteRecord(leaseKind, leased.ID)
+	if finished := waitFinished(t, d, leased.ID); finished.Status != StatusDelivered {
+		t.Errorf("got %s for the released delivery, want delivered", finished.Status)
+	}
+}
@@ -0,0 +1,277 @@
+package webhook // import "github.com/cafebazaar/bahram/webhook"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/cafebazaar/bahram/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	debugTag = "WEBHOOK"
+
+	webhookKind = "webhooks"
+	// The pending deliveries are kept apart from the finished ones, so the
+	// dispatcher doesn't list the history to find the due ones
+	pendingKind  = "webhook-pending"
+	deliveryKind = "webhook-deliveries"
+	leaseKind    = "webhook-leases"
+
+	// deliveryHistoryTTL is how long the finished deliveries are kept
+	deliveryHistoryTTL = 7 * 24 * time.Hour
+)
+
+// The event types. A subscription to AllEvents receives every one of them.
+const (
+	AllEvents          = "*"
+	EventPing          = "ping"
+	EventUserCreated   = "user.created"
+	EventUserUpdated   = "user.updated"
+	EventUserDisabled  = "user.deactivated"
+	EventUserRenamed   = "user.renamed"
+	EventUserDeleted   = "user.deleted"
+	EventGroupCreated  = "group.created"
+	EventGroupUpdated  = "group.updated"
+	EventGroupDeleted  = "group.deleted"
+	EventMemberAdded   = "group.member_added"
+	EventMemberRemoved = "group.member_removed"
+)
+
+var eventTypes = []string{
+	AllEvents, EventPing,
+	EventUserCreated, EventUserUpdated, EventUserDisabled, EventUserRenamed, EventUserDeleted,
+	EventGroupCreated, EventGroupUpdated, EventGroupDeleted, EventMemberAdded, EventMemberRemoved,
+}
+
+var (
+	ErrInvalidURL   = errors.New("The URL must be absolute http or https")
+	ErrInvalidEvent = errors.New("Unknown event type")
+)
+
+// Webhook is a subscription of an URL to some event types. The events are
+// POSTed to it as JSON, signed by Secret (see Sign).
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	CreatedAt int64    `json:"createdAt"`
+}
+
+func (h *Webhook) subscribed(eventType string) bool {
+	if eventType == EventPing {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == AllEvents || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the URL and the event types
+func (h *Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrInvalidURL
+	}
+	for _, e := range h.Events {
+		found := false
+		for _, known := range eventTypes {
+			found = found || e == known
+		}
+		if !found {
+			return fmt.Errorf("%s: %s", ErrInvalidEvent, e)
+		}
+	}
+	return nil
+}
+
+// Event is the body of the deliveries
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	// Changes are the changed fields, as in the audit log
+	Changes map[string]datasource.AuditChange `json:"changes,omitempty"`
+}
+
+// Delivery is an event on its way to a webhook, or its result
+type Delivery struct {
+	ID           string `json:"id"`
+	WebhookID    string `json:"webhookId"`
+	Event        Event  `json:"event"`
+	Status       string `json:"status"`
+	Attempts     int    `json:"attempts"`
+	NextAttempt  int64  `json:"nextAttempt,omitempty"`
+	ResponseCode int    `json:"responseCode,omitempty"`
+	LastError    string `json:"lastError,omitempty"`
+	CreatedAt    int64  `json:"createdAt"`
+	FinishedAt   int64  `json:"finishedAt,omitempty"`
+}
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+func putWebhook(ds *datasource.DataSource, h *Webhook) error {
+	value, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return ds.PutRecord(webhookKind, h.ID, value, 0)
+}
+
+// Get returns the webhook with the id
+func Get(ds *datasource.DataSource, id string) (*Webhook, error) {
+	value, err := ds.Record(webhookKind, id)
+	if err != nil {
+		return nil, err
+	}
+	var h Webhook
+	err = json.Unmarshal(value, &h)
+	return &h, err
+}
+
+// List returns the webhooks, the oldest first
+func List(ds *datasource.DataSource) ([]*Webhook, error) {
+	records, err := ds.Records(webhookKind)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []*Webhook{}
+	for id, value := range records {
+		var h Webhook
+		if err := json.Unmarshal(value, &h); err != nil {
+			logging.Log(debugTag, "Error while unmarshaling webhook %s: %s", id, err)
+			continue
+		}
+		hooks = append(hooks, &h)
+	}
+	sort.Sort(byCreatedAt(hooks))
+	return hooks, nil
+}
+
+type byCreatedAt []*Webhook
+
+func (s byCreatedAt) Len() int           { return len(s) }
+func (s byCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreatedAt) Less(i, j int) bool { return s[i].CreatedAt < s[j].CreatedAt }
+
+// Create stores a new webhook. Its Secret is generated if it's empty.
+func Create(ds *datasource.DataSource, h *Webhook) error {
+	err := h.Validate()
+	if err != nil {
+		return err
+	}
+	h.ID, err = randomID()
+	if err != nil {
+		return err
+	}
+	if h.Secret == "" {
+		h.Secret, err = randomID()
+		if err != nil {
+			return err
+		}
+	}
+	h.CreatedAt = time.Now().Unix()
+	return putWebhook(ds, h)
+}
+
+// Update stores the modified webhook
+func Update(ds *datasource.DataSource, h *Webhook) error {
+	err := h.Validate()
+	if err != nil {
+		return err
+	}
+	return putWebhook(ds, h)
+}
+
+// Delete removes the webhook. Its pending deliveries are dropped when their
+// turn comes.
+func Delete(ds *datasource.DataSource, id string) error {
+	return ds.DeleteRecord(webhookKind, id)
+}
+
+// putDelivery stores the delivery. A finished delivery is moved from the
+// pending ones to the history.
+func putDelivery(ds *datasource.DataSource, d *Delivery) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if d.Status == StatusPending {
+		return ds.PutRecord(pendingKind, d.ID, value, 0)
+	}
+	if err := ds.PutRecord(deliveryKind, d.ID, value, deliveryHistoryTTL); err != nil {
+		return err
+	}
+	if err := ds.DeleteRecord(pendingKind, d.ID); err != nil && err != datasource.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func deliveries(ds *datasource.DataSource, kind string) (map[string]*Delivery, error) {
+	records, err := ds.Records(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*Delivery)
+	for id, value := range records {
+		var d Delivery
+		if err := json.Unmarshal(value, &d); err != nil {
+			logging.Log(debugTag, "Error while unmarshaling delivery %s: %s", id, err)
+			continue
+		}
+		result[id] = &d
+	}
+	return result, nil
+}
+
+// Deliveries returns the deliveries of the webhook, the newest first
+func Deliveries(ds *datasource.DataSource, webhookID string) ([]*Delivery, error) {
+	finished, err := deliveries(ds, deliveryKind)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := deliveries(ds, pendingKind)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*Delivery{}
+	for _, d := range finished {
+		if d.WebhookID == webhookID {
+			result = append(result, d)
+		}
+	}
+	for id, d := range pending {
+		// Finished, but not removed from the pending ones yet
+		if _, found := finished[id]; !found && d.WebhookID == webhookID {
+			result = append(result, d)
+		}
+	}
+	sort.Sort(sort.Reverse(byDeliveryID(result)))
+	return result, nil
+}
+
+// The ids of the deliveries are sorted by their creation time
+type byDeliveryID []*Delivery
+
+func (s byDeliveryID) Len() int           { return len(s) }
+func (s byDeliveryID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDeliveryID) Less(i, j int) bool { return s[i].ID < s[j].ID }